@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 当前的 API 版本及其路径前缀；不兼容的修改放到新版本中，旧版本的接口和响应格式保持不变
+const (
+	apiVersion  = "v1"
+	apiV1Prefix = "/api/" + apiVersion
+)
+
+// 所有支持的 API 版本，按发布顺序
+var apiVersions = []string{apiVersion}
+
+// 响应头中的 API 版本
+const apiVersionHeader = "X-API-Version"
+
+// 在响应头中标明处理请求的 API 版本
+func apiVersionMiddleware(version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header(apiVersionHeader, version)
+		c.Next()
+	}
+}
+
+// 去掉版本前缀的路由模板，如 /files/:id；审计日志和限流按该路由配置，各版本共用
+func apiRoute(c *gin.Context) string {
+	route := c.FullPath()
+	if rest, ok := strings.CutPrefix(route, apiV1Prefix); ok {
+		return rest
+	}
+	return route
+}
+
+// 注册 v1 的所有接口。新版本在自己的路由组中注册，可以复用数据访问代码，
+// 只替换需要改变请求或响应格式的处理函数，v1 的处理函数不随之修改。ctx 被取消时停止接口的后台任务
+func registerV1Routes(ctx context.Context, v1 *gin.RouterGroup, cfg Config, db *sql.DB, hooks *webhookDispatcher, store Storage, limiter *rateLimiter, concurrency *concurrencyLimiter, disk *diskGuard) {
+	// 客户端可以据此提前校验上传的文件；类型列表未设置时为空数组
+	allowedTypes, blockedTypes := append([]string{}, cfg.AllowedTypes...), append([]string{}, cfg.BlockedTypes...)
+	v1.GET("/config", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"max_upload_size":      cfg.MaxUploadSize,
+			"max_json_upload_size": cfg.MaxJSONUploadSize,
+			"hash_algorithm":       cfg.HashAlgorithm,
+			"allowed_types":        allowedTypes,
+			"blocked_types":        blockedTypes,
+			"version":              version,
+		})
+	})
+
+	// API 版本和服务端构建信息
+	v1.GET("/meta", func(c *gin.Context) {
+		c.JSON(http.StatusOK, serverMeta())
+	})
+
+	// 注册和登录接口
+	secret := []byte(cfg.JWTSecret)
+	registerAuthRoutes(v1, db, secret, cfg.JWTExpiry, cfg.DefaultQuota)
+
+	// 以下接口需要登录
+	api := v1.Group("/", authMiddleware(db, secret), limiter.middleware(), concurrency.middleware(), disk.middleware())
+
+	// API key 接口
+	registerAPIKeyRoutes(api, db)
+
+	// 较大的上传内容暂存的目录
+	spoolDir := uploadSpoolDir(cfg, store)
+
+	// 文件接口
+	registerFileRoutes(api, db, store, cfg.MaxUploadSize, cfg.MaxVersions, cfg.HashAlgorithm, spoolDir)
+
+	// 以 JSON 上传 base64 内容的接口
+	registerJSONUploadRoutes(api, db, store, cfg.MaxJSONUploadSize, cfg.MaxVersions, cfg.HashAlgorithm, spoolDir)
+
+	// 导出文件列表接口
+	registerFileExportRoutes(api, db)
+
+	// 授权其他用户访问文件和文件夹的接口
+	registerPermissionRoutes(api, db)
+
+	// 从远程地址上传接口
+	registerRemoteUploadRoutes(ctx, api, db, hooks, store, cfg.MaxUploadSize, cfg.HashAlgorithm, spoolDir, cfg.RemoteUploadTimeout, cfg.RemoteUploadAllowPrivate)
+
+	// 复制文件接口
+	registerCopyRoutes(api, db, limiter)
+
+	// 按路径幂等上传接口
+	registerByNameRoutes(api, db, store, cfg.MaxUploadSize, cfg.MaxVersions, cfg.HashAlgorithm, spoolDir)
+
+	// 文件版本接口
+	registerVersionRoutes(api, db, store, cfg.MaxVersions)
+
+	// 分片上传接口
+	registerUploadRoutes(api, db, store, cfg.MaxUploadSize, cfg.HashAlgorithm, spoolDir)
+
+	// 以下接口无需登录
+	public := v1.Group("/", limiter.middleware(), concurrency.middleware())
+
+	// 分享链接接口
+	registerShareRoutes(public, api, db, store, limiter)
+
+	// 签名下载链接接口
+	registerPresignRoutes(public, api, db, store, cfg.PresignKey)
+
+	// 公开文件接口
+	registerPublicRoutes(public, db, store)
+
+	// 全文搜索接口
+	registerSearchRoutes(api, db)
+
+	// 文件夹接口
+	registerFolderRoutes(api, db)
+
+	// 回收站接口
+	registerTrashRoutes(api, db, store)
+
+	// 标签接口
+	registerTagRoutes(api, db)
+
+	// 缩略图接口
+	registerThumbnailRoutes(api, db, store)
+
+	// 文件预览接口
+	registerPreviewRoutes(api, db, store)
+
+	// 打包下载接口
+	registerArchiveRoutes(api, db, store)
+
+	// 以下接口仅管理员可以访问
+	admin := api.Group("/admin", adminMiddleware(db))
+
+	// 存储配额接口
+	registerQuotaRoutes(api, admin, db)
+
+	// 统计接口
+	registerStatsRoutes(api, admin, db, concurrency, disk)
+
+	// 内容校验接口
+	registerVerifyRoutes(admin, db, store)
+
+	// 压缩已有内容接口
+	registerCompressRoutes(admin, db, store)
+
+	// 后台完整性扫描发现的问题
+	registerIntegrityRoutes(admin, cfg, db)
+
+	// 病毒扫描的重新扫描和隔离接口
+	registerScanRoutes(admin, cfg, db, store)
+
+	// 回收没有引用的内容
+	registerGCRoutes(admin, cfg, db, store)
+
+	// 数据库备份接口
+	registerBackupRoutes(admin, db, cfg.BackupDir)
+
+	// 审计日志接口
+	registerAuditRoutes(admin, db)
+
+	// webhook 管理接口
+	registerWebhookRoutes(admin, db)
+}
+
+// 服务端的版本和构建信息，构建信息不可用时对应字段为空
+func serverMeta() gin.H {
+	meta := gin.H{
+		"api_version":  apiVersion,
+		"api_versions": apiVersions,
+		"version":      version,
+		"go_version":   runtime.Version(),
+		"revision":     "",
+		"build_time":   "",
+		"modified":     false,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				meta["revision"] = s.Value
+			case "vcs.time":
+				meta["build_time"] = s.Value
+			case "vcs.modified":
+				meta["modified"] = s.Value == "true"
+			}
+		}
+	}
+	return meta
+}
+
+// 兼容旧的无版本前缀路径：第一段与 v1 接口相同的路径（如 /files/1）在路由前改写为 v1 的路径，
+// 并在响应头中标明已弃用。只保留一个版本，之后删除
+func legacyRoutes(r *gin.Engine) http.Handler {
+	segments := map[string]bool{}
+	for _, route := range r.Routes() {
+		if rest, ok := strings.CutPrefix(route.Path, apiV1Prefix+"/"); ok {
+			segment, _, _ := strings.Cut(rest, "/")
+			segments[segment] = true
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		if segments[segment] {
+			req.URL.Path = apiV1Prefix + req.URL.Path
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = apiV1Prefix + req.URL.RawPath
+			}
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+apiV1Prefix+">; rel=\"successor-version\"")
+		}
+		r.ServeHTTP(w, req)
+	})
+}
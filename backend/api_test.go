@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// JSON 值的结构：每个字段一行 "路径 类型"，按路径排序；数组只取第一个元素，路径中记为 []
+func jsonShape(t *testing.T, body []byte) []string {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("decode %q: %v", body, err)
+	}
+	var shape []string
+	var walk func(path string, v any)
+	walk = func(path string, v any) {
+		typ := "null"
+		switch v := v.(type) {
+		case map[string]any:
+			typ = "object"
+			for key, value := range v {
+				walk(strings.TrimPrefix(path+"."+key, "."), value)
+			}
+		case []any:
+			typ = "array"
+			if len(v) > 0 {
+				walk(path+"[]", v[0])
+			}
+		case string:
+			typ = "string"
+		case float64:
+			typ = "number"
+		case bool:
+			typ = "bool"
+		}
+		if path != "" {
+			shape = append(shape, path+" "+typ)
+		}
+	}
+	walk("", v)
+	sort.Strings(shape)
+	return shape
+}
+
+// 在 fields 的每一项前加上 prefix
+func prefixShape(prefix string, fields []string) []string {
+	shape := make([]string, len(fields))
+	for i, field := range fields {
+		shape[i] = prefix + field
+	}
+	return shape
+}
+
+// v1 中文件的字段，文件在根目录且没有下载过
+var v1FileShape = []string{
+	"created_at string",
+	"downloads number",
+	"folder_id null",
+	"hash string",
+	"hash_algo string",
+	"id number",
+	"last_downloaded_at null",
+	"mime string",
+	"name string",
+	"owner_id number",
+	"protected bool",
+	"scan_status string",
+	"size number",
+	"starred bool",
+	"tags array",
+	"updated_at string",
+	"version number",
+	"visibility string",
+}
+
+// 固定 v1 响应的字段和类型，修改响应格式需要新的 API 版本
+func TestV1JSONShapes(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+
+	upload := s.upload(alice, "a.txt", []byte("hello"), nil)
+	if upload.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", upload.Code, upload.Body)
+	}
+	var uploaded struct {
+		File File `json:"file"`
+	}
+	decodeJSON(t, upload, &uploaded)
+	info := "/api/v1/files/" + strconv.Itoa(uploaded.File.ID) + "/info"
+
+	tests := []struct {
+		name   string
+		w      *httptest.ResponseRecorder
+		status int
+		shape  []string
+	}{
+		{"upload", upload, http.StatusCreated, append([]string{
+			"existing bool",
+			"expires_at null",
+			"file object",
+			"filename string",
+			"hash string",
+			"hash_algo string",
+			"id number",
+			"message string",
+			"mime string",
+			"renamed bool",
+			"replaced bool",
+			"size number",
+			"verified bool",
+			"version number",
+		}, prefixShape("file.", v1FileShape)...)},
+		{"file list", s.do(http.MethodGet, "/api/v1/files", alice, "", nil), http.StatusOK, append([]string{
+			"files array",
+			"files[] object",
+			"limit number",
+			"next_cursor string",
+			"offset number",
+			"order string",
+			"q string",
+			"sort string",
+			"total number",
+		}, prefixShape("files[].", v1FileShape)...)},
+		{"file info", s.do(http.MethodGet, info, alice, "", nil), http.StatusOK, v1FileShape},
+		{"error", s.do(http.MethodGet, "/api/v1/files/999/info", alice, "", nil), http.StatusNotFound, []string{
+			"error object",
+			"error.code string",
+			"error.message string",
+			"error.request_id string",
+		}},
+		{"invalid request", s.do(http.MethodPatch, "/api/v1/files/abc", alice, "application/json", strings.NewReader(`{}`)), http.StatusBadRequest, []string{
+			"error object",
+			"error.code string",
+			"error.message string",
+			"error.request_id string",
+		}},
+		{"meta", s.do(http.MethodGet, "/api/v1/meta", "", "", nil), http.StatusOK, []string{
+			"api_version string",
+			"api_versions array",
+			"api_versions[] string",
+			"build_time string",
+			"go_version string",
+			"modified bool",
+			"revision string",
+			"version string",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", tt.w.Code, tt.status, tt.w.Body)
+			}
+			if got := tt.w.Header().Get(apiVersionHeader); got != apiVersion {
+				t.Errorf("%s = %q, want %q", apiVersionHeader, got, apiVersion)
+			}
+			got := jsonShape(t, tt.w.Body.Bytes())
+			for _, field := range tt.shape {
+				if !slices.Contains(got, field) {
+					t.Errorf("missing %s", field)
+				}
+			}
+			for _, field := range got {
+				if !slices.Contains(tt.shape, field) {
+					t.Errorf("unexpected %s", field)
+				}
+			}
+		})
+	}
+}
+
+// 旧的无版本前缀路径返回与 v1 相同的响应，并标明已弃用
+func TestLegacyPathAliases(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	file := uploadTestFile(t, s, alice, "a.txt", "hello")
+	id := strconv.Itoa(file.ID)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"file list", "/files", http.StatusOK},
+		{"file list with query", "/files?limit=1&sort=name", http.StatusOK},
+		{"file info", "/files/" + id + "/info", http.StatusOK},
+		{"download", "/files/" + id, http.StatusOK},
+		{"error", "/files/999/info", http.StatusNotFound},
+		{"meta", "/meta", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v1 := s.do(http.MethodGet, apiV1Prefix+tt.path, alice, "", nil)
+			legacy := s.do(http.MethodGet, tt.path, alice, "", nil)
+			if v1.Code != tt.status || legacy.Code != tt.status {
+				t.Fatalf("status = %d for v1 and %d for the legacy path, want %d", v1.Code, legacy.Code, tt.status)
+			}
+			if got, want := withoutRequestID(t, legacy), withoutRequestID(t, v1); got != want {
+				t.Errorf("legacy body = %s, want the v1 body %s", got, want)
+			}
+			if legacy.Header().Get("Deprecation") != "true" || !strings.Contains(legacy.Header().Get("Link"), apiV1Prefix) {
+				t.Errorf("legacy path headers: Deprecation %q, Link %q", legacy.Header().Get("Deprecation"), legacy.Header().Get("Link"))
+			}
+			if v1.Header().Get("Deprecation") != "" {
+				t.Errorf("v1 path marked deprecated")
+			}
+			if got := legacy.Header().Get(apiVersionHeader); got != apiVersion {
+				t.Errorf("legacy %s = %q, want %q", apiVersionHeader, got, apiVersion)
+			}
+		})
+	}
+
+	// 旧路径的上传与 v1 一样创建文件，Location 指向 v1 的路径
+	w := s.uploadTo("/upload", alice, "b.txt", []byte("world"), nil)
+	var uploaded struct {
+		File File `json:"file"`
+	}
+	decodeJSON(t, w, &uploaded)
+	if w.Code != http.StatusCreated || uploaded.File.Name != "b.txt" || w.Header().Get("Deprecation") != "true" {
+		t.Errorf("legacy upload: %d, Deprecation %q: %s", w.Code, w.Header().Get("Deprecation"), w.Body)
+	}
+	if want := apiV1Prefix + "/files/" + strconv.Itoa(uploaded.File.ID); w.Header().Get("Location") != want {
+		t.Errorf("legacy upload Location = %q, want %q", w.Header().Get("Location"), want)
+	}
+
+	// 第一段不是 v1 接口的路径不改写
+	if w := s.do(http.MethodGet, "/not-an-api-path", alice, "", nil); w.Code != http.StatusNotFound || w.Header().Get("Deprecation") != "" {
+		t.Errorf("unknown path: %d, Deprecation %q", w.Code, w.Header().Get("Deprecation"))
+	}
+}
+
+// 错误响应中的 request_id 每次请求都不同，比较时去掉
+func withoutRequestID(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		return w.Body.String()
+	}
+	var body map[string]any
+	decodeJSON(t, w, &body)
+	if e, ok := body["error"].(map[string]any); ok {
+		delete(e, "request_id")
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API key 的前缀，便于在配置文件和日志中识别
+const apiKeyPrefix = "nd_"
+
+// 请求头中的 API key，可以代替 Authorization: Bearer
+const apiKeyHeader = "X-API-Key"
+
+// API key 名称的最大长度
+const maxAPIKeyName = 100
+
+// 每隔多久最多更新一次 last_used_at，避免每个请求都写数据库
+const apiKeyUsedInterval = time.Minute
+
+// API key 无效、已撤销或已过期
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// APIKey 用户创建的 API key，只保存哈希，明文只在创建时返回一次
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // 明文的开头部分，用于区分不同的 key
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// 查询 API key 时选取的字段，与 scanAPIKey 的顺序一致
+const apiKeyColumns = "id, name, prefix, created_at, expires_at, last_used_at"
+
+// 注册当前用户的 API key 管理接口
+func registerAPIKeyRoutes(r gin.IRouter, db *sql.DB) {
+	// 创建 API key；expires_in（秒）或 expires_at 设置过期时间，都不设置时不过期。明文只在此时返回
+	r.POST("/me/api-keys", func(c *gin.Context) {
+		var req struct {
+			Name      string     `json:"name"`
+			ExpiresIn *int64     `json:"expires_in"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if len(req.Name) > maxAPIKeyName {
+			renderError(c, invalidRequest("Invalid name, must be at most "+strconv.Itoa(maxAPIKeyName)+" bytes"))
+			return
+		}
+		now := time.Now().UTC()
+		expiresAt, err := expiryTime(req.ExpiresIn, req.ExpiresAt, now)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+
+		token, err := newShareToken()
+		if err != nil {
+			renderError(c, internalError("Failed to create API key", err))
+			return
+		}
+		plaintext := apiKeyPrefix + token
+		key, err := addAPIKey(c.Request.Context(), db, currentUserID(c), req.Name, plaintext, now, expiresAt)
+		if err != nil {
+			renderError(c, internalError("Failed to create API key", err))
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"api_key": key,
+			"key":     plaintext,
+		})
+	})
+
+	// 列出当前用户的 API key，包括已过期的，最新创建的在前
+	r.GET("/me/api-keys", func(c *gin.Context) {
+		keys, err := listAPIKeys(c.Request.Context(), db, currentUserID(c))
+		if err != nil {
+			renderError(c, internalError("Failed to get API keys", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+	})
+
+	// 撤销 API key，之后使用该 key 的请求返回 401
+	r.DELETE("/me/api-keys/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid API key id"))
+			return
+		}
+		deleted, err := deleteAPIKey(c.Request.Context(), db, currentUserID(c), id)
+		if err != nil {
+			renderError(c, internalError("Failed to delete API key", err))
+			return
+		}
+		if !deleted {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "API key not found"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "API key revoked", "id": id})
+	})
+}
+
+// 计算 API key 的哈希；key 是随机生成的，不需要加盐或慢哈希
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// 按 apiKeyColumns 的顺序读取一行 API key
+func scanAPIKey(row interface{ Scan(...any) error }) (APIKey, error) {
+	var key APIKey
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt)
+	return key, err
+}
+
+// 添加 API key，返回包含 id 的 API key 信息
+func addAPIKey(ctx context.Context, db *sql.DB, userID int, name, plaintext string, createdAt time.Time, expiresAt *time.Time) (APIKey, error) {
+	insertQuery := `INSERT INTO api_keys (user_id, name, prefix, key_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING ` + apiKeyColumns
+	prefix := plaintext[:len(apiKeyPrefix)+6]
+	return scanAPIKey(db.QueryRowContext(ctx, insertQuery, userID, name, prefix, hashAPIKey(plaintext), createdAt, expiresAt))
+}
+
+// 获取用户的所有 API key
+func listAPIKeys(ctx context.Context, db *sql.DB, userID int) ([]APIKey, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ? ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// 删除用户的 API key，返回是否存在
+func deleteAPIKey(ctx context.Context, db *sql.DB, userID, id int) (bool, error) {
+	result, err := db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// 校验 API key 并返回其所属用户的 id；key 不存在、已撤销或已过期时返回 errInvalidAPIKey。
+// 同时更新 last_used_at，更新失败只记录日志
+func authenticateAPIKey(ctx context.Context, db *sql.DB, plaintext string) (int, error) {
+	now := time.Now().UTC()
+	var id, userID int
+	query := `SELECT id, user_id FROM api_keys WHERE key_hash = ? AND (expires_at IS NULL OR expires_at > ?)`
+	err := db.QueryRowContext(ctx, query, hashAPIKey(plaintext), now).Scan(&id, &userID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidAPIKey
+	}
+	if err != nil {
+		return 0, err
+	}
+	updateQuery := `UPDATE api_keys SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)`
+	if _, err := db.ExecContext(ctx, updateQuery, now, id, now.Add(-apiKeyUsedInterval)); err != nil {
+		slog.Error("Failed to update API key last use", "api_key_id", id, "error", err)
+	}
+	return userID, nil
+}
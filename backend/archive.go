@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 注册打包下载接口
+func registerArchiveRoutes(r gin.IRouter, db *sql.DB, store Storage) {
+	repo := newFileRepository(db)
+
+	// 将多个文件打包为 zip 下载，边读取边写入响应，不在内存或磁盘中缓存整个压缩包。
+	// strict 为 true 时任一文件不存在则返回 404，否则跳过并在压缩包中附带说明
+	r.POST("/files/archive", func(c *gin.Context) {
+		var req struct {
+			IDs    []int `json:"ids"`
+			Strict bool  `json:"strict"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if len(req.IDs) == 0 || len(req.IDs) > maxBatchSize {
+			renderError(c, invalidRequest("ids must contain 1 to "+strconv.Itoa(maxBatchSize)+" file ids"))
+			return
+		}
+
+		// 开始写入响应后无法再返回错误，因此先确认所有文件
+		ownerID := currentUserID(c)
+		var files []File
+		var missing []int
+		for _, id := range req.IDs {
+			file, err := repo.GetByID(c.Request.Context(), ownerID, id)
+			if errors.Is(err, errNotFound) || errors.Is(err, errFileExpired) {
+				missing = append(missing, id)
+				continue
+			}
+			if err != nil {
+				renderError(c, internalError("Failed to get file", err))
+				return
+			}
+			// 被隔离的文件与不存在的文件一样跳过
+			if file.ScanStatus == scanInfected {
+				missing = append(missing, id)
+				continue
+			}
+			files = append(files, file)
+			addAuditFile(c, file)
+		}
+		if len(missing) > 0 && (req.Strict || len(files) == 0) {
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File not found").with(gin.H{"missing_ids": missing}))
+			return
+		}
+
+		filename := "files-" + time.Now().UTC().Format("2006-01-02") + ".zip"
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", contentDisposition("attachment", filename))
+		c.Status(http.StatusOK)
+
+		detachDeadline(c)
+		if err := writeArchive(c.Request.Context(), c.Writer, store, files, missing); err != nil {
+			// 响应已经开始，只能记录错误；压缩包缺少目录，客户端解压时会发现不完整
+			slog.ErrorContext(c.Request.Context(), "Failed to write archive", "user_id", ownerID, "error", err)
+		}
+	})
+
+	// 将文件夹（包括子文件夹）中的文件打包为 zip 下载，条目名称为相对于该文件夹的路径，空的子文件夹也会保留。
+	// 开始写入前检查对文件夹的权限（所有者或被授权的用户），之后不再逐个检查；
+	// 列出后被删除的文件会被跳过，并在压缩包末尾的 MANIFEST.txt 中说明
+	r.GET("/folders/:id/archive", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid folder id"))
+			return
+		}
+		ownerID := currentUserID(c)
+		folder, err := getFolder(c.Request.Context(), db, ownerID, id)
+		if err == sql.ErrNoRows {
+			ownerID, _, err = folderPermission(c.Request.Context(), db, currentUserID(c), id)
+			if err == nil {
+				folder, err = getFolder(c.Request.Context(), db, ownerID, id)
+			}
+		}
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Folder not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get folder", err))
+			return
+		}
+		dirs, files, err := folderArchiveEntries(c.Request.Context(), db, ownerID, id)
+		if err != nil {
+			renderError(c, internalError("Failed to get files", err))
+			return
+		}
+		for _, file := range files {
+			addAuditFile(c, file.File)
+		}
+
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", contentDisposition("attachment", folder.Name+".zip"))
+		c.Status(http.StatusOK)
+
+		detachDeadline(c)
+		if err := writeFolderArchive(c.Request.Context(), c.Writer, repo, store, dirs, files); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to write folder archive", "user_id", currentUserID(c), "folder_id", id, "error", err)
+		}
+	})
+}
+
+// 压缩包中的文件及其相对路径
+type archiveEntry struct {
+	File File
+	Path string
+}
+
+// 列出文件夹下所有子文件夹的相对路径（以 / 结尾）和所有未删除、未过期的文件，按路径排序
+func folderArchiveEntries(ctx context.Context, db *sql.DB, ownerID, folderID int) ([]string, []archiveEntry, error) {
+	treeQuery := `
+	WITH RECURSIVE tree (id, path) AS (
+		SELECT id, '' FROM folders WHERE id = ? AND owner_id = ?
+		UNION ALL
+		SELECT folders.id, tree.path || folders.name || '/' FROM folders JOIN tree ON folders.parent_id = tree.id
+	)
+	SELECT id, path FROM tree ORDER BY path`
+	rows, err := db.QueryContext(ctx, treeQuery, folderID, ownerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := map[int]string{}
+	var dirs []string
+	for rows.Next() {
+		var id int
+		var p string
+		if err := rows.Scan(&id, &p); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		p = safeArchiveDir(p)
+		paths[id] = p
+		if p != "" {
+			dirs = append(dirs, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil, nil
+	}
+
+	ids := make([]any, 0, len(paths))
+	for id := range paths {
+		ids = append(ids, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	fileQuery := `SELECT ` + fileColumns + ` FROM files WHERE owner_id = ? AND folder_id IN (` + placeholders + `) AND deleted_at IS NULL AND ` + fileNotExpired + ` ORDER BY name, id`
+	fileRows, err := db.QueryContext(ctx, fileQuery, append(append([]any{ownerID}, ids...), time.Now().UTC())...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fileRows.Close()
+	var files []archiveEntry
+	for fileRows.Next() {
+		file, err := scanFile(fileRows)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, archiveEntry{File: file, Path: paths[*file.FolderID] + sanitizeFileName(file.Name)})
+	}
+	if err := fileRows.Err(); err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return dirs, files, nil
+}
+
+// 依次写入子文件夹和文件；写入每个文件前重新读取文件信息，已被删除或内容丢失的文件跳过，
+// 跳过的文件列在末尾的 MANIFEST.txt 中。同一路径下的同名文件按顺序重命名为 name (1).ext
+func writeFolderArchive(ctx context.Context, w io.Writer, repo *FileRepository, store Storage, dirs []string, files []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	used := map[string]bool{}
+	for _, dir := range dirs {
+		used[dir] = true
+		if _, err := zw.CreateHeader(&zip.FileHeader{Name: dir, Method: zip.Store}); err != nil {
+			return err
+		}
+	}
+	var skipped []string
+	for _, entry := range files {
+		file, err := repo.GetByID(ctx, entry.File.OwnerID, entry.File.ID)
+		if errors.Is(err, errNotFound) || errors.Is(err, errFileExpired) {
+			skipped = append(skipped, entry.Path)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		content, _, err := openFileContent(ctx, store, file)
+		if errors.Is(err, errBlobNotFound) || errors.Is(err, errFileInfected) {
+			skipped = append(skipped, entry.Path)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		ew, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     uniqueName(used, entry.Path),
+			Method:   zip.Deflate,
+			Modified: file.UpdatedAt,
+		})
+		if err == nil {
+			_, err = io.Copy(ew, contextReader{ctx, content})
+		}
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(skipped) > 0 {
+		entry, err := zw.Create(uniqueName(used, "MANIFEST.txt"))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(entry, "The following files were removed while the archive was being created or are quarantined, and have been skipped:\n%s\n", strings.Join(skipped, "\n")); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// 将文件依次写入 zip；同名文件按顺序重命名为 name (1).ext，missing 不为空时附带说明文件
+func writeArchive(ctx context.Context, w io.Writer, store Storage, files []File, missing []int) error {
+	zw := zip.NewWriter(w)
+	used := map[string]bool{}
+	for _, file := range files {
+		name := uniqueName(used, sanitizeFileName(file.Name))
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: file.UpdatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		content, _, err := openFileContent(ctx, store, file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(entry, contextReader{ctx, content})
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(missing) > 0 {
+		ids := make([]string, len(missing))
+		for i, id := range missing {
+			ids[i] = strconv.Itoa(id)
+		}
+		entry, err := zw.Create(uniqueName(used, "MISSING.txt"))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(entry, "The following file ids were not found or are quarantined, and have been skipped:\n%s\n", strings.Join(ids, "\n")); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// 清理压缩包中以 / 结尾的文件夹路径的每一段；旧版本保存的名称可能包含 .. 或分隔符，解压时会写到目标目录之外
+func safeArchiveDir(p string) string {
+	if p == "" {
+		return ""
+	}
+	segments := strings.Split(strings.TrimSuffix(p, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = sanitizeFileName(segment)
+	}
+	return strings.Join(segments, "/") + "/"
+}
+
+// 返回 used 中未使用的文件名，重名时在扩展名前加上序号，如 name (1).ext
+func uniqueName(used map[string]bool, name string) string {
+	candidate := name
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; used[candidate]; i++ {
+		candidate = base + " (" + strconv.Itoa(i) + ")" + ext
+	}
+	used[candidate] = true
+	return candidate
+}
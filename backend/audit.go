@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 清理过期审计日志的间隔
+const auditPruneInterval = time.Hour
+
+// 需要记录审计日志的接口及其操作，"METHOD 路由"（不含版本前缀） -> 操作。
+// 修改数据的接口（POST、PUT、PATCH、DELETE）必须在此或 auditExempt 中，否则 checkAuditRoutes 在启动时报错
+var auditActions = map[string]string{
+	"POST /upload":                            "upload",
+	"POST /upload/check":                      "upload",
+	"PUT /files/by-name/*name":                "upload",
+	"POST /upload/json":                       "upload",
+	"POST /upload/remote":                     "upload",
+	"POST /uploads/:id/complete":              "upload",
+	"GET /files/:id":                          "download",
+	"GET /files/hash/:hash":                   "download",
+	"GET /files/:id/versions/:v":              "download",
+	"GET /files/:id/preview":                  "download",
+	"POST /files/archive":                     "download",
+	"GET /folders/:id/archive":                "download",
+	"GET /s/:token":                           "download",
+	"POST /s/:token":                          "download",
+	"GET /dl/:id":                             "download",
+	"GET /public/:hash":                       "download",
+	"PATCH /files/:id":                        "update",
+	"PATCH /files/:id/move":                   "move",
+	"POST /files/move":                        "move",
+	"POST /files/:id/copy":                    "copy",
+	"POST /files/:id/versions/:v/restore":     "restore_version",
+	"DELETE /files/:id":                       "delete",
+	"POST /files/batch-delete":                "delete",
+	"POST /trash/:id/restore":                 "restore",
+	"DELETE /trash/:id":                       "purge",
+	"POST /files/:id/share":                   "share",
+	"PATCH /shares/:id":                       "share",
+	"DELETE /shares/:id":                      "unshare",
+	"POST /files/:id/presign":                 "presign",
+	"POST /files/:id/permissions":             "grant",
+	"DELETE /files/:id/permissions/:userId":   "revoke",
+	"POST /folders/:id/permissions":           "grant",
+	"DELETE /folders/:id/permissions/:userId": "revoke",
+	"POST /folders":                           "create_folder",
+	"PATCH /folders/:id":                      "update_folder",
+	"DELETE /folders/:id":                     "delete_folder",
+}
+
+// 不记录审计日志的修改接口：登录和账号、只影响自己视图的标记（星标、标签）、上传会话的中间步骤
+// （完成时记录）、只读的批量查询以及管理员的维护操作
+var auditExempt = map[string]bool{
+	"POST /register":                  true,
+	"POST /login":                     true,
+	"POST /me/api-keys":               true,
+	"DELETE /me/api-keys/:id":         true,
+	"POST /files/:id/star":            true,
+	"DELETE /files/:id/star":          true,
+	"PUT /files/:id/tags":             true,
+	"DELETE /files/:id/tags/:tag":     true,
+	"POST /files/lookup":              true,
+	"POST /uploads":                   true,
+	"PATCH /uploads/:id":              true,
+	"PUT /uploads/:id/parts/:n":       true,
+	"DELETE /uploads/:id":             true,
+	"PUT /admin/users/:id/quota":      true,
+	"POST /admin/verify":              true,
+	"POST /admin/compress":            true,
+	"POST /admin/scan":                true,
+	"POST /admin/gc":                  true,
+	"POST /admin/backup":              true,
+	"POST /admin/webhooks":            true,
+	"POST /admin/webhooks/:id/enable": true,
+	"DELETE /admin/webhooks/:id":      true,
+}
+
+// 检查 v1 的每个修改接口都在 auditActions 或 auditExempt 中，且 auditActions 中没有不存在的接口，
+// 避免新增的接口遗漏审计日志
+func checkAuditRoutes(routes gin.RoutesInfo) error {
+	registered := map[string]bool{}
+	for _, route := range routes {
+		path, ok := strings.CutPrefix(route.Path, apiV1Prefix)
+		if !ok {
+			continue
+		}
+		key := route.Method + " " + path
+		registered[key] = true
+		switch route.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			if auditActions[key] == "" && !auditExempt[key] {
+				return fmt.Errorf("route %s has no audit action, add it to auditActions or auditExempt", key)
+			}
+		}
+	}
+	for key := range auditActions {
+		if !registered[key] {
+			return fmt.Errorf("audit action for %s does not match any route", key)
+		}
+	}
+	for key := range auditExempt {
+		if !registered[key] {
+			return fmt.Errorf("audit exemption for %s does not match any route", key)
+		}
+	}
+	return nil
+}
+
+// 操作在请求返回后才在后台完成时使用的操作名，审计中间件不记录，由处理函数完成后调用 writeAuditEntries
+const auditDeferred = "deferred"
+
+// 处理函数通过 gin.Context 传给审计中间件的信息
+const (
+	auditActionKey = "auditAction"
+	auditFilesKey  = "auditFiles"
+)
+
+// AuditEntry 一条审计日志
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ActorID   *int      `json:"actor_id"` // 未登录的请求（如分享链接）为空
+	Actor     *string   `json:"actor"`
+	Action    string    `json:"action"`
+	FileID    *int      `json:"file_id"`
+	Hash      string    `json:"hash,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"` // success 或 failure
+}
+
+// 审计日志的查询条件
+type auditFilter struct {
+	ActorID *int
+	Action  string
+	Since   *time.Time
+	Until   *time.Time
+	Limit   int
+	Offset  int
+}
+
+// 指定本次请求记录的操作，覆盖 auditActions 中的操作；也用于不在 auditActions 中但需要记录的请求
+func setAuditAction(c *gin.Context, action string) {
+	c.Set(auditActionKey, action)
+}
+
+// 记录本次请求涉及的文件，每个文件一条审计日志并触发对应的 webhook 事件；未记录时使用路由中的文件 id
+func addAuditFile(c *gin.Context, file File) {
+	files, _ := c.Get(auditFilesKey)
+	list, _ := files.([]File)
+	c.Set(auditFilesKey, append(list, file))
+}
+
+// 审计中间件，在请求处理完成后记录 auditActions 中的操作，成功时通知订阅了该事件的 webhook；
+// 写入失败时只记录日志，不影响已经返回的响应
+func auditLogger(db *sql.DB, hooks *webhookDispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		route := apiRoute(c)
+		action := auditActions[c.Request.Method+" "+route]
+		if v := c.GetString(auditActionKey); v != "" {
+			action = v
+		}
+		if action == "" || action == auditDeferred {
+			return
+		}
+
+		files, _ := c.Get(auditFilesKey)
+		list, _ := files.([]File)
+		if len(list) == 0 {
+			var file File
+			if strings.HasPrefix(route, "/files/:id") || strings.HasPrefix(route, "/trash/:id") {
+				file.ID, _ = strconv.Atoi(c.Param("id"))
+			}
+			file.Hash = c.Param("hash")
+			list = []File{file}
+		}
+		// 客户端断开或请求超时后仍然记录
+		writeAuditEntries(context.WithoutCancel(c.Request.Context()), db, hooks, action, currentUserID(c), c.ClientIP(), c.Writer.Status(), list)
+	}
+}
+
+// 为每个文件写入一条操作 action 的审计日志，status 为操作结果的状态码，成功时通知订阅了对应事件的 webhook；
+// actorID 为 0 表示未登录的请求。也用于请求返回后在后台完成的操作，如异步的远程上传
+func writeAuditEntries(ctx context.Context, db *sql.DB, hooks *webhookDispatcher, action string, actorID int, clientIP string, status int, files []File) {
+	outcome := "success"
+	if status >= http.StatusBadRequest {
+		outcome = "failure"
+	}
+	for _, file := range files {
+		entry := AuditEntry{
+			CreatedAt: time.Now().UTC(),
+			Action:    action,
+			Hash:      file.Hash,
+			ClientIP:  clientIP,
+			Status:    status,
+			Outcome:   outcome,
+		}
+		if actorID != 0 {
+			entry.ActorID = &actorID
+		}
+		if file.ID != 0 {
+			entry.FileID = &file.ID
+		}
+		if err := insertAuditEntry(ctx, db, entry); err != nil {
+			slog.ErrorContext(ctx, "Failed to write audit log", "action", action, "error", err)
+		}
+		event := webhookEvents[action]
+		if event == "" || outcome != "success" {
+			continue
+		}
+		// 处理函数只记录了文件 id 时读取文件信息生成事件，文件已被彻底删除时无法生成
+		if file.Name == "" && file.ID != 0 {
+			row := db.QueryRowContext(ctx, `SELECT `+fileColumns+` FROM files WHERE id = ?`, file.ID)
+			if f, err := scanFile(row); err == nil {
+				file = f
+			} else if err != sql.ErrNoRows {
+				slog.ErrorContext(ctx, "Failed to get file for webhook event", "event", event, "file_id", file.ID, "error", err)
+			}
+		}
+		if file.Name != "" {
+			hooks.notify(ctx, event, file)
+		} else {
+			slog.WarnContext(ctx, "Webhook event skipped without file information", "event", event, "file_id", file.ID)
+		}
+	}
+}
+
+// 注册审计日志接口，仅管理员可以访问
+func registerAuditRoutes(admin gin.IRouter, db *sql.DB) {
+	// 分页查询审计日志，最新的在前；可以按操作者 id、操作和时间范围过滤
+	admin.GET("/audit", func(c *gin.Context) {
+		limit, err := queryInt(c, "limit", defaultPageLimit)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxPageLimit)))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil || offset < 0 {
+			renderError(c, invalidRequest("Invalid offset, must be a non-negative integer"))
+			return
+		}
+		filter := auditFilter{Action: c.Query("action"), Limit: limit, Offset: offset}
+		if v := c.Query("actor"); v != "" {
+			actorID, err := strconv.Atoi(v)
+			if err != nil {
+				renderError(c, invalidRequest("Invalid actor, must be a user id"))
+				return
+			}
+			filter.ActorID = &actorID
+		}
+		for key, dst := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if v := c.Query(key); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					renderError(c, invalidRequest("Invalid "+key+", must be an RFC 3339 time"))
+					return
+				}
+				t = t.UTC()
+				*dst = &t
+			}
+		}
+
+		entries, total, err := listAuditEntries(c.Request.Context(), db, filter)
+		if err != nil {
+			renderError(c, internalError("Failed to get audit log", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"entries": entries,
+			"total":   total,
+			"limit":   limit,
+			"offset":  offset,
+		})
+	})
+}
+
+// 写入一条审计日志；请求可能已经结束，不使用请求的 context
+func insertAuditEntry(ctx context.Context, db *sql.DB, entry AuditEntry) error {
+	insertQuery := `INSERT INTO audit_log (created_at, actor_id, action, file_id, hash, client_ip, status, outcome) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.ExecContext(ctx, insertQuery, entry.CreatedAt, entry.ActorID, entry.Action, entry.FileID, entry.Hash, entry.ClientIP, entry.Status, entry.Outcome)
+	return err
+}
+
+// 查询符合条件的审计日志及总数
+func listAuditEntries(ctx context.Context, db *sql.DB, filter auditFilter) ([]AuditEntry, int, error) {
+	var conditions []string
+	var args []any
+	if filter.ActorID != nil {
+		conditions = append(conditions, "audit_log.actor_id = ?")
+		args = append(args, *filter.ActorID)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "audit_log.action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Since != nil {
+		conditions = append(conditions, "audit_log.created_at >= ?")
+		args = append(args, *filter.Since)
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, "audit_log.created_at < ?")
+		args = append(args, *filter.Until)
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_log"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+	SELECT audit_log.id, audit_log.created_at, audit_log.actor_id, users.username, audit_log.action,
+		audit_log.file_id, audit_log.hash, audit_log.client_ip, audit_log.status, audit_log.outcome
+	FROM audit_log LEFT JOIN users ON users.id = audit_log.actor_id` + where + `
+	ORDER BY audit_log.created_at DESC, audit_log.id DESC LIMIT ? OFFSET ?`
+	rows, err := db.QueryContext(ctx, query, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.Actor, &e.Action, &e.FileID, &e.Hash, &e.ClientIP, &e.Status, &e.Outcome); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+// 定期删除超过 retentionDays 天的审计日志，retentionDays 为 0 时不删除
+func pruneAuditLog(ctx context.Context, db *sql.DB, retentionDays int) {
+	if retentionDays == 0 {
+		return
+	}
+	ticker := time.NewTicker(auditPruneInterval)
+	defer ticker.Stop()
+	for {
+		before := time.Now().UTC().AddDate(0, 0, -retentionDays)
+		result, err := db.ExecContext(ctx, `DELETE FROM audit_log WHERE created_at < ?`, before)
+		if err != nil {
+			slog.Error("Failed to prune audit log", "error", err)
+		} else if n, _ := result.RowsAffected(); n > 0 {
+			slog.Info("Pruned audit log", "entries", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
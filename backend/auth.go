@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 密码的最小长度；bcrypt 只使用前 72 字节
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// 用户名已被注册
+var errUserExists = errors.New("username already exists")
+
+// 合法的用户名
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+// User 数据结构；QuotaBytes 为 0 表示不限制存储空间
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	IsAdmin      bool      `json:"is_admin"`
+	QuotaBytes   int64     `json:"quota_bytes"`
+	UsedBytes    int64     `json:"used_bytes"`
+}
+
+// 查询用户时使用的字段，顺序与 scanUser 一致
+const userColumns = "id, username, password_hash, created_at, is_admin, quota_bytes, used_bytes"
+
+// 注册用户相关接口
+func registerAuthRoutes(r gin.IRouter, db *sql.DB, secret []byte, expiry time.Duration, defaultQuota int64) {
+	// 用户注册接口
+	r.POST("/register", func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if !usernamePattern.MatchString(req.Username) {
+			renderError(c, invalidRequest("Username must be 3-32 letters, digits, '_', '.' or '-'"))
+			return
+		}
+		if len(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength {
+			renderError(c, invalidRequest("Password must be 8-72 bytes long"))
+			return
+		}
+
+		// 提前检查以免无谓地计算密码哈希；并发注册同名用户时由唯一约束保证只有一个成功
+		exists, err := userExists(c.Request.Context(), db, req.Username)
+		if err != nil {
+			renderError(c, internalError("Failed to check user existence", err))
+			return
+		}
+		if exists {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Username already exists"))
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			renderError(c, internalError("Failed to create user", err))
+			return
+		}
+		user, err := addUser(c.Request.Context(), db, User{
+			Username:     req.Username,
+			PasswordHash: string(hash),
+			CreatedAt:    time.Now().UTC(),
+			QuotaBytes:   defaultQuota,
+		})
+		if errors.Is(err, errUserExists) {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Username already exists"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to create user", err))
+			return
+		}
+		// 升级前上传的文件没有所有者，归第一个注册的用户所有
+		if err := claimUnownedFiles(db); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to assign file owner", "error", err)
+		}
+		c.JSON(http.StatusCreated, user)
+	})
+
+	// 用户登录接口，成功时返回 JWT
+	r.POST("/login", func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+
+		user, err := getUserByName(c.Request.Context(), db, req.Username)
+		if err != nil && err != sql.ErrNoRows {
+			renderError(c, internalError("Failed to get user", err))
+			return
+		}
+		if err == sql.ErrNoRows || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+			renderError(c, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Invalid username or password"))
+			return
+		}
+
+		expiresAt := time.Now().Add(expiry)
+		token, err := newToken(secret, user.ID, expiresAt)
+		if err != nil {
+			renderError(c, internalError("Failed to create token", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"token":      token,
+			"expires_at": expiresAt.UTC(),
+			"user":       user,
+		})
+	})
+}
+
+// 校验 Authorization: Bearer 请求头中的 JWT 或 X-API-Key 请求头中的 API key，并将用户 id 保存到上下文中
+func authMiddleware(db *sql.DB, secret []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := c.GetHeader(apiKeyHeader); key != "" {
+			userID, err := authenticateAPIKey(c.Request.Context(), db, key)
+			if errors.Is(err, errInvalidAPIKey) {
+				renderError(c, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Invalid or missing token"))
+				return
+			}
+			if err != nil {
+				renderError(c, internalError("Failed to check API key", err))
+				return
+			}
+			c.Set("userID", userID)
+			c.Next()
+			return
+		}
+
+		header := c.GetHeader("Authorization")
+		tokenString, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || tokenString == "" {
+			renderError(c, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Invalid or missing token"))
+			return
+		}
+
+		userID, err := parseToken(secret, tokenString)
+		if err != nil {
+			renderError(c, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Invalid or missing token"))
+			return
+		}
+		c.Set("userID", userID)
+		c.Next()
+	}
+}
+
+// 只允许管理员访问，需在 authMiddleware 之后使用
+func adminMiddleware(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, err := isAdmin(c.Request.Context(), db, currentUserID(c))
+		if err != nil {
+			renderError(c, internalError("Failed to get user", err))
+			return
+		}
+		if !admin {
+			renderError(c, newAPIError(http.StatusForbidden, codeForbidden, "Admin permission required"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// 检查用户是否为管理员；用户不存在时返回 false
+func isAdmin(ctx context.Context, db *sql.DB, userID int) (bool, error) {
+	var admin bool
+	err := db.QueryRowContext(ctx, `SELECT is_admin FROM users WHERE id = ?`, userID).Scan(&admin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return admin, err
+}
+
+// 获取当前登录用户的 id
+func currentUserID(c *gin.Context) int {
+	return c.GetInt("userID")
+}
+
+// 生成携带用户 id 的 JWT
+func newToken(secret []byte, userID int, expiresAt time.Time) (string, error) {
+	claims := jwt.RegisteredClaims{
+		Subject:   strconv.Itoa(userID),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+}
+
+// 校验 JWT 并返回其中的用户 id
+func parseToken(secret []byte, tokenString string) (int, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(*jwt.Token) (any, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(claims.Subject)
+}
+
+// 检查用户名是否已存在
+func userExists(ctx context.Context, db *sql.DB, username string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`
+	err := db.QueryRowContext(ctx, query, username).Scan(&exists)
+	return exists, err
+}
+
+// 添加用户，返回包含 id 的用户信息；第一个注册的用户成为管理员，用户名已存在时返回 errUserExists
+func addUser(ctx context.Context, db *sql.DB, user User) (User, error) {
+	insertQuery := `
+	INSERT INTO users (username, password_hash, created_at, is_admin, quota_bytes)
+	VALUES (?, ?, ?, NOT EXISTS(SELECT 1 FROM users), ?) RETURNING ` + userColumns
+	user, err := scanUser(db.QueryRowContext(ctx, insertQuery, user.Username, user.PasswordHash, user.CreatedAt, user.QuotaBytes))
+	if isUniqueViolation(err) {
+		return user, errUserExists
+	}
+	return user, err
+}
+
+// 根据用户名获取用户；不存在时返回 sql.ErrNoRows
+func getUserByName(ctx context.Context, db *sql.DB, username string) (User, error) {
+	return scanUser(db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+}
+
+// 按 userColumns 的顺序读取一行用户数据
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.IsAdmin, &user.QuotaBytes, &user.UsedBytes)
+	return user, err
+}
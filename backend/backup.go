@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 备份文件名的前缀和扩展名，文件名中间为备份的时间
+const (
+	backupPrefix     = "files-"
+	backupExt        = ".db"
+	backupTimeLayout = "20060102T150405Z"
+)
+
+// Backup 数据库备份文件
+type Backup struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	CreatedAt  time.Time `json:"created_at"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+}
+
+// 注册数据库备份接口，仅管理员可以访问。备份只包括数据库，使用本地存储后端时文件内容需要另外备份
+func registerBackupRoutes(admin gin.IRouter, db *sql.DB, dir string) {
+	var running sync.Mutex
+
+	// 使用 VACUUM INTO 生成数据库的一致快照，备份期间服务正常读写。
+	// 默认保存到 BACKUP_DIR 并返回备份的信息；stream 为 true 时直接作为响应返回，不保留备份文件
+	admin.POST("/backup", func(c *gin.Context) {
+		stream, err := queryBool(c, "stream")
+		if err != nil {
+			renderError(c, invalidRequest("Invalid stream, must be true or false"))
+			return
+		}
+		if !stream && dir == "" {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Backup directory is not configured, set BACKUP_DIR or use stream=true"))
+			return
+		}
+		if !running.TryLock() {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "A backup is already running"))
+			return
+		}
+		defer running.Unlock()
+
+		// 先写入临时文件，完成后才改为备份的名称，列出备份时不会出现不完整的文件；流式返回的备份发送后删除
+		target := dir
+		if stream {
+			target = os.TempDir()
+		}
+		start := time.Now().UTC()
+		name := backupPrefix + start.Format(backupTimeLayout) + backupExt
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			renderError(c, internalError("Failed to back up database", err))
+			return
+		}
+		path := filepath.Join(target, name)
+		if _, err := os.Stat(path); err == nil && !stream {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "A backup with the same time already exists"))
+			return
+		}
+		tmp := filepath.Join(target, ".backup-"+strconv.FormatInt(start.UnixNano(), 10)+backupExt)
+		defer os.Remove(tmp)
+		if _, err := db.ExecContext(c.Request.Context(), `VACUUM INTO ?`, tmp); err != nil {
+			renderError(c, internalError("Failed to back up database", err))
+			return
+		}
+		info, err := os.Stat(tmp)
+		if err != nil {
+			renderError(c, internalError("Failed to back up database", err))
+			return
+		}
+		backup := Backup{Name: name, Size: info.Size(), CreatedAt: start, DurationMS: time.Since(start).Milliseconds()}
+		slog.InfoContext(c.Request.Context(), "Database backed up", "name", backup.Name, "size", backup.Size, "duration_ms", backup.DurationMS, "stream", stream)
+
+		if stream {
+			c.Header("X-Backup-Duration-Ms", strconv.FormatInt(backup.DurationMS, 10))
+			c.FileAttachment(tmp, name)
+			return
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			renderError(c, internalError("Failed to back up database", err))
+			return
+		}
+		c.JSON(http.StatusCreated, backup)
+	})
+
+	// 列出 BACKUP_DIR 中的备份，最新的在前
+	admin.GET("/backups", func(c *gin.Context) {
+		if dir == "" {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Backup directory is not configured, set BACKUP_DIR"))
+			return
+		}
+		backups, err := listBackups(dir)
+		if err != nil {
+			renderError(c, internalError("Failed to list backups", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"backups": backups})
+	})
+}
+
+// 读取目录中的备份文件，时间取自文件名，文件名不符合格式的文件忽略
+func listBackups(dir string) ([]Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Backup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := []Backup{}
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), backupPrefix)
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		createdAt, err := time.Parse(backupTimeLayout, strings.TrimSuffix(stamp, backupExt))
+		if err != nil || !strings.HasSuffix(stamp, backupExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, Backup{Name: entry.Name(), Size: info.Size(), CreatedAt: createdAt})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 令牌桶最多累积的字节数，同时也是每次读取的上限，避免限速较低时单次读取需要等待过久
+const maxBandwidthBurst = 256 << 10
+
+// 带宽限制的范围，用作指标的 scope 标签
+const (
+	bandwidthGlobal      = "global"
+	bandwidthPerDownload = "per_download"
+)
+
+// 下载的带宽限制：所有下载共用 global，每个请求另有各自的 perDownload 限制（字节/秒），0 表示不限制
+type bandwidthLimiter struct {
+	global      *tokenBucket
+	perDownload int64
+}
+
+// 单个请求使用的令牌桶，通过请求的 context 传给读取内容的代码
+type downloadThrottle struct {
+	global *tokenBucket
+	own    *tokenBucket
+}
+
+type downloadThrottleKey struct{}
+
+// 令牌桶，令牌为字节，每秒补充 rate 个，最多累积 burst 个
+type tokenBucket struct {
+	mu     sync.Mutex
+	scope  string
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(global, perDownload int64) *bandwidthLimiter {
+	bandwidthLimitGauge.WithLabelValues(bandwidthGlobal).Set(float64(global))
+	bandwidthLimitGauge.WithLabelValues(bandwidthPerDownload).Set(float64(perDownload))
+	l := &bandwidthLimiter{perDownload: perDownload}
+	if global > 0 {
+		l.global = newTokenBucket(bandwidthGlobal, global)
+	}
+	return l
+}
+
+func newTokenBucket(scope string, rate int64) *tokenBucket {
+	burst := float64(min(rate, maxBandwidthBurst))
+	return &tokenBucket{scope: scope, rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// 为请求设置下载限速，经 contextReader 读取的内容按限制的速度读取；都不限制时不做任何处理
+func (l *bandwidthLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l.global == nil && l.perDownload <= 0 {
+			c.Next()
+			return
+		}
+		throttle := &downloadThrottle{global: l.global}
+		if l.perDownload > 0 {
+			throttle.own = newTokenBucket(bandwidthPerDownload, l.perDownload)
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), downloadThrottleKey{}, throttle))
+		c.Next()
+	}
+}
+
+// 单次读取的最大字节数，不限速时为 n
+func throttleReadSize(ctx context.Context, n int) int {
+	if ctx.Value(downloadThrottleKey{}) == nil {
+		return n
+	}
+	return min(n, maxBandwidthBurst)
+}
+
+// 读取了 n 字节后按请求的限速等待；ctx 结束（客户端断开）时立即返回错误，未等到的令牌退回
+func waitBandwidth(ctx context.Context, n int) error {
+	throttle, ok := ctx.Value(downloadThrottleKey{}).(*downloadThrottle)
+	if !ok || n <= 0 {
+		return nil
+	}
+	if throttle.own != nil {
+		if err := throttle.own.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	if throttle.global != nil {
+		return throttle.global.wait(ctx, n)
+	}
+	return nil
+}
+
+// 取出 n 个令牌，不足时等待补充
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+
+	delay := time.Duration(deficit / b.rate * float64(time.Second))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start := time.Now()
+	select {
+	case <-timer.C:
+		throttledSeconds.WithLabelValues(b.scope).Add(delay.Seconds())
+		return nil
+	case <-ctx.Done():
+		throttledSeconds.WithLabelValues(b.scope).Add(time.Since(start).Seconds())
+		b.mu.Lock()
+		b.tokens = min(b.burst, b.tokens+float64(n))
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// 字节单位的倍数
+var byteRateUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// 解析每秒字节数，如 50MB/s、512KiB 或 1000000，单位不区分大小写，/s 可以省略；空字符串或 0 表示不限制
+func parseByteRate(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "/s")
+	if s == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := byteRateUnits[strings.TrimSpace(s[i:])]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", s[i:])
+	}
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(value * float64(unit)), nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 注册按路径幂等上传的接口；maxUploadSize 限制上传的大小，maxVersions 限制保留的版本数，
+// 新上传的内容使用 hashAlgo 计算哈希，较大的内容暂存在 spoolDir 中
+func registerByNameRoutes(r gin.IRouter, db *sql.DB, store Storage, maxUploadSize int64, maxVersions int, hashAlgo, spoolDir string) {
+	repo := newFileRepository(db)
+
+	// 确保路径 name 下的文件是请求体的内容，请求体为原始内容而不是表单，可以重复执行：
+	// 文件不存在时创建并返回 201，路径中的文件夹不存在时一并创建；内容相同时不做修改并返回 200；
+	// 内容不同时作为新版本保存。If-Match 为期望的当前内容的 ETag（"哈希"）或 *，与当前内容不一致、
+	// 或文件不存在时返回 412。可以通过 X-Content-SHA256 请求头声明内容的哈希。
+	// 响应中 changed 表示是否修改了文件，ETag 为结果内容的哈希
+	r.PUT("/files/by-name/*name", limitBodySize(maxUploadSize), func(c *gin.Context) {
+		defer trackUpload()()
+		detachDeadline(c)
+		folders, name, err := splitFilePath(c.Param("name"))
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		hashes, ok := expectedHashes(c, nil, 1)
+		if !ok {
+			return
+		}
+		ifMatch := c.GetHeader("If-Match")
+
+		content, err := spoolContent(c.Request.Body, spoolDir, hashAlgo, spoolMemoryLimit)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			uploadTooLarge(c, maxUploadSize)
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to receive upload", err))
+			return
+		}
+		defer content.Close()
+		if hashes[0] != "" && content.sha256 != hashes[0] {
+			renderError(c, newAPIError(http.StatusUnprocessableEntity, codeHashMismatch, "Hash does not match").with(gin.H{
+				"expected_hash": hashes[0],
+				"actual_hash":   content.sha256,
+			}))
+			return
+		}
+
+		ownerID := currentUserID(c)
+		folderID, found, err := resolveFolderPath(c.Request.Context(), db, ownerID, folders, false)
+		if err != nil {
+			renderError(c, internalError("Failed to get folder", err))
+			return
+		}
+		current, err := File{}, errNotFound
+		if found {
+			current, err = repo.GetByName(c.Request.Context(), ownerID, folderID, name)
+		}
+		if err != nil && !errors.Is(err, errNotFound) {
+			renderError(c, internalError("Failed to get file", err))
+			return
+		}
+		exists := err == nil
+
+		switch {
+		case exists && sameContent(current, content, hashAlgo):
+			setCacheHeaders(c, `"`+current.Hash+`"`)
+			c.JSON(http.StatusOK, byNameResponse(current, false))
+			return
+		case ifMatch != "" && (!exists || !ifMatchHash(ifMatch, current.Hash)):
+			details := gin.H{}
+			if exists {
+				details["current_hash"] = current.Hash
+				details["current_hash_algo"] = current.HashAlgo
+			}
+			renderError(c, newAPIError(http.StatusPreconditionFailed, codePreconditionFailed, "File does not match If-Match").with(details))
+			return
+		}
+
+		body, err := content.reader()
+		if err != nil {
+			renderError(c, internalError("Failed to read upload", err))
+			return
+		}
+		mimeType, _, err := detectContentType(body, c.ContentType(), name)
+		if err != nil {
+			renderError(c, internalError("Failed to read upload", err))
+			return
+		}
+		file := File{
+			HashAlgo:  hashAlgo,
+			Name:      name,
+			Mime:      mimeType,
+			CreatedAt: time.Now().UTC(),
+			OwnerID:   ownerID,
+			FolderID:  folderID,
+		}
+		if exists {
+			file.ID = current.ID
+		} else if !found {
+			if file.FolderID, _, err = resolveFolderPath(c.Request.Context(), db, ownerID, folders, true); err != nil {
+				renderError(c, internalError("Failed to create folder", err))
+				return
+			}
+		}
+
+		fileInfo, err := storeSpooled(c.Request.Context(), db, store, file, content, "", false)
+		if e := uploadRejectedError(err); e != nil {
+			renderError(c, e)
+			return
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			quotaExceeded(c, db, ownerID)
+			return
+		}
+		if errors.Is(err, errFolderNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Folder not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to save file", err))
+			return
+		}
+		if fileInfo.Version > 1 {
+			pruneVersions(c.Request.Context(), db, store, fileInfo, maxVersions)
+		}
+		addAuditFile(c, fileInfo)
+		// 新版本只返回了部分字段，重新读取完整的文件信息
+		if updated, err := repo.GetByID(c.Request.Context(), ownerID, fileInfo.ID); err == nil {
+			fileInfo = updated
+		}
+
+		setCacheHeaders(c, `"`+fileInfo.Hash+`"`)
+		if exists {
+			c.JSON(http.StatusOK, byNameResponse(fileInfo, true))
+			return
+		}
+		c.Header("Location", apiV1Prefix+"/files/"+strconv.Itoa(fileInfo.ID))
+		c.JSON(http.StatusCreated, byNameResponse(fileInfo, true))
+	})
+}
+
+// 按路径上传的响应
+func byNameResponse(file File, changed bool) gin.H {
+	return gin.H{
+		"file":      file,
+		"hash":      file.Hash,
+		"hash_algo": file.HashAlgo,
+		"version":   file.Version,
+		"changed":   changed,
+	}
+}
+
+// 将 a/b/c.txt 形式的路径拆分为文件夹名和文件名，各部分都需是合法的名称
+func splitFilePath(p string) ([]string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for _, part := range parts {
+		if part == "." || part == ".." {
+			return nil, "", errors.New("Path must not contain . or .. segments")
+		}
+		if err := checkFileName(part); err != nil {
+			return nil, "", err
+		}
+	}
+	return parts[:len(parts)-1], parts[len(parts)-1], nil
+}
+
+// 从根目录开始依次查找路径上的文件夹，返回最后一个文件夹的 id（根目录为空）和是否都已存在；
+// create 为 true 时创建不存在的文件夹
+func resolveFolderPath(ctx context.Context, db *sql.DB, ownerID int, names []string, create bool) (*int, bool, error) {
+	var folderID *int
+	for _, name := range names {
+		id, missing, err := findOrCreateFolder(ctx, db, ownerID, folderID, name, !create)
+		if err != nil {
+			return nil, false, err
+		}
+		if missing && !create {
+			return nil, false, nil
+		}
+		folderID = id
+	}
+	return folderID, true, nil
+}
+
+// 文件的内容是否与暂存的内容相同；文件使用其他哈希算法时通过 sha256 比较
+func sameContent(file File, content *spooledContent, hashAlgo string) bool {
+	if file.HashAlgo == hashAlgo {
+		return file.Hash == content.hash
+	}
+	return file.HashAlgo == hashSHA256 && file.Hash == content.sha256
+}
+
+// If-Match 是否与内容的哈希匹配，按强比较处理；也接受不带引号的哈希
+func ifMatchHash(ifMatch, hash string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == `"`+hash+`"` || candidate == hash {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 导出文件列表时每次查询的文件数
+const catalogPageSize = 1000
+
+// 导出文件列表的格式
+const (
+	catalogCSV    = "csv"
+	catalogNDJSON = "ndjson"
+)
+
+// 导出的每个文件的字段，也是 CSV 的列
+var catalogColumns = []string{"id", "name", "hash", "size", "mime", "owner", "created_at", "folder_path"}
+
+// CatalogEntry 导出的文件信息，folder_path 为所在文件夹的路径，根目录为 /
+type CatalogEntry struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	Hash       string    `json:"hash"`
+	Size       int64     `json:"size"`
+	Mime       string    `json:"mime"`
+	Owner      string    `json:"owner"`
+	CreatedAt  time.Time `json:"created_at"`
+	FolderPath string    `json:"folder_path"`
+}
+
+// 注册导出文件列表的接口
+func registerFileExportRoutes(r gin.IRouter, db *sql.DB) {
+	repo := newFileRepository(db)
+
+	// 以 format=csv（默认）或 ndjson 流式导出所有文件的信息，按上传时间排列，分页查询，不会一次读入所有文件。
+	// 支持与 /files 相同的 q、starred、folder、tag、type、mime、since 和 until 过滤参数；管理员可以用 owner（用户 id）
+	// 导出其他用户的文件。bom=true 时在 CSV 前写入 UTF-8 BOM，便于 Excel 识别编码
+	r.GET("/files/export", func(c *gin.Context) {
+		format := c.DefaultQuery("format", catalogCSV)
+		if format != catalogCSV && format != catalogNDJSON {
+			renderError(c, invalidRequest("Invalid format, must be csv or ndjson"))
+			return
+		}
+		bom, err := queryBool(c, "bom")
+		if err != nil {
+			renderError(c, invalidRequest("Invalid bom, must be true or false"))
+			return
+		}
+		starred, err := queryBool(c, "starred")
+		if err != nil {
+			renderError(c, invalidRequest("Invalid starred, must be true or false"))
+			return
+		}
+		opts := listOptions{
+			OwnerID: currentUserID(c),
+			Query:   c.Query("q"),
+			Starred: starred,
+			Sort:    "created_at",
+			Limit:   catalogPageSize,
+		}
+		if v := c.Query("owner"); v != "" {
+			ownerID, err := strconv.Atoi(v)
+			if err != nil {
+				renderError(c, invalidRequest("Invalid owner, must be a user id"))
+				return
+			}
+			if ownerID != opts.OwnerID {
+				admin, err := isAdmin(c.Request.Context(), db, opts.OwnerID)
+				if err != nil {
+					renderError(c, internalError("Failed to get user", err))
+					return
+				}
+				if !admin {
+					renderError(c, newAPIError(http.StatusForbidden, codeForbidden, "Admin permission required to export files of other users"))
+					return
+				}
+			}
+			opts.OwnerID = ownerID
+		}
+		if !parseListFilters(c, &opts) {
+			return
+		}
+		var owner string
+		err = db.QueryRowContext(c.Request.Context(), `SELECT username FROM users WHERE id = ?`, opts.OwnerID).Scan(&owner)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "User not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get user", err))
+			return
+		}
+
+		// 第一页出错时还能返回错误响应，之后的错误只能中断输出
+		files, _, more, err := repo.List(c.Request.Context(), opts)
+		if err != nil {
+			renderError(c, internalError("Failed to get files", err))
+			return
+		}
+		detachDeadline(c)
+		name := "files-" + time.Now().UTC().Format("2006-01-02") + "." + format
+		c.Header("Content-Disposition", contentDisposition("attachment", name))
+		if format == catalogCSV {
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+		} else {
+			c.Header("Content-Type", "application/x-ndjson")
+		}
+		c.Status(http.StatusOK)
+
+		w := newCatalogWriter(c.Writer, format, bom)
+		paths := folderPaths{db: db, paths: map[int]string{}}
+		ctx := c.Request.Context()
+		for {
+			for _, file := range files {
+				folderPath, err := paths.get(ctx, file)
+				if err == nil {
+					err = w.write(CatalogEntry{
+						ID:         file.ID,
+						Name:       file.Name,
+						Hash:       file.Hash,
+						Size:       file.Size,
+						Mime:       file.Mime,
+						Owner:      owner,
+						CreatedAt:  file.CreatedAt,
+						FolderPath: folderPath,
+					})
+				}
+				if err != nil {
+					slog.WarnContext(ctx, "Failed to export files", "error", err)
+					return
+				}
+			}
+			if err := w.flush(); err != nil || !more {
+				return
+			}
+			c.Writer.Flush()
+			opts.After = fileCursorAfter(opts.Sort, opts.Desc, files[len(files)-1])
+			if files, _, more, err = repo.List(ctx, opts); err != nil {
+				slog.WarnContext(ctx, "Failed to export files", "error", err)
+				return
+			}
+		}
+	})
+}
+
+// 按格式写入导出的文件信息
+type catalogWriter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+func newCatalogWriter(w io.Writer, format string, bom bool) *catalogWriter {
+	if format == catalogNDJSON {
+		return &catalogWriter{json: json.NewEncoder(w)}
+	}
+	if bom {
+		io.WriteString(w, "\ufeff")
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(catalogColumns)
+	return &catalogWriter{csv: cw}
+}
+
+func (w *catalogWriter) write(entry CatalogEntry) error {
+	if w.json != nil {
+		return w.json.Encode(entry)
+	}
+	return w.csv.Write([]string{
+		strconv.Itoa(entry.ID),
+		entry.Name,
+		entry.Hash,
+		strconv.FormatInt(entry.Size, 10),
+		entry.Mime,
+		entry.Owner,
+		entry.CreatedAt.UTC().Format(time.RFC3339),
+		entry.FolderPath,
+	})
+}
+
+func (w *catalogWriter) flush() error {
+	if w.csv == nil {
+		return nil
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// 文件夹路径的缓存，同一文件夹下的文件只查询一次
+type folderPaths struct {
+	db    *sql.DB
+	paths map[int]string
+}
+
+// 文件所在文件夹的路径，如 /docs/2024，根目录为 /
+func (p folderPaths) get(ctx context.Context, file File) (string, error) {
+	if file.FolderID == nil {
+		return "/", nil
+	}
+	if path, ok := p.paths[*file.FolderID]; ok {
+		return path, nil
+	}
+	path, err := filePath(ctx, p.db, File{OwnerID: file.OwnerID, FolderID: file.FolderID})
+	if err != nil {
+		return "", err
+	}
+	path = strings.TrimSuffix(path, "/")
+	p.paths[*file.FolderID] = path
+	return path, nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"math/bits"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 内容的分块方式
+const (
+	chunkingOff   = "off"
+	chunkingFixed = "fixed"
+	chunkingCDC   = "cdc"
+)
+
+// 分块大小的默认值和允许的范围
+const (
+	defaultChunkSize = 4 << 20
+	minChunkSize     = 64 << 10
+	maxChunkSize     = 64 << 20
+)
+
+// 分块在存储后端中的键的前缀，后面是分块的 sha256 摘要；与 blobKey 的格式相同，不会与内容的键冲突
+const chunkKeyPrefix = "chunk:"
+
+// 将内容切分为分块保存的存储后端，相同的分块在所有内容之间只保存一次，适合大量相似的大文件。
+// 分块保存在 base 中，分块的引用计数和每个内容的分块列表保存在 chunks 和 file_chunks 表中。
+// 关闭分块后新内容整体保存在 base 中，已分块保存的内容仍然可以读取和删除；
+// 没有分块列表的内容（开启分块前保存的）同样直接读写 base
+type chunkedStorage struct {
+	base     Storage
+	db       *sql.DB
+	chunking string
+	size     int
+	locks    [256]sync.Mutex // 同一分块的引用和删除互斥，按摘要分组
+}
+
+// 分块列表中的一项
+type chunkRef struct {
+	hash string
+	size int64
+}
+
+// 创建分块存储后端
+func newChunkedStorage(db *sql.DB, base Storage, chunking string, size int) *chunkedStorage {
+	return &chunkedStorage{base: base, db: db, chunking: chunking, size: size}
+}
+
+// 分块在存储后端中的键
+func chunkKey(hash string) string {
+	return chunkKeyPrefix + hash
+}
+
+func (s *chunkedStorage) Put(ctx context.Context, hash string, r io.Reader) error {
+	if s.chunking == chunkingOff {
+		return s.base.Put(ctx, hash, r)
+	}
+	next := s.splitter(r)
+	var refs []chunkRef
+	for {
+		data, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			sum := sha256.Sum256(data)
+			ref := chunkRef{hash: hex.EncodeToString(sum[:]), size: int64(len(data))}
+			if err = s.acquireChunk(ctx, ref, data); err == nil {
+				refs = append(refs, ref)
+			}
+		}
+		if err != nil {
+			s.releaseChunks(refs)
+			return err
+		}
+	}
+	// 空内容没有分块，整体保存
+	if len(refs) == 0 {
+		return s.base.Put(ctx, hash, bytes.NewReader(nil))
+	}
+	err := s.saveChunkList(ctx, hash, refs)
+	if err != nil {
+		s.releaseChunks(refs)
+	}
+	return err
+}
+
+// 保存内容的分块列表；已经保存过时保留原来的列表并释放这次的分块。
+// 调用方持有内容的 lockContent，同一内容不会被并发保存
+func (s *chunkedStorage) saveChunkList(ctx context.Context, hash string, refs []chunkRef) error {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM file_chunks WHERE blob_hash = ?)`, hash).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		s.releaseChunks(refs)
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, ref := range refs {
+		insertQuery := `INSERT INTO file_chunks (blob_hash, seq, chunk_hash, size) VALUES (?, ?, ?, ?)`
+		if _, err := tx.ExecContext(ctx, insertQuery, hash, i, ref.hash, ref.size); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *chunkedStorage) Get(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	refs, err := s.chunkList(ctx, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(refs) == 0 {
+		return s.base.Get(ctx, hash)
+	}
+	r := &chunkReader{ctx: ctx, base: s.base, refs: refs, offsets: make([]int64, len(refs))}
+	for i, ref := range refs {
+		r.offsets[i] = r.size
+		r.size += ref.size
+	}
+	return r, r.size, nil
+}
+
+func (s *chunkedStorage) Delete(ctx context.Context, hash string) error {
+	rows, err := s.db.QueryContext(ctx, `DELETE FROM file_chunks WHERE blob_hash = ? RETURNING chunk_hash, size`, hash)
+	if err != nil {
+		return err
+	}
+	var refs []chunkRef
+	for rows.Next() {
+		var ref chunkRef
+		if err := rows.Scan(&ref.hash, &ref.size); err != nil {
+			rows.Close()
+			return err
+		}
+		refs = append(refs, ref)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return s.base.Delete(ctx, hash)
+	}
+	s.releaseChunks(refs)
+	return nil
+}
+
+func (s *chunkedStorage) Exists(ctx context.Context, hash string) (bool, error) {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM file_chunks WHERE blob_hash = ?)`, hash).Scan(&exists); err != nil || exists {
+		return exists, err
+	}
+	return s.base.Exists(ctx, hash)
+}
+
+// 按顺序读取内容的分块列表，内容没有分块保存时返回空列表
+func (s *chunkedStorage) chunkList(ctx context.Context, hash string) ([]chunkRef, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT chunk_hash, size FROM file_chunks WHERE blob_hash = ? ORDER BY seq`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var refs []chunkRef
+	for rows.Next() {
+		var ref chunkRef
+		if err := rows.Scan(&ref.hash, &ref.size); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// 锁定分块，返回解锁函数
+func (s *chunkedStorage) lockChunk(hash string) func() {
+	n, _ := strconv.ParseUint(hash[:2], 16, 8)
+	s.locks[n].Lock()
+	return s.locks[n].Unlock
+}
+
+// 增加分块的引用计数，分块尚未保存时先保存 data
+func (s *chunkedStorage) acquireChunk(ctx context.Context, ref chunkRef, data []byte) error {
+	unlock := s.lockChunk(ref.hash)
+	defer unlock()
+	result, err := s.db.ExecContext(ctx, `UPDATE chunks SET refcount = refcount + 1 WHERE hash = ?`, ref.hash)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if err := s.base.Put(ctx, chunkKey(ref.hash), bytes.NewReader(data)); err != nil {
+			return err
+		}
+		insertQuery := `INSERT INTO chunks (hash, size, refcount, created_at) VALUES (?, ?, 1, ?)`
+		if _, err := s.db.ExecContext(ctx, insertQuery, ref.hash, ref.size, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	// 其他进程可能在增加引用前已认领删除该分块
+	if err := awaitContentDeletion(ctx, s.db, chunkKey(ref.hash)); err != nil {
+		return err
+	}
+	exists, err := s.base.Exists(ctx, chunkKey(ref.hash))
+	if err != nil || exists {
+		return err
+	}
+	return s.base.Put(ctx, chunkKey(ref.hash), bytes.NewReader(data))
+}
+
+// 减少分块的引用计数，没有引用的分块从存储后端删除。内容的记录已经删除或保存失败，失败时只记录日志
+func (s *chunkedStorage) releaseChunks(refs []chunkRef) {
+	// 请求结束后也要完成释放，不使用请求的 context
+	ctx := context.Background()
+	for _, ref := range refs {
+		unlock := s.lockChunk(ref.hash)
+		var refcount int
+		err := s.db.QueryRowContext(ctx, `UPDATE chunks SET refcount = refcount - 1 WHERE hash = ? RETURNING refcount`, ref.hash).Scan(&refcount)
+		if err == nil && refcount <= 0 {
+			err = s.deleteChunk(ctx, ref.hash)
+		}
+		unlock()
+		if err != nil && err != sql.ErrNoRows {
+			slog.Error("Failed to release content chunk", "chunk", ref.hash, "error", err)
+		}
+	}
+}
+
+// 删除已没有引用的分块；其他进程期间又引用了该分块时保留。调用方需要持有 lockChunk
+func (s *chunkedStorage) deleteChunk(ctx context.Context, hash string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM chunks WHERE hash = ? AND refcount <= 0`, hash)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	claimed, err := claimContentDeletion(ctx, s.db, "chunks", hash, chunkKey(hash))
+	if err != nil || !claimed {
+		return err
+	}
+	defer finishContentDeletion(ctx, s.db, chunkKey(hash))
+	return s.base.Delete(ctx, chunkKey(hash))
+}
+
+// 返回依次读取 r 的分块的函数，读完时返回 io.EOF
+func (s *chunkedStorage) splitter(r io.Reader) func() ([]byte, error) {
+	if s.chunking == chunkingCDC {
+		return cdcSplitter(bufio.NewReaderSize(r, 1<<20), s.size)
+	}
+	buf := make([]byte, s.size)
+	return func() ([]byte, error) {
+		n, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if n == 0 && err == nil {
+			err = io.EOF
+		}
+		return buf[:n], err
+	}
+}
+
+// 按内容切分的分块使用的 gear 哈希表，由固定的种子生成，切分结果在不同进程之间保持一致
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	x := uint64(0x6e65742d6469736b)
+	for i := range table {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// 按内容切分：滚动哈希的高位全为 0 时在此处切分，插入或删除数据只影响附近的分块。
+// 分块的平均大小约为 size，最小为 size/4，最大为 size*4
+func cdcSplitter(r *bufio.Reader, size int) func() ([]byte, error) {
+	shift := bits.Len(uint(size)) - 1
+	mask := ^uint64(0) << (64 - shift)
+	minSize, maxSize := size/4, size*4
+	buf := make([]byte, 0, maxSize)
+	return func() ([]byte, error) {
+		buf = buf[:0]
+		var h uint64
+		for len(buf) < maxSize {
+			b, err := r.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, b)
+			h = h<<1 + gearTable[b]
+			if len(buf) >= minSize && h&mask == 0 {
+				break
+			}
+		}
+		if len(buf) == 0 {
+			return nil, io.EOF
+		}
+		return buf, nil
+	}
+}
+
+// 按顺序读取分块拼接出的内容，实现 io.ReadSeekCloser；只在读取时打开当前所在的分块
+type chunkReader struct {
+	ctx     context.Context
+	base    Storage
+	refs    []chunkRef
+	offsets []int64 // 每个分块在内容中的起始位置
+	size    int64
+	pos     int64
+	cur     io.ReadCloser // 当前打开的分块，读取位置为 curPos，分块在 curEnd 处结束
+	curPos  int64
+	curEnd  int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.pos >= r.size {
+			return 0, io.EOF
+		}
+		if r.cur == nil || r.curPos != r.pos || r.pos >= r.curEnd {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+		// 不读到下一个分块的范围，分块的内容比记录的长时忽略多余的部分
+		if remaining := r.curEnd - r.pos; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		n, err := r.cur.Read(p)
+		r.pos += int64(n)
+		r.curPos = r.pos
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			err = nil
+			if r.pos < r.curEnd && n == 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// 打开当前位置所在的分块并跳到当前位置
+func (r *chunkReader) open() error {
+	if r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > r.pos }) - 1
+	content, _, err := r.base.Get(r.ctx, chunkKey(r.refs[i].hash))
+	if err != nil {
+		return err
+	}
+	skip := r.pos - r.offsets[i]
+	if seeker, ok := content.(io.Seeker); ok {
+		_, err = seeker.Seek(skip, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, content, skip)
+	}
+	if err != nil {
+		content.Close()
+		return err
+	}
+	r.cur = content
+	r.curPos = r.pos
+	r.curEnd = r.offsets[i] + r.refs[i].size
+	return nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 压缩时每次从数据库读取的内容数
+const compressBatchSize = 100
+
+// CompressJob 压缩已有内容的任务及其进度，状态与校验任务相同
+type CompressJob struct {
+	ID            string     `json:"id"`
+	Status        string     `json:"status"`
+	Total         int        `json:"total"`
+	Processed     int        `json:"processed"`
+	Compressed    int        `json:"compressed"`
+	OriginalBytes int64      `json:"original_bytes"` // 被压缩的内容的原大小之和
+	StoredBytes   int64      `json:"stored_bytes"`   // 被压缩的内容压缩后的大小之和
+	Error         string     `json:"error,omitempty"`
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+}
+
+// 保存在内存中的压缩任务，同一时间只运行一个
+type compressJobs struct {
+	mu       sync.Mutex
+	jobs     map[string]*CompressJob
+	finished []string // 已结束的任务 id，按结束顺序
+	running  string
+}
+
+// 尚未压缩的内容：整体保存的内容和所有分块在存储后端中的键
+const uncompressedObjectsSQL = `
+SELECT key FROM (
+	SELECT hash AS key FROM blobs WHERE hash NOT IN (SELECT blob_hash FROM file_chunks)
+	UNION ALL SELECT '` + chunkKeyPrefix + `' || hash FROM chunks
+) WHERE key NOT IN (SELECT hash FROM compressed_content)`
+
+// 注册压缩已有内容的接口，仅管理员可以访问
+func registerCompressRoutes(admin gin.IRouter, db *sql.DB, store Storage) {
+	jobs := &compressJobs{jobs: map[string]*CompressJob{}}
+
+	// 在后台压缩开启压缩前保存的内容，立即返回任务；不值得压缩的内容保持不变
+	admin.POST("/compress", func(c *gin.Context) {
+		compressed := findCompressedStorage(store)
+		if compressed == nil || compressed.compression == compressionOff {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Compression is disabled, set COMPRESSION to compress existing content"))
+			return
+		}
+		id, err := newUploadID()
+		if err != nil {
+			renderError(c, internalError("Failed to create compression job", err))
+			return
+		}
+		job := &CompressJob{ID: id, Status: verifyRunning, StartedAt: time.Now().UTC()}
+		if running, ok := jobs.start(job); !ok {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Compression is already running").with(gin.H{"job": running}))
+			return
+		}
+		slog.Info("Started content compression", "job", job.ID)
+		go jobs.run(context.Background(), db, store, compressed, job.ID)
+		c.JSON(http.StatusAccepted, jobs.get(job.ID))
+	})
+
+	// 获取压缩任务的进度
+	admin.GET("/compress/:job", func(c *gin.Context) {
+		job := jobs.get(c.Param("job"))
+		if job == nil {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Compression job not found"))
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	})
+}
+
+// 记录新任务；已有任务在运行时返回该任务的副本和 false
+func (j *compressJobs) start(job *CompressJob) (*CompressJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running != "" {
+		return j.copy(j.running), false
+	}
+	j.jobs[job.ID] = job
+	j.running = job.ID
+	return nil, true
+}
+
+// 返回任务的副本，不存在时返回 nil
+func (j *compressJobs) get(id string) *CompressJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.copy(id)
+}
+
+// 复制任务，避免返回的任务被后台的压缩修改；调用方需要持有 mu
+func (j *compressJobs) copy(id string) *CompressJob {
+	job, ok := j.jobs[id]
+	if !ok {
+		return nil
+	}
+	c := *job
+	return &c
+}
+
+// 在锁内更新任务
+func (j *compressJobs) update(id string, fn func(job *CompressJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(j.jobs[id])
+}
+
+// 结束任务，只保留最近 maxFinishedVerifyJobs 个已结束的任务
+func (j *compressJobs) finish(id string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.jobs[id]
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	job.Status = verifyCompleted
+	if err != nil {
+		job.Status = verifyFailed
+		job.Error = err.Error()
+	}
+	j.running = ""
+	j.finished = append(j.finished, id)
+	if len(j.finished) > maxFinishedVerifyJobs {
+		delete(j.jobs, j.finished[0])
+		j.finished = j.finished[1:]
+	}
+}
+
+// 逐批压缩尚未压缩的内容，每个内容在锁定后压缩，上传和删除可以同时进行
+func (j *compressJobs) run(ctx context.Context, db *sql.DB, store Storage, compressed *compressedStorage, id string) {
+	err := func() error {
+		var total int
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM (`+uncompressedObjectsSQL+`)`).Scan(&total); err != nil {
+			return err
+		}
+		j.update(id, func(job *CompressJob) { job.Total = total })
+
+		after := ""
+		for {
+			batch, err := nextUncompressedObjects(ctx, db, after)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				return nil
+			}
+			for _, key := range batch {
+				record, err := compressObject(ctx, store, compressed, key)
+				if err != nil {
+					return err
+				}
+				j.update(id, func(job *CompressJob) {
+					job.Processed++
+					if record != nil {
+						job.Compressed++
+						job.OriginalBytes += record.size
+						job.StoredBytes += record.storedSize
+					}
+				})
+			}
+			after = batch[len(batch)-1]
+		}
+	}()
+	j.finish(id, err)
+
+	job := j.get(id)
+	if err != nil {
+		slog.Error("Content compression failed", "job", id, "processed", job.Processed, "error", err)
+		return
+	}
+	slog.Info("Finished content compression", "job", id, "compressed", job.Compressed, "saved_bytes", job.OriginalBytes-job.StoredBytes)
+}
+
+// 按键的顺序读取 after 之后的一批尚未压缩的内容
+func nextUncompressedObjects(ctx context.Context, db *sql.DB, after string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, uncompressedObjectsSQL+` AND key > ? ORDER BY key LIMIT ?`, after, compressBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// 压缩存储后端中的一个对象，返回压缩记录；对象已被删除或不值得压缩时返回 nil。
+// 压缩期间锁定该内容或分块，避免同时被删除；存储后端的 Put 覆盖原内容，原内容在替换前保持完整
+func compressObject(ctx context.Context, store Storage, s *compressedStorage, key string) (*compressionRecord, error) {
+	if digest, ok := strings.CutPrefix(key, chunkKeyPrefix); ok {
+		chunked, _ := store.(*chunkedStorage)
+		if chunked == nil {
+			return nil, errors.New("chunk found without chunked storage")
+		}
+		defer chunked.lockChunk(digest)()
+	} else {
+		defer lockContent(key)()
+	}
+
+	content, _, err := s.base.Get(ctx, key)
+	if errors.Is(err, errBlobNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	r := bufio.NewReaderSize(content, compressionSampleSize)
+	head, err := r.Peek(compressionSampleSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if !compressible(head) {
+		return nil, nil
+	}
+	return s.put(ctx, key, r)
+}
+
+// 在存储后端的包装中找到压缩存储后端，不存在时返回 nil
+func findCompressedStorage(store Storage) *compressedStorage {
+	for {
+		switch s := store.(type) {
+		case *compressedStorage:
+			return s
+		case *chunkedStorage:
+			store = s.base
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 内容的压缩方式
+const (
+	compressionOff  = "off"
+	compressionGzip = "gzip"
+)
+
+// 判断内容是否值得压缩时检查的开头部分的长度
+const compressionSampleSize = 64 << 10
+
+// 小于该大小的内容不压缩，压缩格式的开销超过节省的空间
+const minCompressSize = 256
+
+// 开头部分的信息熵（比特/字节）超过该值时认为内容已经压缩或加密过，不再压缩
+const maxCompressEntropy = 7.5
+
+// gzip 格式的开头两个字节
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// 在保存到 base 之前压缩内容、读取时解压的存储后端。内容的键和大小仍按原内容计算，去重和下载不受影响。
+// 压缩过的内容记录在 compressed_content 表中，包括压缩方式、原大小和实际保存的大小；
+// 没有记录的内容（关闭压缩或压缩前保存的）直接读写 base。已经压缩过的格式（图片、视频、压缩包等）不压缩
+type compressedStorage struct {
+	base        Storage
+	db          *sql.DB
+	compression string
+}
+
+// compressed_content 表中的一条记录
+type compressionRecord struct {
+	codec      string
+	size       int64
+	storedSize int64
+}
+
+// 创建压缩存储后端
+func newCompressedStorage(db *sql.DB, base Storage, compression string) *compressedStorage {
+	return &compressedStorage{base: base, db: db, compression: compression}
+}
+
+func (s *compressedStorage) Put(ctx context.Context, hash string, r io.Reader) error {
+	_, err := s.put(ctx, hash, r)
+	return err
+}
+
+// 保存内容，值得压缩时压缩后保存，返回压缩记录；未压缩时返回 nil。
+// 压缩后的内容先写入临时文件，得到大小后再记录并保存；压缩没有节省空间时解压临时文件保存原内容。
+// 覆盖已有内容时，记录总是在压缩的内容保存前写入、在未压缩的内容保存后删除，读取时再检查 gzip 格式，
+// 因此并发读取的内容总能被正确解释
+func (s *compressedStorage) put(ctx context.Context, hash string, r io.Reader) (*compressionRecord, error) {
+	br := bufio.NewReaderSize(r, compressionSampleSize)
+	head, err := br.Peek(compressionSampleSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if s.compression == compressionOff || !compressible(head) {
+		return nil, s.putRaw(ctx, hash, br)
+	}
+
+	tmp, err := os.CreateTemp(uploadTempDir(s.base), "compress-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	zw := gzip.NewWriter(tmp)
+	size, err := io.Copy(zw, br)
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	storedSize, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if storedSize >= size {
+		zr, err := gzip.NewReader(tmp)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.putRaw(ctx, hash, zr)
+	}
+
+	record := &compressionRecord{codec: compressionGzip, size: size, storedSize: storedSize}
+	upsertQuery := `
+	INSERT INTO compressed_content (hash, codec, size, stored_size, created_at) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (hash) DO UPDATE SET codec = excluded.codec, size = excluded.size, stored_size = excluded.stored_size, created_at = excluded.created_at`
+	if _, err := s.db.ExecContext(ctx, upsertQuery, hash, record.codec, record.size, record.storedSize, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if err := s.base.Put(ctx, hash, tmp); err != nil {
+		s.deleteRecord(hash)
+		return nil, err
+	}
+	return record, nil
+}
+
+// 不压缩直接保存内容，并删除覆盖前的内容的压缩记录
+func (s *compressedStorage) putRaw(ctx context.Context, hash string, r io.Reader) error {
+	if err := s.base.Put(ctx, hash, r); err != nil {
+		return err
+	}
+	return s.deleteRecord(hash)
+}
+
+// 删除内容的压缩记录；请求结束后也要完成删除，不使用请求的 context
+func (s *compressedStorage) deleteRecord(hash string) error {
+	_, err := s.db.ExecContext(context.Background(), `DELETE FROM compressed_content WHERE hash = ?`, hash)
+	return err
+}
+
+// 读取内容的压缩记录，没有压缩时返回 nil
+func (s *compressedStorage) record(ctx context.Context, hash string) (*compressionRecord, error) {
+	var record compressionRecord
+	err := s.db.QueryRowContext(ctx, `SELECT codec, size, stored_size FROM compressed_content WHERE hash = ?`, hash).
+		Scan(&record.codec, &record.size, &record.storedSize)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// 先打开内容再读取记录：压缩的内容保存前已写入记录，读到压缩的内容时一定能读到记录
+func (s *compressedStorage) Get(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	content, size, err := s.base.Get(ctx, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	record, err := s.record(ctx, hash)
+	if err != nil || record == nil {
+		if err != nil {
+			content.Close()
+		}
+		return content, size, err
+	}
+	// 记录已写入但内容尚未被压缩的内容替换时，按原内容读取
+	content, compressed, err := hasGzipMagic(content)
+	if err != nil || !compressed {
+		if err != nil {
+			content.Close()
+		}
+		return content, size, err
+	}
+	r := &gzipReader{ctx: ctx, base: s.base, hash: hash, size: record.size, cur: content}
+	if r.zr, err = gzip.NewReader(content); err != nil {
+		content.Close()
+		return nil, 0, err
+	}
+	return r, record.size, nil
+}
+
+func (s *compressedStorage) Delete(ctx context.Context, hash string) error {
+	if err := s.base.Delete(ctx, hash); err != nil {
+		return err
+	}
+	return s.deleteRecord(hash)
+}
+
+func (s *compressedStorage) Exists(ctx context.Context, hash string) (bool, error) {
+	return s.base.Exists(ctx, hash)
+}
+
+// 判断内容开头是否为 gzip 格式，返回从头读取的内容；内容支持 Seek 时仍然支持
+func hasGzipMagic(content io.ReadCloser) (io.ReadCloser, bool, error) {
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		magic := make([]byte, len(gzipMagic))
+		n, err := io.ReadFull(seeker, magic)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return content, false, err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return content, false, err
+		}
+		return content, bytes.Equal(magic[:n], gzipMagic), nil
+	}
+	br := bufio.NewReader(content)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return content, false, err
+	}
+	return readCloser{br, content}, bytes.Equal(magic, gzipMagic), nil
+}
+
+// 从 Reader 读取、关闭时关闭 Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// 根据开头部分判断内容是否值得压缩：太小、已是压缩格式或信息熵接近随机数据的内容不压缩
+func compressible(head []byte) bool {
+	if len(head) < minCompressSize {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	switch {
+	case strings.HasPrefix(mediaType, "image/") && mediaType != "image/bmp" && mediaType != "image/svg+xml",
+		strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return false
+	case mediaType == "application/zip", mediaType == "application/x-gzip", mediaType == "application/x-rar-compressed",
+		mediaType == "application/pdf", mediaType == "application/wasm", mediaType == "font/woff", mediaType == "font/woff2":
+		return false
+	}
+	return entropy(head) <= maxCompressEntropy
+}
+
+// 计算数据中字节分布的信息熵，单位为比特/字节
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var h float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// 解压 gzip 内容，实现 io.ReadSeekCloser。gzip 不支持随机访问，
+// 向后跳转时丢弃中间的内容，向前跳转时重新打开内容从头解压；Seek 本身不读取内容
+type gzipReader struct {
+	ctx    context.Context
+	base   Storage
+	hash   string
+	size   int64
+	pos    int64
+	cur    io.ReadCloser // 打开的压缩内容，已解压到 curPos
+	zr     *gzip.Reader
+	curPos int64
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.cur == nil || r.curPos > r.pos {
+		if err := r.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	if r.curPos < r.pos {
+		n, err := io.CopyN(io.Discard, r.zr, r.pos-r.curPos)
+		r.curPos += n
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if remaining := r.size - r.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.zr.Read(p)
+	r.pos += int64(n)
+	r.curPos = r.pos
+	if err == io.EOF && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// 重新打开压缩内容，从头解压
+func (r *gzipReader) reopen() error {
+	if r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+	content, _, err := r.base.Get(r.ctx, r.hash)
+	if err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(content)
+	if err != nil {
+		content.Close()
+		return err
+	}
+	r.cur, r.zr, r.curPos = content, zr, 0
+	return nil
+}
+
+func (r *gzipReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *gzipReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
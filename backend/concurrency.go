@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/semaphore"
+)
+
+// 限制并发数的接口类别；上传和下载分别限制，下载的开销较小，上限可以设得更高
+var concurrencyClasses = []struct {
+	name   string
+	routes []string
+}{
+	{"upload", []string{"POST /upload", "POST /upload/json", "PUT /files/by-name/*name", "PUT /dav/*path", "PATCH /uploads/:id", "PUT /uploads/:id/parts/:n", "POST /uploads/:id/complete"}},
+	{"download", []string{"GET /files/:id", "GET /files/hash/:hash", "GET /s/:token", "POST /s/:token", "GET /dl/:id", "GET /public/:hash", "POST /files/archive", "GET /folders/:id/archive", "GET /files/:id/versions/:v", "GET /dav/*path"}},
+}
+
+// 一类接口的并发限制；limit 为 0 时不限制，只统计正在处理的请求数
+type concurrencyLimit struct {
+	name     string
+	limit    int
+	sem      *semaphore.Weighted
+	inFlight atomic.Int64
+	waiting  atomic.Int64
+}
+
+// ConcurrencyStats 一类接口当前的并发情况
+type ConcurrencyStats struct {
+	InFlight int64 `json:"in_flight"`
+	Waiting  int64 `json:"waiting"` // 正在排队等待的请求数
+	Limit    int   `json:"limit"`   // 0 表示不限制
+}
+
+// 按接口类别限制同时处理的请求数，避免同时上传过多时内存和数据库写锁的竞争拖慢所有请求
+type concurrencyLimiter struct {
+	classes map[string]*concurrencyLimit // "METHOD 路由"（不含版本前缀） -> 限制
+	limits  []*concurrencyLimit
+	wait    time.Duration // 达到上限时最多等待的时间
+}
+
+// 创建并发限制，上传和下载各自同时最多处理 uploads、downloads 个请求
+func newConcurrencyLimiter(uploads, downloads int, wait time.Duration) *concurrencyLimiter {
+	l := &concurrencyLimiter{classes: map[string]*concurrencyLimit{}, wait: wait}
+	limits := map[string]int{"upload": uploads, "download": downloads}
+	for _, class := range concurrencyClasses {
+		limit := &concurrencyLimit{name: class.name, limit: limits[class.name]}
+		if limit.limit > 0 {
+			limit.sem = semaphore.NewWeighted(int64(limit.limit))
+		}
+		concurrencyLimitGauge.WithLabelValues(class.name).Set(float64(limit.limit))
+		l.limits = append(l.limits, limit)
+		for _, route := range class.routes {
+			l.classes[route] = limit
+		}
+	}
+	return l
+}
+
+// 并发限制中间件，需在 authMiddleware 之后使用，未登录的请求不占用名额。
+// 达到上限时最多等待 wait，仍没有空闲名额时返回 503 并在 Retry-After 中建议重试的时间
+func (l *concurrencyLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, ok := l.classes[c.Request.Method+" "+apiRoute(c)]
+		if !ok {
+			c.Next()
+			return
+		}
+		if limit.sem != nil {
+			if err := l.acquire(c.Request.Context(), limit); err != nil {
+				concurrencyRejected.WithLabelValues(limit.name).Inc()
+				if c.Request.Context().Err() != nil {
+					renderError(c, internalError("Request was canceled", err))
+					return
+				}
+				c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(l.wait.Seconds())), 1)))
+				renderError(c, newAPIError(http.StatusServiceUnavailable, codeServerBusy, "Too many concurrent "+limit.name+"s, please retry later").with(gin.H{
+					"limit": limit.limit,
+				}))
+				return
+			}
+			defer limit.sem.Release(1)
+		}
+		limit.inFlight.Add(1)
+		concurrentRequests.WithLabelValues(limit.name).Inc()
+		defer func() {
+			limit.inFlight.Add(-1)
+			concurrentRequests.WithLabelValues(limit.name).Dec()
+		}()
+		c.Next()
+	}
+}
+
+// 获取一个名额，没有空闲名额时最多等待 l.wait
+func (l *concurrencyLimiter) acquire(ctx context.Context, limit *concurrencyLimit) error {
+	if limit.sem.TryAcquire(1) {
+		return nil
+	}
+	if l.wait == 0 {
+		return context.DeadlineExceeded
+	}
+	limit.waiting.Add(1)
+	defer limit.waiting.Add(-1)
+	ctx, cancel := context.WithTimeout(ctx, l.wait)
+	defer cancel()
+	return limit.sem.Acquire(ctx, 1)
+}
+
+// 各类接口当前的并发情况，按类别名称索引
+func (l *concurrencyLimiter) stats() map[string]ConcurrencyStats {
+	stats := map[string]ConcurrencyStats{}
+	for _, limit := range l.limits {
+		stats[limit.name] = ConcurrencyStats{InFlight: limit.inFlight.Load(), Waiting: limit.waiting.Load(), Limit: limit.limit}
+	}
+	return stats
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 构建版本，发布时通过 go build -ldflags "-X main.version=v1.0.0" 设置
+var version = "dev"
+
+// Config 运行时配置；命令行参数优先于环境变量
+type Config struct {
+	Addr                     string        // 监听地址
+	DBPath                   string        // SQLite 数据库文件路径
+	DBBusyTimeout            time.Duration // 数据库被其他连接锁定时等待的最长时间
+	DBTimeout                time.Duration // 每个请求中数据库操作的最长时间，0 表示不限制；传输文件内容的请求不受限制
+	GinMode                  string        // gin 运行模式：debug、release 或 test
+	StorageBackend           string        // 文件内容的存储后端：sqlite 或 local
+	StorageDir               string        // local 后端存储文件内容的目录
+	SpoolDir                 string        // 较大的上传内容在保存前暂存的目录，为空时使用 local 后端的临时目录或系统临时目录
+	DiskReserve              int64         // 数据库、存储和暂存目录所在卷保留的空间（字节），剩余空间扣除后不足时拒绝上传
+	Chunking                 string        // 内容分块方式：off、fixed（固定大小）或 cdc（按内容切分）
+	ChunkSize                int           // 分块大小（字节），cdc 时为平均大小
+	Compression              string        // 新内容的压缩方式：off 或 gzip
+	JWTSecret                string        // JWT 签名密钥，只能通过环境变量设置，避免出现在进程列表中
+	EncryptionKey            []byte        // 文件内容的 AES-256 加密密钥，为空时不加密；与 JWTSecret 一样只能通过环境变量设置
+	PresignKey               []byte        // 签名下载链接的 HMAC 密钥，只能通过环境变量设置，未设置时由 JWTSecret 派生
+	JWTExpiry                time.Duration // JWT 有效期
+	DefaultQuota             int64         // 新用户的默认存储配额（字节），0 表示不限制
+	MaxUploadSize            int64         // 单次上传的最大字节数
+	MaxJSONUploadSize        int64         // /upload/json 解码后内容的最大字节数，不超过 MaxUploadSize
+	MaxVersions              int           // 每个文件最多保留的版本数（包括当前版本），0 表示不限制
+	MaxConcurrentUploads     int           // 同时处理的上传请求数，0 表示不限制
+	MaxConcurrentDownloads   int           // 同时处理的下载请求数，0 表示不限制
+	DownloadRateLimit        int64         // 所有下载合计的带宽上限（字节/秒），0 表示不限制
+	PerDownloadLimit         int64         // 每个下载请求的带宽上限（字节/秒），0 表示不限制
+	ConcurrencyWait          time.Duration // 达到并发上限时请求排队等待的最长时间，超过后返回 503
+	HashAlgorithm            string        // 新上传内容的哈希算法：sha256、blake2b-256 或 sha1
+	UploadExpiry             time.Duration // 超过该时间没有收到内容的上传会话会被清理，0 表示不清理
+	AuditRetention           int           // 审计日志保留的天数，0 表示一直保留
+	BackupDir                string        // 数据库备份保存的目录，为空时只能流式下载备份
+	IntegrityScan            bool          // 是否在后台持续校验内容
+	IntegrityScanRate        int           // 后台每小时校验的内容数
+	IntegrityScanMaxRequests int           // 正在处理的请求数达到该值时暂停后台校验
+	ShutdownTimeout          time.Duration // 退出时等待进行中的请求完成的最长时间
+	ReadHeaderTimeout        time.Duration // 读取请求头的最长时间，避免连接迟迟不发送完请求头而一直占用
+	TLSCertFile              string        // TLS 证书文件，与 TLSKeyFile 同时设置时使用 HTTPS
+	TLSKeyFile               string        // TLS 私钥文件
+	HTTPRedirect             string        // 启用 HTTPS 时将 HTTP 请求重定向到 HTTPS 的监听地址，为空时不监听
+	MetricsAddr              string        // 单独提供 /metrics 的监听地址，为空时在主地址上无需登录即可访问
+	CORSOrigins              []string      // 允许跨域访问的来源，为空时不允许跨域
+	WebDAV                   bool          // 是否在 /dav/ 下提供 WebDAV 接口
+	RemoteUploadTimeout      time.Duration // 从远程地址上传时获取内容的最长时间
+	RemoteUploadAllowPrivate bool          // 是否允许从内网地址上传，默认拒绝以防止 SSRF
+	Scanner                  string        // 上传内容的病毒扫描服务：none 或 clamd
+	ClamdAddr                string        // clamd 的 TCP 地址
+	ScanTimeout              time.Duration // 扫描一个文件的最长时间，超过时按扫描服务不可用处理
+	ScanFailOpen             bool          // 扫描服务不可用时是否仍然保存上传的内容（标记为 pending），默认拒绝上传
+	AllowedTypes             []string      // 允许上传的扩展名和 MIME 类型，为空时允许所有未被禁止的类型
+	BlockedTypes             []string      // 禁止上传的扩展名和 MIME 类型
+	GCInterval               time.Duration // 定期回收没有引用的内容的间隔，0 时不定期回收
+	GCGracePeriod            time.Duration // 创建后在该时间内的内容即使没有引用也不回收
+	LogLevel                 slog.Level    // 日志级别：debug、info、warn 或 error
+	ShowVersion              bool          // 只打印版本号
+	Rehash                   bool          // 按 HashAlgorithm 重新计算已有内容的哈希后退出
+	ReindexContent           bool          // 重建文本内容的全文索引后退出
+	BackfillMetadata         bool          // 重新提取所有图片和音视频内容的元数据后退出
+	MetadataStripGPS         bool          // 提取元数据时不保存 GPS 坐标
+	EncryptContent           bool          // 使用 EncryptionKey 加密已有的未加密内容后退出
+	ImportDir                string        // 将该目录下的文件导入为 ImportUser 的文件后退出
+	ImportUser               string        // 导入的文件所属的用户名
+	DryRun                   bool          // 导入时只输出将要执行的操作
+	ExportDir                string        // 将文件导出到该目录后退出
+	ExportLayout             string        // 导出的目录结构：names 或 hash
+	ExportSince              *time.Time    // 只导出该时间之后上传或更新的文件
+	ExportOwner              string        // 只导出该用户的文件
+}
+
+// 从命令行参数和环境变量读取配置并校验
+func loadConfig(args []string) (Config, error) {
+	var cfg Config
+	fs := flag.NewFlagSet("api-server", flag.ContinueOnError)
+
+	// 兼容 gin 的 r.Run()：未设置 ADDR 时使用 PORT
+	defaultAddr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		defaultAddr = ":" + port
+	}
+	fs.StringVar(&cfg.Addr, "addr", envOr("ADDR", defaultAddr), "listen address (env ADDR)")
+	fs.StringVar(&cfg.DBPath, "db", envOr("DB_PATH", "./files.db"), "SQLite database path (env DB_PATH)")
+	dbTimeout := fs.String("db-timeout", envOr("DB_TIMEOUT", "30s"), "time limit for the database work of a request, 0 for no limit; content transfers are not limited (env DB_TIMEOUT)")
+	dbBusyTimeout := fs.String("db-busy-timeout", envOr("DB_BUSY_TIMEOUT", "5s"), "time to wait for a locked database before failing (env DB_BUSY_TIMEOUT)")
+	fs.StringVar(&cfg.GinMode, "gin-mode", envOr("GIN_MODE", gin.DebugMode), "gin mode: debug, release or test (env GIN_MODE)")
+	fs.StringVar(&cfg.StorageBackend, "storage-backend", os.Getenv("STORAGE_BACKEND"), "file content storage backend: sqlite or local, defaults to local when -storage-dir is set (env STORAGE_BACKEND)")
+	fs.StringVar(&cfg.StorageDir, "storage-dir", os.Getenv("STORAGE_DIR"), "directory for file content with the local backend (env STORAGE_DIR)")
+	fs.StringVar(&cfg.SpoolDir, "spool-dir", os.Getenv("SPOOL_DIR"), "directory for spooling large uploads before they are stored, defaults to the storage directory with the local backend or the system temp directory (env SPOOL_DIR)")
+	diskReserve := fs.String("disk-reserve", envOr("DISK_RESERVE", strconv.Itoa(defaultDiskReserve)), "free disk space in bytes kept for the database and not used for uploads (env DISK_RESERVE)")
+	fs.StringVar(&cfg.Chunking, "chunking", envOr("CHUNKING", chunkingOff), "split new content into deduplicated chunks: off, fixed or cdc (content-defined) (env CHUNKING)")
+	chunkSize := fs.String("chunk-size", envOr("CHUNK_SIZE", strconv.Itoa(defaultChunkSize)), "chunk size in bytes, the average size with -chunking=cdc (env CHUNK_SIZE)")
+	fs.StringVar(&cfg.Compression, "compression", envOr("COMPRESSION", compressionOff), "compress new content before storing it unless already compressed: off or gzip (env COMPRESSION)")
+	jwtExpiry := fs.String("jwt-expiry", envOr("JWT_EXPIRY", "24h"), "JWT lifetime (env JWT_EXPIRY)")
+	defaultQuota := fs.String("default-quota", envOr("DEFAULT_QUOTA", "0"), "default storage quota in bytes for new users, 0 for unlimited (env DEFAULT_QUOTA)")
+	maxUploadSize := fs.String("max-upload-size", envOr("MAX_UPLOAD_SIZE", strconv.Itoa(defaultMaxUploadSize)), "maximum upload size in bytes (env MAX_UPLOAD_SIZE)")
+	maxJSONUploadSize := fs.String("max-json-upload-size", envOr("MAX_JSON_UPLOAD_SIZE", strconv.Itoa(defaultMaxJSONUploadSize)), "maximum decoded size in bytes of content uploaded with POST /upload/json, capped at -max-upload-size (env MAX_JSON_UPLOAD_SIZE)")
+	maxVersions := fs.String("max-versions", envOr("MAX_FILE_VERSIONS", "10"), "maximum versions kept per file including the current one, 0 for unlimited (env MAX_FILE_VERSIONS)")
+	maxConcurrentUploads := fs.String("max-concurrent-uploads", envOr("MAX_CONCURRENT_UPLOADS", "4"), "uploads received at the same time, 0 for unlimited (env MAX_CONCURRENT_UPLOADS)")
+	maxConcurrentDownloads := fs.String("max-concurrent-downloads", envOr("MAX_CONCURRENT_DOWNLOADS", "32"), "downloads served at the same time, 0 for unlimited (env MAX_CONCURRENT_DOWNLOADS)")
+	downloadRateLimit := fs.String("download-rate-limit", os.Getenv("DOWNLOAD_RATE_LIMIT"), "total download bandwidth such as 50MB/s, empty or 0 for unlimited (env DOWNLOAD_RATE_LIMIT)")
+	perDownloadLimit := fs.String("per-download-limit", os.Getenv("PER_DOWNLOAD_LIMIT"), "bandwidth of each download such as 10MB/s, empty or 0 for unlimited (env PER_DOWNLOAD_LIMIT)")
+	concurrencyWait := fs.String("concurrency-wait", envOr("CONCURRENCY_WAIT", "2s"), "time a request waits for an upload or download slot before getting 503, 0 to reject at once (env CONCURRENCY_WAIT)")
+	fs.StringVar(&cfg.HashAlgorithm, "hash-algorithm", envOr("HASH_ALGORITHM", hashSHA256), "content hash algorithm for new uploads: sha256, blake2b-256 or sha1 (env HASH_ALGORITHM)")
+	uploadExpiry := fs.String("upload-expiry", envOr("UPLOAD_EXPIRY", "24h"), "time after which idle incomplete uploads are removed, 0 to keep them (env UPLOAD_EXPIRY)")
+	auditRetention := fs.String("audit-retention-days", envOr("AUDIT_RETENTION_DAYS", "90"), "days to keep audit log entries, 0 to keep them forever (env AUDIT_RETENTION_DAYS)")
+	fs.StringVar(&cfg.BackupDir, "backup-dir", os.Getenv("BACKUP_DIR"), "directory for database backups created with POST /admin/backup (env BACKUP_DIR)")
+	integrityScan := fs.String("integrity-scan", envOr("INTEGRITY_SCAN", "false"), "continuously re-hash stored content in the background: true or false (env INTEGRITY_SCAN)")
+	integrityScanRate := fs.String("integrity-scan-rate", envOr("INTEGRITY_SCAN_RATE", "100"), "content re-hashed per hour by the background scan (env INTEGRITY_SCAN_RATE)")
+	integrityScanMaxRequests := fs.String("integrity-scan-max-requests", envOr("INTEGRITY_SCAN_MAX_REQUESTS", "16"), "pause the background scan while this many requests are in flight (env INTEGRITY_SCAN_MAX_REQUESTS)")
+	webDAV := fs.String("webdav", envOr("WEBDAV", "false"), "serve the files over WebDAV under /dav/ with HTTP Basic auth: true or false (env WEBDAV)")
+	remoteUploadTimeout := fs.String("remote-upload-timeout", envOr("REMOTE_UPLOAD_TIMEOUT", "10m"), "time allowed for fetching a remote URL in POST /upload/remote (env REMOTE_UPLOAD_TIMEOUT)")
+	remoteUploadAllowPrivate := fs.String("remote-upload-allow-private", envOr("REMOTE_UPLOAD_ALLOW_PRIVATE", "false"), "allow POST /upload/remote to fetch loopback and private addresses: true or false (env REMOTE_UPLOAD_ALLOW_PRIVATE)")
+	fs.StringVar(&cfg.Scanner, "scanner", envOr("SCANNER", scannerNone), "virus scanner for uploads: none or clamd (env SCANNER)")
+	fs.StringVar(&cfg.ClamdAddr, "clamd-addr", envOr("CLAMD_ADDR", "127.0.0.1:3310"), "TCP address of clamd for -scanner=clamd (env CLAMD_ADDR)")
+	scanTimeout := fs.String("scan-timeout", envOr("SCAN_TIMEOUT", "2m"), "time allowed for scanning one file (env SCAN_TIMEOUT)")
+	scanFailMode := fs.String("scan-fail-mode", envOr("SCAN_FAIL_MODE", "closed"), "when the scanner is unavailable, closed rejects uploads with 503 and open saves them unscanned (env SCAN_FAIL_MODE)")
+	allowedTypes := fs.String("allowed-types", os.Getenv("ALLOWED_TYPES"), "comma-separated extensions and MIME types such as .pdf,image/* allowed for uploads, empty to allow any type not blocked (env ALLOWED_TYPES)")
+	blockedTypes := fs.String("blocked-types", os.Getenv("BLOCKED_TYPES"), "comma-separated extensions and MIME types such as .exe,application/x-msdownload rejected for uploads; the detected content type wins over the extension (env BLOCKED_TYPES)")
+	gcInterval := fs.String("gc-interval", envOr("GC_INTERVAL", "24h"), "interval of the garbage collection that removes unreferenced content and fixes reference counts, 0 to run it only with POST /admin/gc (env GC_INTERVAL)")
+	gcGracePeriod := fs.String("gc-grace-period", envOr("GC_GRACE_PERIOD", "1h"), "unreferenced content created within this time is not collected (env GC_GRACE_PERIOD)")
+	metadataStripGPS := fs.String("metadata-strip-gps", envOr("METADATA_STRIP_GPS", "false"), "do not store GPS coordinates extracted from photos: true or false (env METADATA_STRIP_GPS)")
+	readHeaderTimeout := fs.String("read-header-timeout", envOr("READ_HEADER_TIMEOUT", "10s"), "time allowed to read request headers (env READ_HEADER_TIMEOUT)")
+	shutdownTimeout := fs.String("shutdown-timeout", envOr("SHUTDOWN_TIMEOUT", "30s"), "time to wait for in-flight requests on shutdown (env SHUTDOWN_TIMEOUT)")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert-file", os.Getenv("TLS_CERT_FILE"), "TLS certificate file, serves HTTPS when set with -tls-key-file; reloaded on SIGHUP (env TLS_CERT_FILE)")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key-file", os.Getenv("TLS_KEY_FILE"), "TLS private key file (env TLS_KEY_FILE)")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", os.Getenv("METRICS_ADDR"), "separate listen address for /metrics such as 127.0.0.1:9090, served on the main address without auth when empty (env METRICS_ADDR)")
+	fs.StringVar(&cfg.HTTPRedirect, "http-redirect-addr", os.Getenv("HTTP_REDIRECT_ADDR"), "listen address for plain HTTP that redirects to HTTPS, such as :80 (env HTTP_REDIRECT_ADDR)")
+	corsOrigins := fs.String("cors-origins", os.Getenv("CORS_ORIGINS"), "comma-separated origins allowed for CORS, * for any (env CORS_ORIGINS)")
+	logLevel := fs.String("log-level", envOr("LOG_LEVEL", "info"), "log level: debug, info, warn or error (env LOG_LEVEL)")
+	fs.BoolVar(&cfg.ShowVersion, "version", false, "print version and exit")
+	fs.BoolVar(&cfg.Rehash, "rehash", false, "rehash existing file content with -hash-algorithm and exit")
+	fs.BoolVar(&cfg.ReindexContent, "reindex-content", false, "rebuild the full-text index of text file content and exit")
+	fs.BoolVar(&cfg.BackfillMetadata, "backfill-metadata", false, "extract EXIF and media metadata of all existing image, audio and video content and exit")
+	fs.BoolVar(&cfg.EncryptContent, "encrypt-content", false, "encrypt existing unencrypted file content with ENCRYPTION_KEY and exit")
+	fs.StringVar(&cfg.ImportDir, "import-dir", "", "import the files under this directory for -import-user, subdirectories become folders, and exit")
+	fs.StringVar(&cfg.ImportUser, "import-user", "", "username that owns the files imported with -import-dir")
+	fs.BoolVar(&cfg.DryRun, "dry-run", false, "with -import-dir, only print what would be imported")
+	fs.StringVar(&cfg.ExportDir, "export-dir", "", "export all files to this new or empty directory with a manifest.json, and exit")
+	fs.StringVar(&cfg.ExportLayout, "export-layout", exportLayoutNames, "export layout: names (owner and folder paths) or hash (one file per content)")
+	exportSince := fs.String("export-since", "", "only export files uploaded or updated since this RFC 3339 time")
+	fs.StringVar(&cfg.ExportOwner, "export-owner", "", "only export files of this username")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if cfg.ShowVersion {
+		return cfg, nil
+	}
+
+	var err error
+	if cfg.Addr == "" {
+		return cfg, errors.New("invalid -addr/ADDR, must not be empty")
+	}
+	if cfg.DBPath == "" {
+		return cfg, errors.New("invalid -db/DB_PATH, must not be empty")
+	}
+	if cfg.DBTimeout, err = time.ParseDuration(*dbTimeout); err != nil || cfg.DBTimeout < 0 {
+		return cfg, fmt.Errorf("invalid -db-timeout/DB_TIMEOUT %q, must be a non-negative duration such as 30s", *dbTimeout)
+	}
+	if cfg.DBBusyTimeout, err = time.ParseDuration(*dbBusyTimeout); err != nil || cfg.DBBusyTimeout < time.Millisecond {
+		return cfg, fmt.Errorf("invalid -db-busy-timeout/DB_BUSY_TIMEOUT %q, must be a duration of at least 1ms such as 5s", *dbBusyTimeout)
+	}
+	if cfg.GinMode != gin.DebugMode && cfg.GinMode != gin.ReleaseMode && cfg.GinMode != gin.TestMode {
+		return cfg, fmt.Errorf("invalid -gin-mode/GIN_MODE %q, must be debug, release or test", cfg.GinMode)
+	}
+	// 兼容只设置 STORAGE_DIR 的旧配置
+	if cfg.StorageBackend == "" {
+		cfg.StorageBackend = storageBackendSQLite
+		if cfg.StorageDir != "" {
+			cfg.StorageBackend = storageBackendLocal
+		}
+	}
+	switch cfg.StorageBackend {
+	case storageBackendSQLite:
+		if cfg.StorageDir != "" {
+			return cfg, errors.New("invalid -storage-dir/STORAGE_DIR, only used by the local storage backend")
+		}
+	case storageBackendLocal:
+		if cfg.StorageDir == "" {
+			return cfg, errors.New("invalid -storage-dir/STORAGE_DIR, must be set for the local storage backend")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid -storage-backend/STORAGE_BACKEND %q, must be sqlite or local", cfg.StorageBackend)
+	}
+	if cfg.Chunking != chunkingOff && cfg.Chunking != chunkingFixed && cfg.Chunking != chunkingCDC {
+		return cfg, fmt.Errorf("invalid -chunking/CHUNKING %q, must be off, fixed or cdc", cfg.Chunking)
+	}
+	if cfg.ChunkSize, err = strconv.Atoi(*chunkSize); err != nil || cfg.ChunkSize < minChunkSize || cfg.ChunkSize > maxChunkSize {
+		return cfg, fmt.Errorf("invalid -chunk-size/CHUNK_SIZE %q, must be between %d and %d bytes", *chunkSize, minChunkSize, maxChunkSize)
+	}
+	if cfg.Compression != compressionOff && cfg.Compression != compressionGzip {
+		return cfg, fmt.Errorf("invalid -compression/COMPRESSION %q, must be off or gzip", cfg.Compression)
+	}
+	cfg.JWTSecret = os.Getenv("JWT_SECRET")
+	if cfg.JWTSecret == "" {
+		return cfg, errors.New("JWT_SECRET environment variable must be set")
+	}
+	// 更换密钥后已生成的签名下载链接全部失效
+	if v := os.Getenv("PRESIGN_KEY"); v != "" {
+		cfg.PresignKey = []byte(v)
+	} else {
+		mac := hmac.New(sha256.New, []byte(cfg.JWTSecret))
+		mac.Write([]byte("presign"))
+		cfg.PresignKey = mac.Sum(nil)
+	}
+	if v := os.Getenv("ENCRYPTION_KEY"); v != "" {
+		if cfg.EncryptionKey, err = parseEncryptionKey(v); err != nil {
+			return cfg, fmt.Errorf("invalid ENCRYPTION_KEY, %w", err)
+		}
+	}
+	if cfg.EncryptContent && cfg.EncryptionKey == nil {
+		return cfg, errors.New("invalid -encrypt-content, ENCRYPTION_KEY must be set")
+	}
+	if (cfg.ImportDir == "") != (cfg.ImportUser == "") {
+		return cfg, errors.New("invalid import, -import-dir and -import-user must be set together")
+	}
+	if cfg.DryRun && cfg.ImportDir == "" {
+		return cfg, errors.New("invalid -dry-run, only used with -import-dir")
+	}
+	if cfg.ExportLayout != exportLayoutNames && cfg.ExportLayout != exportLayoutHash {
+		return cfg, fmt.Errorf("invalid -export-layout %q, must be names or hash", cfg.ExportLayout)
+	}
+	if *exportSince != "" {
+		since, err := time.Parse(time.RFC3339, *exportSince)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -export-since %q, must be an RFC 3339 time", *exportSince)
+		}
+		since = since.UTC()
+		cfg.ExportSince = &since
+	}
+	if cfg.ExportDir == "" && (cfg.ExportSince != nil || cfg.ExportOwner != "") {
+		return cfg, errors.New("invalid export, -export-since and -export-owner are only used with -export-dir")
+	}
+	if cfg.JWTExpiry, err = time.ParseDuration(*jwtExpiry); err != nil || cfg.JWTExpiry <= 0 {
+		return cfg, fmt.Errorf("invalid -jwt-expiry/JWT_EXPIRY %q, must be a positive duration such as 24h", *jwtExpiry)
+	}
+	if cfg.DefaultQuota, err = strconv.ParseInt(*defaultQuota, 10, 64); err != nil || cfg.DefaultQuota < 0 {
+		return cfg, fmt.Errorf("invalid -default-quota/DEFAULT_QUOTA %q, must be a non-negative number of bytes", *defaultQuota)
+	}
+	if cfg.MaxUploadSize, err = strconv.ParseInt(*maxUploadSize, 10, 64); err != nil || cfg.MaxUploadSize <= 0 {
+		return cfg, fmt.Errorf("invalid -max-upload-size/MAX_UPLOAD_SIZE %q, must be a positive number of bytes", *maxUploadSize)
+	}
+	if cfg.MaxJSONUploadSize, err = strconv.ParseInt(*maxJSONUploadSize, 10, 64); err != nil || cfg.MaxJSONUploadSize <= 0 {
+		return cfg, fmt.Errorf("invalid -max-json-upload-size/MAX_JSON_UPLOAD_SIZE %q, must be a positive number of bytes", *maxJSONUploadSize)
+	}
+	cfg.MaxJSONUploadSize = min(cfg.MaxJSONUploadSize, cfg.MaxUploadSize)
+	if cfg.MaxVersions, err = strconv.Atoi(*maxVersions); err != nil || cfg.MaxVersions < 0 {
+		return cfg, fmt.Errorf("invalid -max-versions/MAX_FILE_VERSIONS %q, must be a non-negative integer", *maxVersions)
+	}
+	if cfg.DiskReserve, err = strconv.ParseInt(*diskReserve, 10, 64); err != nil || cfg.DiskReserve < 0 {
+		return cfg, fmt.Errorf("invalid -disk-reserve/DISK_RESERVE %q, must be a non-negative number of bytes", *diskReserve)
+	}
+	if cfg.MaxConcurrentUploads, err = strconv.Atoi(*maxConcurrentUploads); err != nil || cfg.MaxConcurrentUploads < 0 {
+		return cfg, fmt.Errorf("invalid -max-concurrent-uploads/MAX_CONCURRENT_UPLOADS %q, must be a non-negative integer", *maxConcurrentUploads)
+	}
+	if cfg.MaxConcurrentDownloads, err = strconv.Atoi(*maxConcurrentDownloads); err != nil || cfg.MaxConcurrentDownloads < 0 {
+		return cfg, fmt.Errorf("invalid -max-concurrent-downloads/MAX_CONCURRENT_DOWNLOADS %q, must be a non-negative integer", *maxConcurrentDownloads)
+	}
+	if cfg.DownloadRateLimit, err = parseByteRate(*downloadRateLimit); err != nil {
+		return cfg, fmt.Errorf("invalid -download-rate-limit/DOWNLOAD_RATE_LIMIT %q, must be a number of bytes per second such as 50MB/s", *downloadRateLimit)
+	}
+	if cfg.PerDownloadLimit, err = parseByteRate(*perDownloadLimit); err != nil {
+		return cfg, fmt.Errorf("invalid -per-download-limit/PER_DOWNLOAD_LIMIT %q, must be a number of bytes per second such as 10MB/s", *perDownloadLimit)
+	}
+	if cfg.ConcurrencyWait, err = time.ParseDuration(*concurrencyWait); err != nil || cfg.ConcurrencyWait < 0 {
+		return cfg, fmt.Errorf("invalid -concurrency-wait/CONCURRENCY_WAIT %q, must be a non-negative duration such as 2s", *concurrencyWait)
+	}
+	if _, ok := hashAlgorithms[cfg.HashAlgorithm]; !ok {
+		return cfg, fmt.Errorf("invalid -hash-algorithm/HASH_ALGORITHM %q, must be sha256, blake2b-256 or sha1", cfg.HashAlgorithm)
+	}
+	if cfg.UploadExpiry, err = time.ParseDuration(*uploadExpiry); err != nil || cfg.UploadExpiry < 0 {
+		return cfg, fmt.Errorf("invalid -upload-expiry/UPLOAD_EXPIRY %q, must be a non-negative duration such as 24h", *uploadExpiry)
+	}
+	if cfg.AuditRetention, err = strconv.Atoi(*auditRetention); err != nil || cfg.AuditRetention < 0 {
+		return cfg, fmt.Errorf("invalid -audit-retention-days/AUDIT_RETENTION_DAYS %q, must be a non-negative integer", *auditRetention)
+	}
+	if cfg.IntegrityScan, err = strconv.ParseBool(*integrityScan); err != nil {
+		return cfg, fmt.Errorf("invalid -integrity-scan/INTEGRITY_SCAN %q, must be true or false", *integrityScan)
+	}
+	if cfg.IntegrityScanRate, err = strconv.Atoi(*integrityScanRate); err != nil || cfg.IntegrityScanRate <= 0 {
+		return cfg, fmt.Errorf("invalid -integrity-scan-rate/INTEGRITY_SCAN_RATE %q, must be a positive integer", *integrityScanRate)
+	}
+	if cfg.IntegrityScanMaxRequests, err = strconv.Atoi(*integrityScanMaxRequests); err != nil || cfg.IntegrityScanMaxRequests <= 0 {
+		return cfg, fmt.Errorf("invalid -integrity-scan-max-requests/INTEGRITY_SCAN_MAX_REQUESTS %q, must be a positive integer", *integrityScanMaxRequests)
+	}
+	if cfg.WebDAV, err = strconv.ParseBool(*webDAV); err != nil {
+		return cfg, fmt.Errorf("invalid -webdav/WEBDAV %q, must be true or false", *webDAV)
+	}
+	if cfg.RemoteUploadTimeout, err = time.ParseDuration(*remoteUploadTimeout); err != nil || cfg.RemoteUploadTimeout <= 0 {
+		return cfg, fmt.Errorf("invalid -remote-upload-timeout/REMOTE_UPLOAD_TIMEOUT %q, must be a positive duration such as 10m", *remoteUploadTimeout)
+	}
+	if cfg.RemoteUploadAllowPrivate, err = strconv.ParseBool(*remoteUploadAllowPrivate); err != nil {
+		return cfg, fmt.Errorf("invalid -remote-upload-allow-private/REMOTE_UPLOAD_ALLOW_PRIVATE %q, must be true or false", *remoteUploadAllowPrivate)
+	}
+	if cfg.Scanner != scannerNone && cfg.Scanner != scannerClamd {
+		return cfg, fmt.Errorf("invalid -scanner/SCANNER %q, must be none or clamd", cfg.Scanner)
+	}
+	if cfg.ScanTimeout, err = time.ParseDuration(*scanTimeout); err != nil || cfg.ScanTimeout <= 0 {
+		return cfg, fmt.Errorf("invalid -scan-timeout/SCAN_TIMEOUT %q, must be a positive duration such as 2m", *scanTimeout)
+	}
+	switch *scanFailMode {
+	case "open":
+		cfg.ScanFailOpen = true
+	case "closed":
+	default:
+		return cfg, fmt.Errorf("invalid -scan-fail-mode/SCAN_FAIL_MODE %q, must be open or closed", *scanFailMode)
+	}
+	if cfg.AllowedTypes, err = parseFileTypeList(*allowedTypes); err != nil {
+		return cfg, fmt.Errorf("invalid -allowed-types/ALLOWED_TYPES: %w", err)
+	}
+	if cfg.BlockedTypes, err = parseFileTypeList(*blockedTypes); err != nil {
+		return cfg, fmt.Errorf("invalid -blocked-types/BLOCKED_TYPES: %w", err)
+	}
+	if cfg.GCInterval, err = time.ParseDuration(*gcInterval); err != nil || cfg.GCInterval < 0 {
+		return cfg, fmt.Errorf("invalid -gc-interval/GC_INTERVAL %q, must be a non-negative duration such as 24h", *gcInterval)
+	}
+	if cfg.GCGracePeriod, err = time.ParseDuration(*gcGracePeriod); err != nil || cfg.GCGracePeriod < 0 {
+		return cfg, fmt.Errorf("invalid -gc-grace-period/GC_GRACE_PERIOD %q, must be a non-negative duration such as 1h", *gcGracePeriod)
+	}
+	if cfg.MetadataStripGPS, err = strconv.ParseBool(*metadataStripGPS); err != nil {
+		return cfg, fmt.Errorf("invalid -metadata-strip-gps/METADATA_STRIP_GPS %q, must be true or false", *metadataStripGPS)
+	}
+	if cfg.ShutdownTimeout, err = time.ParseDuration(*shutdownTimeout); err != nil || cfg.ShutdownTimeout <= 0 {
+		return cfg, fmt.Errorf("invalid -shutdown-timeout/SHUTDOWN_TIMEOUT %q, must be a positive duration such as 30s", *shutdownTimeout)
+	}
+	if cfg.ReadHeaderTimeout, err = time.ParseDuration(*readHeaderTimeout); err != nil || cfg.ReadHeaderTimeout <= 0 {
+		return cfg, fmt.Errorf("invalid -read-header-timeout/READ_HEADER_TIMEOUT %q, must be a positive duration such as 10s", *readHeaderTimeout)
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return cfg, errors.New("invalid TLS configuration, -tls-cert-file/TLS_CERT_FILE and -tls-key-file/TLS_KEY_FILE must be set together")
+	}
+	if cfg.HTTPRedirect != "" && cfg.TLSCertFile == "" {
+		return cfg, errors.New("invalid -http-redirect-addr/HTTP_REDIRECT_ADDR, only used when TLS is enabled")
+	}
+	if err := cfg.LogLevel.UnmarshalText([]byte(*logLevel)); err != nil {
+		return cfg, fmt.Errorf("invalid -log-level/LOG_LEVEL %q, must be debug, info, warn or error", *logLevel)
+	}
+	cfg.CORSOrigins = parseOrigins(*corsOrigins)
+	return cfg, nil
+}
+
+// 读取环境变量，未设置时返回默认值
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
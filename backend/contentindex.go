@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 每个内容最多索引的字节数，超过的部分不参与全文搜索
+const contentIndexMaxBytes = 1 << 20
+
+// 后台索引每批处理的内容数
+const contentIndexBatch = 50
+
+// 没有待索引的内容时，后台索引再次检查的间隔；上传后会立即唤醒
+const contentIndexPoll = time.Minute
+
+// 全文搜索的默认和最大返回数量
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// 搜索结果摘要中标记匹配词的私有区字符，转义 HTML 后替换为 <mark> 标签
+const (
+	snippetMarkStart = "\ue000"
+	snippetMarkEnd   = "\ue001"
+)
+
+// 需要索引的文本类文件的 MIME 类型条件；内容还要是不含 NUL 字节的 UTF-8 才会被索引
+var textContentSQL = fileMediaTypeSQL + ` LIKE 'text/%' OR ` + fileMediaTypeSQL + ` IN ('application/json', 'application/xml', 'application/x-ndjson', 'application/yaml', 'application/x-yaml')`
+
+// 文件内容在 content_index_state 中的键，与 blobKey 一致
+const fileBlobKeySQL = `CASE WHEN files.hash_algo = 'sha256' THEN files.hash ELSE files.hash_algo || ':' || files.hash END`
+
+// 唤醒后台索引，上传了新内容时调用；已有待处理的唤醒时不阻塞
+var contentIndexWake = make(chan struct{}, 1)
+
+func wakeContentIndexer() {
+	select {
+	case contentIndexWake <- struct{}{}:
+	default:
+	}
+}
+
+// SearchResult 全文搜索的一条结果
+type SearchResult struct {
+	File    File    `json:"file"`
+	Snippet string  `json:"snippet"` // 匹配位置附近的内容，已转义 HTML，匹配词用 <mark> 标出
+	Rank    float64 `json:"rank"`    // bm25 相关度，越小越相关
+}
+
+// 注册全文搜索接口
+func registerSearchRoutes(r gin.IRouter, db *sql.DB) {
+	// 按内容搜索当前用户的文本文件，q 中的各个词都要出现，按相关度排序；
+	// 不包括回收站中和已过期的文件，新上传的内容在后台索引完成后才能搜索到
+	r.GET("/search", func(c *gin.Context) {
+		query := ftsQuery(c.Query("q"))
+		if query == "" {
+			renderError(c, invalidRequest("Missing search query q"))
+			return
+		}
+		limit, err := queryInt(c, "limit", defaultSearchLimit)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxSearchLimit)))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil || offset < 0 {
+			renderError(c, invalidRequest("Invalid offset, must be a non-negative integer"))
+			return
+		}
+
+		results, err := searchContent(c.Request.Context(), db, currentUserID(c), query, limit, offset)
+		if err != nil {
+			renderError(c, internalError("Failed to search files", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"results": results,
+			"limit":   limit,
+			"offset":  offset,
+		})
+	})
+}
+
+// 将用户输入转换为 FTS5 查询：每个词作为带引号的字符串，全部出现才匹配，避免输入被解释为查询语法
+func ftsQuery(q string) string {
+	var terms []string
+	for _, term := range strings.Fields(q) {
+		terms = append(terms, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// 按内容搜索用户的文件，返回匹配的文件、摘要和相关度
+func searchContent(ctx context.Context, db *sql.DB, ownerID int, query string, limit, offset int) ([]SearchResult, error) {
+	searchQuery := `
+	SELECT ` + fileColumns + `, snippet(content_index, 0, ?, ?, '…', 16), content_index.rank
+	FROM content_index
+	JOIN content_index_state ON content_index_state.doc_id = content_index.rowid
+	JOIN files ON ` + fileBlobKeySQL + ` = content_index_state.blob_key
+	WHERE content_index MATCH ? AND files.owner_id = ? AND files.deleted_at IS NULL AND ` + fileNotExpired + `
+	ORDER BY content_index.rank, files.id LIMIT ? OFFSET ?`
+	rows, err := db.QueryContext(ctx, searchQuery, snippetMarkStart, snippetMarkEnd, query, ownerID, time.Now().UTC(), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		var snippet string
+		file, err := scanFile(searchRow{rows, &snippet, &result.Rank})
+		if err != nil {
+			return nil, err
+		}
+		result.File = file
+		result.Snippet = highlightSnippet(snippet)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// 读取 scanFile 的字段之后再读取摘要和相关度
+type searchRow struct {
+	rows    *sql.Rows
+	snippet *string
+	rank    *float64
+}
+
+func (r searchRow) Scan(dest ...any) error {
+	return r.rows.Scan(append(dest, r.snippet, r.rank)...)
+}
+
+// 转义摘要中的 HTML，并将匹配标记替换为 <mark> 标签
+func highlightSnippet(snippet string) string {
+	return strings.NewReplacer(snippetMarkStart, "<mark>", snippetMarkEnd, "</mark>").Replace(html.EscapeString(snippet))
+}
+
+// 在后台索引新上传的文本内容，直到 ctx 被取消；上传后通过 wakeContentIndexer 立即唤醒，
+// 否则每 contentIndexPoll 检查一次，因此也会逐步索引功能上线前上传的内容
+func runContentIndexer(ctx context.Context, db *sql.DB, store Storage) {
+	for {
+		n, err := indexPendingContent(ctx, db, store, contentIndexBatch)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Content indexing failed", "error", err)
+		}
+		if n == contentIndexBatch && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-contentIndexWake:
+		case <-time.After(contentIndexPoll):
+		}
+	}
+}
+
+// 重建全文索引：清空已有的索引后重新索引所有文本内容，返回处理的内容数，包括因不是文本而跳过的
+func reindexContent(ctx context.Context, db *sql.DB, store Storage) (int, error) {
+	if _, err := db.ExecContext(ctx, `DELETE FROM content_index; DELETE FROM content_index_state`); err != nil {
+		return 0, err
+	}
+	total := 0
+	for {
+		n, err := indexPendingContent(ctx, db, store, contentIndexBatch)
+		total += n
+		if err != nil || n < contentIndexBatch {
+			return total, err
+		}
+	}
+}
+
+// 索引最多 limit 个尚未处理的文本内容，返回处理的内容数；不是 UTF-8 文本的内容也记为已处理，不再重试
+func indexPendingContent(ctx context.Context, db *sql.DB, store Storage, limit int) (int, error) {
+	pendingQuery := `
+	SELECT DISTINCT ` + fileBlobKeySQL + ` AS blob_key FROM files
+	WHERE (` + textContentSQL + `) AND ` + fileBlobKeySQL + ` NOT IN (SELECT blob_key FROM content_index_state)
+	LIMIT ?`
+	rows, err := db.QueryContext(ctx, pendingQuery, limit)
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		if err := indexContent(ctx, db, store, key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// 读取内容的前 contentIndexMaxBytes 字节并写入 content_index；内容已被删除时跳过
+func indexContent(ctx context.Context, db *sql.DB, store Storage, key string) error {
+	content, _, err := store.Get(ctx, key)
+	if err != nil && err != errBlobNotFound {
+		return err
+	}
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(io.LimitReader(content, contentIndexMaxBytes+1))
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	text, ok := indexableText(body)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM blobs WHERE hash = ?)`, key).Scan(&exists); err != nil || !exists {
+		return err
+	}
+	if err := deleteContentIndex(ctx, tx, key); err != nil {
+		return err
+	}
+	var docID int64
+	insertQuery := `INSERT INTO content_index_state (blob_key, indexed, indexed_at) VALUES (?, ?, ?) RETURNING doc_id`
+	if err := tx.QueryRowContext(ctx, insertQuery, key, ok, time.Now().UTC()).Scan(&docID); err != nil {
+		return err
+	}
+	if ok {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO content_index (rowid, body) VALUES (?, ?)`, docID, text); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 截取要索引的文本，丢弃截断处不完整的字符；含 NUL 字节或不是 UTF-8 的内容视为二进制，返回 false
+func indexableText(body []byte) (string, bool) {
+	if len(body) > contentIndexMaxBytes {
+		body = body[:contentIndexMaxBytes]
+		for i := 0; i < utf8.UTFMax-1 && len(body) > 0 && !utf8.Valid(body); i++ {
+			body = body[:len(body)-1]
+		}
+	}
+	if len(body) == 0 || bytes.IndexByte(body, 0) >= 0 || !utf8.Valid(body) {
+		return "", false
+	}
+	return string(body), true
+}
+
+// 删除内容的全文索引，在删除内容记录的事务中调用
+func deleteContentIndex(ctx context.Context, tx *sql.Tx, key string) error {
+	deleteQuery := `DELETE FROM content_index WHERE rowid = (SELECT doc_id FROM content_index_state WHERE blob_key = ?)`
+	if _, err := tx.ExecContext(ctx, deleteQuery, key); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM content_index_state WHERE blob_key = ?`, key)
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// 检测文件类型时读取的内容长度，与 http.DetectContentType 使用的长度一致
+const sniffLen = 512
+
+// 根据内容开头的 512 字节检测文件类型，只有通用类型时依次使用客户端声明的类型和扩展名对应的类型。
+// 只预读开头部分而不缓存整个文件，返回的 Reader 从头读取完整内容；声明的类型与内容不符时记录日志
+func detectContentType(r io.Reader, declared, name string) (string, io.Reader, error) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	sniffed := http.DetectContentType(head)
+	declared = normalizeContentType(declared)
+	byExtension := normalizeContentType(mime.TypeByExtension(filepath.Ext(name)))
+
+	if declared != "" && !compatibleContentType(sniffed, declared) {
+		slog.Warn("Declared content type does not match content", "name", name, "declared", declared, "detected", sniffed)
+	}
+	// 内容只能识别为通用类型时，与之相符的声明类型或扩展名类型更具体
+	if isGenericContentType(sniffed) {
+		for _, candidate := range []string{declared, byExtension} {
+			if candidate != "" && candidate != "application/octet-stream" && compatibleContentType(sniffed, candidate) {
+				return candidate, br, nil
+			}
+		}
+	}
+	return sniffed, br, nil
+}
+
+// 解析并规范化类型，无法解析时返回空字符串；只保留 charset 参数
+func normalizeContentType(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if charset, ok := params["charset"]; ok {
+		return mime.FormatMediaType(mediaType, map[string]string{"charset": strings.ToLower(charset)})
+	}
+	return mediaType
+}
+
+// 检测结果只说明了内容的大致格式，例如 docx 和 jar 都会被识别为 zip
+func isGenericContentType(sniffed string) bool {
+	mediaType, _, _ := mime.ParseMediaType(sniffed)
+	return mediaType == "application/octet-stream" || mediaType == "text/plain" || mediaType == "application/zip"
+}
+
+// 判断 contentType 是否可能是检测结果 sniffed 所代表的内容
+func compatibleContentType(sniffed, contentType string) bool {
+	sniffedType, _, _ := mime.ParseMediaType(sniffed)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case sniffedType == mediaType, sniffedType == "application/octet-stream", mediaType == "application/octet-stream":
+		return true
+	case sniffedType == "text/plain":
+		return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") ||
+			strings.HasSuffix(mediaType, "xml") || mediaType == "application/javascript"
+	case sniffedType == "application/zip":
+		// Office、OpenDocument、EPUB、JAR 等格式均基于 zip
+		return strings.HasPrefix(mediaType, "application/vnd.") || strings.HasSuffix(mediaType, "+zip") ||
+			mediaType == "application/java-archive"
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 注册复制文件接口；limiter 用于限制分享链接密码错误的次数
+func registerCopyRoutes(r gin.IRouter, db *sql.DB, limiter *rateLimiter) {
+	repo := newFileRepository(db)
+
+	// 复制文件到 folder_id 文件夹下（缺省为根目录），name 为新文件名，缺省与原文件相同。
+	// 只新增一条引用相同内容的文件记录，不复制内容，耗时与文件大小无关；标签、星标和过期时间不会复制。
+	// 复制其他用户的文件时需提供该文件有效的分享链接 share_token，分享链接有密码时还需提供 share_password。
+	// on_conflict 与上传相同，见 uploadConflictCreate
+	r.POST("/files/:id/copy", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+		var req struct {
+			FolderID      *int    `json:"folder_id"`
+			Name          *string `json:"name"`
+			OnConflict    string  `json:"on_conflict"`
+			ShareToken    string  `json:"share_token"`
+			SharePassword string  `json:"share_password"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				renderError(c, invalidRequest("Invalid request body"))
+				return
+			}
+		}
+		if req.OnConflict != "" && req.OnConflict != uploadConflictCreate && req.OnConflict != uploadConflictReject && req.OnConflict != uploadConflictReturn {
+			renderError(c, invalidRequest("Invalid on_conflict, must be create, reject or return"))
+			return
+		}
+
+		ownerID := currentUserID(c)
+		source, share, err := copySource(c.Request.Context(), db, repo, ownerID, id, req.ShareToken)
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+		if !checkSharePassword(c, limiter, share, req.SharePassword) {
+			return
+		}
+		name := source.Name
+		if req.Name != nil {
+			name = *req.Name
+		}
+		name, err = cleanFileName(name)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		if !checkTargetFolder(c, db, ownerID, req.FolderID) {
+			return
+		}
+
+		if req.OnConflict == uploadConflictReject || req.OnConflict == uploadConflictReturn {
+			existing, err := repo.GetByName(c.Request.Context(), ownerID, req.FolderID, name)
+			switch {
+			case errors.Is(err, errNotFound):
+			case err != nil:
+				renderError(c, internalError("Failed to get file", err))
+				return
+			case req.OnConflict == uploadConflictReturn && existing.HashAlgo == source.HashAlgo && existing.Hash == source.Hash:
+				c.JSON(http.StatusOK, gin.H{"file": existing, "existing": true})
+				return
+			default:
+				renderError(c, newAPIError(http.StatusConflict, codeFileExists, "A file with the same name already exists").with(gin.H{
+					"existing_file": newExistingFile(existing),
+				}))
+				return
+			}
+		}
+
+		// 通过分享链接复制也算一次下载
+		if share.ID != 0 {
+			err := useShareDownload(c.Request.Context(), db, share)
+			if errors.Is(err, errShareExhausted) {
+				renderError(c, newAPIError(http.StatusGone, codeGone, "Share download limit reached"))
+				return
+			}
+			if err != nil {
+				renderError(c, internalError("Failed to update share", err))
+				return
+			}
+		}
+
+		file, err := repo.Copy(c.Request.Context(), source, File{
+			Name:      name,
+			CreatedAt: time.Now().UTC(),
+			OwnerID:   ownerID,
+			FolderID:  req.FolderID,
+			// 并发创建同名文件时在复制的事务中再次检查
+			rejectConflict: req.OnConflict == uploadConflictReject || req.OnConflict == uploadConflictReturn,
+		})
+		if errors.Is(err, errNameConflict) {
+			renderError(c, newAPIError(http.StatusConflict, codeFileExists, "A file with the same name already exists").with(gin.H{
+				"existing_file": newExistingFile(file),
+			}))
+			return
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			quotaExceeded(c, db, ownerID)
+			return
+		}
+		if errors.Is(err, errFolderNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Target folder not found"))
+			return
+		}
+		if err != nil {
+			fileError(c, err, "Failed to copy file")
+			return
+		}
+		addAuditFile(c, file)
+		c.Header("Location", apiV1Prefix+"/files/"+strconv.Itoa(file.ID))
+		c.JSON(http.StatusCreated, gin.H{"file": file, "existing": false})
+	})
+}
+
+// 获取要复制的文件和使用的分享链接：没有 shareToken 时只能是用户自己的文件，否则需是该分享链接有效时分享的文件。
+// 分享链接不存在、已失效或不是该文件的都返回 errNotFound，不透露其他用户的文件是否存在
+func copySource(ctx context.Context, db *sql.DB, repo *FileRepository, ownerID, id int, shareToken string) (File, Share, error) {
+	if shareToken == "" {
+		file, err := repo.GetByID(ctx, ownerID, id)
+		return file, Share{}, err
+	}
+	share, err := getShareByToken(ctx, db, shareToken)
+	if err == sql.ErrNoRows {
+		return File{}, Share{}, errNotFound
+	}
+	if err != nil {
+		return File{}, Share{}, err
+	}
+	if share.FileID != id || share.RevokedAt != nil || (share.ExpiresAt != nil && !share.ExpiresAt.After(time.Now())) {
+		return File{}, Share{}, errNotFound
+	}
+	file, err := repo.GetByID(ctx, share.OwnerID, id)
+	return file, share, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 跨域请求允许使用的方法和请求头
+const (
+	corsAllowMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders = "Authorization, Content-Type, Range, If-Range, If-Match, If-None-Match, If-Modified-Since, X-Content-SHA256, Upload-Offset, Content-Range, X-Request-ID, X-API-Key, X-Share-Password"
+	// 浏览器默认无法读取的响应头，需显式暴露给前端
+	corsExposeHeaders = "Location, Content-Disposition, Content-Length, Content-Range, Accept-Ranges, ETag, Retry-After, X-Preview-Truncated, Upload-Offset, Upload-Length, X-Request-ID, X-API-Version"
+	// 预检结果的缓存时间（秒）
+	corsMaxAge = "600"
+)
+
+// 解析逗号分隔的允许来源列表，忽略空项
+func parseOrigins(s string) []string {
+	var origins []string
+	for _, origin := range strings.Split(s, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// 跨域中间件，只为 origins 中的来源设置 CORS 响应头，并直接响应预检请求。
+// origins 包含 * 时允许任意来源，仅用于开发环境；接口通过 Authorization 请求头认证，因此不允许携带 Cookie
+func corsMiddleware(origins []string) gin.HandlerFunc {
+	allowAll := slices.Contains(origins, "*")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		if !allowAll && !slices.Contains(origins, origin) {
+			// 不允许的来源不设置响应头，由浏览器拒绝
+			if c.Request.Method == http.MethodOptions {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if allowAll {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		c.Header("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		// 预检请求
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", corsAllowMethods)
+			c.Header("Access-Control-Allow-Headers", corsAllowHeaders)
+			c.Header("Access-Control-Max-Age", corsMaxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
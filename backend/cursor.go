@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// 游标不合法或已损坏
+var errInvalidCursor = errors.New("Invalid after, must be a next_cursor returned by a previous page")
+
+// 文件列表的游标，记录上一页最后一个文件的排序字段值和 id；
+// 游标同时记录排序方式，只能用于相同排序的下一页
+type fileCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"` // 排序字段的值，时间为 RFC 3339 格式
+	ID    int    `json:"id"`
+}
+
+// 生成 file 之后一页的游标
+func newFileCursor(sort string, desc bool, file File) string {
+	b, _ := json.Marshal(fileCursorAfter(sort, desc, file))
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// file 之后一页的游标，用于在服务端连续分页
+func fileCursorAfter(sort string, desc bool, file File) *fileCursor {
+	cursor := &fileCursor{Sort: sort, Desc: desc, ID: file.ID}
+	switch sort {
+	case "name":
+		cursor.Value = file.Name
+	case "size":
+		cursor.Value = strconv.FormatInt(file.Size, 10)
+	case "downloads":
+		cursor.Value = strconv.Itoa(file.Downloads)
+	case "taken_at":
+		taken := file.CreatedAt
+		if file.TakenAt != nil {
+			taken = *file.TakenAt
+		}
+		cursor.Value = taken.UTC().Format(time.RFC3339Nano)
+	default:
+		cursor.Value = file.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return cursor
+}
+
+// 解析游标，无法解析时返回 errInvalidCursor
+func parseFileCursor(s string) (*fileCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor fileCursor
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return nil, errInvalidCursor
+	}
+	if _, ok := fileSortColumns[cursor.Sort]; !ok {
+		return nil, errInvalidCursor
+	}
+	if _, err := cursor.value(); err != nil {
+		return nil, errInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// 用于 SQL 比较的排序字段值
+func (c *fileCursor) value() (any, error) {
+	switch c.Sort {
+	case "name":
+		return c.Value, nil
+	case "size", "downloads":
+		return strconv.ParseInt(c.Value, 10, 64)
+	default:
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+		return t.UTC(), err
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// 连接池的最大连接数。WAL 模式下读取可以并发进行，写入仍然逐个执行，过多的连接只会增加等待
+const dbMaxOpenConns = 8
+
+// 请求 context 中保存未设置超时的 context 的键
+type requestDeadlineKey struct{}
+
+// 为请求的 context 设置 timeout 的超时，请求中的数据库操作超时后中止，timeout 为 0 时不设置。
+// 上传和下载文件内容的时间取决于内容大小和客户端的速度，处理函数在传输内容前调用 detachDeadline 取消超时
+func dbTimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+		parent := c.Request.Context()
+		ctx, cancel := context.WithTimeout(context.WithValue(parent, requestDeadlineKey{}, parent), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// 取消 dbTimeoutMiddleware 设置的超时，之后的操作只在客户端断开时中止
+func detachDeadline(c *gin.Context) {
+	if parent, ok := c.Request.Context().Value(requestDeadlineKey{}).(context.Context); ok {
+		c.Request = c.Request.WithContext(parent)
+	}
+}
+
+// 打开 SQLite 数据库并设置连接参数。参数在每个新连接建立时执行，因此对连接池中的所有连接都生效；
+// 事务以 IMMEDIATE 方式开始，先读后写的事务在开始时等待写锁，而不是在写入时直接因锁冲突失败
+func openDB(path string, busyTimeout time.Duration) (*sql.DB, error) {
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout("+strconv.FormatInt(busyTimeout.Milliseconds(), 10)+")")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	params.Add("_pragma", "foreign_keys(ON)")
+	params.Set("_txlock", "immediate")
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite", path+separator+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxOpenConns)
+	if err := checkPragmas(db, busyTimeout); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// 读回连接参数并确认已生效，例如数据库所在的文件系统不支持 WAL 时 journal_mode 会保持原值
+func checkPragmas(db *sql.DB, busyTimeout time.Duration) error {
+	var journalMode string
+	var timeout, synchronous int64
+	var foreignKeys bool
+	// 在同一个连接上读取
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, p := range []struct {
+		name string
+		dest any
+	}{
+		{"journal_mode", &journalMode},
+		{"busy_timeout", &timeout},
+		{"synchronous", &synchronous},
+		{"foreign_keys", &foreignKeys},
+	} {
+		if err := conn.QueryRowContext(context.Background(), "PRAGMA "+p.name).Scan(p.dest); err != nil {
+			return fmt.Errorf("failed to read pragma %s: %w", p.name, err)
+		}
+	}
+	slog.Info("Database opened", "journal_mode", journalMode, "busy_timeout_ms", timeout, "synchronous", synchronous, "foreign_keys", foreignKeys, "max_open_conns", dbMaxOpenConns)
+
+	switch {
+	case !strings.EqualFold(journalMode, "wal"):
+		return fmt.Errorf("journal_mode is %q, the database file system must support WAL", journalMode)
+	case timeout != busyTimeout.Milliseconds():
+		return fmt.Errorf("busy_timeout is %d, expected %d", timeout, busyTimeout.Milliseconds())
+	// 1 为 NORMAL
+	case synchronous != 1:
+		return fmt.Errorf("synchronous is %d, expected 1 (NORMAL)", synchronous)
+	case !foreignKeys:
+		return errors.New("foreign_keys is off, expected on")
+	}
+	return nil
+}
+
+// 初始化数据库：依次执行未执行过的迁移，然后修正不依赖表结构的数据。
+// defaultQuota 为新用户的存储配额（字节），0 表示不限制
+func initDB(db *sql.DB, defaultQuota int64) error {
+	if err := runMigrations(db, schemaMigrations(defaultQuota)); err != nil {
+		return err
+	}
+	// 没有管理员时由第一个注册的用户担任
+	if _, err := db.Exec(`UPDATE users SET is_admin = 1 WHERE id = (SELECT MIN(id) FROM users) AND NOT EXISTS(SELECT 1 FROM users WHERE is_admin)`); err != nil {
+		return fmt.Errorf("failed to assign admin: %w", err)
+	}
+	// 重新统计已用空间，修正升级前或异常退出导致的偏差
+	if err := recalculateUsage(db); err != nil {
+		return fmt.Errorf("failed to calculate storage usage: %w", err)
+	}
+	return nil
+}
+
+// 第一个迁移：创建初始的表结构，并升级引入迁移之前各个版本创建的数据库。
+// 其中每一步都会先检查当前结构，因此对新数据库和任何旧数据库都可以执行
+func createBaselineSchema(tx *sql.Tx, defaultQuota int64) error {
+	if _, err := tx.Exec(filesTableSchema("files")); err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
+	// 文件内容的引用计数，相同内容只保存一份，由 files 和 file_versions 按哈希引用；
+	// 内容本身保存在存储后端中，使用 sqlite 后端时保存在 blob_data 表中
+	createBlobsTableQuery := `
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash TEXT PRIMARY KEY,
+		size INTEGER NOT NULL,
+		refcount INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS blob_data (
+		hash TEXT PRIMARY KEY,
+		data BLOB NOT NULL
+	);`
+	if _, err := tx.Exec(createBlobsTableQuery); err != nil {
+		return fmt.Errorf("failed to create blobs table: %w", err)
+	}
+	// 旧版本数据库的 blobs 表中直接保存内容
+	if err := moveBlobData(tx); err != nil {
+		return fmt.Errorf("failed to upgrade blobs table: %w", err)
+	}
+
+	// 分片上传会话及分片
+	createUploadTablesQuery := `
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		hash TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		owner_id INTEGER REFERENCES users (id)
+	);
+	CREATE TABLE IF NOT EXISTS upload_parts (
+		upload_id TEXT NOT NULL,
+		part_number INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		hash TEXT NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (upload_id, part_number)
+	);`
+	if _, err := tx.Exec(createUploadTablesQuery); err != nil {
+		return fmt.Errorf("failed to create upload tables: %w", err)
+	}
+
+	// 用户表
+	createUsersTableQuery := `
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		is_admin BOOLEAN NOT NULL DEFAULT 0,
+		quota_bytes INTEGER NOT NULL DEFAULT 0,
+		used_bytes INTEGER NOT NULL DEFAULT 0
+	);`
+	if _, err := tx.Exec(createUsersTableQuery); err != nil {
+		return fmt.Errorf("failed to create users table: %w", err)
+	}
+
+	// 分享链接表
+	createSharesTableQuery := `
+	CREATE TABLE IF NOT EXISTS shares (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token TEXT NOT NULL UNIQUE,
+		file_id INTEGER NOT NULL REFERENCES files (id),
+		owner_id INTEGER NOT NULL REFERENCES users (id),
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	);`
+	if _, err := tx.Exec(createSharesTableQuery); err != nil {
+		return fmt.Errorf("failed to create shares table: %w", err)
+	}
+
+	// 文件夹表；同一目录下的文件夹名唯一，根目录的 parent_id 为 NULL
+	createFoldersTableQuery := `
+	CREATE TABLE IF NOT EXISTS folders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		parent_id INTEGER REFERENCES folders (id),
+		owner_id INTEGER NOT NULL REFERENCES users (id),
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS folders_owner_parent_name ON folders (owner_id, IFNULL(parent_id, 0), name);`
+	if _, err := tx.Exec(createFoldersTableQuery); err != nil {
+		return fmt.Errorf("failed to create folders table: %w", err)
+	}
+
+	// 缩略图缓存，按内容哈希和边长保存
+	createThumbnailsTableQuery := `
+	CREATE TABLE IF NOT EXISTS thumbnails (
+		hash TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (hash, size)
+	);`
+	if _, err := tx.Exec(createThumbnailsTableQuery); err != nil {
+		return fmt.Errorf("failed to create thumbnails table: %w", err)
+	}
+
+	// 为旧版本数据库补充新增的字段
+	upgrades := []struct{ column, definition string }{
+		{"size", "INTEGER NOT NULL DEFAULT 0"},
+		{"mime", "TEXT NOT NULL DEFAULT ''"},
+		{"created_at", "TIMESTAMP"},
+		{"owner_id", "INTEGER REFERENCES users (id)"},
+		{"folder_id", "INTEGER REFERENCES folders (id)"},
+		{"deleted_at", "TIMESTAMP"},
+		{"version", "INTEGER NOT NULL DEFAULT 1"},
+		{"updated_at", "TIMESTAMP"},
+		{"protected", "BOOLEAN NOT NULL DEFAULT 0"},
+	}
+	for _, u := range upgrades {
+		if err := addColumnIfMissing(tx, "files", u.column, u.definition); err != nil {
+			return fmt.Errorf("failed to add column %s: %w", u.column, err)
+		}
+	}
+	if err := addColumnIfMissing(tx, "upload_sessions", "owner_id", "INTEGER REFERENCES users (id)"); err != nil {
+		return fmt.Errorf("failed to add column owner_id: %w", err)
+	}
+	// 已有用户使用默认配额
+	userUpgrades := []struct{ column, definition string }{
+		{"is_admin", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"quota_bytes", "INTEGER NOT NULL DEFAULT " + strconv.FormatInt(defaultQuota, 10)},
+		{"used_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, u := range userUpgrades {
+		if err := addColumnIfMissing(tx, "users", u.column, u.definition); err != nil {
+			return fmt.Errorf("failed to add column %s: %w", u.column, err)
+		}
+	}
+
+	// 旧版本数据库在 files 表中保存内容（file 字段）或磁盘路径（path 字段）
+	hasBlob, err := hasColumn(tx, "files", "file")
+	if err != nil {
+		return fmt.Errorf("failed to inspect table: %w", err)
+	}
+	hasPath, err := hasColumn(tx, "files", "path")
+	if err != nil {
+		return fmt.Errorf("failed to inspect table: %w", err)
+	}
+
+	if _, err := tx.Exec(versionsTableSchema); err != nil {
+		return fmt.Errorf("failed to create file versions table: %w", err)
+	}
+
+	// 旧数据没有所有者，归第一个注册的用户所有
+	if err := claimUnownedFiles(tx); err != nil {
+		return fmt.Errorf("failed to assign file owner: %w", err)
+	}
+	if hasBlob {
+		// 旧数据的大小可以从内容计算
+		if _, err := tx.Exec(`UPDATE files SET size = length(file) WHERE size = 0`); err != nil {
+			return fmt.Errorf("failed to backfill file size: %w", err)
+		}
+	}
+	// 旧数据没有上传时间，以升级时间代替
+	if _, err := tx.Exec(`UPDATE files SET created_at = ? WHERE created_at IS NULL`, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to backfill upload time: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE files SET updated_at = created_at WHERE updated_at IS NULL`); err != nil {
+		return fmt.Errorf("failed to backfill update time: %w", err)
+	}
+
+	// 将旧版本数据库中的内容移入 blobs 表，并重建 files 表去掉内容字段和哈希的唯一约束
+	if err := upgradeFilesTable(tx, hasBlob, hasPath); err != nil {
+		return fmt.Errorf("failed to upgrade files table: %w", err)
+	}
+	if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS files_owner_hash ON files (owner_id, hash)`); err != nil {
+		return fmt.Errorf("failed to create files index: %w", err)
+	}
+	return nil
+}
+
+// 返回 files 表的建表语句；文件内容按 hash 引用 blobs 表，
+// 同一用户可以有多个相同内容的文件
+func filesTableSchema(table string) string {
+	return `
+	CREATE TABLE IF NOT EXISTS ` + table + ` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hash TEXT NOT NULL,
+		name TEXT NOT NULL,
+		size INTEGER NOT NULL DEFAULT 0,
+		mime TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP,
+		owner_id INTEGER REFERENCES users (id),
+		folder_id INTEGER REFERENCES folders (id),
+		deleted_at TIMESTAMP,
+		version INTEGER NOT NULL DEFAULT 1,
+		updated_at TIMESTAMP,
+		protected BOOLEAN NOT NULL DEFAULT 0
+	);`
+}
+
+// file_versions 表的建表语句，保存文件被替换前的各个版本；当前版本仍保存在 files 表中
+const versionsTableSchema = `
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL REFERENCES files (id),
+		version INTEGER NOT NULL,
+		hash TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		mime TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		UNIQUE (file_id, version)
+	);`
+
+// 旧版本的 files 表带有哈希的唯一约束，并在 file 或 path 字段中保存内容，历史版本表与其相同。
+// 将内容按哈希合并到 blobs 表并统计引用次数，然后去掉这些字段；SQLite 无法直接修改约束，因此重建 files 表
+func upgradeFilesTable(tx *sql.Tx, hasBlob, hasPath bool) error {
+	var schema string
+	if err := tx.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'files'`).Scan(&schema); err != nil {
+		return err
+	}
+	if !hasBlob && !hasPath && !strings.Contains(schema, "UNIQUE") {
+		return nil
+	}
+
+	// 更早的数据库没有历史版本，file_versions 表刚以新的结构创建
+	versionsHasBlob, err := hasColumn(tx, "file_versions", "file")
+	if err != nil {
+		return err
+	}
+	versionsHasPath, err := hasColumn(tx, "file_versions", "path")
+	if err != nil {
+		return err
+	}
+
+	var statements []string
+	if hasBlob || hasPath {
+		// 磁盘上的文件已按哈希命名，只需记录引用次数
+		data, versionData := "NULL", "NULL"
+		if hasBlob {
+			data = "file"
+		}
+		if versionsHasBlob {
+			versionData = "file"
+		}
+		statements = append(statements, `INSERT INTO blobs (hash, size, refcount, created_at)
+		SELECT hash, MAX(size), COUNT(*), MIN(created_at) FROM (
+			SELECT hash, size, created_at FROM files
+			UNION ALL SELECT hash, size, created_at FROM file_versions
+		) GROUP BY hash`)
+		if hasBlob || versionsHasBlob {
+			statements = append(statements, `INSERT INTO blob_data (hash, data)
+			SELECT hash, MAX(data) FROM (
+				SELECT hash, `+data+` AS data FROM files
+				UNION ALL SELECT hash, `+versionData+` FROM file_versions
+			) WHERE data IS NOT NULL GROUP BY hash`)
+		}
+	}
+	columns := "id, hash, name, size, mime, created_at, owner_id, folder_id, deleted_at, version, updated_at, protected"
+	statements = append(statements,
+		filesTableSchema("files_new"),
+		"INSERT INTO files_new ("+columns+") SELECT "+columns+" FROM files",
+		"DROP TABLE files",
+		"ALTER TABLE files_new RENAME TO files",
+	)
+	if versionsHasBlob {
+		statements = append(statements, "ALTER TABLE file_versions DROP COLUMN file")
+	}
+	if versionsHasPath {
+		statements = append(statements, "ALTER TABLE file_versions DROP COLUMN path")
+	}
+	return execAll(tx, statements)
+}
+
+// 将 blobs 表中的 data 字段移到 blob_data 表，blobs 表只保留引用计数
+func moveBlobData(tx *sql.Tx) error {
+	hasData, err := hasColumn(tx, "blobs", "data")
+	if err != nil || !hasData {
+		return err
+	}
+	statements := []string{
+		`INSERT INTO blob_data (hash, data) SELECT hash, data FROM blobs WHERE data IS NOT NULL`,
+		`ALTER TABLE blobs DROP COLUMN data`,
+	}
+	return execAll(tx, statements)
+}
+
+// 依次执行多条语句
+func execAll(tx *sql.Tx, statements []string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// *sql.DB 和 *sql.Tx 共有的查询方法，使同一个函数既可以在事务中也可以直接执行
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// 将没有所有者的文件归第一个注册的用户所有；还没有用户时不做处理
+func claimUnownedFiles(db querier) error {
+	result, err := db.Exec(`UPDATE files SET owner_id = (SELECT MIN(id) FROM users) WHERE owner_id IS NULL`)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	return recalculateUsage(db)
+}
+
+// 检查表中是否存在指定字段
+func hasColumn(db querier, table, column string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`
+	err := db.QueryRow(query, table, column).Scan(&exists)
+	return exists, err
+}
+
+// 表中不存在指定字段时添加该字段
+func addColumnIfMissing(db querier, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// 检查是否为违反唯一约束的错误
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// 检查是否为违反外键约束的错误，例如引用的文件夹在检查之后被并发删除
+func isForeignKeyViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY
+}
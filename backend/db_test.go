@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 不会结束的查询，只能通过取消 context 中止
+const slowQuery = `WITH RECURSIVE n (i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n) SELECT COUNT(*) FROM n`
+
+// 中止慢查询允许的最长时间，留出 -race 下的余量
+const abortTimeout = 2 * time.Second
+
+func TestOpenDBPragmas(t *testing.T) {
+	db := openTestFileDB(t)
+	// 连接池中的每个连接都使用相同的参数
+	for i := 0; i < dbMaxOpenConns; i++ {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var journalMode string
+		var timeout, synchronous int
+		var foreignKeys bool
+		for name, dest := range map[string]any{"journal_mode": &journalMode, "busy_timeout": &timeout, "synchronous": &synchronous, "foreign_keys": &foreignKeys} {
+			if err := conn.QueryRowContext(context.Background(), "PRAGMA "+name).Scan(dest); err != nil {
+				t.Fatalf("PRAGMA %s: %v", name, err)
+			}
+		}
+		if journalMode != "wal" || timeout != 5000 || synchronous != 1 || !foreignKeys {
+			t.Errorf("connection %d: journal_mode %s, busy_timeout %d, synchronous %d, foreign_keys %v", i, journalMode, timeout, synchronous, foreignKeys)
+		}
+	}
+}
+
+func TestOpenDBRejectsDatabaseWithoutWAL(t *testing.T) {
+	// 内存数据库不支持 WAL，journal_mode 保持为 memory
+	db, err := openDB("file:nowal?mode=memory", time.Second)
+	if err == nil {
+		db.Close()
+		t.Fatal("openDB succeeded without WAL")
+	}
+	if !strings.Contains(err.Error(), "journal_mode") {
+		t.Errorf("err = %v, want a journal_mode error", err)
+	}
+}
+
+// 并发的上传和列表不应因数据库被锁定而失败
+func TestConcurrentWritesAndReads(t *testing.T) {
+	db := openTestFileDB(t)
+	repo := newFileRepository(db)
+	alice := newTestUser(t, db, "alice")
+
+	const writers, filesPerWriter = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*filesPerWriter*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < filesPerWriter; i++ {
+				name := fmt.Sprintf("file-%d-%d.txt", w, i)
+				_, err := repo.Create(context.Background(), File{HashAlgo: hashSHA256, Hash: name, Name: name, Size: 1, CreatedAt: time.Now().UTC(), OwnerID: alice})
+				if err != nil {
+					errs <- fmt.Errorf("create %s: %w", name, err)
+				}
+				if _, _, _, err := repo.List(context.Background(), listOptions{OwnerID: alice, Limit: 50}); err != nil {
+					errs <- fmt.Errorf("list: %w", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var count int
+	var used int64
+	if err := db.QueryRow(`SELECT COUNT(*), (SELECT used_bytes FROM users WHERE id = ?) FROM files`, alice).Scan(&count, &used); err != nil {
+		t.Fatal(err)
+	}
+	if count != writers*filesPerWriter || used != writers*filesPerWriter {
+		t.Errorf("files = %d, used_bytes = %d, want %d", count, used, writers*filesPerWriter)
+	}
+}
+
+// 取消 context 或超时后正在执行的查询立即中止，返回 context 的错误
+func TestCancelledContextAbortsSlowQuery(t *testing.T) {
+	db := openTestFileDB(t)
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		want error
+	}{
+		{"canceled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+		{"deadline exceeded", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			start := time.Now()
+			var n int
+			err := db.QueryRowContext(ctx, slowQuery).Scan(&n)
+			if elapsed := time.Since(start); elapsed > abortTimeout {
+				t.Errorf("query took %v after the context ended", elapsed)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			// 中止后连接仍然可用
+			if err := db.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM files`).Scan(&n); err != nil {
+				t.Errorf("query after abort: %v", err)
+			}
+		})
+	}
+}
+
+// 请求的数据库操作超时返回 503，客户端断开返回 408，都不等待慢查询结束
+func TestRequestContextAbortsSlowQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := openTestFileDB(t)
+	r := gin.New()
+	r.Use(dbTimeoutMiddleware(50 * time.Millisecond))
+	r.GET("/slow", func(c *gin.Context) {
+		var n int
+		if err := db.QueryRowContext(c.Request.Context(), slowQuery).Scan(&n); err != nil {
+			renderError(c, internalError("Failed to count", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"n": n})
+	})
+	r.GET("/detached", func(c *gin.Context) {
+		detachDeadline(c)
+		var n int
+		if err := db.QueryRowContext(c.Request.Context(), slowQuery).Scan(&n); err != nil {
+			renderError(c, internalError("Failed to count", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"n": n})
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		cancel time.Duration // 大于 0 时在这之后模拟客户端断开
+		status int
+		code   string
+	}{
+		{"timeout", "/slow", 0, http.StatusServiceUnavailable, codeTimeout},
+		{"client gone", "/slow", 20 * time.Millisecond, http.StatusRequestTimeout, codeCanceled},
+		{"client gone after detaching the deadline", "/detached", 100 * time.Millisecond, http.StatusRequestTimeout, codeCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel > 0 {
+				time.AfterFunc(tt.cancel, cancel)
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+			start := time.Now()
+			r.ServeHTTP(w, req)
+			if elapsed := time.Since(start); elapsed > abortTimeout {
+				t.Errorf("request took %v", elapsed)
+			}
+			var body struct {
+				Error struct {
+					Code string `json:"code"`
+				} `json:"error"`
+			}
+			decodeJSON(t, w, &body)
+			if w.Code != tt.status || body.Error.Code != tt.code {
+				t.Errorf("status = %d, code %q, want %d and %q", w.Code, body.Error.Code, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+// 仓库的方法使用调用方的 context，context 结束后不再执行查询和写入
+func TestFileRepositoryUsesContext(t *testing.T) {
+	db := openTestFileDB(t)
+	repo := newFileRepository(db)
+	alice := newTestUser(t, db, "alice")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := repo.List(ctx, listOptions{OwnerID: alice, Limit: 10}); !errors.Is(err, context.Canceled) {
+		t.Errorf("List err = %v, want context.Canceled", err)
+	}
+	if _, err := repo.Create(ctx, File{OwnerID: alice, Name: "a.txt", Size: 1, Hash: "x", HashAlgo: hashSHA256}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Create err = %v, want context.Canceled", err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("%d files after a canceled create: %v", n, err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 剩余空间低于保留空间，包装 ENOSPC 以便与写入时磁盘已满一样返回 507
+var errInsufficientStorage = fmt.Errorf("free disk space is below the reserve: %w", syscall.ENOSPC)
+
+// 默认保留的剩余空间
+const defaultDiskReserve = 1 << 30
+
+// 接收上传内容时每读取该字节数重新检查一次剩余空间
+const diskCheckInterval = 8 << 20
+
+// 需要检查剩余空间的上传接口，"METHOD 路由"（不含版本前缀）
+var diskGuardRoutes = []string{"POST /upload", "POST /upload/json", "PUT /files/by-name/*name", "PUT /dav/*path", "PATCH /uploads/:id", "PUT /uploads/:id/parts/:n"}
+
+// DiskSpace 一个目录所在卷的空间
+type DiskSpace struct {
+	Path           string `json:"path"`
+	TotalBytes     int64  `json:"total_bytes"`
+	FreeBytes      int64  `json:"free_bytes"`      // 非特权用户可用的空间
+	ReservedBytes  int64  `json:"reserved_bytes"`  // 保留给数据库等其他写入、不用于上传的空间
+	AvailableBytes int64  `json:"available_bytes"` // 扣除保留空间后可用于上传的空间，可能为负数
+}
+
+// 接收上传前检查数据库、存储和暂存目录所在卷的剩余空间，剩余空间扣除 reserve 后不足时拒绝上传，
+// 避免磁盘写满后上传中途失败，甚至数据库无法写入 WAL
+type diskGuard struct {
+	paths   []string
+	reserve int64
+}
+
+// 创建剩余空间检查，忽略空的和重复的目录
+func newDiskGuard(reserve int64, paths ...string) *diskGuard {
+	g := &diskGuard{reserve: reserve}
+	for _, path := range paths {
+		if path != "" && !slices.Contains(g.paths, path) {
+			g.paths = append(g.paths, path)
+		}
+	}
+	return g
+}
+
+// 各个目录所在卷的空间
+func (g *diskGuard) usage() ([]DiskSpace, error) {
+	spaces := make([]DiskSpace, 0, len(g.paths))
+	for _, path := range g.paths {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err != nil {
+			return nil, fmt.Errorf("statfs %s: %w", path, err)
+		}
+		free := int64(st.Bavail) * int64(st.Bsize)
+		spaces = append(spaces, DiskSpace{
+			Path:           path,
+			TotalBytes:     int64(st.Blocks) * int64(st.Bsize),
+			FreeBytes:      free,
+			ReservedBytes:  g.reserve,
+			AvailableBytes: free - g.reserve,
+		})
+	}
+	return spaces, nil
+}
+
+// 剩余空间最少的卷
+func (g *diskGuard) lowest() (DiskSpace, error) {
+	spaces, err := g.usage()
+	if err != nil || len(spaces) == 0 {
+		return DiskSpace{}, err
+	}
+	return slices.MinFunc(spaces, func(a, b DiskSpace) int {
+		return cmp.Compare(a.AvailableBytes, b.AvailableBytes)
+	}), nil
+}
+
+// 检查上传接口的剩余空间：请求声明了 Content-Length 时在读取前检查，不足时返回 507；
+// 读取内容时每读取 diskCheckInterval 字节再检查一次，剩余空间低于保留空间时中止读取。
+// 无法获取剩余空间时只记录日志，不拒绝上传
+func (g *diskGuard) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !slices.Contains(diskGuardRoutes, c.Request.Method+" "+apiRoute(c)) {
+			c.Next()
+			return
+		}
+		space, err := g.lowest()
+		if err != nil {
+			slog.WarnContext(c.Request.Context(), "Failed to check free disk space", "error", err)
+			c.Next()
+			return
+		}
+		if space.AvailableBytes < max(c.Request.ContentLength, 0) {
+			renderError(c, newAPIError(http.StatusInsufficientStorage, codeInsufficientStorage, "Not enough free disk space for this upload").with(gin.H{
+				"free_bytes":     space.FreeBytes,
+				"reserved_bytes": space.ReservedBytes,
+				"required_bytes": max(c.Request.ContentLength, 0),
+			}))
+			return
+		}
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{&diskGuardReader{r: c.Request.Body, guard: g}, c.Request.Body}
+		c.Next()
+	}
+}
+
+// 读取上传内容的同时定期检查剩余空间，低于保留空间时返回 errInsufficientStorage
+type diskGuardReader struct {
+	r         io.Reader
+	guard     *diskGuard
+	unchecked int64 // 上次检查后读取的字节数
+}
+
+func (r *diskGuardReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.unchecked += int64(n); r.unchecked >= diskCheckInterval {
+		r.unchecked = 0
+		if space, statErr := r.guard.lowest(); statErr == nil && space.AvailableBytes < 0 {
+			return n, errInsufficientStorage
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 不认识 filename* 的客户端使用的 ASCII 文件名的最大长度（字节）
+const maxFallbackNameLength = 128
+
+// 生成 Content-Disposition 响应头：filename 为只含可打印 ASCII 的替代名称，
+// 名称含其他字符时再附加 RFC 5987 编码的 filename*，支持的客户端会优先使用。
+// 控制字符（包括换行）会被删除，不会出现在响应头中
+func contentDisposition(disposition, name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	if strings.TrimSpace(name) == "" {
+		name = "download"
+	}
+	fallback := asciiFileName(name)
+	value := disposition + `; filename="` + fallback + `"`
+	if fallback != name {
+		value += "; filename*=UTF-8''" + rfc5987Escape(name)
+	}
+	return value
+}
+
+// 将文件名转换为可以放在引号中的 ASCII 名称：非 ASCII 字符以及引号、反斜杠、分号和百分号替换为 _，
+// 过长时截断主名并保留扩展名
+func asciiFileName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 0x20 || r > 0x7e, r == '"', r == '\\', r == ';', r == '%':
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	fallback := b.String()
+	if len(fallback) > maxFallbackNameLength {
+		ext := path.Ext(fallback)
+		if len(ext) > maxFallbackNameLength/2 {
+			ext = ""
+		}
+		fallback = fallback[:maxFallbackNameLength-len(ext)] + ext
+	}
+	return fallback
+}
+
+// 按 RFC 5987 的 attr-char 编码值，其余字节编码为 %XX
+func rfc5987Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	long := strings.Repeat("a", 200) + ".txt"
+	tests := []struct {
+		name        string
+		disposition string
+		file        string
+		want        string
+		decoded     string // 支持 filename* 的客户端得到的文件名
+	}{
+		{"ascii", "attachment", "report.pdf", `attachment; filename="report.pdf"`, "report.pdf"},
+		{"inline", "inline", "a.txt", `inline; filename="a.txt"`, "a.txt"},
+		{"spaces", "attachment", "my file.txt", `attachment; filename="my file.txt"`, "my file.txt"},
+		{"cjk", "attachment", "报告.pdf", `attachment; filename="__.pdf"; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf`, "报告.pdf"},
+		{"cjk with spaces", "attachment", "年度 报告.docx", `attachment; filename="__ __.docx"; filename*=UTF-8''%E5%B9%B4%E5%BA%A6%20%E6%8A%A5%E5%91%8A.docx`, "年度 报告.docx"},
+		{"emoji", "attachment", "😀.png", `attachment; filename="_.png"; filename*=UTF-8''%F0%9F%98%80.png`, "😀.png"},
+		{"double quotes", "attachment", `say "hi".txt`, `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`, `say "hi".txt`},
+		{"single quote", "attachment", "it's.txt", `attachment; filename="it's.txt"`, "it's.txt"},
+		{"semicolon", "attachment", "a;b.txt", `attachment; filename="a_b.txt"; filename*=UTF-8''a%3Bb.txt`, "a;b.txt"},
+		{"backslash", "attachment", `a\b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%5Cb.txt`, `a\b.txt`},
+		{"percent", "attachment", "100%.txt", `attachment; filename="100_.txt"; filename*=UTF-8''100%25.txt`, "100%.txt"},
+		{"header injection", "attachment", "a\r\nSet-Cookie: x=1.txt", `attachment; filename="aSet-Cookie: x=1.txt"`, "aSet-Cookie: x=1.txt"},
+		{"newline in cjk", "attachment", "报\n告.pdf", `attachment; filename="__.pdf"; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf`, "报告.pdf"},
+		{"empty", "attachment", "", `attachment; filename="download"`, "download"},
+		{"only control characters", "attachment", "\n\t", `attachment; filename="download"`, "download"},
+		{"long", "attachment", long, `attachment; filename="` + strings.Repeat("a", maxFallbackNameLength-len(".txt")) + `.txt"; filename*=UTF-8''` + long, long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentDisposition(tt.disposition, tt.file)
+			if got != tt.want {
+				t.Errorf("contentDisposition(%q, %q) =\n%s\nwant\n%s", tt.disposition, tt.file, got, tt.want)
+			}
+			if strings.ContainsAny(got, "\r\n") {
+				t.Errorf("header value contains a line break: %q", got)
+			}
+			disposition, params, err := mime.ParseMediaType(got)
+			if err != nil {
+				t.Fatalf("parse %q: %v", got, err)
+			}
+			if disposition != tt.disposition || params["filename"] != tt.decoded {
+				t.Errorf("parsed as %s with filename %q, want %s with %q", disposition, params["filename"], tt.disposition, tt.decoded)
+			}
+		})
+	}
+}
+
+func TestASCIIFileNameTruncatesLongExtension(t *testing.T) {
+	name := "a." + strings.Repeat("x", 200)
+	got := asciiFileName(name)
+	if len(got) != maxFallbackNameLength || got != name[:maxFallbackNameLength] {
+		t.Errorf("asciiFileName of a name with a long extension = %q (%d bytes)", got, len(got))
+	}
+}
+
+func TestDownloadContentDisposition(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	file := uploadTestFile(t, s, alice, "报告.txt", "hello")
+
+	w := s.do(http.MethodGet, "/api/v1/files/"+strconv.Itoa(file.ID), alice, "", nil)
+	want := `attachment; filename="__.txt"; filename*=UTF-8''%E6%8A%A5%E5%91%8A.txt`
+	if got := w.Header().Get("Content-Disposition"); w.Code != http.StatusOK || got != want {
+		t.Errorf("download: %d, Content-Disposition %q, want %q", w.Code, got, want)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// 加密内容的格式：encryptionMagic、1 字节的密钥 id 长度、密钥 id、12 字节的随机 nonce，
+// 之后是按 encryptionSegmentSize 切分明文后分别用 AES-256-GCM 加密的各段，每段末尾带 16 字节的认证标签。
+// 每段的 nonce 为随机 nonce 与段序号异或，附加数据为头部加上是否为最后一段，
+// 因此各段不能调换顺序，内容被截断或拼接时解密失败。分段加密使内容可以流式读写和随机访问
+var encryptionMagic = []byte("NDE\x01")
+
+// 加密时每段明文的大小
+const encryptionSegmentSize = 64 << 10
+
+// settings 表中记录内容加密状态的名称，值为加密算法
+const (
+	settingContentEncryption = "content_encryption"
+	contentEncryptionAESGCM  = "aes-256-gcm"
+)
+
+// 内容无法通过完整性校验：未加密、被篡改或使用了未知的密钥
+var errContentIntegrity = errors.New("content failed integrity check")
+
+// 在保存到 base 之前加密内容、读取时解密的存储后端。内容的键仍按明文的哈希计算，去重不受影响
+type encryptedStorage struct {
+	base  Storage
+	keyID string
+	keys  map[string]cipher.AEAD // 按密钥 id 查找解密使用的密钥，轮换密钥时保留旧密钥
+}
+
+// 解析 ENCRYPTION_KEY：32 字节密钥的十六进制或 base64 编码
+func parseEncryptionKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("must be 32 bytes encoded as 64 hex characters or base64")
+}
+
+// 密钥 id，由密钥的哈希得出，保存在加密内容的头部中，用于选择解密的密钥
+func encryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// 使用 key 创建加密存储后端
+func newEncryptedStorage(base Storage, key []byte) (*encryptedStorage, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	keyID := encryptionKeyID(key)
+	return &encryptedStorage{base: base, keyID: keyID, keys: map[string]cipher.AEAD{keyID: aead}}, nil
+}
+
+func (s *encryptedStorage) Put(ctx context.Context, hash string, r io.Reader) error {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	header := append(append(append(bytes.Clone(encryptionMagic), byte(len(s.keyID))), s.keyID...), nonce...)
+	return s.base.Put(ctx, hash, &sealReader{
+		src:    bufio.NewReaderSize(r, encryptionSegmentSize),
+		aead:   s.keys[s.keyID],
+		header: header,
+		nonce:  nonce,
+		buf:    make([]byte, encryptionSegmentSize),
+		out:    header,
+	})
+}
+
+// 内容损坏时在返回之前就能发现第一段的错误，下载接口据此返回 500 而不是输出错误的内容
+func (s *encryptedStorage) Get(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	content, size, err := s.base.Get(ctx, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := s.openReader(hash, content, size)
+	if err != nil {
+		content.Close()
+		return nil, 0, err
+	}
+	if err := r.load(0); err != nil {
+		content.Close()
+		return nil, 0, err
+	}
+	return r, r.size, nil
+}
+
+func (s *encryptedStorage) Delete(ctx context.Context, hash string) error {
+	return s.base.Delete(ctx, hash)
+}
+
+func (s *encryptedStorage) Exists(ctx context.Context, hash string) (bool, error) {
+	return s.base.Exists(ctx, hash)
+}
+
+// 读取加密内容的头部并计算明文的大小
+func (s *encryptedStorage) openReader(hash string, content io.ReadCloser, size int64) (*openReader, error) {
+	prefix := make([]byte, len(encryptionMagic)+1)
+	if _, err := io.ReadFull(content, prefix); err != nil || !bytes.Equal(prefix[:len(encryptionMagic)], encryptionMagic) {
+		return nil, fmt.Errorf("%w: %s is not encrypted", errContentIntegrity, hash)
+	}
+	rest := make([]byte, int(prefix[len(prefix)-1])+12)
+	if _, err := io.ReadFull(content, rest); err != nil {
+		return nil, fmt.Errorf("%w: %s has a truncated header", errContentIntegrity, hash)
+	}
+	keyID := string(rest[:len(rest)-12])
+	aead, ok := s.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is encrypted with unknown key %q", errContentIntegrity, hash, keyID)
+	}
+	header := append(prefix, rest...)
+	// 每段密文比明文多一个认证标签，最后一段可以为空但仍有标签
+	sealed := int64(encryptionSegmentSize + aead.Overhead())
+	body := size - int64(len(header))
+	segments := (body + sealed - 1) / sealed
+	if segments == 0 || body-(segments-1)*sealed < int64(aead.Overhead()) {
+		return nil, fmt.Errorf("%w: %s has an invalid length", errContentIntegrity, hash)
+	}
+	return &openReader{
+		hash:     hash,
+		keyID:    keyID,
+		content:  content,
+		aead:     aead,
+		header:   header,
+		nonce:    header[len(header)-12:],
+		segments: segments,
+		size:     body - segments*int64(aead.Overhead()),
+		seg:      -1,
+	}, nil
+}
+
+// 每段的 nonce：随机 nonce 的后 8 字节与段序号异或
+func segmentNonce(dst, nonce []byte, seg uint64) []byte {
+	dst = append(dst[:0], nonce...)
+	binary.BigEndian.PutUint64(dst[4:], binary.BigEndian.Uint64(nonce[4:])^seg)
+	return dst
+}
+
+// 每段的附加数据：头部和是否为最后一段
+func segmentAAD(dst, header []byte, last bool) []byte {
+	dst = append(dst[:0], header...)
+	if last {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// 读取明文时输出头部和加密后的各段
+type sealReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	buf     []byte
+	out     []byte // 尚未输出的密文
+	seg     uint64
+	done    bool
+	scratch struct{ nonce, aad []byte }
+}
+
+func (r *sealReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err == nil {
+			// 明文恰好是整段时，读到末尾才能确定这是最后一段
+			_, err = r.src.Peek(1)
+			last = err == io.EOF
+		}
+		if err != nil && !last {
+			return 0, err
+		}
+		r.scratch.nonce = segmentNonce(r.scratch.nonce, r.nonce, r.seg)
+		r.scratch.aad = segmentAAD(r.scratch.aad, r.header, last)
+		r.out = r.aead.Seal(r.out[:0], r.scratch.nonce, r.buf[:n], r.scratch.aad)
+		r.seg++
+		r.done = last
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// 解密读取加密的内容，实现 io.ReadSeekCloser；按段读取和校验，从不输出未经认证的数据
+type openReader struct {
+	hash     string
+	keyID    string
+	content  io.ReadCloser
+	aead     cipher.AEAD
+	header   []byte
+	nonce    []byte
+	segments int64
+	size     int64 // 明文的大小
+	pos      int64
+	seg      int64  // plain 中是第几段，-1 表示尚未读取
+	plain    []byte // 当前段解密后的明文
+	next     int64  // content 的读取位置对应的段序号
+	buf      []byte
+	scratch  struct{ nonce, aad []byte }
+}
+
+// 读取并解密第 seg 段；校验失败时记录日志并返回 errContentIntegrity
+func (r *openReader) load(seg int64) error {
+	if seg == r.seg {
+		return nil
+	}
+	sealed := int64(encryptionSegmentSize + r.aead.Overhead())
+	if seg != r.next {
+		seeker, ok := r.content.(io.Seeker)
+		if !ok {
+			return errors.New("encrypted content does not support seeking")
+		}
+		if _, err := seeker.Seek(int64(len(r.header))+seg*sealed, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if r.buf == nil {
+		r.buf = make([]byte, sealed)
+	}
+	// 失败后读取位置不确定，下次读取时重新定位
+	r.next = -1
+	n, err := io.ReadFull(r.content, r.buf)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && n == 0) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	last := seg == r.segments-1
+	r.scratch.nonce = segmentNonce(r.scratch.nonce, r.nonce, uint64(seg))
+	r.scratch.aad = segmentAAD(r.scratch.aad, r.header, last)
+	plain, err := r.aead.Open(r.plain[:0], r.scratch.nonce, r.buf[:n], r.scratch.aad)
+	if err != nil {
+		slog.Error("Encrypted content failed integrity check", "hash", r.hash, "key_id", r.keyID, "segment", seg)
+		r.seg = -1
+		return fmt.Errorf("%w: %s segment %d", errContentIntegrity, r.hash, seg)
+	}
+	r.plain, r.seg, r.next = plain, seg, seg+1
+	return nil
+}
+
+func (r *openReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	seg := r.pos / encryptionSegmentSize
+	if err := r.load(seg); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.plain[r.pos-seg*encryptionSegmentSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *openReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *openReader) Close() error {
+	return r.content.Close()
+}
+
+// 启动时检查内容的加密状态与配置是否一致：启用加密时数据库中不能有未加密的内容，
+// 需要先用 -encrypt-content 加密；已加密的内容在关闭加密后无法读取
+func checkContentEncryption(ctx context.Context, db *sql.DB, encrypted bool) error {
+	var state string
+	err := db.QueryRowContext(ctx, `SELECT value FROM settings WHERE name = ?`, settingContentEncryption).Scan(&state)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	switch {
+	case encrypted && state == "":
+		var hasContent bool
+		query := `SELECT EXISTS(SELECT 1 FROM blobs) OR EXISTS(SELECT 1 FROM chunks)`
+		if err := db.QueryRowContext(ctx, query).Scan(&hasContent); err != nil {
+			return err
+		}
+		if hasContent {
+			return errors.New("database contains unencrypted file content, run once with -encrypt-content to encrypt it before enabling ENCRYPTION_KEY")
+		}
+		return setContentEncrypted(ctx, db)
+	case !encrypted && state != "":
+		return errors.New("file content is encrypted, ENCRYPTION_KEY must be set")
+	}
+	return nil
+}
+
+// 记录所有内容都已加密
+func setContentEncrypted(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO settings (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value`,
+		settingContentEncryption, contentEncryptionAESGCM)
+	return err
+}
+
+// 加密所有未加密的内容和分块，完成后记录加密状态；已加密的内容跳过，中途失败时可以重新执行
+func encryptContent(ctx context.Context, db *sql.DB, store Storage) error {
+	encrypted := findEncryptedStorage(store)
+	if encrypted == nil {
+		return errors.New("ENCRYPTION_KEY must be set to encrypt file content")
+	}
+	rows, err := db.QueryContext(ctx, `SELECT hash FROM blobs UNION ALL SELECT ? || hash FROM chunks`, chunkKeyPrefix)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	slog.Info("Encrypting file content", "objects", len(keys), "key_id", encrypted.keyID)
+	count := 0
+	for _, key := range keys {
+		done, err := encryptObject(ctx, encrypted, key)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", key, err)
+		}
+		if done {
+			count++
+		}
+	}
+	slog.Info("Encrypted file content", "encrypted", count, "skipped", len(keys)-count)
+	if err := setContentEncrypted(ctx, db); err != nil {
+		return err
+	}
+	// 被替换的明文仍留在数据库的空闲页和 WAL 中，重建数据库将其清除
+	if _, ok := encrypted.base.(*sqliteStorage); ok && count > 0 {
+		if _, err := db.ExecContext(ctx, `VACUUM`); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 加密存储后端中的一个对象，返回是否加密了；对象不存在（如分块保存的内容）或已加密时跳过。
+// 存储后端的 Put 覆盖原内容，本地后端先写入临时文件再替换，原内容在替换前保持完整
+func encryptObject(ctx context.Context, s *encryptedStorage, key string) (bool, error) {
+	content, _, err := s.base.Get(ctx, key)
+	if errors.Is(err, errBlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer content.Close()
+	r := bufio.NewReader(content)
+	magic, err := r.Peek(len(encryptionMagic))
+	if err == nil && bytes.Equal(magic, encryptionMagic) {
+		return false, nil
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return true, s.Put(ctx, key, r)
+}
+
+// 在存储后端的包装中找到加密存储后端，未启用加密时返回 nil
+func findEncryptedStorage(store Storage) *encryptedStorage {
+	for {
+		switch s := store.(type) {
+		case *encryptedStorage:
+			return s
+		case *chunkedStorage:
+			store = s.base
+		case *compressedStorage:
+			store = s.base
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"regexp"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 错误响应中的错误码，客户端应按错误码而不是错误信息处理错误：
+//
+//	invalid_request         400 请求参数或请求体不合法
+//	unauthorized            401 未登录、token 或 API key 无效
+//	password_required       401 分享链接需要密码，或提供的密码错误
+//	forbidden               403 没有权限
+//	not_found               404 文件以外的资源不存在
+//	file_not_found          404 文件或文件内容不存在
+//	canceled                408 客户端在处理完成前断开了连接
+//	conflict                409 与当前状态冲突，如上传偏移不一致
+//	file_exists             409 同名文件已存在
+//	gone                    410 文件已过期、分享已撤销
+//	precondition_failed     412 文件的当前内容与 If-Match 不一致
+//	too_large               413 超过大小限制
+//	quota_exceeded          413 超过存储配额
+//	unsupported_media_type  415 不支持该文件类型
+//	hash_mismatch           422 内容的哈希与声明的不一致
+//	file_infected           422 上传的内容被病毒扫描判定为感染；下载被隔离的文件时为 403
+//	unprocessable           422 无法处理的内容，如无法解码的图片
+//	locked                  423 文件受保护
+//	rate_limited            429 请求过于频繁
+//	internal                500 服务端错误，具体原因只记录在日志中
+//	remote_failed           502 无法获取远程地址的内容，超时时为 504
+//	server_busy             503 同时处理的上传或下载过多，稍后按 Retry-After 重试
+//	timeout                 503 数据库操作超过了 DB_TIMEOUT
+//	scan_unavailable        503 病毒扫描服务不可用，上传被拒绝，稍后重试
+//	insufficient_storage    507 服务端磁盘空间不足，如暂存上传内容时
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeUnauthorized         = "unauthorized"
+	codePasswordRequired     = "password_required"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeFileNotFound         = "file_not_found"
+	codeCanceled             = "canceled"
+	codeConflict             = "conflict"
+	codeFileExists           = "file_exists"
+	codeGone                 = "gone"
+	codePreconditionFailed   = "precondition_failed"
+	codeTooLarge             = "too_large"
+	codeQuotaExceeded        = "quota_exceeded"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeHashMismatch         = "hash_mismatch"
+	codeFileInfected         = "file_infected"
+	codeUnprocessable        = "unprocessable"
+	codeLocked               = "locked"
+	codeRateLimited          = "rate_limited"
+	codeInternal             = "internal"
+	codeRemoteFailed         = "remote_failed"
+	codeServerBusy           = "server_busy"
+	codeTimeout              = "timeout"
+	codeScanUnavailable      = "scan_unavailable"
+	codeInsufficientStorage  = "insufficient_storage"
+)
+
+// 请求头中的请求 id，客户端未提供或不合法时由服务端生成
+const requestIDHeader = "X-Request-ID"
+
+// 客户端可以提供的请求 id
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// 请求 id 在 gin.Context 和请求 context 中的键
+const requestIDKey = "requestID"
+
+type requestIDContextKey struct{}
+
+// apiError 带有状态码和错误码的错误，由 renderError 转换为错误响应
+type apiError struct {
+	status  int
+	code    string
+	message string // 返回给客户端的信息，不包含内部错误的细节
+	details gin.H  // 错误响应中的附加字段
+	cause   error  // 内部错误，只记录在日志中
+}
+
+func (e *apiError) Error() string {
+	if e.cause != nil {
+		return e.message + ": " + e.cause.Error()
+	}
+	return e.message
+}
+
+func (e *apiError) Unwrap() error {
+	return e.cause
+}
+
+// 创建错误
+func newAPIError(status int, code, message string) *apiError {
+	return &apiError{status: status, code: code, message: message}
+}
+
+// 请求不合法
+func invalidRequest(message string) *apiError {
+	return newAPIError(http.StatusBadRequest, codeInvalidRequest, message)
+}
+
+// 服务端错误；cause 记录在日志中，不返回给客户端
+func internalError(message string, cause error) *apiError {
+	e := newAPIError(http.StatusInternalServerError, codeInternal, message)
+	e.cause = cause
+	return e
+}
+
+// 返回附加了字段的错误副本
+func (e *apiError) with(details gin.H) *apiError {
+	c := *e
+	c.details = maps.Clone(e.details)
+	if c.details == nil {
+		c.details = gin.H{}
+	}
+	maps.Copy(c.details, details)
+	return &c
+}
+
+// 将错误转换为 {"error": {"code", "message", "request_id", ...}} 响应并中止请求。
+// 数据访问层的错误转换为对应的错误码，其他未知错误返回 500，内部错误只记录在请求日志中
+func renderError(c *gin.Context, err error) {
+	var e *apiError
+	switch {
+	case errors.As(err, &e):
+	case errors.Is(err, errNotFound):
+		e = newAPIError(http.StatusNotFound, codeFileNotFound, "File not found")
+	case errors.Is(err, errDuplicate):
+		e = newAPIError(http.StatusConflict, codeFileExists, "File already exists")
+	case errors.Is(err, errFileExpired):
+		e = newAPIError(http.StatusGone, codeGone, "File has expired")
+	default:
+		e = internalError("Internal server error", err)
+	}
+	if e.status == http.StatusInternalServerError {
+		e = contextError(c, e)
+	}
+	if e.status == http.StatusInternalServerError && errors.Is(e, syscall.ENOSPC) {
+		full := newAPIError(http.StatusInsufficientStorage, codeInsufficientStorage, "Insufficient storage").with(e.details)
+		full.cause = e.cause
+		e = full
+	}
+	if e.cause != nil {
+		c.Error(e.cause)
+	}
+	body := gin.H{}
+	maps.Copy(body, e.details)
+	body["code"] = e.code
+	body["message"] = e.message
+	body["request_id"] = requestID(c)
+	c.AbortWithStatusJSON(e.status, gin.H{"error": body})
+}
+
+// 请求超时或客户端断开时，数据库等操作因 context 结束而失败，不是服务端的错误：
+// 超时返回 503，客户端断开返回 408，其他错误原样返回
+func contextError(c *gin.Context, e *apiError) *apiError {
+	var status int
+	var code, message string
+	switch {
+	case errors.Is(e, context.DeadlineExceeded) || errors.Is(c.Request.Context().Err(), context.DeadlineExceeded):
+		status, code, message = http.StatusServiceUnavailable, codeTimeout, "Request timed out"
+	case errors.Is(e, context.Canceled) || errors.Is(c.Request.Context().Err(), context.Canceled):
+		status, code, message = http.StatusRequestTimeout, codeCanceled, "Request was canceled"
+	default:
+		return e
+	}
+	timeout := newAPIError(status, code, message)
+	timeout.cause = e.cause
+	return timeout
+}
+
+// 为每个请求分配请求 id：沿用客户端提供的合法 X-Request-ID，否则随机生成，并在响应头中返回。
+// 请求 id 同时保存在请求的 context 中，使用 slog 的 Context 方法记录的日志都会带上它
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDContextKey{}, id))
+		c.Next()
+	}
+}
+
+// 当前请求的 id
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// 生成随机的请求 id
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 为日志添加 context 中的请求 id
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRenderErrorStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errNotFound, http.StatusNotFound, codeFileNotFound},
+		{fmt.Errorf("get file: %w", errNotFound), http.StatusNotFound, codeFileNotFound},
+		{errDuplicate, http.StatusConflict, codeFileExists},
+		{errFileExpired, http.StatusGone, codeGone},
+		{invalidRequest("bad"), http.StatusBadRequest, codeInvalidRequest},
+		{errors.New("disk on fire"), http.StatusInternalServerError, codeInternal},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		renderError(c, tt.err)
+		if w.Code != tt.status {
+			t.Errorf("renderError(%v) status = %d, want %d", tt.err, w.Code, tt.status)
+		}
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		decodeJSON(t, w, &body)
+		if body.Error.Code != tt.code {
+			t.Errorf("renderError(%v) code = %q, want %q", tt.err, body.Error.Code, tt.code)
+		}
+	}
+}
+
+func TestGetFileErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	bob := s.login("bob")
+
+	w := s.upload(alice, "a.txt", []byte("hello"), nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		File File `json:"file"`
+	}
+	decodeJSON(t, w, &resp)
+	path := "/api/v1/files/" + strconv.Itoa(resp.File.ID)
+
+	if w := s.do(http.MethodGet, path, alice, "", nil); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("download: %d %q", w.Code, w.Body)
+	}
+	if w := s.do(http.MethodGet, path, bob, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("download of another user's file: %d, want 404", w.Code)
+	}
+	if w := s.do(http.MethodGet, "/api/v1/files/999", alice, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("download of a missing file: %d, want 404", w.Code)
+	}
+	if w := s.do(http.MethodGet, "/api/v1/files/abc", alice, "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("download with an invalid id: %d, want 400", w.Code)
+	}
+}
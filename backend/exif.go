@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// 查找 EXIF 时最多读取的字节数；EXIF 通常位于文件开头
+const exifMaxBytes = 4 << 20
+
+// 内容中没有 EXIF 数据
+var errNoExif = errors.New("no exif data")
+
+// 用到的 EXIF 标签
+const (
+	exifTagMake             = 0x010f
+	exifTagModel            = 0x0110
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+	exifTagOffsetOriginal   = 0x9011
+	gpsTagLatitudeRef       = 0x0001
+	gpsTagLatitude          = 0x0002
+	gpsTagLongitudeRef      = 0x0003
+	gpsTagLongitude         = 0x0004
+)
+
+// 各 TIFF 数据类型每个值的字节数
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// 一个 TIFF 目录项的类型和原始值
+type tiffValue struct {
+	typ   uint16
+	count int
+	data  []byte
+}
+
+// 解析后的 TIFF 数据
+type tiffData struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// 从 JPEG、PNG、WebP 或 TIFF 内容中读取 EXIF，写入拍摄时间、相机型号和 GPS 坐标
+func readExif(r io.Reader, mediaType string, meta *FileMetadata) error {
+	r = io.LimitReader(r, exifMaxBytes)
+	var raw []byte
+	var err error
+	switch mediaType {
+	case "image/jpeg":
+		raw, err = jpegExif(r)
+	case "image/png":
+		raw, err = pngExif(r)
+	case "image/webp":
+		raw, err = webpExif(r)
+	case "image/tiff":
+		raw, err = io.ReadAll(r)
+	default:
+		return errNoExif
+	}
+	if err != nil {
+		return err
+	}
+	t, err := parseTIFF(raw)
+	if err != nil {
+		return err
+	}
+	ifd0, err := t.ifd(t.uint32(raw[4:8]))
+	if err != nil {
+		return err
+	}
+	meta.CameraMake = t.string(ifd0[exifTagMake])
+	meta.CameraModel = t.string(ifd0[exifTagModel])
+
+	taken, offset := t.string(ifd0[exifTagDateTime]), ""
+	if v, ok := ifd0[exifTagExifIFD]; ok {
+		if exifIFD, err := t.ifd(t.uint(v)); err == nil {
+			if s := t.string(exifIFD[exifTagDateTimeOriginal]); s != "" {
+				taken, offset = s, t.string(exifIFD[exifTagOffsetOriginal])
+			}
+		}
+	}
+	meta.TakenAt = exifTime(taken, offset)
+
+	if v, ok := ifd0[exifTagGPSIFD]; ok {
+		if gps, err := t.ifd(t.uint(v)); err == nil {
+			lat, latOK := t.coordinate(gps[gpsTagLatitude], t.string(gps[gpsTagLatitudeRef]), "S", 90)
+			lon, lonOK := t.coordinate(gps[gpsTagLongitude], t.string(gps[gpsTagLongitudeRef]), "W", 180)
+			if latOK && lonOK {
+				meta.Latitude, meta.Longitude = &lat, &lon
+			}
+		}
+	}
+	return nil
+}
+
+// 读取 JPEG 的 APP1 段中的 EXIF，遇到图像数据时停止
+func jpegExif(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:2]); err != nil || header[0] != 0xff || header[1] != 0xd8 {
+		return nil, errNoExif
+	}
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil || header[0] != 0xff {
+			return nil, errNoExif
+		}
+		marker := header[1]
+		if marker == 0xda || marker == 0xd9 {
+			return nil, errNoExif
+		}
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return nil, errNoExif
+		}
+		if marker != 0xe1 {
+			if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+				return nil, errNoExif
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoExif
+		}
+		if raw, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+			return raw, nil
+		}
+	}
+}
+
+// 读取 PNG 的 eXIf 块，遇到图像数据时停止
+func pngExif(r io.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:]) != "\x89PNG\r\n\x1a\n" {
+		return nil, errNoExif
+	}
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errNoExif
+		}
+		length, typ := int64(binary.BigEndian.Uint32(header[:4])), string(header[4:])
+		if typ == "IDAT" || typ == "IEND" {
+			return nil, errNoExif
+		}
+		if typ == "eXIf" {
+			raw := make([]byte, length)
+			_, err := io.ReadFull(r, raw)
+			return raw, err
+		}
+		if _, err := io.CopyN(io.Discard, r, length+4); err != nil {
+			return nil, errNoExif
+		}
+	}
+}
+
+// 读取 WebP 的 EXIF 块
+func webpExif(r io.Reader) ([]byte, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return nil, errNoExif
+	}
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return nil, errNoExif
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+		if string(header[:4]) == "EXIF" {
+			raw := make([]byte, size)
+			if _, err := io.ReadFull(r, raw); err != nil {
+				return nil, err
+			}
+			return bytes.TrimPrefix(raw, []byte("Exif\x00\x00")), nil
+		}
+		if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+			return nil, errNoExif
+		}
+	}
+}
+
+// 检查 TIFF 头并确定字节序
+func parseTIFF(raw []byte) (*tiffData, error) {
+	if len(raw) < 8 {
+		return nil, errNoExif
+	}
+	switch string(raw[:4]) {
+	case "II*\x00":
+		return &tiffData{raw, binary.LittleEndian}, nil
+	case "MM\x00*":
+		return &tiffData{raw, binary.BigEndian}, nil
+	}
+	return nil, errNoExif
+}
+
+func (t *tiffData) uint32(b []byte) uint32 { return t.order.Uint32(b) }
+
+// 读取 offset 处的目录；值超出数据范围的项被忽略
+func (t *tiffData) ifd(offset uint32) (map[uint16]tiffValue, error) {
+	if int64(offset)+2 > int64(len(t.data)) {
+		return nil, errNoExif
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	entries := make(map[uint16]tiffValue, n)
+	for i := range n {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(t.data) {
+			break
+		}
+		entry := t.data[start : start+12]
+		tag, typ, count := t.order.Uint16(entry), t.order.Uint16(entry[2:]), int(t.order.Uint32(entry[4:]))
+		size, ok := tiffTypeSizes[typ]
+		if !ok || count <= 0 || count > len(t.data) {
+			continue
+		}
+		value := entry[8:12]
+		if length := size * count; length > 4 {
+			valueOffset := int(t.order.Uint32(entry[8:]))
+			if valueOffset < 0 || valueOffset+length > len(t.data) {
+				continue
+			}
+			value = t.data[valueOffset : valueOffset+length]
+		} else {
+			value = value[:length]
+		}
+		entries[tag] = tiffValue{typ: typ, count: count, data: value}
+	}
+	return entries, nil
+}
+
+// ASCII 值，去掉结尾的 NUL 和空白；值不存在或不是 ASCII 时为空
+func (t *tiffData) string(v tiffValue) string {
+	if v.typ != 2 {
+		return ""
+	}
+	s, _, _ := strings.Cut(string(v.data), "\x00")
+	return strings.TrimSpace(s)
+}
+
+// SHORT 或 LONG 值
+func (t *tiffData) uint(v tiffValue) uint32 {
+	switch v.typ {
+	case 3:
+		return uint32(t.order.Uint16(v.data))
+	case 4:
+		return t.order.Uint32(v.data)
+	}
+	return math.MaxUint32
+}
+
+// 由度、分、秒三个 RATIONAL 组成的坐标，ref 为 negative 时取负值；不是合法坐标时返回 false
+func (t *tiffData) coordinate(v tiffValue, ref, negative string, limit float64) (float64, bool) {
+	if v.typ != 5 || v.count != 3 || ref == "" {
+		return 0, false
+	}
+	value := 0.0
+	for i, unit := range []float64{1, 60, 3600} {
+		num, den := t.order.Uint32(v.data[i*8:]), t.order.Uint32(v.data[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		value += float64(num) / float64(den) / unit
+	}
+	if strings.EqualFold(ref, negative) {
+		value = -value
+	}
+	return value, value >= -limit && value <= limit
+}
+
+// 解析 EXIF 的时间，如 2024:05:01 12:30:00。offset 为 OffsetTimeOriginal（如 +08:00），
+// 没有时区时按 UTC 处理；无法解析时返回 nil
+func exifTime(s, offset string) *time.Time {
+	if s == "" {
+		return nil
+	}
+	loc := time.UTC
+	if offset != "" {
+		if t, err := time.Parse("-07:00", offset); err == nil {
+			_, seconds := t.Zone()
+			loc = time.FixedZone("", seconds)
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, loc)
+	if err != nil || t.Year() < 1900 {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
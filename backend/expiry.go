@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// 清理过期文件的间隔及每次从数据库读取的文件数
+const (
+	expiryPurgeInterval = 5 * time.Minute
+	expiryPurgeBatch    = 100
+)
+
+// expires_in 的上限（秒），约 10 年
+const maxExpiresIn = 10 * 365 * 24 * 60 * 60
+
+// 根据 expires_in（秒）或 expires_at 计算文件的过期时间，都未指定时返回 nil；
+// 同时指定、不是正数或不在 now 之后时返回错误
+func expiryTime(expiresIn *int64, expiresAt *time.Time, now time.Time) (*time.Time, error) {
+	switch {
+	case expiresIn != nil && expiresAt != nil:
+		return nil, errors.New("Use either expires_in or expires_at, not both")
+	case expiresIn != nil:
+		if *expiresIn <= 0 || *expiresIn > maxExpiresIn {
+			return nil, errors.New("Invalid expires_in, must be between 1 and " + strconv.Itoa(maxExpiresIn) + " seconds")
+		}
+		t := now.Add(time.Duration(*expiresIn) * time.Second)
+		return &t, nil
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return nil, errors.New("Invalid expires_at, must be in the future")
+		}
+		t := expiresAt.UTC()
+		return &t, nil
+	}
+	return nil, nil
+}
+
+// 读取表单中的 expires_in 和 expires_at 并计算过期时间
+func formExpiryTime(expiresIn, expiresAt string, now time.Time) (*time.Time, error) {
+	var in *int64
+	var at *time.Time
+	if expiresIn != "" {
+		n, err := strconv.ParseInt(expiresIn, 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid expires_in, must be a number of seconds")
+		}
+		in = &n
+	}
+	if expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, errors.New("Invalid expires_at, must be an RFC 3339 time")
+		}
+		at = &t
+	}
+	return expiryTime(in, at, now)
+}
+
+// 文件在 now 时是否已过期
+func (f File) expired(now time.Time) bool {
+	return f.ExpiresAt != nil && !f.ExpiresAt.After(now)
+}
+
+// 剩余的有效时间（秒），向上取整，已过期时为 0
+func remainingSeconds(expiresAt, now time.Time) int64 {
+	d := expiresAt.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// 定期彻底删除已过期的文件，直到 ctx 被取消
+func purgeExpiredFiles(ctx context.Context, db *sql.DB, store Storage) {
+	ticker := time.NewTicker(expiryPurgeInterval)
+	defer ticker.Stop()
+	for {
+		n, err := deleteExpiredFiles(ctx, db, store, time.Now().UTC())
+		if err != nil {
+			slog.Error("Failed to purge expired files", "error", err)
+		} else if n > 0 {
+			slog.Info("Purged expired files", "files", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 彻底删除 now 时已过期的文件，返回删除的文件数。每个文件在单独的事务中删除，
+// 内容只在没有其他文件或版本引用时从存储后端删除
+func deleteExpiredFiles(ctx context.Context, db *sql.DB, store Storage, now time.Time) (int, error) {
+	repo := newFileRepository(db)
+	deleted := 0
+	for {
+		ids, err := repo.ListExpired(ctx, now, expiryPurgeBatch)
+		if err != nil || len(ids) == 0 {
+			return deleted, err
+		}
+		for _, id := range ids {
+			file, unused, err := repo.DeleteExpired(ctx, id, now)
+			// 期间被其他请求删除或取消过期
+			if errors.Is(err, errNotFound) {
+				continue
+			}
+			if err != nil {
+				return deleted, err
+			}
+			deleteUnusedContent(db, store, unused)
+			slog.Info("Expired file purged", "file_id", file.ID, "owner_id", file.OwnerID, "name", file.Name)
+			deleted++
+		}
+		if len(ids) < expiryPurgeBatch {
+			return deleted, nil
+		}
+	}
+}
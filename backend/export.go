@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 导出的目录结构
+const (
+	exportLayoutNames = "names" // 按用户名和文件夹路径保存为原文件名
+	exportLayoutHash  = "hash"  // 按内容的键保存在同一目录下，相同内容只保存一次
+)
+
+// 导出时每次从数据库读取的文件数
+const exportBatchSize = 100
+
+// 导出目录中的清单文件名
+const exportManifestName = "manifest.json"
+
+// 导出的筛选条件
+type exportOptions struct {
+	Layout string
+	Since  *time.Time // 只导出该时间之后上传或更新的文件
+	Owner  string     // 只导出该用户的文件，为空时导出所有用户的文件
+}
+
+// 清单中的一个文件
+type exportEntry struct {
+	ID        int       `json:"id"`
+	Owner     string    `json:"owner"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path"` // 文件在网盘中的完整路径
+	File      string    `json:"file"` // 导出的文件相对于导出目录的路径
+	Hash      string    `json:"hash"`
+	HashAlgo  string    `json:"hash_algo"`
+	Size      int64     `json:"size"`
+	Mime      string    `json:"mime"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 清单中导出失败的文件
+type exportFailure struct {
+	ID    int    `json:"id"`
+	Owner string `json:"owner"`
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// 导出目录中的清单
+type exportManifest struct {
+	ExportedAt time.Time       `json:"exported_at"`
+	Layout     string          `json:"layout"`
+	Files      []exportEntry   `json:"files"`
+	Failures   []exportFailure `json:"failures"`
+}
+
+// 将未删除文件的当前版本导出到 dir，逐个流式写入并按文件的哈希校验，最后写入 manifest.json，返回清单。
+// dir 需不存在或为空；文件先写入临时文件，校验通过后才改为最终的名称，失败的文件记入清单的 failures 并继续。
+// 重名的文件（包括只有大小写不同的）在扩展名前加上序号区分
+func exportFiles(ctx context.Context, db *sql.DB, store Storage, dir string, options exportOptions) (exportManifest, error) {
+	manifest := exportManifest{ExportedAt: time.Now().UTC(), Layout: options.Layout, Files: []exportEntry{}, Failures: []exportFailure{}}
+	var ownerID *int
+	if options.Owner != "" {
+		user, err := getUserByName(ctx, db, options.Owner)
+		if err == sql.ErrNoRows {
+			return manifest, fmt.Errorf("user %q not found", options.Owner)
+		}
+		if err != nil {
+			return manifest, err
+		}
+		ownerID = &user.ID
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return manifest, err
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		return manifest, err
+	} else if len(entries) > 0 {
+		return manifest, fmt.Errorf("%s is not empty", dir)
+	}
+
+	usernames := map[int]string{}
+	used := map[string]bool{}     // 已使用的路径，按小写比较
+	exported := map[string]bool{} // hash 布局下已导出的内容
+	after := 0
+	for {
+		files, err := nextExportFiles(ctx, db, after, options.Since, ownerID)
+		if err != nil {
+			return manifest, err
+		}
+		if len(files) == 0 {
+			break
+		}
+		for _, file := range files {
+			after = file.ID
+			owner, ok := usernames[file.OwnerID]
+			if !ok {
+				if err := db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = ?`, file.OwnerID).Scan(&owner); err != nil {
+					return manifest, err
+				}
+				usernames[file.OwnerID] = owner
+			}
+			fullPath, err := filePath(ctx, db, file)
+			if err != nil {
+				return manifest, err
+			}
+			entry := exportEntry{
+				ID: file.ID, Owner: owner, Name: file.Name, Path: fullPath, Hash: file.Hash, HashAlgo: file.HashAlgo,
+				Size: file.Size, Mime: file.Mime, CreatedAt: file.CreatedAt, UpdatedAt: file.UpdatedAt,
+			}
+
+			if options.Layout == exportLayoutHash {
+				entry.File = strings.ReplaceAll(file.blobKey(), ":", "-")
+				if !exported[entry.File] {
+					err = exportContent(ctx, store, file, filepath.Join(dir, entry.File))
+					exported[entry.File] = err == nil
+				}
+			} else {
+				entry.File = uniqueExportPath(used, exportRelativePath(owner, fullPath))
+				err = exportContent(ctx, store, file, filepath.Join(dir, filepath.FromSlash(entry.File)))
+			}
+			if err != nil {
+				manifest.Failures = append(manifest.Failures, exportFailure{ID: file.ID, Owner: owner, Path: fullPath, Error: err.Error()})
+				continue
+			}
+			manifest.Files = append(manifest.Files, entry)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, os.WriteFile(filepath.Join(dir, exportManifestName), append(data, '\n'), 0o644)
+}
+
+// 按 id 的顺序读取 after 之后的一批未删除的文件
+func nextExportFiles(ctx context.Context, db *sql.DB, after int, since *time.Time, ownerID *int) ([]File, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id > ? AND deleted_at IS NULL AND (? IS NULL OR updated_at >= ?) AND (? IS NULL OR owner_id = ?) ORDER BY id LIMIT ?`
+	rows, err := db.QueryContext(ctx, query, after, since, since, ownerID, ownerID, exportBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// 导出文件在导出目录中的相对路径：用户名加上文件在网盘中的路径，每一段都替换为可以安全使用的名称
+func exportRelativePath(owner, fullPath string) string {
+	segments := []string{safePathSegment(owner)}
+	for _, segment := range strings.Split(strings.TrimPrefix(fullPath, "/"), "/") {
+		segments = append(segments, safePathSegment(segment))
+	}
+	return path.Join(segments...)
+}
+
+// 替换文件名中的路径分隔符，以及 . 和 .. 等不能作为文件名的名称
+func safePathSegment(name string) string {
+	name = strings.NewReplacer("/", "_", `\`, "_", "\x00", "_").Replace(name)
+	if strings.Trim(name, ".") == "" {
+		return strings.Repeat("_", max(len(name), 1))
+	}
+	return name
+}
+
+// 路径已被使用时在扩展名前加上序号，如 report (2).pdf，并记录为已使用。
+// 按小写比较，避免在不区分大小写的文件系统上相互覆盖；文件夹与文件重名时同样加上序号
+func uniqueExportPath(used map[string]bool, p string) string {
+	dir, base := path.Split(p)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	candidate := p
+	for n := 2; used[strings.ToLower(candidate)]; n++ {
+		candidate = dir + stem + " (" + strconv.Itoa(n) + ")" + ext
+	}
+	used[strings.ToLower(candidate)] = true
+	// 上级路径被文件占用时无法创建文件夹，记录上级路径以便之后的文件避开
+	for d := path.Dir(candidate); d != "." && d != "/"; d = path.Dir(d) {
+		used[strings.ToLower(d)] = true
+	}
+	return candidate
+}
+
+// 将文件内容流式写入 dst 并按文件的哈希算法校验，内容不一致时删除写入的文件
+func exportContent(ctx context.Context, store Storage, file File, dst string) error {
+	content, _, err := openFileContent(ctx, store, file)
+	if errors.Is(err, errBlobNotFound) {
+		return errors.New("content is missing from storage")
+	}
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash, size, err := copyAndHash(tmp, content, file.HashAlgo)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if hash != file.Hash {
+		return fmt.Errorf("%s mismatch, stored %s but exported content is %s", file.HashAlgo, file.Hash, hash)
+	}
+	if size != file.Size {
+		return fmt.Errorf("size mismatch, stored %d bytes but exported %d bytes", file.Size, size)
+	}
+	if err := os.Chtimes(tmp.Name(), file.UpdatedAt, file.UpdatedAt); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// 输出导出失败的文件
+func printExportFailures(w io.Writer, failures []exportFailure) {
+	for _, f := range failures {
+		fmt.Fprintf(w, "failed   %s%s (file %d): %s\n", f.Owner, f.Path, f.ID, f.Error)
+	}
+}
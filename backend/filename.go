@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// 文件名的最大字符数；字节数的限制见 maxFileNameLength
+const maxFileNameRunes = 255
+
+// 截断过长的文件名时保留的扩展名的最大字节数，更长的扩展名与文件名一起截断
+const maxFileNameExtLength = 16
+
+// 上传的文件名清理后为空时使用的名称
+const defaultFileName = "unnamed"
+
+// Windows 保留的设备名，不区分大小写，带扩展名（如 nul.txt）同样不能使用
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// 清理客户端提供的文件名，返回实际保存和返回的名称，结果不会为空（没有可用的字符时为 defaultFileName）。
+// 所有保存文件名和文件夹名的地方都应经过清理，避免名称在导出、打包或写入文件系统时造成路径穿越
+func sanitizeFileName(name string) string {
+	if s := stripFileName(name); s != "" {
+		return s
+	}
+	return defaultFileName
+}
+
+// 清理客户端指定的名称（如重命名、新建文件夹），名称为空或清理后没有可用的字符时返回错误
+func cleanFileName(name string) (string, error) {
+	s := stripFileName(name)
+	if s == "" {
+		return "", errors.New("File name must not be empty or consist only of dots")
+	}
+	return s, nil
+}
+
+// 校验按路径访问的名称（如 /files/by-name 和 WebDAV），这些名称需要与路径一致，不能被清理为其他名称
+func checkFileName(name string) error {
+	s, err := cleanFileName(name)
+	if err != nil {
+		return err
+	}
+	if s != name {
+		return errors.New("File name contains path separators, control characters or other characters that are not allowed")
+	}
+	return nil
+}
+
+// 清理文件名，没有可用的字符时返回空字符串：
+//   - 统一为 NFC，/ 和 \ 都作为路径分隔符，只保留最后一级，. 和 .. 被去掉
+//   - 控制字符（包括 NUL）、双向文本控制字符、无效的 UTF-8 以及兼容规范化后为 / 或 \ 的相似字符（如全角斜杠）替换为 _
+//   - 去掉开头的空白和结尾的空白与 .，兼容规范化后只剩 . 的名称（如全角的 ．．）视为没有可用的字符
+//   - Windows 保留的设备名前加上 _
+//   - 超过 maxFileNameLength 字节或 maxFileNameRunes 个字符时截断，尽量保留扩展名
+func stripFileName(name string) string {
+	name = norm.NFC.String(strings.ToValidUTF8(name, "\uFFFD"))
+	name = path.Base(path.Clean("/" + strings.ReplaceAll(name, `\`, "/")))
+	if name == "/" || name == "." {
+		return ""
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || isBidiControl(r) || r == utf8.RuneError || isSeparatorLookalike(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = trimFileName(name)
+	if strings.Trim(norm.NFKC.String(name), ". ") == "" {
+		return ""
+	}
+
+	stem, _, _ := strings.Cut(name, ".")
+	if windowsReservedNames[strings.ToUpper(strings.TrimSpace(stem))] {
+		name = "_" + name
+	}
+	if len(name) > maxFileNameLength || utf8.RuneCountInString(name) > maxFileNameRunes {
+		ext := path.Ext(name)
+		if len(ext) > maxFileNameExtLength || ext == name {
+			ext = ""
+		}
+		stem := strings.TrimSuffix(name, ext)
+		stem = truncateUTF8(stem, maxFileNameLength-len(ext))
+		stem = truncateRunes(stem, maxFileNameRunes-utf8.RuneCountInString(ext))
+		name = trimFileName(stem + ext)
+	}
+	return name
+}
+
+// 去掉开头的空白和结尾的空白与 .，Windows 会忽略结尾的 . 和空格
+func trimFileName(name string) string {
+	name = strings.TrimLeftFunc(name, unicode.IsSpace)
+	return strings.TrimRightFunc(name, func(r rune) bool { return r == '.' || unicode.IsSpace(r) })
+}
+
+// 改变文字显示方向的控制字符，可以用来伪装扩展名，如 "invoice\u202efdp.exe"
+func isBidiControl(r rune) bool {
+	return r == '\u200e' || r == '\u200f' || r == '\u061c' || (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// 兼容规范化后包含 / 或 \ 的字符，如全角斜杠 ／ 和 ＼；除号斜杠 ∕ 等不会被规范化的字符单独列出
+func isSeparatorLookalike(r rune) bool {
+	if r < utf8.RuneSelf {
+		return false
+	}
+	switch r {
+	case '⁄', '∕', '∖', '⧵', '⧸', '⧹', '﹨':
+		return true
+	}
+	return strings.ContainsAny(norm.NFKC.String(string(r)), `/\`)
+}
+
+// 截断为最多 n 个字符
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
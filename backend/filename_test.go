@@ -0,0 +1,247 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"cjk", "报告.pdf", "报告.pdf"},
+		{"inner spaces and dots", "my file.v2.txt", "my file.v2.txt"},
+
+		// 路径穿越
+		{"parent directories", "../../etc/cron.d/evil", "evil"},
+		{"absolute path", "/etc/passwd", "passwd"},
+		{"windows path", `..\..\windows\system32\evil.dll`, "evil.dll"},
+		{"mixed separators", `a/..\b/c.txt`, "c.txt"},
+		{"trailing separator", "docs/", "docs"},
+		{"only parent", "..", defaultFileName},
+		{"only dot", ".", defaultFileName},
+		{"only separators", `/\/`, defaultFileName},
+		{"parent with separator", "../", defaultFileName},
+
+		// 控制字符和无效的 UTF-8
+		{"nul", "evil\x00.txt", "evil_.txt"},
+		{"newline", "a\r\nb.txt", "a__b.txt"},
+		{"tab", "a\tb.txt", "a_b.txt"},
+		{"delete", "a\x7fb.txt", "a_b.txt"},
+		{"invalid utf-8", "a\xffb.txt", "a_b.txt"},
+		{"right-to-left override", "invoice\u202efdp.exe", "invoice_fdp.exe"},
+		{"left-to-right mark", "a\u200eb.txt", "a_b.txt"},
+
+		// Unicode 中的相似字符
+		{"fullwidth slash", "..／..／evil.txt", ".._.._evil.txt"},
+		{"fullwidth backslash", "a＼b.txt", "a_b.txt"},
+		{"division slash", "a∕b.txt", "a_b.txt"},
+		{"fraction slash", "a⁄b.txt", "a_b.txt"},
+		{"set minus", "a∖b.txt", "a_b.txt"},
+		{"fullwidth dots", "．．", defaultFileName},
+		{"one dot leader", "․․", defaultFileName},
+		{"decomposed accent", "e\u0301.txt", "é.txt"},
+
+		// 开头和结尾的空白与 .
+		{"trailing dots", "file.txt...", "file.txt"},
+		{"trailing spaces", "file.txt   ", "file.txt"},
+		{"trailing dots and spaces", "file. . .", "file"},
+		{"leading spaces", "  file.txt", "file.txt"},
+		{"leading dot kept", ".env", ".env"},
+		{"only dots", "...", defaultFileName},
+		{"only spaces", "   ", defaultFileName},
+		{"ideographic space", "file.txt\u3000", "file.txt"},
+		{"empty", "", defaultFileName},
+
+		// Windows 保留的设备名
+		{"reserved", "CON", "_CON"},
+		{"reserved lowercase", "nul.txt", "_nul.txt"},
+		{"reserved with two extensions", "Com1.tar.gz", "_Com1.tar.gz"},
+		{"reserved with trailing space", "aux .txt", "_aux .txt"},
+		{"reserved prefix only", "CONSOLE.txt", "CONSOLE.txt"},
+		{"reserved after directory", "../lpt9", "_lpt9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFileName(tt.file)
+			if got != tt.want {
+				t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.file, got, tt.want)
+			}
+			if strings.ContainsAny(got, `/\`) || got == "." || got == ".." {
+				t.Errorf("sanitizeFileName(%q) = %q is not a single path element", tt.file, got)
+			}
+			// 清理的结果再次清理时不变
+			if again := sanitizeFileName(got); again != got {
+				t.Errorf("sanitizeFileName(%q) = %q, want it unchanged", got, again)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileNameLength(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"bytes", strings.Repeat("a", 300) + ".txt", strings.Repeat("a", maxFileNameLength-len(".txt")) + ".txt"},
+		{"runes", strings.Repeat("长", 300) + ".txt", strings.Repeat("长", (maxFileNameLength-len(".txt"))/len("长")) + ".txt"},
+		{"long extension", "a." + strings.Repeat("b", 300), "a." + strings.Repeat("b", maxFileNameLength-len("a."))},
+		{"trailing space after truncation", strings.Repeat("a", maxFileNameLength-1) + " " + strings.Repeat("b", 10), strings.Repeat("a", maxFileNameLength-1)},
+		{"at the limit", strings.Repeat("a", maxFileNameLength), strings.Repeat("a", maxFileNameLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFileName(tt.file)
+			if got != tt.want {
+				t.Errorf("sanitizeFileName() = %q (%d bytes), want %q (%d bytes)", got, len(got), tt.want, len(tt.want))
+			}
+			if len(got) > maxFileNameLength || utf8.RuneCountInString(got) > maxFileNameRunes || !utf8.ValidString(got) {
+				t.Errorf("sanitizeFileName() = %d bytes, %d runes", len(got), utf8.RuneCountInString(got))
+			}
+		})
+	}
+}
+
+func TestCleanFileName(t *testing.T) {
+	tests := []struct {
+		file string
+		want string // 为空时应返回错误
+	}{
+		{"notes.txt", "notes.txt"},
+		{"../notes.txt", "notes.txt"},
+		{"a\x00b", "a_b"},
+		{"prn", "_prn"},
+		{"", ""},
+		{"..", ""},
+		{"...", ""},
+		{"  ", ""},
+		{"．．", ""},
+		{"../", ""},
+	}
+	for _, tt := range tests {
+		got, err := cleanFileName(tt.file)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("cleanFileName(%q) = %q, want an error", tt.file, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("cleanFileName(%q) = %q, %v, want %q", tt.file, got, err, tt.want)
+		}
+	}
+}
+
+// 按路径访问的名称不能被清理为其他名称
+func TestCheckFileName(t *testing.T) {
+	tests := []struct {
+		file string
+		ok   bool
+	}{
+		{"notes.txt", true},
+		{"报告 2024.pdf", true},
+		{".env", true},
+		{"a/b.txt", false},
+		{`a\b.txt`, false},
+		{"..", false},
+		{"a.txt.", false},
+		{"a.txt ", false},
+		{"nul", false},
+		{"a\x00b", false},
+		{"a／b", false},
+		{"e\u0301.txt", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := checkFileName(tt.file); (err == nil) != tt.ok {
+			t.Errorf("checkFileName(%q) = %v, want ok %v", tt.file, err, tt.ok)
+		}
+	}
+}
+
+// 上传时保存和返回的都是清理后的名称
+func TestUploadSanitizesFileName(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"../../etc/cron.d/evil", "evil"},
+		{`..\..\evil.dll`, "evil.dll"},
+		{"invoice\u202efdp.exe", "invoice_fdp.exe"},
+		{"a／b.txt", "a_b.txt"},
+		{"report.txt. . ", "report.txt"},
+		{"CON.txt", "_CON.txt"},
+		{"..", defaultFileName},
+	}
+	for _, tt := range tests {
+		w := s.upload(alice, tt.file, []byte("content of "+tt.file), nil)
+		if w.Code != http.StatusCreated {
+			t.Errorf("upload %q: %d %s", tt.file, w.Code, w.Body)
+			continue
+		}
+		var resp struct {
+			File File `json:"file"`
+		}
+		decodeJSON(t, w, &resp)
+		if resp.File.Name != tt.want {
+			t.Errorf("upload %q: returned name %q, want %q", tt.file, resp.File.Name, tt.want)
+		}
+		var stored File
+		decodeJSON(t, s.do(http.MethodGet, "/api/v1/files/"+strconv.Itoa(resp.File.ID)+"/info", alice, "", nil), &stored)
+		if stored.Name != tt.want {
+			t.Errorf("upload %q: stored name %q, want %q", tt.file, stored.Name, tt.want)
+		}
+	}
+}
+
+// 重命名时保存和返回的都是清理后的名称，清理后为空的名称被拒绝且不修改原名称
+func TestRenameSanitizesFileName(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	file := uploadTestFile(t, s, alice, "a.txt", "hello")
+	path := "/api/v1/files/" + strconv.Itoa(file.ID)
+	tests := []struct {
+		name   string
+		status int
+		want   string // 重命名后保存的名称
+	}{
+		{"../../etc/passwd", http.StatusOK, "passwd"},
+		{`C:\Windows\evil.bat`, http.StatusOK, "evil.bat"},
+		{"x\u202egpj.exe", http.StatusOK, "x_gpj.exe"},
+		{"a∕b.txt", http.StatusOK, "a_b.txt"},
+		{"notes.txt...", http.StatusOK, "notes.txt"},
+		{"aux", http.StatusOK, "_aux"},
+		{"../..", http.StatusBadRequest, "_aux"},
+		{" . . ", http.StatusBadRequest, "_aux"},
+		{"．．", http.StatusBadRequest, "_aux"},
+	}
+	for _, tt := range tests {
+		body := strings.NewReader(`{"name":` + strconv.Quote(tt.name) + `}`)
+		w := s.do(http.MethodPatch, path, alice, "application/json", body)
+		if w.Code != tt.status {
+			t.Errorf("rename to %q: %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if w.Code == http.StatusOK {
+			var got File
+			decodeJSON(t, w, &got)
+			if got.Name != tt.want {
+				t.Errorf("rename to %q: returned name %q, want %q", tt.name, got.Name, tt.want)
+			}
+		}
+		var stored File
+		decodeJSON(t, s.do(http.MethodGet, path+"/info", alice, "", nil), &stored)
+		if stored.Name != tt.want {
+			t.Errorf("rename to %q: stored name %q, want %q", tt.name, stored.Name, tt.want)
+		}
+	}
+}
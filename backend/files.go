@@ -0,0 +1,1534 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文件名的最大长度（字节）
+const maxFileNameLength = 255
+
+// 上传大小的默认限制，以及解析表单时保存在内存中的最大字节数
+const (
+	defaultMaxUploadSize = 100 << 20
+	maxMultipartMemory   = 8 << 20
+)
+
+// 文件列表分页的默认和最大条数
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 1000
+)
+
+// 最近文件接口的默认和最大返回数量及时间范围
+const (
+	defaultRecentLimit  = 20
+	maxRecentLimit      = 100
+	defaultRecentWindow = "7d"
+	maxRecentWindow     = 365 * 24 * time.Hour
+)
+
+// 最近文件的类型：最近上传或最近下载
+const (
+	recentUploaded   = "uploaded"
+	recentDownloaded = "downloaded"
+)
+
+// 上传时同名文件的处理方式：默认新建文件，replace 时替换同名文件的内容
+const (
+	uploadModeCreate  = "create"
+	uploadModeReplace = "replace"
+)
+
+// 上传时目标文件夹下已有同名文件的处理方式（on_conflict）：create 新建同名文件，reject 时返回 409 和已有文件的信息，
+// return 时已有文件的内容相同则不保存、直接返回已有文件，内容不同时与 reject 相同；
+// rename 时改用 name (1).ext 形式的未被占用的名称，由 on_name_conflict=rename 设置
+const (
+	uploadConflictCreate = "create"
+	uploadConflictReject = "reject"
+	uploadConflictReturn = "return"
+	uploadConflictRename = "rename"
+)
+
+// 上传时同名文件的处理策略（on_name_conflict）：默认 error，即 on_conflict=reject；
+// rename 自动重命名，replace 即 mode=replace
+const (
+	nameConflictError   = "error"
+	nameConflictRename  = "rename"
+	nameConflictReplace = "replace"
+)
+
+// 自动重命名时尝试的最大序号
+const maxRenameSuffix = 1000
+
+// 重复文件报告的分组方式：按文件名（忽略大小写和首尾空格）或按内容
+const (
+	duplicatesByName    = "name"
+	duplicatesByContent = "content"
+)
+
+// 文件列表可以排序的字段，按在错误信息中列出的顺序排列
+var fileSortKeys = []string{"name", "size", "created_at", "downloads", "taken_at"}
+
+// 排序字段对应的 SQL 表达式，只使用其中的表达式拼接 ORDER BY
+var fileSortColumns = map[string]string{
+	"name":       "name COLLATE NOCASE",
+	"size":       "size",
+	"created_at": "created_at",
+	"downloads":  "download_count",
+	"taken_at":   "COALESCE(" + takenAtSQL + ", created_at)", // 没有拍摄时间的文件按上传时间排列
+}
+
+// 客户端声明上传内容 sha256 哈希的请求头，服务端据此校验收到的内容
+const contentSHA256Header = "X-Content-SHA256"
+
+// 文件受保护，不能删除或覆盖
+var errFileProtected = errors.New("file is protected")
+
+// File 数据结构
+type File struct {
+	ID               int           `json:"id"`
+	Hash             string        `json:"hash"`
+	HashAlgo         string        `json:"hash_algo"` // 计算 hash 使用的算法
+	Name             string        `json:"name"`
+	Size             int64         `json:"size"`
+	Mime             string        `json:"mime"`
+	CreatedAt        time.Time     `json:"created_at"`
+	OwnerID          int           `json:"owner_id"`
+	FolderID         *int          `json:"folder_id"`
+	DeletedAt        *time.Time    `json:"deleted_at,omitempty"` // 移入回收站的时间
+	Version          int           `json:"version"`              // 当前版本号，从 1 开始
+	UpdatedAt        time.Time     `json:"updated_at"`           // 当前版本的上传时间
+	Protected        bool          `json:"protected"`            // 受保护的文件在取消保护前不能删除
+	Starred          bool          `json:"starred"`              // 加星标的文件可以通过 /files/starred 快速找到
+	Visibility       string        `json:"visibility"`           // private 或 public，公开文件无需登录即可通过 /public/:hash 下载
+	Downloads        int           `json:"downloads"`            // 下载次数，包括通过分享链接和公开链接的下载，计数规则见 recordDownload
+	LastDownloadedAt *time.Time    `json:"last_downloaded_at"`   // 最近一次计入下载次数的时间
+	Tags             []string      `json:"tags"`                 // 按名称排序
+	ExpiresAt        *time.Time    `json:"expires_at,omitempty"` // 过期时间，过期后不再列出并被自动清理
+	ExpiresIn        *int64        `json:"expires_in,omitempty"` // 距离过期的秒数
+	TakenAt          *time.Time    `json:"taken_at,omitempty"`   // 从内容中提取的拍摄时间，见 FileMetadata
+	Metadata         *FileMetadata `json:"metadata,omitempty"`   // 从内容中提取的元数据，只在 /files/:id/info 中返回
+	ScanStatus       string        `json:"scan_status"`          // 当前内容的病毒扫描状态：pending、clean 或 infected，infected 的文件不能下载
+
+	replacedHash   string // 上传时替换了同名文件的内容时为原内容的哈希，不返回给客户端
+	existing       bool   // 上传时 on_conflict=return 且已有内容相同的同名文件，没有保存新文件
+	autoRename     bool   // 保存新文件时目标文件夹下已有同名文件则改用未被占用的名称
+	rejectConflict bool   // 保存新文件时目标文件夹下已有同名文件则返回该文件和 errNameConflict，在保存的事务中检查
+}
+
+// 查询文件信息时选取的字段，与 scanFile 的顺序一致
+const fileColumns = "id, hash, name, size, mime, created_at, owner_id, folder_id, deleted_at, version, updated_at, protected, hash_algo, starred, download_count, expires_at, visibility, last_downloaded_at, " + fileTagsColumn + ", " + takenAtSQL + ", " + scanStatusSQL
+
+// DuplicateGroup 重复文件报告中的一组文件，按上传时间排列
+type DuplicateGroup struct {
+	Key       string `json:"key"`        // 按名称分组时为规范化的文件名，按内容分组时为 算法:哈希
+	Count     int    `json:"count"`      // 组内的文件数
+	TotalSize int64  `json:"total_size"` // 组内文件的大小之和
+	Files     []File `json:"files"`
+}
+
+// SiblingFile 与某个文件内容相同的其他文件，Owner 为所有者的用户名，只在管理员查看时返回
+type SiblingFile struct {
+	File
+	Owner string `json:"owner,omitempty"`
+}
+
+// 文件列表的查询条件
+type listOptions struct {
+	OwnerID    int        // 只列出该用户的文件
+	FolderID   *int       // 只列出该文件夹下的文件，0 表示根目录，为空时不过滤
+	Query      string     // 按文件名模糊搜索，为空时不过滤
+	Tags       []string   // 只列出同时带有所有这些标签的文件，为空时不过滤
+	Starred    bool       // 为 true 时只列出加星标的文件
+	Type       string     // 只列出该类型（见 fileTypeGroups）的文件，为空时不过滤
+	MediaType  string     // 只列出该 MIME 类型的文件，不比较 charset 等参数，为空时不过滤
+	Since      *time.Time // 只列出在该时间及之后上传的文件，为空时不过滤
+	Until      *time.Time // 只列出在该时间之前上传的文件，为空时不过滤
+	TakenSince *time.Time // 只列出在该时间及之后拍摄的文件，没有拍摄时间的文件不列出，为空时不过滤
+	TakenUntil *time.Time // 只列出在该时间之前拍摄的文件，没有拍摄时间的文件不列出，为空时不过滤
+	Sort       string     // fileSortColumns 中的排序字段，为空时使用默认顺序
+	Desc       bool       // 按 Sort 倒序排列
+	Trashed    bool       // 为 true 时只列出回收站中的文件，按移入时间倒序
+	Limit      int
+	Offset     int
+	After      *fileCursor // 使用游标分页时从该游标之后开始，不使用 Offset，也不统计总数
+}
+
+// 注册文件上传、列表、下载、删除和重命名接口；maxUploadSize 限制单次上传的大小，
+// maxVersions 限制每个文件保留的版本数，新上传的内容使用 hashAlgo 计算哈希，较大的内容暂存在 spoolDir 中
+func registerFileRoutes(r gin.IRouter, db *sql.DB, store Storage, maxUploadSize int64, maxVersions int, hashAlgo, spoolDir string) {
+	repo := newFileRepository(db)
+
+	// 上传文件接口，支持在一个请求中上传多个文件；new_version=true 时同名文件作为新版本上传，
+	// mode=replace 时直接替换同名文件的内容，响应中 replaced 为 true 并返回原内容的 previous_hash。
+	// 可以通过 X-Content-SHA256 请求头（仅限单个文件）或按文件顺序的 sha256 表单字段声明内容的哈希，
+	// 与收到的内容不一致时不保存。expires_in（秒）或 expires_at 设置文件的过期时间，visibility 设置新文件的可见性。
+	// 目标文件夹下已有同名文件时，on_name_conflict 为 error（默认，返回 409）、rename 或 replace，
+	// 也可以用 on_conflict 设置，见 uploadConflictCreate；两者都未设置且不是 new_version 或 mode=replace 时按 error 处理，
+	// 需要保留多个同名文件时使用 on_conflict=create。上传单个文件新建了文件时返回 201，
+	// Location 为文件的地址，响应的 file 为完整的文件信息
+	r.POST("/upload", limitBodySize(maxUploadSize), func(c *gin.Context) {
+		defer trackUpload()()
+		detachDeadline(c)
+		// 流式读取表单，文件在读取的同时计算哈希，超过内存限制的部分暂存到 spoolDir
+		mr, err := c.Request.MultipartReader()
+		if err != nil {
+			renderError(c, invalidRequest("No file is uploaded"))
+			return
+		}
+		form, err := readUploadForm(mr, spoolDir, hashAlgo, spoolMemoryLimit)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			uploadTooLarge(c, maxUploadSize)
+			return
+		}
+		if errors.Is(err, errFormTooLarge) {
+			renderError(c, invalidRequest("Form fields exceed "+strconv.Itoa(maxFormValuesSize)+" bytes"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to receive upload", err))
+			return
+		}
+		defer form.Close()
+		if len(form.files) == 0 {
+			renderError(c, invalidRequest("No file is uploaded"))
+			return
+		}
+		parts := form.files
+
+		// 可选的目标文件夹，缺省时上传到根目录。其他用户授予 write 权限的文件夹中上传的文件属于该用户
+		var folderID *int
+		ownerID := currentUserID(c)
+		if v := form.values.Get("folder"); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				renderError(c, invalidRequest("Invalid folder id"))
+				return
+			}
+			owner, ok := writableFolderOwner(c, db, id)
+			if !ok {
+				return
+			}
+			folderID, ownerID = &id, owner
+		}
+		newVersion := form.values.Get("new_version") == "true"
+		// mode=replace 可以放在查询参数或表单字段中
+		mode := form.values.Get("mode")
+		if mode == "" {
+			mode = c.Query("mode")
+		}
+		if mode != "" && mode != uploadModeCreate && mode != uploadModeReplace {
+			renderError(c, invalidRequest("Invalid mode, must be create or replace"))
+			return
+		}
+		if mode == uploadModeReplace && newVersion {
+			renderError(c, invalidRequest("Use either new_version or mode=replace, not both"))
+			return
+		}
+		// on_conflict 同样可以放在查询参数或表单字段中
+		onConflict := form.values.Get("on_conflict")
+		if onConflict == "" {
+			onConflict = c.Query("on_conflict")
+		}
+		if onConflict != "" && onConflict != uploadConflictCreate && onConflict != uploadConflictReject && onConflict != uploadConflictReturn {
+			renderError(c, invalidRequest("Invalid on_conflict, must be create, reject or return"))
+			return
+		}
+		if onConflict != "" && onConflict != uploadConflictCreate && (newVersion || mode == uploadModeReplace) {
+			renderError(c, invalidRequest("on_conflict cannot be used with new_version or mode=replace"))
+			return
+		}
+		onNameConflict := form.values.Get("on_name_conflict")
+		if onNameConflict == "" {
+			onNameConflict = c.Query("on_name_conflict")
+		}
+		switch onNameConflict {
+		case "":
+			if onConflict == "" && !newVersion && mode != uploadModeReplace {
+				onConflict = uploadConflictReject
+			}
+		case nameConflictError, nameConflictRename, nameConflictReplace:
+			if onConflict != "" || newVersion || mode == uploadModeReplace {
+				renderError(c, invalidRequest("on_name_conflict cannot be used with on_conflict, new_version or mode=replace"))
+				return
+			}
+			switch onNameConflict {
+			case nameConflictError:
+				onConflict = uploadConflictReject
+			case nameConflictRename:
+				onConflict = uploadConflictRename
+			case nameConflictReplace:
+				mode = uploadModeReplace
+			}
+		default:
+			renderError(c, invalidRequest("Invalid on_name_conflict, must be rename, error or replace"))
+			return
+		}
+		expiresAt, err := formExpiryTime(form.values.Get("expires_in"), form.values.Get("expires_at"), time.Now().UTC())
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		visibility := form.values.Get("visibility")
+		if !validVisibility(visibility) {
+			renderError(c, invalidRequest("Invalid visibility, must be private or public"))
+			return
+		}
+		hashes, ok := expectedHashes(c, form.values["sha256"], len(parts))
+		if !ok {
+			return
+		}
+		options := uploadOptions{ExpiresAt: expiresAt, Visibility: visibility, Replace: mode == uploadModeReplace, OnConflict: onConflict}
+
+		if len(parts) == 1 {
+			fileInfo, err := uploadFormFile(c.Request.Context(), db, store, hashAlgo, ownerID, folderID, parts[0], newVersion, hashes[0], options)
+			renderUploadedFile(c, db, store, repo, maxVersions, ownerID, parts[0].filename, hashes[0], fileInfo, err)
+			return
+		}
+
+		// 逐个处理，单个文件失败不影响其他文件
+		results := make([]uploadResult, 0, len(parts))
+		status := http.StatusOK
+		for i, part := range parts {
+			fileInfo, err := uploadFormFile(c.Request.Context(), db, store, hashAlgo, ownerID, folderID, part, newVersion, hashes[i], options)
+			result := uploadResult{Name: part.filename, Hash: fileInfo.Hash, HashAlgo: fileInfo.HashAlgo, Size: fileInfo.Size}
+			switch {
+			case err == nil && fileInfo.existing:
+				result.Status = "exists"
+				result.ID = fileInfo.ID
+			case err == nil:
+				result.Status = "uploaded"
+				result.ID = fileInfo.ID
+				if fileInfo.Name != part.filename {
+					result.RenamedTo = fileInfo.Name
+				}
+				result.Version = fileInfo.Version
+				result.ExpiresAt = fileInfo.ExpiresAt
+				addAuditFile(c, fileInfo)
+				result.Verified = hashes[i] != ""
+				result.Replaced = fileInfo.replacedHash != ""
+				result.PreviousHash = fileInfo.replacedHash
+				if fileInfo.Version > 1 {
+					pruneVersions(c.Request.Context(), db, store, fileInfo, maxVersions)
+				}
+			case errors.Is(err, errFileTypeNotAllowed):
+				result.Status = "failed"
+				result.Error = "File type is not allowed"
+				var typeErr *fileTypeError
+				if errors.As(err, &typeErr) {
+					result.Error = "File type " + typeErr.typ + " is not allowed"
+				}
+			case errors.Is(err, errFileInfected):
+				result.Status = "failed"
+				result.Error = "File is infected"
+			case errors.Is(err, errScanUnavailable):
+				result.Status = "failed"
+				result.Error = "Virus scanner is unavailable"
+			case errors.Is(err, errHashMismatch):
+				result.Status = "failed"
+				result.Error = "Hash does not match"
+				result.ExpectedHash = hashes[i]
+			case errors.Is(err, errQuotaExceeded):
+				result.Status = "failed"
+				result.Error = "Quota exceeded"
+			case errors.Is(err, errFolderNotFound):
+				result.Status = "failed"
+				result.Error = "Folder not found"
+			case errors.Is(err, errFileProtected):
+				result.Status = "failed"
+				result.Error = "File is protected"
+			case errors.Is(err, errNameConflict):
+				result.Status = "failed"
+				result.Error = "A file with the same name already exists"
+				if fileInfo.ID != 0 {
+					result.ExistingFile = newExistingFile(fileInfo)
+				}
+			default:
+				result.Status = "failed"
+				result.Error = "Failed to save file"
+			}
+			if result.Status == "failed" {
+				status = http.StatusMultiStatus
+			}
+			results = append(results, result)
+		}
+		c.JSON(status, results)
+	})
+
+	// 秒传接口：用户已有相同内容的文件时，直接以新的文件名保存，无需再上传内容。
+	// hash_algo 为 hash 使用的算法，缺省为 sha256；expires_in 或 expires_at 设置文件的过期时间，visibility 设置可见性
+	r.POST("/upload/check", func(c *gin.Context) {
+		var req struct {
+			Hash       string     `json:"hash"`
+			HashAlgo   string     `json:"hash_algo"`
+			Name       string     `json:"name"`
+			FolderID   *int       `json:"folder_id"`
+			ExpiresIn  *int64     `json:"expires_in"`
+			ExpiresAt  *time.Time `json:"expires_at"`
+			Visibility string     `json:"visibility"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if req.HashAlgo == "" {
+			req.HashAlgo = hashSHA256
+		}
+		if !checkDigest(c, req.HashAlgo, req.Hash) {
+			return
+		}
+		name, err := cleanFileName(req.Name)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		req.Name = name
+		now := time.Now().UTC()
+		expiresAt, err := expiryTime(req.ExpiresIn, req.ExpiresAt, now)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		if !validVisibility(req.Visibility) {
+			renderError(c, invalidRequest("Invalid visibility, must be private or public"))
+			return
+		}
+
+		ownerID := currentUserID(c)
+		if !checkTargetFolder(c, db, ownerID, req.FolderID) {
+			return
+		}
+
+		file, err := repo.Link(c.Request.Context(), File{
+			Hash:       req.Hash,
+			HashAlgo:   req.HashAlgo,
+			Name:       req.Name,
+			CreatedAt:  now,
+			OwnerID:    ownerID,
+			FolderID:   req.FolderID,
+			ExpiresAt:  expiresAt,
+			Visibility: req.Visibility,
+		})
+		if errors.Is(err, errNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File not found, upload it with /upload"))
+			return
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			quotaExceeded(c, db, ownerID)
+			return
+		}
+		if errors.Is(err, errFolderNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Target folder not found"))
+			return
+		}
+		if err != nil {
+			fileError(c, err, "Failed to save file")
+			return
+		}
+		addAuditFile(c, file)
+		c.JSON(http.StatusOK, gin.H{
+			"instant": true,
+			"file":    file,
+		})
+	})
+
+	// 批量查询当前用户是否已有这些内容的文件，供同步客户端决定需要上传哪些文件；hash_algo 缺省为 sha256。
+	// 每个哈希返回一条结果，格式不正确的哈希在该条结果中返回错误，不影响其他哈希
+	r.POST("/files/lookup", func(c *gin.Context) {
+		var req struct {
+			Hashes   []string `json:"hashes"`
+			HashAlgo string   `json:"hash_algo"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if len(req.Hashes) == 0 || len(req.Hashes) > maxBatchSize {
+			renderError(c, invalidRequest("hashes must contain 1 to "+strconv.Itoa(maxBatchSize)+" hashes"))
+			return
+		}
+		if req.HashAlgo == "" {
+			req.HashAlgo = hashSHA256
+		}
+		newFunc, ok := hashAlgorithms[req.HashAlgo]
+		if !ok {
+			renderError(c, invalidRequest("Unsupported hash algorithm, must be sha256, blake2b-256 or sha1"))
+			return
+		}
+
+		results := make([]lookupResult, len(req.Hashes))
+		var valid []string
+		for i, hash := range req.Hashes {
+			results[i].Hash = hash
+			if hash = strings.ToLower(hash); isValidDigest(req.HashAlgo, hash) {
+				valid = append(valid, hash)
+			} else {
+				results[i].Error = "Invalid hash, must be " + strconv.Itoa(newFunc().Size()*2) + " hex characters"
+			}
+		}
+		files, err := repo.FindByHashes(c.Request.Context(), currentUserID(c), req.HashAlgo, valid)
+		if err != nil {
+			renderError(c, internalError("Failed to look up files", err))
+			return
+		}
+		for i := range results {
+			if file, ok := files[strings.ToLower(results[i].Hash)]; ok && results[i].Error == "" {
+				results[i].Exists = true
+				results[i].ID = file.ID
+				results[i].Name = file.Name
+				results[i].Size = file.Size
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"hash_algo": req.HashAlgo, "results": results})
+	})
+
+	// 分页获取文件信息，支持按文件名搜索、按标签过滤和按 sort、order 排序，默认按上传时间倒序；
+	// starred 为 true 时只列出加星标的文件，type 按文件类型过滤，mime 按 MIME 类型过滤，since 和 until 按上传时间过滤，
+	// taken_since 和 taken_until 按照片的拍摄时间过滤，sort=taken_at 按拍摄时间排序；counts=true 时
+	// 同时返回不按 type 过滤时每种类型的文件数。after 为上一页返回的 next_cursor 时按游标分页，
+	// 翻页期间新增或删除文件不会导致重复或遗漏，此时不返回 total；next_cursor 为空表示没有下一页
+	listFiles := func(c *gin.Context, starred bool) {
+		limit, err := queryInt(c, "limit", defaultPageLimit)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxPageLimit)))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil || offset < 0 {
+			renderError(c, invalidRequest("Invalid offset, must be a non-negative integer"))
+			return
+		}
+
+		opts := listOptions{
+			OwnerID: currentUserID(c),
+			Query:   c.Query("q"),
+			Starred: starred,
+			Sort:    c.DefaultQuery("sort", "created_at"),
+			Limit:   limit,
+			Offset:  offset,
+		}
+		if _, ok := fileSortColumns[opts.Sort]; !ok {
+			renderError(c, invalidRequest("Invalid sort, must be one of "+strings.Join(fileSortKeys, ", ")).with(gin.H{
+				"valid_sorts": fileSortKeys,
+			}))
+			return
+		}
+		order := c.DefaultQuery("order", "desc")
+		switch order {
+		case "asc":
+		case "desc":
+			opts.Desc = true
+		default:
+			renderError(c, invalidRequest("Invalid order, must be asc or desc"))
+			return
+		}
+		if v := c.Query("after"); v != "" {
+			if c.Query("offset") != "" {
+				renderError(c, invalidRequest("Use either offset or after, not both"))
+				return
+			}
+			if opts.After, err = parseFileCursor(v); err != nil {
+				renderError(c, invalidRequest(err.Error()))
+				return
+			}
+			// 游标只能用于生成它时的排序，未指定 sort 和 order 时沿用游标的排序
+			if _, ok := c.GetQuery("sort"); !ok {
+				opts.Sort = opts.After.Sort
+			}
+			if _, ok := c.GetQuery("order"); !ok {
+				opts.Desc = opts.After.Desc
+			}
+			if opts.Sort != opts.After.Sort || opts.Desc != opts.After.Desc {
+				renderError(c, invalidRequest("Invalid after, the cursor was created with a different sort or order"))
+				return
+			}
+			order = "asc"
+			if opts.Desc {
+				order = "desc"
+			}
+		}
+		if !parseListFilters(c, &opts) {
+			return
+		}
+		withCounts, err := queryBool(c, "counts")
+		if err != nil {
+			renderError(c, invalidRequest("Invalid counts, must be true or false"))
+			return
+		}
+		files, total, more, err := repo.List(c.Request.Context(), opts)
+		if err != nil {
+			renderError(c, internalError("Failed to get files", err))
+			return
+		}
+		nextCursor := ""
+		if more {
+			nextCursor = newFileCursor(opts.Sort, opts.Desc, files[len(files)-1])
+		}
+		resp := gin.H{
+			"files":       files,
+			"q":           opts.Query,
+			"sort":        opts.Sort,
+			"order":       order,
+			"limit":       limit,
+			"next_cursor": nextCursor,
+		}
+		if opts.After == nil {
+			resp["total"] = total
+			resp["offset"] = offset
+		}
+		if withCounts {
+			counts, err := repo.CountTypes(c.Request.Context(), opts)
+			if err != nil {
+				renderError(c, internalError("Failed to get files", err))
+				return
+			}
+			resp["counts"] = counts
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+
+	// 文件列表接口，starred=true 时只列出加星标的文件
+	r.GET("/files", func(c *gin.Context) {
+		starred, err := queryBool(c, "starred")
+		if err != nil {
+			renderError(c, invalidRequest("Invalid starred, must be true or false"))
+			return
+		}
+		listFiles(c, starred)
+	})
+
+	// 加星标的文件列表接口，参数与 /files 相同
+	r.GET("/files/starred", func(c *gin.Context) {
+		listFiles(c, true)
+	})
+
+	// 最近上传的文件，按上传时间倒序；mode=downloaded 时为最近下载的文件，按最近下载时间倒序。
+	// window 为时间范围，如 24h、7d，默认 7d
+	r.GET("/files/recent", func(c *gin.Context) {
+		limit, err := queryInt(c, "limit", defaultRecentLimit)
+		if err != nil || limit < 1 || limit > maxRecentLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxRecentLimit)))
+			return
+		}
+		window := c.DefaultQuery("window", defaultRecentWindow)
+		d, err := parseWindow(window)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		mode := c.DefaultQuery("mode", recentUploaded)
+		if mode != recentUploaded && mode != recentDownloaded {
+			renderError(c, invalidRequest("Invalid mode, must be uploaded or downloaded"))
+			return
+		}
+
+		since := time.Now().UTC().Add(-d)
+		files, err := repo.Recent(c.Request.Context(), currentUserID(c), mode, since, limit)
+		if err != nil {
+			renderError(c, internalError("Failed to get files", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"files":  files,
+			"mode":   mode,
+			"window": window,
+			"since":  since,
+			"limit":  limit,
+		})
+	})
+
+	// 重复文件报告：by=name 时列出规范化文件名相同的文件组，by=content 时列出内容相同的文件组，
+	// 只包括多于一个文件的组；文件数多的组在前，按组分页
+	r.GET("/files/duplicates", func(c *gin.Context) {
+		limit, err := queryInt(c, "limit", defaultPageLimit)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxPageLimit)))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil || offset < 0 {
+			renderError(c, invalidRequest("Invalid offset, must be a non-negative integer"))
+			return
+		}
+		by := c.DefaultQuery("by", duplicatesByName)
+		if by != duplicatesByName && by != duplicatesByContent {
+			renderError(c, invalidRequest("Invalid by, must be name or content"))
+			return
+		}
+
+		groups, total, err := repo.Duplicates(c.Request.Context(), currentUserID(c), by, limit, offset)
+		if err != nil {
+			renderError(c, internalError("Failed to get duplicate files", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"groups": groups,
+			"by":     by,
+			"total":  total,
+			"limit":  limit,
+			"offset": offset,
+		})
+	})
+
+	// 为文件加星标，重复添加不报错
+	r.POST("/files/:id/star", func(c *gin.Context) {
+		setStarred(c, repo, true)
+	})
+
+	// 取消文件的星标，重复取消不报错
+	r.DELETE("/files/:id/star", func(c *gin.Context) {
+		setStarred(c, repo, false)
+	})
+
+	// 根据 id 下载文件接口，也可以下载其他用户授权给当前用户的文件；HEAD 请求使用同一处理函数，返回相同的状态码和响应头但不返回内容
+	download := func(c *gin.Context) {
+		file, ok := readableFileParam(c, db, repo)
+		if !ok {
+			return
+		}
+		serveFile(c, store, file)
+		recordDownload(c, repo, file)
+	}
+	r.GET("/files/:id", download)
+	r.HEAD("/files/:id", download)
+
+	// 以 JSON 返回文件信息，也可以查看其他用户授权给当前用户的文件；metadata 为从图片和音视频中提取的元数据，
+	// 上传后在后台提取，尚未提取或没有元数据时不返回
+	r.GET("/files/:id/info", func(c *gin.Context) {
+		file, ok := readableFileParam(c, db, repo)
+		if !ok {
+			return
+		}
+		metadata, err := getFileMetadata(c.Request.Context(), db, file.blobKey())
+		if err != nil {
+			renderError(c, internalError("Failed to get file metadata", err))
+			return
+		}
+		file.Metadata = metadata
+		c.JSON(http.StatusOK, file)
+	})
+
+	// 列出与文件内容相同的其他文件（包括回收站中的文件），用于在删除前提示内容是否仍被引用。
+	// 管理员可以看到所有用户的文件及其所有者，其他用户只能看到自己的文件，其他用户的文件只返回数量 other_files；
+	// versions 为其他文件的历史版本中引用该内容的数量，frees_space 表示彻底删除该文件后内容是否会被释放。
+	// 只有文件的所有者可以查看，避免被授权的用户借此探测其他用户是否存有相同的内容
+	r.GET("/files/:id/siblings", func(c *gin.Context) {
+		file, ok := fileParam(c, repo)
+		if !ok {
+			return
+		}
+		userID := currentUserID(c)
+		admin, err := isAdmin(c.Request.Context(), db, userID)
+		if err != nil {
+			renderError(c, internalError("Failed to get user", err))
+			return
+		}
+		ownerID := userID
+		if admin {
+			ownerID = 0
+		}
+		siblings, total, versions, err := repo.Siblings(c.Request.Context(), file, ownerID)
+		if err != nil {
+			renderError(c, internalError("Failed to get files with the same content", err))
+			return
+		}
+		if !admin {
+			for i := range siblings {
+				siblings[i].Owner = ""
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"file_id":     file.ID,
+			"hash_algo":   file.HashAlgo,
+			"hash":        file.Hash,
+			"files":       siblings,
+			"other_files": total - len(siblings),
+			"versions":    versions,
+			"frees_space": total == 0 && versions == 0,
+		})
+	})
+
+	// 根据哈希下载文件接口，algo 为哈希使用的算法，缺省为 sha256
+	r.GET("/files/hash/:hash", func(c *gin.Context) {
+		algo := c.DefaultQuery("algo", hashSHA256)
+		if !checkDigest(c, algo, c.Param("hash")) {
+			return
+		}
+		file, err := repo.GetByHash(c.Request.Context(), currentUserID(c), algo, c.Param("hash"))
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+		addAuditFile(c, file)
+		c.Header("Cache-Control", cacheImmutable)
+		serveFile(c, store, file)
+		recordDownload(c, repo, file)
+	})
+
+	// 删除文件接口，文件移入回收站，彻底删除前内容和配额保留；有 write 权限的用户删除的文件移入所有者的回收站
+	r.DELETE("/files/:id", func(c *gin.Context) {
+		target, ok := writableFileParam(c, db, repo)
+		if !ok {
+			return
+		}
+		id := target.ID
+
+		file, err := repo.Trash(c.Request.Context(), target.OwnerID, id)
+		if errors.Is(err, errFileProtected) {
+			renderError(c, newAPIError(http.StatusLocked, codeLocked, "File is protected, unprotect it before deleting"))
+			return
+		}
+		if err != nil {
+			fileError(c, err, "Failed to delete file")
+			return
+		}
+		addAuditFile(c, file)
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "File moved to trash",
+			"id":      id,
+			"hash":    file.Hash,
+		})
+	})
+
+	// 批量将文件移入回收站，在一个事务中处理，返回每个 id 的结果；部分失败时返回 207，成功的文件仍然删除。
+	// atomic=true 时有任何一个文件失败都不删除，返回 409，其余文件的结果为 skipped
+	r.POST("/files/batch-delete", func(c *gin.Context) {
+		var req struct {
+			IDs    []int `json:"ids"`
+			Atomic bool  `json:"atomic"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if len(req.IDs) == 0 || len(req.IDs) > maxBatchSize {
+			renderError(c, invalidRequest("ids must contain 1 to "+strconv.Itoa(maxBatchSize)+" file ids"))
+			return
+		}
+
+		files, errs, err := repo.TrashBatch(c.Request.Context(), currentUserID(c), req.IDs, req.Atomic)
+		if err != nil {
+			renderError(c, internalError("Failed to delete files", err))
+			return
+		}
+		results := make([]batchDeleteResult, len(req.IDs))
+		failed := false
+		for i, id := range req.IDs {
+			results[i] = batchDeleteResult{ID: id, Status: "deleted"}
+			switch {
+			case errors.Is(errs[i], errNotFound):
+				results[i].Status = "not_found"
+			case errors.Is(errs[i], errFileProtected):
+				results[i].Status = "protected"
+			}
+			failed = failed || errs[i] != nil
+		}
+		if failed && req.Atomic {
+			for i := range results {
+				if errs[i] == nil {
+					results[i].Status = "skipped"
+				}
+			}
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Some files cannot be deleted, no file was deleted").with(gin.H{"results": results}))
+			return
+		}
+		for i, file := range files {
+			if errs[i] == nil {
+				addAuditFile(c, file)
+			}
+		}
+		if failed {
+			c.JSON(http.StatusMultiStatus, results)
+			return
+		}
+		c.JSON(http.StatusOK, results)
+	})
+
+	// 修改文件接口：重命名、设置保护标记或可见性。有 write 权限的用户可以重命名，保护标记和可见性只有所有者可以修改
+	r.PATCH("/files/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+
+		var req struct {
+			Name       *string `json:"name"`
+			Protected  *bool   `json:"protected"`
+			Visibility *string `json:"visibility"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if req.Name == nil && req.Protected == nil && req.Visibility == nil {
+			renderError(c, invalidRequest("Nothing to update, name, protected or visibility is required"))
+			return
+		}
+		if req.Visibility != nil && (*req.Visibility == "" || !validVisibility(*req.Visibility)) {
+			renderError(c, invalidRequest("Invalid visibility, must be private or public"))
+			return
+		}
+		if req.Name != nil {
+			name, err := cleanFileName(*req.Name)
+			if err != nil {
+				renderError(c, invalidRequest(err.Error()))
+				return
+			}
+			req.Name = &name
+		}
+
+		userID := currentUserID(c)
+		var file File
+		if req.Name != nil {
+			target, ok := writableFileParam(c, db, repo)
+			if !ok {
+				return
+			}
+			if target.OwnerID != userID && (req.Protected != nil || req.Visibility != nil) {
+				renderError(c, newAPIError(http.StatusForbidden, codeForbidden, "Only the owner can change protected or visibility"))
+				return
+			}
+			setAuditAction(c, "rename")
+			file, err = repo.Rename(c.Request.Context(), target.OwnerID, id, *req.Name)
+			if errors.Is(err, errNameConflict) {
+				renderError(c, newAPIError(http.StatusConflict, codeFileExists, "A file with the same name already exists").with(gin.H{
+					"existing_file": newExistingFile(file),
+				}))
+				return
+			}
+			if err != nil {
+				fileError(c, err, "Failed to rename file")
+				return
+			}
+		}
+		if req.Protected != nil {
+			// 管理员可以修改任何用户文件的保护标记
+			admin, err := isAdmin(c.Request.Context(), db, userID)
+			if err != nil {
+				renderError(c, internalError("Failed to get user", err))
+				return
+			}
+			ownerID := userID
+			if admin {
+				ownerID = 0
+			}
+			file, err = repo.SetProtected(c.Request.Context(), ownerID, id, *req.Protected)
+			if err != nil {
+				fileError(c, err, "Failed to update file")
+				return
+			}
+			if !file.Protected {
+				slog.InfoContext(c.Request.Context(), "File unprotected", "file_id", file.ID, "owner_id", file.OwnerID, "user_id", userID)
+			}
+		}
+		if req.Visibility != nil {
+			file, err = repo.SetVisibility(c.Request.Context(), userID, id, *req.Visibility)
+			if err != nil {
+				fileError(c, err, "Failed to update file")
+				return
+			}
+		}
+		addAuditFile(c, file)
+		c.JSON(http.StatusOK, file)
+	})
+}
+
+// 计算文件的 sha256 哈希
+func calculateHash(file io.Reader) (string, error) {
+	hash, _, err := copyAndHash(io.Discard, file, hashSHA256)
+	return hash, err
+}
+
+// 检查是否为合法的 sha256 哈希（64 位小写十六进制）
+func isValidHash(hash string) bool {
+	return isValidDigest(hashSHA256, hash)
+}
+
+// 检查请求中的算法和摘要，不合法时写入错误响应并返回 false
+func checkDigest(c *gin.Context, algo, digest string) bool {
+	newFunc, ok := hashAlgorithms[algo]
+	if !ok {
+		renderError(c, invalidRequest("Unsupported hash algorithm, must be sha256, blake2b-256 or sha1"))
+		return false
+	}
+	if !isValidDigest(algo, digest) {
+		renderError(c, invalidRequest("Invalid hash, must be "+strconv.Itoa(newFunc().Size()*2)+" hex characters"))
+		return false
+	}
+	return true
+}
+
+// 将 src 的内容写入 dst，同时按 algo 计算哈希，返回哈希和写入的字节数
+func copyAndHash(dst io.Writer, src io.Reader, algo string) (string, int64, error) {
+	hash := newHash(algo)
+	n, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+// 添加文件到数据库并计入用户的已用空间，返回包含 id 的文件信息；内容尚未存储时从 content 读取并保存，
+// 否则只增加引用计数。超过配额时返回 errQuotaExceeded
+func addFile(ctx context.Context, db *sql.DB, store Storage, file File, content io.Reader) (File, error) {
+	unlock := lockContent(file.blobKey())
+	defer unlock()
+	created, err := putContent(ctx, store, file.blobKey(), content)
+	if err != nil {
+		return file, err
+	}
+	saved, err := newFileRepository(db).Create(ctx, file)
+	if err != nil && created {
+		discardContent(store, file.blobKey())
+	}
+	return saved, err
+}
+
+// 插入文件记录，返回包含 id 的文件信息
+func insertFile(ctx context.Context, tx *sql.Tx, file File) (File, error) {
+	if file.Visibility == "" {
+		file.Visibility = visibilityPrivate
+	}
+	insertQuery := `INSERT INTO files (hash, hash_algo, name, search_name, size, mime, created_at, updated_at, owner_id, folder_id, expires_at, visibility) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING ` + fileColumns
+	return scanFile(tx.QueryRowContext(ctx, insertQuery, file.Hash, file.HashAlgo, file.Name, searchName(file.Name), file.Size, file.Mime, file.CreatedAt, file.CreatedAt, file.OwnerID, file.FolderID, file.ExpiresAt, file.Visibility))
+}
+
+// 批量上传中单个文件的处理结果
+type uploadResult struct {
+	ID           int           `json:"id,omitempty"`
+	Name         string        `json:"name"`
+	Status       string        `json:"status"` // uploaded、exists（on_conflict=return 时已有内容相同的同名文件）或 failed
+	Hash         string        `json:"hash,omitempty"`
+	HashAlgo     string        `json:"hash_algo,omitempty"`
+	Size         int64         `json:"size,omitempty"`
+	Version      int           `json:"version,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	Verified     bool          `json:"verified,omitempty"`      // 内容与客户端声明的哈希一致
+	ExpectedHash string        `json:"expected_hash,omitempty"` // 哈希不一致时客户端声明的哈希
+	ExpiresAt    *time.Time    `json:"expires_at,omitempty"`
+	Replaced     bool          `json:"replaced,omitempty"`      // 替换了同名文件的内容
+	PreviousHash string        `json:"previous_hash,omitempty"` // 被替换的内容的哈希
+	ExistingFile *existingFile `json:"existing_file,omitempty"` // 同名文件冲突时已有的文件
+	RenamedTo    string        `json:"renamed_to,omitempty"`    // 自动重命名后的文件名
+}
+
+// 批量查询哈希时单个哈希的结果，已有该内容的文件时返回最早上传的文件
+type lookupResult struct {
+	Hash   string `json:"hash"`
+	Exists bool   `json:"exists"`
+	ID     int    `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Error  string `json:"error,omitempty"` // 哈希格式不正确
+}
+
+// 批量删除中单个文件的结果
+type batchDeleteResult struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"` // deleted、not_found、protected，atomic 时因其他文件失败而未删除的为 skipped
+}
+
+// 上传时冲突的已有文件，客户端可以据此直接引用该文件
+type existingFile struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Hash     string `json:"hash"`
+	HashAlgo string `json:"hash_algo"`
+}
+
+func newExistingFile(file File) *existingFile {
+	return &existingFile{ID: file.ID, Name: file.Name, Hash: file.Hash, HashAlgo: file.HashAlgo}
+}
+
+// 上传时可以为文件设置的选项
+type uploadOptions struct {
+	ExpiresAt  *time.Time // 过期时间，为空表示不过期；上传新版本时为空则保留原来的过期时间
+	Visibility string     // 新文件的可见性，为空表示 private；上传新版本时不改变
+	Replace    bool       // 目标文件夹下已有同名文件时直接替换其内容，不保留原内容为历史版本
+	OnConflict string     // 目标文件夹下已有同名文件时的处理方式，见 uploadConflictCreate 等，为空表示 create
+}
+
+// 读取 /files 和 /files/export 共用的过滤参数：folder、tag、type、mime、按上传时间过滤的 since 和 until 以及
+// 按拍摄时间过滤的 taken_since 和 taken_until（RFC 3339），参数不合法时返回错误响应和 false
+func parseListFilters(c *gin.Context, opts *listOptions) bool {
+	if v := c.Query("folder"); v != "" {
+		folderID, err := strconv.Atoi(v)
+		if err != nil || folderID < 0 {
+			renderError(c, invalidRequest("Invalid folder id"))
+			return false
+		}
+		opts.FolderID = &folderID
+	}
+	// 多个 tag 参数表示同时带有这些标签
+	if tags := c.QueryArray("tag"); len(tags) > 0 {
+		if len(tags) > maxTagsPerQuery {
+			renderError(c, invalidRequest("Too many tags, at most "+strconv.Itoa(maxTagsPerQuery)+" are allowed"))
+			return false
+		}
+		normalized, err := normalizeTags(tags)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return false
+		}
+		opts.Tags = normalized
+	}
+	if v := c.Query("type"); v != "" {
+		if !validFileType(v) {
+			renderError(c, invalidRequest("Invalid type, must be one of "+strings.Join(fileTypeNames, ", ")).with(gin.H{
+				"valid_types": fileTypeNames,
+			}))
+			return false
+		}
+		opts.Type = v
+	}
+	if v := c.Query("mime"); v != "" {
+		mediaType, _, err := mime.ParseMediaType(v)
+		if err != nil || !strings.Contains(mediaType, "/") {
+			renderError(c, invalidRequest("Invalid mime, must be a MIME type such as application/pdf"))
+			return false
+		}
+		opts.MediaType = mediaType
+	}
+	for key, dst := range map[string]**time.Time{"since": &opts.Since, "until": &opts.Until, "taken_since": &opts.TakenSince, "taken_until": &opts.TakenUntil} {
+		if v := c.Query(key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				renderError(c, invalidRequest("Invalid "+key+", must be an RFC 3339 time"))
+				return false
+			}
+			t = t.UTC()
+			*dst = &t
+		}
+	}
+	return true
+}
+
+// 返回上传单个文件的结果，ownerID 为文件的所有者，name 为上传时的文件名，expectedHash 为客户端声明的 sha256；
+// /upload 上传单个文件和 /upload/json 共用，两者的响应相同
+func renderUploadedFile(c *gin.Context, db *sql.DB, store Storage, repo *FileRepository, maxVersions, ownerID int, name, expectedHash string, fileInfo File, err error) {
+	if e := uploadRejectedError(err); e != nil {
+		renderError(c, e)
+		return
+	}
+	if errors.Is(err, errHashMismatch) {
+		renderError(c, newAPIError(http.StatusUnprocessableEntity, codeHashMismatch, "Hash does not match").with(gin.H{
+			"expected_hash": expectedHash,
+			"actual_hash":   fileInfo.Hash,
+		}))
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		quotaExceeded(c, db, ownerID)
+		return
+	}
+	if errors.Is(err, errFolderNotFound) {
+		renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Folder not found"))
+		return
+	}
+	if errors.Is(err, errFileProtected) {
+		renderError(c, newAPIError(http.StatusLocked, codeLocked, "The file with the same name is protected, unprotect it before replacing"))
+		return
+	}
+	if errors.Is(err, errNameConflict) && fileInfo.ID == 0 {
+		renderError(c, newAPIError(http.StatusConflict, codeFileExists, "Too many files with the same name, no name is available"))
+		return
+	}
+	if errors.Is(err, errNameConflict) {
+		renderError(c, newAPIError(http.StatusConflict, codeFileExists, "A file with the same name already exists").with(gin.H{
+			"existing_file": newExistingFile(fileInfo),
+		}))
+		return
+	}
+	if err != nil {
+		renderError(c, internalError("Failed to save file", err))
+		return
+	}
+	message := "File already exists, upload skipped"
+	if !fileInfo.existing {
+		message = "File uploaded successfully"
+		if fileInfo.Version > 1 {
+			pruneVersions(c.Request.Context(), db, store, fileInfo, maxVersions)
+		}
+		addAuditFile(c, fileInfo)
+	}
+	// 新版本和替换只返回了部分字段，重新读取完整的文件信息
+	file := fileInfo
+	if current, err := repo.GetByID(c.Request.Context(), ownerID, fileInfo.ID); err == nil {
+		file = current
+	}
+
+	resp := gin.H{
+		"message":    message,
+		"id":         file.ID,
+		"file":       file,
+		"existing":   fileInfo.existing,
+		"filename":   fileInfo.Name,
+		"renamed":    fileInfo.Name != name,
+		"hash":       fileInfo.Hash,
+		"hash_algo":  fileInfo.HashAlgo,
+		"size":       fileInfo.Size,
+		"mime":       fileInfo.Mime,
+		"version":    fileInfo.Version,
+		"verified":   expectedHash != "",
+		"expires_at": fileInfo.ExpiresAt,
+		"replaced":   fileInfo.replacedHash != "",
+	}
+	if fileInfo.replacedHash != "" {
+		resp["previous_hash"] = fileInfo.replacedHash
+	}
+	// 新建了文件时返回 201 和文件的地址；新版本、替换和 on_conflict=return 没有新建文件，返回 200
+	if fileInfo.existing || fileInfo.Version > 1 || fileInfo.replacedHash != "" {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	c.Header("Location", apiV1Prefix+"/files/"+strconv.Itoa(file.ID))
+	c.JSON(http.StatusCreated, resp)
+}
+
+// 保存用户在表单中上传的单个文件；newVersion 为 true 且目标文件夹下已有同名文件时作为该文件的新版本保存，
+// options.Replace 为 true 时替换该文件的内容。
+// options.OnConflict 为 reject 或 return 且已有同名文件时返回该文件和 errNameConflict；
+// return 且内容相同时返回已有文件且 existing 为 true，不保存新文件；rename 时在保存的事务中选取未被占用的名称。
+// expectedHash 不为空且与内容的哈希不一致时返回 errHashMismatch
+func uploadFormFile(ctx context.Context, db *sql.DB, store Storage, hashAlgo string, ownerID int, folderID *int, part uploadFormPart, newVersion bool, expectedHash string, options uploadOptions) (File, error) {
+	body, err := part.content.reader()
+	if err != nil {
+		return File{}, err
+	}
+	mimeType, _, err := detectContentType(body, part.contentType, part.filename)
+	if err != nil {
+		return File{}, err
+	}
+
+	file := File{
+		HashAlgo:   hashAlgo,
+		Name:       part.filename,
+		Mime:       mimeType,
+		CreatedAt:  time.Now().UTC(),
+		OwnerID:    ownerID,
+		FolderID:   folderID,
+		ExpiresAt:  options.ExpiresAt,
+		Visibility: options.Visibility,
+	}
+	if newVersion || options.Replace {
+		current, err := newFileRepository(db).GetByName(ctx, ownerID, folderID, part.filename)
+		if err == nil {
+			file.ID = current.ID
+		} else if !errors.Is(err, errNotFound) {
+			return File{}, err
+		}
+	}
+	if options.OnConflict == uploadConflictReject || options.OnConflict == uploadConflictReturn {
+		existing, err := newFileRepository(db).GetByName(ctx, ownerID, folderID, part.filename)
+		switch {
+		case errors.Is(err, errNotFound):
+		case err != nil:
+			return File{}, err
+		case expectedHash != "" && part.content.sha256 != expectedHash:
+			return File{HashAlgo: hashSHA256, Hash: part.content.sha256, Size: part.content.size}, errHashMismatch
+		case options.OnConflict == uploadConflictReturn && existing.HashAlgo == hashAlgo && existing.Hash == part.content.hash:
+			existing.existing = true
+			return existing, nil
+		default:
+			return existing, errNameConflict
+		}
+	}
+
+	// 上面的检查避免保存注定冲突的内容，并发上传同名文件时由保存的事务再次检查
+	file.autoRename = options.OnConflict == uploadConflictRename
+	file.rejectConflict = options.OnConflict == uploadConflictReject || options.OnConflict == uploadConflictReturn
+
+	// 哈希已在接收时计算
+	return storeSpooled(ctx, db, store, file, part.content, expectedHash, options.Replace)
+}
+
+// 读取客户端声明的各个文件的哈希，未声明的为空字符串；格式不正确时写入错误响应并返回 false
+func expectedHashes(c *gin.Context, fields []string, count int) ([]string, bool) {
+	hashes := make([]string, count)
+	header := c.GetHeader(contentSHA256Header)
+	switch {
+	case header != "" && len(fields) > 0:
+		renderError(c, invalidRequest("Use either the "+contentSHA256Header+" header or sha256 form fields, not both"))
+		return nil, false
+	case header != "":
+		if count > 1 {
+			renderError(c, invalidRequest(contentSHA256Header+" can only be used when uploading a single file, use sha256 form fields instead"))
+			return nil, false
+		}
+		hashes[0] = header
+	case len(fields) > 0:
+		if len(fields) != count {
+			renderError(c, invalidRequest("sha256 fields must match the uploaded files one to one"))
+			return nil, false
+		}
+		copy(hashes, fields)
+	}
+	for i, hash := range hashes {
+		hashes[i] = strings.ToLower(hash)
+		if hash != "" && !isValidHash(hashes[i]) {
+			renderError(c, invalidRequest("Invalid hash, must be 64 hex characters"))
+			return nil, false
+		}
+	}
+	return hashes, true
+}
+
+// 转义 LIKE 模式中的特殊字符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// 读取整数类型的查询参数，参数缺省时返回默认值
+func queryInt(c *gin.Context, key string, def int) (int, error) {
+	value, ok := c.GetQuery(key)
+	if !ok {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// 读取布尔类型的查询参数，参数缺省时返回 false
+func queryBool(c *gin.Context, key string) (bool, error) {
+	value, ok := c.GetQuery(key)
+	if !ok {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// 解析 24h、7d 形式的时间范围，单位为 h（小时）或 d（天），最长 maxRecentWindow
+func parseWindow(s string) (time.Duration, error) {
+	invalid := errors.New("Invalid window, must be a number of hours or days such as 24h or 7d, at most " + strconv.Itoa(int(maxRecentWindow/(24*time.Hour))) + "d")
+	if len(s) < 2 {
+		return 0, invalid
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n <= 0 {
+		return 0, invalid
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	default:
+		return 0, invalid
+	}
+	if int64(n) > int64(maxRecentWindow/unit) {
+		return 0, invalid
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// 设置路径中文件的星标并返回更新后的文件信息
+func setStarred(c *gin.Context, repo *FileRepository, starred bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		renderError(c, invalidRequest("Invalid file id"))
+		return
+	}
+	file, err := repo.SetStarred(c.Request.Context(), currentUserID(c), id, starred)
+	if err != nil {
+		fileError(c, err, "Failed to update file")
+		return
+	}
+	c.JSON(http.StatusOK, file)
+}
+
+// 按 fileColumns 的字段顺序读取一行文件信息
+func scanFile(row interface{ Scan(...any) error }) (File, error) {
+	var file File
+	var tags string
+	err := row.Scan(&file.ID, &file.Hash, &file.Name, &file.Size, &file.Mime, &file.CreatedAt, &file.OwnerID, &file.FolderID, &file.DeletedAt, &file.Version, &file.UpdatedAt, &file.Protected, &file.HashAlgo, &file.Starred, &file.Downloads, &file.ExpiresAt, &file.Visibility, &file.LastDownloadedAt, &tags, &file.TakenAt, &file.ScanStatus)
+	if err != nil {
+		return file, err
+	}
+	if file.ExpiresAt != nil {
+		remaining := remainingSeconds(*file.ExpiresAt, time.Now())
+		file.ExpiresIn = &remaining
+	}
+	err = json.Unmarshal([]byte(tags), &file.Tags)
+	return file, err
+}
+
+// 下载响应的缓存策略：同一 id 的内容会随新版本变化，需要每次用 ETag 验证；
+// 按哈希或版本号访问的内容不会变化，可以长期缓存。响应需要认证，因此只允许浏览器缓存
+const (
+	cacheRevalidate = "private, no-cache"
+	cacheImmutable  = "private, max-age=31536000, immutable"
+)
+
+// 解析路径中的文件 id 并获取当前用户的文件，失败时写入错误响应并返回 false
+func fileParam(c *gin.Context, repo *FileRepository) (File, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		renderError(c, invalidRequest("Invalid file id"))
+		return File{}, false
+	}
+	file, err := repo.GetByID(c.Request.Context(), currentUserID(c), id)
+	if err != nil {
+		fileError(c, err, "Failed to get file")
+		return File{}, false
+	}
+	return file, true
+}
+
+// 根据文件仓库返回的错误写入响应：不存在返回 404，重复返回 409，已过期返回 410，其他错误返回 500 和 message
+func fileError(c *gin.Context, err error, message string) {
+	if errors.Is(err, errNotFound) || errors.Is(err, errDuplicate) || errors.Is(err, errFileExpired) {
+		renderError(c, err)
+		return
+	}
+	renderError(c, internalError(message, err))
+}
+
+// 在 serveFile 之后为文件记录一次下载：只有返回 200 或 206 的 GET 请求计入，
+// 206 只计入从第 0 字节开始的请求，断点续传和分段下载的后续部分不计入，因此一次完整的下载只计一次。
+// 计数失败不影响下载，只记录日志
+func recordDownload(c *gin.Context, repo *FileRepository, file File) {
+	status := c.Writer.Status()
+	if c.Request.Method != http.MethodGet || (status != http.StatusOK && status != http.StatusPartialContent) {
+		return
+	}
+	if status == http.StatusPartialContent && !strings.HasPrefix(c.GetHeader("Range"), "bytes=0-") {
+		return
+	}
+	// 客户端读取完内容后可能已断开连接，不随请求取消
+	if err := repo.RecordDownload(context.WithoutCancel(c.Request.Context()), file.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to record download", "file_id", file.ID, "error", err)
+	}
+}
+
+// 将文件内容作为附件返回给客户端，支持 Range 请求、以哈希为 ETag 的 If-Range 和 If-None-Match。
+// 默认每次验证缓存，调用方可以预先设置 Cache-Control；ETag 匹配时不读取内容，直接返回 304
+func serveFile(c *gin.Context, store Storage, file File) {
+	serveFileAs(c, store, file, "attachment")
+}
+
+// 与 serveFile 相同，disposition 为 Content-Disposition 的类型：attachment 或 inline
+func serveFileAs(c *gin.Context, store Storage, file File, disposition string) {
+	// 被隔离的文件即使客户端已缓存也不能返回 304
+	if file.ScanStatus == scanInfected {
+		c.Writer.Header().Del("Cache-Control")
+		renderError(c, fileQuarantined())
+		return
+	}
+	etag := `"` + file.Hash + `"`
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		setCacheHeaders(c, etag)
+		c.Status(http.StatusNotModified)
+		return
+	}
+	detachDeadline(c)
+	content, size, err := openFileContent(c.Request.Context(), store, file)
+	if err != nil {
+		// 错误响应不能被缓存
+		c.Writer.Header().Del("Cache-Control")
+		if errors.Is(err, errBlobNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File content not found"))
+			return
+		}
+		if errors.Is(err, errFileInfected) {
+			renderError(c, fileQuarantined())
+			return
+		}
+		renderError(c, internalError("Failed to read file", err))
+		return
+	}
+	defer content.Close()
+	serveContent(c, file, content, size, disposition)
+}
+
+// 以 file 的名称、类型和哈希返回内容
+func serveContent(c *gin.Context, file File, content io.Reader, size int64, disposition string) {
+	// 在浏览器中直接显示时与预览使用相同的类型和安全响应头，HTML、SVG 等按纯文本显示，
+	// 不支持预览的类型改为下载，避免上传的内容在本站点下执行脚本
+	if disposition == "inline" {
+		if contentType, _ := previewContentType(file); contentType != "" {
+			c.Header("Content-Type", contentType)
+			setInlineSecurityHeaders(c)
+		} else {
+			disposition = "attachment"
+		}
+	}
+	// 未记录类型时由 http.ServeContent 根据扩展名或内容检测
+	if disposition != "inline" && file.Mime != "" {
+		c.Header("Content-Type", file.Mime)
+	}
+	setCacheHeaders(c, `"`+file.Hash+`"`)
+	c.Header("Content-Disposition", contentDisposition(disposition, file.Name))
+	writeContent(c, file.Name, file.UpdatedAt, content, size)
+}
+
+// 输出内容；支持 Seek 时由 http.ServeContent 处理 Range 和条件请求，否则直接输出完整内容
+func writeContent(c *gin.Context, name string, modTime time.Time, content io.Reader, size int64) {
+	if rs, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, name, modTime, struct {
+			io.Reader
+			io.Seeker
+		}{contextReader{c.Request.Context(), rs}, rs})
+		return
+	}
+	if c.Writer.Header().Get("Content-Type") == "" {
+		c.Header("Content-Type", "application/octet-stream")
+	}
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+	if c.Request.Method != http.MethodHead {
+		io.Copy(c.Writer, contextReader{c.Request.Context(), content})
+	}
+}
+
+// ctx 结束（客户端断开）后停止读取内容；请求设置了下载限速时按限制的速度读取，见 bandwidthLimiter
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p[:throttleReadSize(r.ctx, len(p))])
+	if werr := waitBandwidth(r.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// 设置 ETag，未设置 Cache-Control 时使用 cacheRevalidate
+func setCacheHeaders(c *gin.Context, etag string) {
+	c.Header("ETag", etag)
+	if c.Writer.Header().Get("Cache-Control") == "" {
+		c.Header("Cache-Control", cacheRevalidate)
+	}
+}
+
+// 检查 If-None-Match 请求头是否与 etag 匹配，按弱比较处理
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 上传文件并返回保存的文件信息
+func uploadTestFile(t *testing.T, s *testServer, token, name, content string) File {
+	t.Helper()
+	w := s.upload(token, name, []byte(content), nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload %s: %d %s", name, w.Code, w.Body)
+	}
+	var resp struct {
+		File File `json:"file"`
+	}
+	decodeJSON(t, w, &resp)
+	return resp.File
+}
+
+func TestRenameFile(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	file := uploadTestFile(t, s, alice, "a.txt", "hello")
+	uploadTestFile(t, s, alice, "taken.txt", "other")
+	path := "/api/v1/files/" + strconv.Itoa(file.ID)
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+		want   string // 成功时的文件名
+	}{
+		{"rename", alice, `{"name":"report.txt"}`, http.StatusOK, "report.txt"},
+		{"path separators keep the last element", alice, `{"name":"../docs/notes.txt"}`, http.StatusOK, "notes.txt"},
+		{"control characters", alice, `{"name":"a\nb.txt"}`, http.StatusOK, "a_b.txt"},
+		{"empty", alice, `{"name":""}`, http.StatusBadRequest, ""},
+		{"only dots", alice, `{"name":".."}`, http.StatusBadRequest, ""},
+		{"nothing to update", alice, `{}`, http.StatusBadRequest, ""},
+		{"taken", alice, `{"name":"taken.txt"}`, http.StatusConflict, ""},
+		{"another user's file", bob, `{"name":"x.txt"}`, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do(http.MethodPatch, path, tt.token, "application/json", strings.NewReader(tt.body))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got File
+			decodeJSON(t, w, &got)
+			if got.Name != tt.want || got.Hash != file.Hash || got.Size != file.Size {
+				t.Errorf("renamed file = %+v, want name %q with the original content", got, tt.want)
+			}
+		})
+	}
+
+	long := strings.Repeat("长", maxFileNameRunes+10) + ".txt"
+	w := s.do(http.MethodPatch, path, alice, "application/json", strings.NewReader(`{"name":"`+long+`"}`))
+	var got File
+	decodeJSON(t, w, &got)
+	if w.Code != http.StatusOK || len(got.Name) > maxFileNameLength || !strings.HasSuffix(got.Name, ".txt") {
+		t.Errorf("long name: %d, name %q (%d bytes)", w.Code, got.Name, len(got.Name))
+	}
+}
+
+// 并发上传同名同内容的文件时只有一个成功，其余返回 409，不能出现 500 或重复的文件
+func TestConcurrentUploadsOfTheSameFile(t *testing.T) {
+	s := newTestServerWithDB(t, nil, openTestFileDB(t))
+	alice := s.login("alice")
+
+	const uploads = 8
+	codes := make(chan int, uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- s.upload(alice, "same.txt", []byte("same content"), nil).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusConflict] != uploads-1 {
+		t.Errorf("status counts = %v, want one 201 and %d 409", counts, uploads-1)
+	}
+
+	var files, refcount int
+	var used int64
+	if err := s.db.QueryRow(`SELECT (SELECT COUNT(*) FROM files), (SELECT SUM(refcount) FROM blobs), (SELECT used_bytes FROM users WHERE username = 'alice')`).Scan(&files, &refcount, &used); err != nil {
+		t.Fatal(err)
+	}
+	if files != 1 || refcount != 1 || used != int64(len("same content")) {
+		t.Errorf("files = %d, refcount = %d, used_bytes = %d; want a single file", files, refcount, used)
+	}
+}
+
+// 并发上传相同内容、不同名称的文件都成功，内容只保存一份
+func TestConcurrentUploadsOfTheSameContent(t *testing.T) {
+	s := newTestServerWithDB(t, nil, openTestFileDB(t))
+	alice := s.login("alice")
+
+	const uploads = 8
+	codes := make(chan int, uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- s.upload(alice, "copy-"+strconv.Itoa(i)+".txt", []byte("same content"), nil).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusCreated {
+			t.Errorf("status = %d, want 201", code)
+		}
+	}
+
+	var blobs, refcount int
+	if err := s.db.QueryRow(`SELECT COUNT(*), SUM(refcount) FROM blobs`).Scan(&blobs, &refcount); err != nil {
+		t.Fatal(err)
+	}
+	if blobs != 1 || refcount != uploads {
+		t.Errorf("blobs = %d, refcount = %d, want 1 and %d", blobs, refcount, uploads)
+	}
+}
+
+// 同内容的文件只对所有者可见，被授权读取文件的用户不能查看，避免借此探测其他用户存有的内容
+func TestSiblingsOnlyForOwner(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.login("admin") // 第一个用户是管理员，可以看到所有用户的文件
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+	file := uploadTestFile(t, s, alice, "a.txt", "hello")
+	uploadTestFile(t, s, carol, "c.txt", "hello")
+	path := "/api/v1/files/" + strconv.Itoa(file.ID)
+	if w := s.do(http.MethodPost, path+"/permissions", alice, "application/json", strings.NewReader(`{"username":"bob"}`)); w.Code != http.StatusCreated {
+		t.Fatalf("grant: %d %s", w.Code, w.Body)
+	}
+	if w := s.do(http.MethodGet, path, bob, "", nil); w.Code != http.StatusOK {
+		t.Fatalf("download by grantee: %d %s", w.Code, w.Body)
+	}
+
+	if w := s.do(http.MethodGet, path+"/siblings", bob, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("siblings for grantee: %d, want 404: %s", w.Code, w.Body)
+	}
+	w := s.do(http.MethodGet, path+"/siblings", alice, "", nil)
+	var resp struct {
+		OtherFiles int `json:"other_files"`
+	}
+	decodeJSON(t, w, &resp)
+	if w.Code != http.StatusOK || resp.OtherFiles != 1 {
+		t.Errorf("siblings for owner: %d, other_files = %d, want 200 and 1", w.Code, resp.OtherFiles)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+)
+
+// 文件类型分组，用于按类型过滤文件列表；不属于任何分组的文件为 other
+type fileTypeGroup struct {
+	name         string
+	mimePrefixes []string // 以这些前缀开头的 MIME 类型属于该分组
+	mimes        []string // 属于该分组的 MIME 类型
+	extensions   []string // 保存的 MIME 类型只是通用类型时按扩展名判断
+}
+
+// 所有文件类型分组，按顺序匹配，第一个匹配的分组生效。文件的类型以保存的 MIME 类型为准，
+// 只有 MIME 类型为无法区分具体格式的通用类型（见 isGenericContentType）时才按扩展名判断，
+// 因此扩展名与内容不符的文件按内容归类，例如内容为 PNG 的 report.pdf 属于 image
+var fileTypeGroups = []fileTypeGroup{
+	{
+		name:         "image",
+		mimePrefixes: []string{"image/"},
+		extensions:   []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".svg", ".heic", ".heif", ".avif", ".tif", ".tiff", ".ico"},
+	},
+	{
+		name:         "video",
+		mimePrefixes: []string{"video/"},
+		extensions:   []string{".mp4", ".m4v", ".mov", ".mkv", ".webm", ".avi", ".wmv", ".flv", ".mpeg", ".mpg"},
+	},
+	{
+		name:         "audio",
+		mimePrefixes: []string{"audio/"},
+		mimes:        []string{"application/ogg"},
+		extensions:   []string{".mp3", ".wav", ".flac", ".ogg", ".oga", ".opus", ".m4a", ".aac", ".wma"},
+	},
+	{
+		name:       "archive",
+		mimes:      []string{"application/zip", "application/x-tar", "application/gzip", "application/x-gzip", "application/x-bzip2", "application/x-xz", "application/zstd", "application/x-7z-compressed", "application/vnd.rar", "application/x-rar-compressed", "application/java-archive"},
+		extensions: []string{".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar", ".jar"},
+	},
+	{
+		name:         "document",
+		mimePrefixes: []string{"text/", "application/vnd.openxmlformats-officedocument.", "application/vnd.oasis.opendocument.", "application/vnd.ms-"},
+		mimes:        []string{"application/pdf", "application/msword", "application/rtf", "application/epub+zip", "application/json", "application/xml"},
+		extensions:   []string{".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx", ".odt", ".ods", ".odp", ".rtf", ".epub", ".txt", ".md", ".csv", ".json", ".xml"},
+	},
+}
+
+// 不属于任何分组的文件类型
+const fileTypeOther = "other"
+
+// 所有文件类型，按 fileTypeGroups 的顺序，最后为 other
+var fileTypeNames = func() []string {
+	var names []string
+	for _, group := range fileTypeGroups {
+		names = append(names, group.name)
+	}
+	return append(names, fileTypeOther)
+}()
+
+// 检查文件类型是否合法
+func validFileType(name string) bool {
+	for _, n := range fileTypeNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// files.mime 中不含参数的媒体类型，如 text/plain; charset=utf-8 为 text/plain
+const fileMediaTypeSQL = `lower(trim(CASE WHEN instr(files.mime, ';') > 0 THEN substr(files.mime, 1, instr(files.mime, ';') - 1) ELSE files.mime END))`
+
+// 计算文件类型的 SQL 表达式，由 fileTypeGroups 生成：先按通用类型文件的扩展名匹配，再按 MIME 类型匹配
+var fileTypeSQL = func() string {
+	generic := fileMediaTypeSQL + ` IN ('', 'application/octet-stream', 'text/plain', 'application/zip')`
+	var b strings.Builder
+	b.WriteString("CASE")
+	for _, group := range fileTypeGroups {
+		var exts []string
+		for _, ext := range group.extensions {
+			exts = append(exts, "lower(files.name) LIKE "+sqlString("%"+ext))
+		}
+		b.WriteString(" WHEN " + generic + " AND (" + strings.Join(exts, " OR ") + ") THEN " + sqlString(group.name))
+	}
+	for _, group := range fileTypeGroups {
+		var matches []string
+		for _, prefix := range group.mimePrefixes {
+			matches = append(matches, fileMediaTypeSQL+" LIKE "+sqlString(prefix+"%"))
+		}
+		for _, mime := range group.mimes {
+			matches = append(matches, fileMediaTypeSQL+" = "+sqlString(mime))
+		}
+		b.WriteString(" WHEN " + strings.Join(matches, " OR ") + " THEN " + sqlString(group.name))
+	}
+	b.WriteString(" ELSE " + sqlString(fileTypeOther) + " END")
+	return b.String()
+}()
+
+// 将常量字符串转换为 SQL 字符串字面量，只用于上面的规则，不能用于用户输入
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFileTypeSQL(t *testing.T) {
+	db := newTestDB(t)
+	tests := []struct {
+		name, mime, want string
+	}{
+		{"photo.jpg", "image/jpeg", "image"},
+		{"photo.JPG", "application/octet-stream", "image"},
+		{"clip.mp4", "video/mp4", "video"},
+		{"song.ogg", "application/ogg", "audio"},
+		{"song.mp3", "audio/mpeg", "audio"},
+		{"backup.tar.gz", "application/gzip", "archive"},
+		{"files.zip", "application/zip", "archive"},
+		{"report.pdf", "application/pdf", "document"},
+		{"notes.txt", "text/plain; charset=utf-8", "document"},
+		{"sheet.xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "document"},
+		// docx、xlsx 等的内容也是 zip，按扩展名归类
+		{"letter.docx", "application/zip", "document"},
+		// 扩展名与内容不符时按内容归类
+		{"report.pdf", "image/png", "image"},
+		{"image.png", "application/pdf", "document"},
+		// 通用类型且扩展名无法识别
+		{"data.bin", "application/octet-stream", "other"},
+		{"README", "text/plain", "document"},
+		{"noext", "", "other"},
+		{"program.exe", "application/x-msdownload", "other"},
+		// 参数和大小写不影响
+		{"page.html", " Text/HTML ; charset=utf-8", "document"},
+	}
+	for _, tt := range tests {
+		var got string
+		query := `SELECT ` + fileTypeSQL + ` FROM (SELECT ? AS name, ? AS mime) AS files`
+		if err := db.QueryRow(query, tt.name, tt.mime).Scan(&got); err != nil {
+			t.Fatalf("%s (%s): %v", tt.name, tt.mime, err)
+		}
+		if got != tt.want {
+			t.Errorf("type of %s (%s) = %s, want %s", tt.name, tt.mime, got, tt.want)
+		}
+	}
+}
+
+func TestValidFileType(t *testing.T) {
+	for _, name := range []string{"image", "video", "audio", "document", "archive", "other"} {
+		if !validFileType(name) {
+			t.Errorf("validFileType(%q) = false", name)
+		}
+	}
+	for _, name := range []string{"", "Image", "images", "pdf"} {
+		if validFileType(name) {
+			t.Errorf("validFileType(%q) = true", name)
+		}
+	}
+}
+
+func TestListByType(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	ctx := context.Background()
+	alice := newTestUser(t, db, "alice")
+	for _, f := range []struct{ name, mime string }{
+		{"a.jpg", "image/jpeg"},
+		{"b.png", "image/png"},
+		{"beach.jpg", "image/jpeg"},
+		{"doc.pdf", "application/pdf"},
+		{"fake.pdf", "image/png"},
+		{"data.bin", "application/octet-stream"},
+	} {
+		if _, err := repo.Create(ctx, File{HashAlgo: hashSHA256, Hash: f.name, Name: f.name, Mime: f.mime, CreatedAt: time.Now().UTC(), OwnerID: alice}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, total, hasMore, err := repo.List(ctx, listOptions{OwnerID: alice, Type: "image", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 || !hasMore || len(files) != 2 {
+		t.Errorf("images page = %v, total %d, has more %v; want 2 of 4", fileNames(files), total, hasMore)
+	}
+	files, _, _, err = repo.List(ctx, listOptions{OwnerID: alice, Type: "image", Query: "b", Sort: "name", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "b.png" || files[1].Name != "beach.jpg" {
+		t.Errorf("images matching b = %v, want [b.png beach.jpg]", fileNames(files))
+	}
+	files, _, _, err = repo.List(ctx, listOptions{OwnerID: alice, MediaType: "application/pdf", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "doc.pdf" {
+		t.Errorf("mime=application/pdf = %v, want [doc.pdf]", fileNames(files))
+	}
+
+	counts, err := repo.CountTypes(ctx, listOptions{OwnerID: alice, Type: "image"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"image": 4, "video": 0, "audio": 0, "archive": 0, "document": 1, "other": 1}
+	for name, n := range want {
+		if counts[name] != n {
+			t.Errorf("counts[%s] = %d, want %d (all counts %v)", name, counts[name], n, counts)
+		}
+	}
+}
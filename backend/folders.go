@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// 同一目录下已存在同名文件夹
+	errFolderExists = errors.New("folder already exists")
+	// 文件夹不为空
+	errFolderNotEmpty = errors.New("folder is not empty")
+	// 不能将文件夹移动到自身或其子文件夹下
+	errFolderCycle = errors.New("folder cannot be moved into itself")
+	// 目标文件夹下已存在同名文件
+	errNameConflict = errors.New("file with the same name already exists")
+	// 引用的文件夹已被删除
+	errFolderNotFound = errors.New("folder not found")
+)
+
+// 批量移动和删除时单次请求最多包含的文件数
+const maxBatchSize = 1000
+
+// 移动文件的请求；FolderID 为空表示移动到根目录，Overwrite 为 true 时覆盖目标文件夹下的同名文件
+type moveRequest struct {
+	FolderID  *int `json:"folder_id"`
+	Overwrite bool `json:"overwrite"`
+}
+
+// 批量移动中单个文件的处理结果
+type moveResult struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"` // moved、not_found、conflict、protected、folder_not_found 或 failed
+	Path   string `json:"path,omitempty"`
+}
+
+// Folder 文件夹数据结构；ParentID 为空表示位于根目录
+type Folder struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	ParentID  *int      `json:"parent_id"`
+	OwnerID   int       `json:"owner_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 注册文件夹相关接口
+func registerFolderRoutes(r gin.IRouter, db *sql.DB) {
+	// 创建文件夹
+	r.POST("/folders", func(c *gin.Context) {
+		var req struct {
+			Name     string `json:"name"`
+			ParentID *int   `json:"parent_id"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		name, err := cleanFileName(req.Name)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		req.Name = name
+		ownerID := currentUserID(c)
+		if req.ParentID != nil {
+			if _, err := getFolder(c.Request.Context(), db, ownerID, *req.ParentID); err == sql.ErrNoRows {
+				renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Parent folder not found"))
+				return
+			} else if err != nil {
+				renderError(c, internalError("Failed to get folder", err))
+				return
+			}
+		}
+
+		folder, err := addFolder(c.Request.Context(), db, Folder{
+			Name:      req.Name,
+			ParentID:  req.ParentID,
+			OwnerID:   ownerID,
+			CreatedAt: time.Now().UTC(),
+		})
+		if errors.Is(err, errFolderExists) {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Folder already exists"))
+			return
+		}
+		if errors.Is(err, errFolderNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Parent folder not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to create folder", err))
+			return
+		}
+		c.JSON(http.StatusCreated, folder)
+	})
+
+	// 列出文件夹下的子文件夹，parent 为空时列出根目录
+	r.GET("/folders", func(c *gin.Context) {
+		var parentID *int
+		if v := c.Query("parent"); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				renderError(c, invalidRequest("Invalid parent folder id"))
+				return
+			}
+			parentID = &id
+		}
+		folders, err := getChildFolders(c.Request.Context(), db, currentUserID(c), parentID)
+		if err != nil {
+			renderError(c, internalError("Failed to get folders", err))
+			return
+		}
+		c.JSON(http.StatusOK, folders)
+	})
+
+	// 获取文件夹信息
+	r.GET("/folders/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid folder id"))
+			return
+		}
+		folder, err := getFolder(c.Request.Context(), db, currentUserID(c), id)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Folder not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get folder", err))
+			return
+		}
+		c.JSON(http.StatusOK, folder)
+	})
+
+	// 重命名或移动文件夹；parent_id 为 0 表示移动到根目录
+	r.PATCH("/folders/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid folder id"))
+			return
+		}
+		var req struct {
+			Name     *string `json:"name"`
+			ParentID *int    `json:"parent_id"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+
+		ownerID := currentUserID(c)
+		folder, err := getFolder(c.Request.Context(), db, ownerID, id)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Folder not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get folder", err))
+			return
+		}
+		if req.Name != nil {
+			name, err := cleanFileName(*req.Name)
+			if err != nil {
+				renderError(c, invalidRequest(err.Error()))
+				return
+			}
+			folder.Name = name
+		}
+		if req.ParentID != nil {
+			folder.ParentID = nil
+			if *req.ParentID != 0 {
+				if _, err := getFolder(c.Request.Context(), db, ownerID, *req.ParentID); err == sql.ErrNoRows {
+					renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Parent folder not found"))
+					return
+				} else if err != nil {
+					renderError(c, internalError("Failed to get folder", err))
+					return
+				}
+				folder.ParentID = req.ParentID
+			}
+		}
+
+		err = updateFolder(c.Request.Context(), db, folder)
+		if errors.Is(err, errFolderCycle) {
+			renderError(c, invalidRequest("Folder cannot be moved into itself or its subfolders"))
+			return
+		}
+		if errors.Is(err, errFolderExists) {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Folder already exists"))
+			return
+		}
+		if errors.Is(err, errFolderNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Parent folder not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to update folder", err))
+			return
+		}
+		c.JSON(http.StatusOK, folder)
+	})
+
+	// 将文件移动到其他文件夹
+	r.PATCH("/files/:id/move", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+		var req moveRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		ownerID := currentUserID(c)
+		if !checkTargetFolder(c, db, ownerID, req.FolderID) {
+			return
+		}
+
+		file, err := moveFile(c.Request.Context(), db, ownerID, id, req.FolderID, req.Overwrite)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File not found"))
+			return
+		}
+		if errors.Is(err, errNameConflict) {
+			renderError(c, newAPIError(http.StatusConflict, codeFileExists, "A file with the same name already exists in the target folder"))
+			return
+		}
+		if errors.Is(err, errFileProtected) {
+			renderError(c, newAPIError(http.StatusLocked, codeLocked, "The file with the same name in the target folder is protected"))
+			return
+		}
+		if errors.Is(err, errFolderNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Target folder not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to move file", err))
+			return
+		}
+
+		path, err := filePath(c.Request.Context(), db, file)
+		if err != nil {
+			renderError(c, internalError("Failed to get file path", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"file": file,
+			"path": path,
+		})
+	})
+
+	// 批量移动文件，单个文件失败不影响其他文件
+	r.POST("/files/move", func(c *gin.Context) {
+		var req struct {
+			moveRequest
+			IDs []int `json:"ids"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if len(req.IDs) == 0 || len(req.IDs) > maxBatchSize {
+			renderError(c, invalidRequest("ids must contain 1 to "+strconv.Itoa(maxBatchSize)+" file ids"))
+			return
+		}
+		ownerID := currentUserID(c)
+		if !checkTargetFolder(c, db, ownerID, req.FolderID) {
+			return
+		}
+
+		results := make([]moveResult, 0, len(req.IDs))
+		status := http.StatusOK
+		for _, id := range req.IDs {
+			result := moveResult{ID: id}
+			file, err := moveFile(c.Request.Context(), db, ownerID, id, req.FolderID, req.Overwrite)
+			switch {
+			case err == nil:
+				result.Status = "moved"
+				result.Path, _ = filePath(c.Request.Context(), db, file)
+			case err == sql.ErrNoRows:
+				result.Status = "not_found"
+			case errors.Is(err, errNameConflict):
+				result.Status = "conflict"
+			case errors.Is(err, errFileProtected):
+				result.Status = "protected"
+			case errors.Is(err, errFolderNotFound):
+				result.Status = "folder_not_found"
+			default:
+				result.Status = "failed"
+			}
+			if result.Status != "moved" {
+				status = http.StatusMultiStatus
+			}
+			results = append(results, result)
+		}
+		c.JSON(status, results)
+	})
+
+	// 删除文件夹；不为空时需要 recursive=true 才会连同其中的内容一起删除，其中的文件移入回收站
+	r.DELETE("/folders/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid folder id"))
+			return
+		}
+		recursive := c.Query("recursive") == "true"
+
+		deleted, err := deleteFolder(c.Request.Context(), db, currentUserID(c), id, recursive)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Folder not found"))
+			return
+		}
+		if errors.Is(err, errFolderNotEmpty) {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Folder is not empty, use recursive=true to delete it with its contents"))
+			return
+		}
+		if errors.Is(err, errFileProtected) {
+			renderError(c, newAPIError(http.StatusLocked, codeLocked, "Folder contains protected files"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to delete folder", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":       "Folder deleted successfully",
+			"id":            id,
+			"deleted_files": deleted,
+		})
+	})
+}
+
+// 检查移动的目标文件夹是否存在且属于该用户，不满足时写入错误响应并返回 false
+func checkTargetFolder(c *gin.Context, db *sql.DB, ownerID int, folderID *int) bool {
+	if folderID == nil {
+		return true
+	}
+	_, err := getFolder(c.Request.Context(), db, ownerID, *folderID)
+	if err == sql.ErrNoRows {
+		renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Target folder not found"))
+		return false
+	}
+	if err != nil {
+		renderError(c, internalError("Failed to get folder", err))
+		return false
+	}
+	return true
+}
+
+// 将用户的文件移动到指定文件夹，folderID 为空表示根目录。目标文件夹下已有同名文件时，
+// overwrite 为 true 则将该文件移入回收站，否则返回 errNameConflict；该文件受保护时返回 errFileProtected。
+// 文件不存在时返回 sql.ErrNoRows，目标文件夹已被删除时返回 errFolderNotFound
+func moveFile(ctx context.Context, db *sql.DB, ownerID, id int, folderID *int, overwrite bool) (File, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return File{}, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NULL`
+	file, err := scanFile(tx.QueryRowContext(ctx, query, id, ownerID))
+	if err != nil {
+		return File{}, err
+	}
+
+	var conflictID int
+	var protected bool
+	conflictQuery := `SELECT id, protected FROM files WHERE owner_id = ? AND folder_id IS ? AND name = ? AND id != ? AND deleted_at IS NULL AND ` + fileNotExpired + ` ORDER BY id LIMIT 1`
+	err = tx.QueryRowContext(ctx, conflictQuery, ownerID, folderID, file.Name, id, time.Now().UTC()).Scan(&conflictID, &protected)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return File{}, err
+	case !overwrite:
+		return File{}, errNameConflict
+	case protected:
+		return File{}, errFileProtected
+	default:
+		if _, err := tx.ExecContext(ctx, `UPDATE files SET deleted_at = ? WHERE id = ?`, time.Now().UTC(), conflictID); err != nil {
+			return File{}, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE files SET folder_id = ? WHERE id = ?`, folderID, id); err != nil {
+		if isForeignKeyViolation(err) {
+			return File{}, errFolderNotFound
+		}
+		return File{}, err
+	}
+	file.FolderID = folderID
+	return file, tx.Commit()
+}
+
+// 获取文件的完整路径，如 /docs/2024/report.pdf
+func filePath(ctx context.Context, db *sql.DB, file File) (string, error) {
+	if file.FolderID == nil {
+		return "/" + file.Name, nil
+	}
+	query := `
+	WITH RECURSIVE chain (id, name, parent_id, depth) AS (
+		SELECT id, name, parent_id, 0 FROM folders WHERE id = ? AND owner_id = ?
+		UNION ALL
+		SELECT folders.id, folders.name, folders.parent_id, chain.depth + 1 FROM folders JOIN chain ON folders.id = chain.parent_id
+	)
+	SELECT name FROM chain ORDER BY depth DESC`
+	rows, err := db.QueryContext(ctx, query, *file.FolderID, file.OwnerID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	path := ""
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+		path += "/" + name
+	}
+	return path + "/" + file.Name, rows.Err()
+}
+
+// 添加文件夹，返回包含 id 的文件夹信息；同一目录下已有同名文件夹时返回 errFolderExists，
+// 父文件夹已被删除时返回 errFolderNotFound
+func addFolder(ctx context.Context, db *sql.DB, folder Folder) (Folder, error) {
+	insertQuery := `INSERT INTO folders (name, parent_id, owner_id, created_at) VALUES (?, ?, ?, ?) RETURNING id`
+	err := db.QueryRowContext(ctx, insertQuery, folder.Name, folder.ParentID, folder.OwnerID, folder.CreatedAt).Scan(&folder.ID)
+	if isUniqueViolation(err) {
+		return folder, errFolderExists
+	}
+	if isForeignKeyViolation(err) {
+		return folder, errFolderNotFound
+	}
+	return folder, err
+}
+
+// 获取用户的文件夹；不存在或不属于该用户时返回 sql.ErrNoRows
+func getFolder(ctx context.Context, db *sql.DB, ownerID, id int) (Folder, error) {
+	var folder Folder
+	query := `SELECT id, name, parent_id, owner_id, created_at FROM folders WHERE id = ? AND owner_id = ?`
+	err := db.QueryRowContext(ctx, query, id, ownerID).Scan(&folder.ID, &folder.Name, &folder.ParentID, &folder.OwnerID, &folder.CreatedAt)
+	return folder, err
+}
+
+// 获取用户在指定目录下的子文件夹，parentID 为空时获取根目录下的文件夹
+func getChildFolders(ctx context.Context, db *sql.DB, ownerID int, parentID *int) ([]Folder, error) {
+	query := `SELECT id, name, parent_id, owner_id, created_at FROM folders WHERE owner_id = ? AND parent_id IS ? ORDER BY name`
+	rows, err := db.QueryContext(ctx, query, ownerID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []Folder{}
+	for rows.Next() {
+		var folder Folder
+		if err := rows.Scan(&folder.ID, &folder.Name, &folder.ParentID, &folder.OwnerID, &folder.CreatedAt); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// 更新文件夹的名称和父文件夹；新的父文件夹是其自身或子文件夹时返回 errFolderCycle，
+// 同一目录下已有同名文件夹时返回 errFolderExists，新的父文件夹已被删除时返回 errFolderNotFound
+func updateFolder(ctx context.Context, db *sql.DB, folder Folder) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if folder.ParentID != nil {
+		ids, err := folderTree(ctx, tx, folder.OwnerID, folder.ID)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if id == *folder.ParentID {
+				return errFolderCycle
+			}
+		}
+	}
+
+	updateQuery := `UPDATE folders SET name = ?, parent_id = ? WHERE id = ? AND owner_id = ?`
+	if _, err := tx.ExecContext(ctx, updateQuery, folder.Name, folder.ParentID, folder.ID, folder.OwnerID); err != nil {
+		if isUniqueViolation(err) {
+			return errFolderExists
+		}
+		if isForeignKeyViolation(err) {
+			return errFolderNotFound
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// 删除用户的文件夹，recursive 为 true 时连同子文件夹一起删除，其中的文件移入回收站，返回移入回收站的文件数。
+// 回收站中原本位于这些文件夹的文件恢复时回到根目录。
+// 文件夹不存在时返回 sql.ErrNoRows；不为空且 recursive 为 false 时返回 errFolderNotEmpty，
+// 包含受保护的文件时返回 errFileProtected
+func deleteFolder(ctx context.Context, db *sql.DB, ownerID, id int, recursive bool) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	ids, err := folderTree(ctx, tx, ownerID, id)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, sql.ErrNoRows
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	if !recursive {
+		var hasFiles bool
+		query := `SELECT EXISTS(SELECT 1 FROM files WHERE folder_id = ? AND deleted_at IS NULL)`
+		if err := tx.QueryRowContext(ctx, query, id).Scan(&hasFiles); err != nil {
+			return 0, err
+		}
+		if hasFiles || len(ids) > 1 {
+			return 0, errFolderNotEmpty
+		}
+	}
+
+	var hasProtected bool
+	protectedQuery := `SELECT EXISTS(SELECT 1 FROM files WHERE folder_id IN (` + placeholders + `) AND deleted_at IS NULL AND protected)`
+	if err := tx.QueryRowContext(ctx, protectedQuery, args...).Scan(&hasProtected); err != nil {
+		return 0, err
+	}
+	if hasProtected {
+		return 0, errFileProtected
+	}
+
+	trashQuery := `UPDATE files SET deleted_at = ? WHERE folder_id IN (` + placeholders + `) AND deleted_at IS NULL`
+	result, err := tx.ExecContext(ctx, trashQuery, append([]any{time.Now().UTC()}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE files SET folder_id = NULL WHERE folder_id IN (`+placeholders+`)`, args...); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM folders WHERE id IN (`+placeholders+`)`, args...); err != nil {
+		return 0, err
+	}
+	return int(deleted), tx.Commit()
+}
+
+// 获取文件夹自身及其所有子文件夹的 id；文件夹不存在时返回空列表
+func folderTree(ctx context.Context, tx *sql.Tx, ownerID, id int) ([]int, error) {
+	query := `
+	WITH RECURSIVE tree (id) AS (
+		SELECT id FROM folders WHERE id = ? AND owner_id = ?
+		UNION
+		SELECT folders.id FROM folders JOIN tree ON folders.parent_id = tree.id
+	)
+	SELECT id FROM tree`
+	rows, err := tx.QueryContext(ctx, query, id, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
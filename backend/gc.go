@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 报告中最多列出的被回收的内容数，总数和字节数不受限制
+const maxGCReportBlobs = 1000
+
+// 垃圾回收同一时间只运行一次，定期回收和 POST /admin/gc 共用
+var garbageCollection sync.Mutex
+
+// GCBlob 被回收（或试运行时将被回收）的内容
+type GCBlob struct {
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GCReport 一次垃圾回收的结果
+type GCReport struct {
+	DryRun          bool      `json:"dry_run"`
+	Blobs           int       `json:"blobs"`            // 回收的内容数
+	Bytes           int64     `json:"bytes"`            // 回收的内容大小之和
+	RefcountsFixed  int       `json:"refcounts_fixed"`  // 引用计数与实际引用不一致而被修正的内容数
+	RecordsRestored int       `json:"records_restored"` // 被文件引用但缺少记录、重新创建记录的内容数
+	RecentSkipped   int       `json:"recent_skipped"`   // 没有引用但创建时间在保护期内、本次没有回收的内容数
+	Collected       []GCBlob  `json:"collected"`        // 回收的内容，最多列出 maxGCReportBlobs 个
+	StartedAt       time.Time `json:"started_at"`
+	DurationMS      int64     `json:"duration_ms"`
+}
+
+// 注册垃圾回收接口，仅管理员可以访问
+func registerGCRoutes(admin gin.IRouter, cfg Config, db *sql.DB, store Storage) {
+	// 立即执行一次垃圾回收并返回结果；dry_run 为 true 时只报告将被回收的内容，不做任何修改。
+	// 已经在回收时返回 409
+	admin.POST("/gc", func(c *gin.Context) {
+		dryRun, err := queryBool(c, "dry_run")
+		if err != nil {
+			renderError(c, invalidRequest("Invalid dry_run, must be true or false"))
+			return
+		}
+		if !garbageCollection.TryLock() {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Garbage collection is already running"))
+			return
+		}
+		defer garbageCollection.Unlock()
+		report, err := collectGarbage(c.Request.Context(), db, store, cfg.GCGracePeriod, dryRun)
+		if err != nil {
+			renderError(c, internalError("Failed to collect garbage", err))
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+}
+
+// 每隔 interval 执行一次垃圾回收，直到 ctx 被取消；interval 为 0 时不定期回收
+func runGarbageCollector(ctx context.Context, db *sql.DB, store Storage, interval, grace time.Duration) {
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// 正在通过接口回收时跳过这一次
+		if !garbageCollection.TryLock() {
+			continue
+		}
+		if _, err := collectGarbage(ctx, db, store, grace, false); err != nil {
+			slog.Error("Failed to collect garbage", "error", err)
+		}
+		garbageCollection.Unlock()
+	}
+}
+
+// 按 files 和 file_versions 中的实际引用重新计算内容的引用计数，删除没有引用的内容。
+// 计数和删除记录在一个事务中完成，数据库的写事务互斥，正在提交的上传要么已计入引用，要么在回收后重新创建记录；
+// 存储后端中的内容在提交后由 deleteUnusedContent 删除，期间被重新上传的内容会保留。
+// 创建时间在 grace 之内的内容即使没有引用也不回收，留给进行中的操作；dryRun 为 true 时回滚事务，只返回结果。
+// 存储后端无法列出内容，已保存到后端但从未创建记录的内容（如保存记录前进程退出）不在回收范围内
+func collectGarbage(ctx context.Context, db *sql.DB, store Storage, grace time.Duration, dryRun bool) (GCReport, error) {
+	start := time.Now().UTC()
+	report := GCReport{DryRun: dryRun, Collected: []GCBlob{}, StartedAt: start}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	// 临时表只在当前连接中可见，结束前删除
+	refsQuery := `
+	CREATE TEMP TABLE IF NOT EXISTS gc_refs (hash TEXT PRIMARY KEY, refcount INTEGER NOT NULL, size INTEGER NOT NULL);
+	DELETE FROM gc_refs;
+	INSERT INTO gc_refs (hash, refcount, size)
+	SELECT CASE WHEN hash_algo = 'sha256' THEN hash ELSE hash_algo || ':' || hash END, COUNT(*), MAX(size)
+	FROM (SELECT hash_algo, hash, size FROM files UNION ALL SELECT hash_algo, hash, size FROM file_versions)
+	GROUP BY 1`
+	if _, err := tx.ExecContext(ctx, refsQuery); err != nil {
+		return report, err
+	}
+	restoreQuery := `
+	INSERT INTO blobs (hash, size, refcount, created_at)
+	SELECT hash, size, refcount, ? FROM gc_refs WHERE hash NOT IN (SELECT hash FROM blobs)`
+	if report.RecordsRestored, err = execCount(ctx, tx, restoreQuery, start); err != nil {
+		return report, err
+	}
+	fixQuery := `
+	UPDATE blobs SET refcount = IFNULL((SELECT refcount FROM gc_refs WHERE gc_refs.hash = blobs.hash), 0)
+	WHERE refcount != IFNULL((SELECT refcount FROM gc_refs WHERE gc_refs.hash = blobs.hash), 0)`
+	if report.RefcountsFixed, err = execCount(ctx, tx, fixQuery); err != nil {
+		return report, err
+	}
+	if report.RefcountsFixed > 0 || report.RecordsRestored > 0 {
+		slog.WarnContext(ctx, "Content reference counts drifted", "fixed", report.RefcountsFixed, "restored", report.RecordsRestored, "dry_run", dryRun)
+	}
+
+	cutoff := start.Add(-grace)
+	rows, err := tx.QueryContext(ctx, `SELECT hash, size, created_at FROM blobs WHERE refcount = 0 ORDER BY created_at, hash`)
+	if err != nil {
+		return report, err
+	}
+	var unused []GCBlob
+	for rows.Next() {
+		var blob GCBlob
+		if err := rows.Scan(&blob.Hash, &blob.Size, &blob.CreatedAt); err != nil {
+			rows.Close()
+			return report, err
+		}
+		if blob.CreatedAt.After(cutoff) {
+			report.RecentSkipped++
+			continue
+		}
+		unused = append(unused, blob)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	hashes := make([]string, 0, len(unused))
+	for _, blob := range unused {
+		if err := deleteBlob(ctx, tx, blob.Hash); err != nil {
+			return report, err
+		}
+		hashes = append(hashes, blob.Hash)
+		report.Blobs++
+		report.Bytes += blob.Size
+		if len(report.Collected) < maxGCReportBlobs {
+			report.Collected = append(report.Collected, blob)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DROP TABLE gc_refs`); err != nil {
+		return report, err
+	}
+
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			return report, err
+		}
+		deleteUnusedContent(db, store, hashes)
+		gcReclaimedBlobs.Add(float64(report.Blobs))
+		gcReclaimedBytes.Add(float64(report.Bytes))
+	}
+	report.DurationMS = time.Since(start).Milliseconds()
+	slog.InfoContext(ctx, "Garbage collection finished", "blobs", report.Blobs, "bytes", report.Bytes,
+		"recent_skipped", report.RecentSkipped, "dry_run", dryRun, "duration_ms", report.DurationMS)
+	return report, nil
+}
+
+// 执行语句并返回影响的行数
+func execCount(ctx context.Context, tx *sql.Tx, query string, args ...any) (int, error) {
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// 支持的内容哈希算法；sha1 只用于与旧工具互通
+const (
+	hashSHA256     = "sha256"
+	hashBLAKE2b256 = "blake2b-256"
+	hashSHA1       = "sha1"
+)
+
+// 各算法的哈希函数
+var hashAlgorithms = map[string]func() hash.Hash{
+	hashSHA256: sha256.New,
+	hashBLAKE2b256: func() hash.Hash {
+		// 不使用密钥时不会返回错误
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	hashSHA1: sha1.New,
+}
+
+// 创建指定算法的哈希函数；算法已在读取配置或请求时校验
+func newHash(algo string) hash.Hash {
+	return hashAlgorithms[algo]()
+}
+
+// 检查 digest 是否为该算法的十六进制小写摘要
+func isValidDigest(algo, digest string) bool {
+	newFunc, ok := hashAlgorithms[algo]
+	if !ok || len(digest) != newFunc().Size()*2 {
+		return false
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// 内容在 blobs 表、缩略图和存储后端中的键。sha256 内容使用摘要本身以兼容之前的数据，
+// 其他算法加上算法名前缀，不同算法的摘要即使字面相同也不会被当作同一内容
+func blobKey(algo, digest string) string {
+	if algo == hashSHA256 {
+		return digest
+	}
+	return algo + ":" + digest
+}
+
+// 将内容的键拆分为算法和摘要
+func splitBlobKey(key string) (string, string) {
+	if algo, digest, ok := strings.Cut(key, ":"); ok {
+		return algo, digest
+	}
+	return hashSHA256, key
+}
+
+// 文件当前内容的键
+func (f File) blobKey() string {
+	return blobKey(f.HashAlgo, f.Hash)
+}
+
+// 将所有文件和历史版本的内容重新按 algo 计算哈希，相同内容的引用合并到新的键下，原内容从存储后端删除。
+// 每个内容在单独的事务中迁移，中途失败时已迁移的内容保持新的哈希，可以重新执行
+func rehashContent(ctx context.Context, db *sql.DB, store Storage, algo string) error {
+	query := `
+	SELECT hash_algo, hash FROM files WHERE hash_algo != ?
+	UNION SELECT hash_algo, hash FROM file_versions WHERE hash_algo != ?`
+	rows, err := db.QueryContext(ctx, query, algo, algo)
+	if err != nil {
+		return err
+	}
+	type digest struct{ algo, hash string }
+	var digests []digest
+	for rows.Next() {
+		var d digest
+		if err := rows.Scan(&d.algo, &d.hash); err != nil {
+			rows.Close()
+			return err
+		}
+		digests = append(digests, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	slog.Info("Rehashing file content", "algorithm", algo, "blobs", len(digests))
+	for _, d := range digests {
+		newHash, err := rehashBlob(ctx, db, store, d.algo, d.hash, algo)
+		if err != nil {
+			return fmt.Errorf("failed to rehash %s: %w", blobKey(d.algo, d.hash), err)
+		}
+		slog.Debug("Rehashed content", "from", blobKey(d.algo, d.hash), "to", blobKey(algo, newHash))
+	}
+	slog.Info("Rehashed file content", "algorithm", algo, "blobs", len(digests))
+	return nil
+}
+
+// 按新算法保存一个内容并将引用转移过去，返回新的摘要。只在启动服务前执行，不需要锁定内容
+func rehashBlob(ctx context.Context, db *sql.DB, store Storage, oldAlgo, oldHash, algo string) (string, error) {
+	oldKey := blobKey(oldAlgo, oldHash)
+	content, _, err := store.Get(ctx, oldKey)
+	if err != nil {
+		return "", err
+	}
+	h := newHash(algo)
+	_, err = io.Copy(h, content)
+	content.Close()
+	if err != nil {
+		return "", err
+	}
+	newDigest := hex.EncodeToString(h.Sum(nil))
+	newKey := blobKey(algo, newDigest)
+
+	content, _, err = store.Get(ctx, oldKey)
+	if err != nil {
+		return "", err
+	}
+	created, err := putContent(ctx, store, newKey, content)
+	content.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := moveBlobReferences(ctx, db, oldAlgo, oldHash, algo, newDigest); err != nil {
+		if created {
+			discardContent(store, newKey)
+		}
+		return "", err
+	}
+	deleteUnusedContent(db, store, []string{oldKey})
+	return newDigest, nil
+}
+
+// 在事务中将文件和历史版本的哈希改为新的摘要，并将引用计数合并到新的键下
+func moveBlobReferences(ctx context.Context, db *sql.DB, oldAlgo, oldHash, algo, newHash string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	oldKey, newKey := blobKey(oldAlgo, oldHash), blobKey(algo, newHash)
+	for _, table := range []string{"files", "file_versions"} {
+		updateQuery := `UPDATE ` + table + ` SET hash_algo = ?, hash = ? WHERE hash_algo = ? AND hash = ?`
+		if _, err := tx.ExecContext(ctx, updateQuery, algo, newHash, oldAlgo, oldHash); err != nil {
+			return err
+		}
+	}
+	var size, refcount int64
+	err = tx.QueryRowContext(ctx, `DELETE FROM blobs WHERE hash = ? RETURNING size, refcount`, oldKey).Scan(&size, &refcount)
+	if err == sql.ErrNoRows {
+		slog.Warn("Rehashed content has no blob record", "hash", oldKey)
+		return tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	insertQuery := `INSERT INTO blobs (hash, size, refcount, created_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT (hash) DO UPDATE SET refcount = refcount + excluded.refcount`
+	if _, err := tx.ExecContext(ctx, insertQuery, newKey, size, refcount, time.Now().UTC()); err != nil {
+		return err
+	}
+	if err := deleteThumbnails(ctx, tx, oldKey); err != nil {
+		return err
+	}
+	if err := deleteContentIndex(ctx, tx, oldKey); err != nil {
+		return err
+	}
+	if err := deleteFileMetadata(ctx, tx, oldKey); err != nil {
+		return err
+	}
+	// 内容没有变化，扫描结果沿用到新的键
+	if _, err := tx.ExecContext(ctx, `UPDATE OR REPLACE content_scans SET blob_key = ? WHERE blob_key = ?`, newKey, oldKey); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 就绪检查中每一项检查的超时时间
+const readinessTimeout = 2 * time.Second
+
+// 单项检查的结果
+type checkResult struct {
+	Status    string  `json:"status"` // ok 或 fail
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// 注册存活和就绪检查接口
+func registerHealthRoutes(r gin.IRouter, db *sql.DB, store Storage, disk *diskGuard) {
+	// 存活检查：进程能够处理请求即可
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// 就绪检查：数据库可以查询且存储位置可写，失败时返回 503 并指出失败的检查项。
+	// disk 为剩余空间最少的卷的剩余和保留空间，剩余空间不足时 low 为 true，只拒绝上传，不影响就绪状态
+	r.GET("/readyz", func(c *gin.Context) {
+		checks := []struct {
+			name string
+			fn   func(ctx context.Context) error
+		}{
+			{"database", db.PingContext},
+			{"files_table", func(ctx context.Context) error {
+				var id int
+				err := db.QueryRowContext(ctx, `SELECT id FROM files LIMIT 1`).Scan(&id)
+				if err == sql.ErrNoRows {
+					return nil
+				}
+				return err
+			}},
+			{"storage", func(context.Context) error {
+				return checkWritable(uploadTempDir(store))
+			}},
+		}
+
+		results := make(map[string]checkResult, len(checks))
+		status := http.StatusOK
+		var failed []string
+		for _, check := range checks {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+			start := time.Now()
+			err := check.fn(ctx)
+			cancel()
+
+			result := checkResult{Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status = "fail"
+				// 不返回文件路径，只保留错误原因
+				var pathErr *fs.PathError
+				if errors.As(err, &pathErr) {
+					err = pathErr.Err
+				}
+				result.Error = err.Error()
+				status = http.StatusServiceUnavailable
+				failed = append(failed, check.name)
+			}
+			results[check.name] = result
+		}
+
+		body := gin.H{"status": "ok", "checks": results}
+		if space, err := disk.lowest(); err == nil {
+			body["disk"] = gin.H{
+				"free_bytes":     space.FreeBytes,
+				"reserved_bytes": space.ReservedBytes,
+				"low":            space.AvailableBytes < 0,
+			}
+		}
+		if status != http.StatusOK {
+			body["status"] = "fail"
+			body["failed"] = failed
+		}
+		c.JSON(status, body)
+	})
+}
+
+// 在目录中创建并删除一个临时文件，检查目录是否可写
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(name); err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// 导入一项的结果
+const (
+	importImported = "imported"
+	importSkipped  = "skipped"
+	importFailed   = "failed"
+)
+
+// 导入目录的统计
+type importSummary struct {
+	imported, skipped, failed int
+	bytes                     int64
+}
+
+// 将 dir 下的所有文件导入为 username 的文件，子目录导入为同名的文件夹，逐项输出结果并在最后输出汇总。
+// 文件夹下已有同名文件时跳过，因此中断后可以重新执行；符号链接和特殊文件跳过，无法读取的文件记为失败并继续。
+// 内容与上传一样按哈希去重，逐个流式读取，不会整个读入内存。
+// 可以在服务运行时执行：数据库的修改都在事务中进行，与服务端内容删除的交错通过 content_deletions 协调。
+// dryRun 为 true 时只计算哈希并输出将要执行的操作，不修改数据库和存储后端
+func importDirectory(ctx context.Context, db *sql.DB, store Storage, hashAlgo, dir, username string, dryRun bool, out io.Writer) (importSummary, error) {
+	var summary importSummary
+	user, err := getUserByName(ctx, db, username)
+	if err == sql.ErrNoRows {
+		return summary, fmt.Errorf("user %q not found", username)
+	}
+	if err != nil {
+		return summary, err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return summary, err
+	} else if !info.IsDir() {
+		return summary, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	report := func(status, rel, detail string) {
+		switch status {
+		case importImported:
+			summary.imported++
+		case importSkipped:
+			summary.skipped++
+		case importFailed:
+			summary.failed++
+		}
+		if detail != "" {
+			fmt.Fprintf(out, "%-8s %s (%s)\n", status, rel, detail)
+		} else {
+			fmt.Fprintf(out, "%-8s %s\n", status, rel)
+		}
+	}
+
+	// 按相对路径缓存已找到或创建的文件夹，未创建的文件夹（dryRun）为 nil
+	folders := map[string]*int{".": nil}
+	missing := map[string]bool{}
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if walkErr != nil {
+			report(importFailed, rel, walkErr.Error())
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if rel == "." {
+			return nil
+		}
+		parent := path.Dir(rel)
+
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			report(importSkipped, rel, "symbolic link")
+			return nil
+		case d.IsDir():
+			if missing[parent] {
+				missing[rel] = true
+				return nil
+			}
+			folderID, created, err := findOrCreateFolder(ctx, db, user.ID, folders[parent], d.Name(), dryRun)
+			if err != nil {
+				report(importFailed, rel+"/", err.Error())
+				return fs.SkipDir
+			}
+			folders[rel] = folderID
+			missing[rel] = created && dryRun
+			return nil
+		case !d.Type().IsRegular():
+			report(importSkipped, rel, "not a regular file")
+			return nil
+		}
+
+		status, detail, size := importFile(ctx, db, store, hashAlgo, user.ID, folders[parent], missing[parent], p, d.Name(), dryRun)
+		if status == importImported {
+			summary.bytes += size
+		}
+		report(status, rel, detail)
+		return nil
+	})
+	return summary, err
+}
+
+// 查找 parentID 下名为 name 的文件夹，不存在时创建，返回文件夹 id 和是否新建；
+// dryRun 时不创建，返回 nil 和 true
+func findOrCreateFolder(ctx context.Context, db *sql.DB, ownerID int, parentID *int, name string, dryRun bool) (*int, bool, error) {
+	for {
+		var id int
+		query := `SELECT id FROM folders WHERE owner_id = ? AND parent_id IS ? AND name = ?`
+		err := db.QueryRowContext(ctx, query, ownerID, parentID, name).Scan(&id)
+		if err == nil {
+			return &id, false, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, false, err
+		}
+		if dryRun {
+			return nil, true, nil
+		}
+		folder, err := addFolder(ctx, db, Folder{Name: name, ParentID: parentID, OwnerID: ownerID, CreatedAt: time.Now().UTC()})
+		// 同时被其他请求创建时重新查找
+		if errors.Is(err, errFolderExists) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return &folder.ID, true, nil
+	}
+}
+
+// 导入一个文件，返回结果、说明和文件大小。folderMissing 为 true 表示 dryRun 时文件夹尚未创建，其中不会有同名文件
+func importFile(ctx context.Context, db *sql.DB, store Storage, hashAlgo string, ownerID int, folderID *int, folderMissing bool, p, name string, dryRun bool) (string, string, int64) {
+	name = sanitizeFileName(name)
+	repo := newFileRepository(db)
+	if !folderMissing {
+		existing, err := repo.GetByName(ctx, ownerID, folderID, name)
+		if err == nil {
+			return importSkipped, "file with the same name exists, file " + fmt.Sprint(existing.ID), 0
+		}
+		if !errors.Is(err, errNotFound) {
+			return importFailed, err.Error(), 0
+		}
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return importFailed, err.Error(), 0
+	}
+	defer f.Close()
+	if dryRun {
+		_, size, err := copyAndHash(io.Discard, f, hashAlgo)
+		if err != nil {
+			return importFailed, err.Error(), 0
+		}
+		return importImported, "dry run", size
+	}
+
+	mimeType, body, err := detectContentType(f, "", name)
+	if err != nil {
+		return importFailed, err.Error(), 0
+	}
+	file := File{
+		HashAlgo:  hashAlgo,
+		Name:      name,
+		Mime:      mimeType,
+		CreatedAt: time.Now().UTC(),
+		OwnerID:   ownerID,
+		FolderID:  folderID,
+	}
+	file, err = storeFile(ctx, db, store, file, body, "", false)
+	if errors.Is(err, errQuotaExceeded) {
+		return importFailed, "storage quota exceeded", 0
+	}
+	if errors.Is(err, errFileInfected) {
+		return importFailed, err.Error(), 0
+	}
+	if err != nil {
+		return importFailed, err.Error(), 0
+	}
+	if err := ensureImportedContent(ctx, db, store, file, p); err != nil {
+		slog.Error("Imported file content may be missing", "file_id", file.ID, "path", p, "error", err)
+		return importFailed, "file " + fmt.Sprint(file.ID) + " was created but its content could not be confirmed: " + err.Error(), 0
+	}
+	return importImported, "file " + fmt.Sprint(file.ID), file.Size
+}
+
+// 文件记录提交后确认内容仍然存在：服务端可能在导入确认内容已存在之后、提交引用之前删除了相同的内容，
+// 等待删除结束后内容不存在时，从原文件重新保存，并校验原文件在期间没有改变
+func ensureImportedContent(ctx context.Context, db *sql.DB, store Storage, file File, p string) error {
+	unlock := lockContent(file.blobKey())
+	defer unlock()
+	if err := awaitContentDeletion(ctx, db, file.blobKey()); err != nil {
+		return err
+	}
+	exists, err := store.Exists(ctx, file.blobKey())
+	if err != nil || exists {
+		return err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmp, err := os.CreateTemp(uploadTempDir(store), "import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash, _, err := copyAndHash(tmp, f, file.HashAlgo)
+	if err != nil {
+		return err
+	}
+	if hash != file.Hash {
+		return errHashMismatch
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	slog.Warn("Restoring imported content removed by a concurrent deletion", "hash", file.blobKey())
+	return store.Put(ctx, file.blobKey(), tmp)
+}
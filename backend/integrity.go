@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 后台完整性扫描每轮的时长，每轮最多校验 IntegrityScanRate 个内容并输出汇总
+const integrityScanCycle = time.Hour
+
+// 负载过高时暂停扫描，等待该时间后再检查
+const integrityScanPause = 10 * time.Second
+
+// 完整性问题的状态过滤
+const (
+	integrityOpen     = "open"
+	integrityResolved = "resolved"
+	integrityAll      = "all"
+)
+
+// 正在处理的请求数，后台扫描据此判断负载
+var inFlightRequests atomic.Int64
+
+// 统计正在处理的请求数
+func inFlightMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inFlightRequests.Add(1)
+		defer inFlightRequests.Add(-1)
+		c.Next()
+	}
+}
+
+// IntegrityIssue 后台扫描发现的内容问题；内容再次通过校验或已被删除时标记为已解决
+type IntegrityIssue struct {
+	ID         int            `json:"id"`
+	Hash       string         `json:"hash"`
+	HashAlgo   string         `json:"hash_algo"`
+	Problem    string         `json:"problem"`
+	ActualHash string         `json:"actual_hash,omitempty"`
+	ActualSize *int64         `json:"actual_size,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	DetectedAt time.Time      `json:"detected_at"`
+	LastSeenAt time.Time      `json:"last_seen_at"`
+	ResolvedAt *time.Time     `json:"resolved_at,omitempty"`
+	Files      []AffectedFile `json:"files"`
+}
+
+// 注册完整性问题接口，仅管理员可以访问
+func registerIntegrityRoutes(admin gin.IRouter, cfg Config, db *sql.DB) {
+	// 分页查询后台扫描发现的问题，最新发现的在前；status 为 open（默认）、resolved 或 all。
+	// scan 中为扫描的配置和进度
+	admin.GET("/integrity", func(c *gin.Context) {
+		status := c.DefaultQuery("status", integrityOpen)
+		if status != integrityOpen && status != integrityResolved && status != integrityAll {
+			renderError(c, invalidRequest("Invalid status, must be open, resolved or all"))
+			return
+		}
+		limit, err := queryInt(c, "limit", defaultPageLimit)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxPageLimit)))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil || offset < 0 {
+			renderError(c, invalidRequest("Invalid offset, must be a non-negative integer"))
+			return
+		}
+
+		ctx := c.Request.Context()
+		issues, total, err := listIntegrityIssues(ctx, db, status, limit, offset)
+		if err != nil {
+			renderError(c, internalError("Failed to get integrity issues", err))
+			return
+		}
+		var unverified int
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM blobs WHERE last_verified_at IS NULL`).Scan(&unverified); err != nil {
+			renderError(c, internalError("Failed to get integrity issues", err))
+			return
+		}
+		var oldest *time.Time
+		query := `SELECT last_verified_at FROM blobs WHERE last_verified_at IS NOT NULL ORDER BY last_verified_at LIMIT 1`
+		if err := db.QueryRowContext(ctx, query).Scan(&oldest); err != nil && err != sql.ErrNoRows {
+			renderError(c, internalError("Failed to get integrity issues", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"issues": issues,
+			"total":  total,
+			"limit":  limit,
+			"offset": offset,
+			"scan": gin.H{
+				"enabled":            cfg.IntegrityScan,
+				"rate_per_hour":      cfg.IntegrityScanRate,
+				"unverified_blobs":   unverified,
+				"oldest_verified_at": oldest,
+			},
+		})
+	})
+}
+
+// 查询指定状态的问题及总数
+func listIntegrityIssues(ctx context.Context, db *sql.DB, status string, limit, offset int) ([]IntegrityIssue, int, error) {
+	where := ""
+	switch status {
+	case integrityOpen:
+		where = " WHERE resolved_at IS NULL"
+	case integrityResolved:
+		where = " WHERE resolved_at IS NOT NULL"
+	}
+	var total int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM integrity_issues`+where).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := `
+	SELECT id, hash, problem, IFNULL(actual_hash, ''), actual_size, IFNULL(error, ''), detected_at, last_seen_at, resolved_at
+	FROM integrity_issues` + where + ` ORDER BY detected_at DESC, id DESC LIMIT ? OFFSET ?`
+	rows, err := db.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	issues := []IntegrityIssue{}
+	for rows.Next() {
+		var issue IntegrityIssue
+		if err := rows.Scan(&issue.ID, &issue.Hash, &issue.Problem, &issue.ActualHash, &issue.ActualSize, &issue.Error,
+			&issue.DetectedAt, &issue.LastSeenAt, &issue.ResolvedAt); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		issues = append(issues, issue)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	for i := range issues {
+		issues[i].HashAlgo, issues[i].Hash = splitBlobKey(issues[i].Hash)
+		if issues[i].Files, err = blobFiles(ctx, db, issues[i].HashAlgo, issues[i].Hash); err != nil {
+			return nil, 0, err
+		}
+	}
+	return issues, total, nil
+}
+
+// 在后台持续校验内容，每轮 integrityScanCycle 内均匀地校验 rate 个内容，最久未校验的优先，直到 ctx 被取消。
+// 校验时间记录在 blobs.last_verified_at 中，重启后从最久未校验的内容继续；
+// 正在处理的请求数达到 maxRequests 或数据库连接已用尽时暂停
+func runIntegrityScan(ctx context.Context, db *sql.DB, store Storage, rate, maxRequests int) {
+	interval := integrityScanCycle / time.Duration(rate)
+	slog.Info("Started integrity scan", "rate_per_hour", rate)
+	cycleStart := time.Now()
+	verified, issues := 0, 0
+	var waits int64
+	for {
+		wait := interval
+		busy, w := integrityScanBusy(db, maxRequests, waits)
+		waits = w
+		if busy {
+			wait = integrityScanPause
+		} else if verified < rate {
+			problem, ok, err := scanNextBlob(ctx, db, store)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("Integrity scan failed", "error", err)
+			}
+			if ok {
+				verified++
+			}
+			if problem != nil {
+				issues++
+			}
+		}
+		if time.Since(cycleStart) >= integrityScanCycle {
+			resolveDeletedIssues(ctx, db)
+			slog.Info("Integrity scan cycle finished", "verified", verified, "issues", issues)
+			cycleStart = time.Now()
+			verified, issues = 0, 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// 判断是否需要暂停扫描：正在处理的请求数达到 maxRequests，或数据库连接已用尽、
+// 自上次检查以来有请求在等待连接（waits 为上次检查时的等待次数），同时返回当前的等待次数
+func integrityScanBusy(db *sql.DB, maxRequests int, waits int64) (bool, int64) {
+	stats := db.Stats()
+	if inFlightRequests.Load() >= int64(maxRequests) {
+		return true, stats.WaitCount
+	}
+	return stats.InUse >= dbMaxOpenConns || stats.WaitCount > waits, stats.WaitCount
+}
+
+// 校验最久未校验的内容并记录结果，返回发现的问题和是否校验了内容；没有内容时返回 false
+func scanNextBlob(ctx context.Context, db *sql.DB, store Storage) (*VerifyProblem, bool, error) {
+	var blob verifyBlob
+	err := db.QueryRowContext(ctx, `SELECT hash, size FROM blobs ORDER BY last_verified_at, hash LIMIT 1`).Scan(&blob.key, &blob.size)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	problem, err := verifyBlobContent(ctx, db, store, blob)
+	if err != nil {
+		return nil, false, err
+	}
+	return problem, true, recordIntegrityResult(ctx, db, blob.key, problem)
+}
+
+// 记录内容的校验时间；有问题时新增或更新未解决的问题，没有问题时将之前的问题标记为已解决
+func recordIntegrityResult(ctx context.Context, db *sql.DB, key string, problem *VerifyProblem) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `UPDATE blobs SET last_verified_at = ? WHERE hash = ?`, now, key); err != nil {
+		return err
+	}
+	if problem == nil {
+		if _, err := tx.ExecContext(ctx, `UPDATE integrity_issues SET resolved_at = ? WHERE hash = ? AND resolved_at IS NULL`, now, key); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	var actualHash, errText *string
+	if problem.ActualHash != "" {
+		actualHash = &problem.ActualHash
+	}
+	if problem.Error != "" {
+		errText = &problem.Error
+	}
+	upsertQuery := `
+	INSERT INTO integrity_issues (hash, problem, actual_hash, actual_size, error, detected_at, last_seen_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (hash) WHERE resolved_at IS NULL DO UPDATE SET
+		problem = excluded.problem, actual_hash = excluded.actual_hash, actual_size = excluded.actual_size,
+		error = excluded.error, last_seen_at = excluded.last_seen_at`
+	if _, err := tx.ExecContext(ctx, upsertQuery, key, problem.Problem, actualHash, problem.ActualSize, errText, now, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Warn("Integrity scan found a problem", "hash", key, "problem", problem.Problem, "files", len(problem.Files))
+	return nil
+}
+
+// 内容已被删除的问题不会再被扫描到，标记为已解决
+func resolveDeletedIssues(ctx context.Context, db *sql.DB) {
+	updateQuery := `UPDATE integrity_issues SET resolved_at = ? WHERE resolved_at IS NULL AND hash NOT IN (SELECT hash FROM blobs)`
+	if _, err := db.ExecContext(ctx, updateQuery, time.Now().UTC()); err != nil && ctx.Err() == nil {
+		slog.Error("Failed to resolve integrity issues of deleted content", "error", err)
+	}
+}
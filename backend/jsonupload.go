@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /upload/json 的默认大小限制（解码后）
+const defaultMaxJSONUploadSize = 10 << 20
+
+// 注册以 JSON 上传的接口，供只能发送 JSON 的客户端使用；maxSize 为解码后内容的最大字节数，其余参数与 registerFileRoutes 相同
+func registerJSONUploadRoutes(r gin.IRouter, db *sql.DB, store Storage, maxSize int64, maxVersions int, hashAlgo, spoolDir string) {
+	repo := newFileRepository(db)
+
+	// 上传 {"name", "content_base64", "mime"} 描述的单个文件，content_base64 为标准 base64 编码的内容，mime 为可选的声明类型。
+	// 与 /upload 上传单个文件使用相同的保存逻辑和响应；可选的 folder_id、on_name_conflict（error、rename 或 replace，默认 error）
+	// 和 sha256 与 /upload 的 folder、on_name_conflict 和 sha256 表单字段相同
+	r.POST("/upload/json", limitBodySize(int64(base64.StdEncoding.EncodedLen(int(maxSize)))+maxFormValuesSize), func(c *gin.Context) {
+		defer trackUpload()()
+		detachDeadline(c)
+		var req struct {
+			Name           string  `json:"name"`
+			ContentBase64  *string `json:"content_base64"`
+			Mime           string  `json:"mime"`
+			FolderID       *int    `json:"folder_id"`
+			OnNameConflict string  `json:"on_name_conflict"`
+			SHA256         string  `json:"sha256"`
+		}
+		err := c.ShouldBindJSON(&req)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			uploadTooLarge(c, maxSize)
+			return
+		}
+		if err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if req.Name == "" || req.ContentBase64 == nil {
+			renderError(c, invalidRequest("name and content_base64 are required"))
+			return
+		}
+		name, err := cleanFileName(req.Name)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		req.Name = name
+		data, err := base64.StdEncoding.DecodeString(*req.ContentBase64)
+		if err != nil {
+			renderError(c, invalidRequest("Invalid content_base64, must be standard base64"))
+			return
+		}
+		if int64(len(data)) > maxSize {
+			uploadTooLarge(c, maxSize)
+			return
+		}
+		options := uploadOptions{}
+		switch req.OnNameConflict {
+		case "", nameConflictError:
+			options.OnConflict = uploadConflictReject
+		case nameConflictRename:
+			options.OnConflict = uploadConflictRename
+		case nameConflictReplace:
+			options.Replace = true
+		default:
+			renderError(c, invalidRequest("Invalid on_name_conflict, must be rename, error or replace"))
+			return
+		}
+		expectedHash := strings.ToLower(req.SHA256)
+		if expectedHash != "" && !isValidHash(expectedHash) {
+			renderError(c, invalidRequest("Invalid hash, must be 64 hex characters"))
+			return
+		}
+		ownerID := currentUserID(c)
+		if !checkTargetFolder(c, db, ownerID, req.FolderID) {
+			return
+		}
+
+		content, err := spoolContent(bytes.NewReader(data), spoolDir, hashAlgo, spoolMemoryLimit)
+		if err != nil {
+			renderError(c, internalError("Failed to receive upload", err))
+			return
+		}
+		defer content.Close()
+		part := uploadFormPart{filename: req.Name, contentType: req.Mime, content: content}
+		fileInfo, err := uploadFormFile(c.Request.Context(), db, store, hashAlgo, ownerID, req.FolderID, part, false, expectedHash, options)
+		renderUploadedFile(c, db, store, repo, maxVersions, currentUserID(c), req.Name, expectedHash, fileInfo, err)
+	})
+}
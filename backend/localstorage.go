@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// 存储目录下用于暂存上传内容的子目录
+const stagingDir = "tmp"
+
+// 将内容保存在本地目录中的存储后端，按哈希分两级子目录存放
+type localStorage struct {
+	dir string
+}
+
+// 创建存储目录及其临时目录
+func newLocalStorage(dir string) (*localStorage, error) {
+	if err := os.MkdirAll(filepath.Join(dir, stagingDir), 0o755); err != nil {
+		return nil, err
+	}
+	return &localStorage{dir: dir}, nil
+}
+
+// 根据键计算文件在存储目录中的相对路径，如 ab/cd/abcd1234...；
+// sha256 以外的内容放在以算法命名的目录下，如 sha1/ab/cd/abcd1234...
+func blobPath(key string) string {
+	algo, digest := splitBlobKey(key)
+	p := filepath.Join(digest[0:2], digest[2:4], digest)
+	if algo != hashSHA256 {
+		p = filepath.Join(algo, p)
+	}
+	return p
+}
+
+func (s *localStorage) tempDir() string {
+	return filepath.Join(s.dir, stagingDir)
+}
+
+// 先写入临时文件再移动到最终位置，读取者不会看到不完整的内容
+func (s *localStorage) Put(ctx context.Context, hash string, r io.Reader) error {
+	tmp, err := os.CreateTemp(s.tempDir(), "blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fullPath := filepath.Join(s.dir, blobPath(hash))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fullPath)
+}
+
+func (s *localStorage) Get(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(s.dir, blobPath(hash)))
+	if os.IsNotExist(err) {
+		return nil, 0, errBlobNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, hash string) error {
+	err := os.Remove(filepath.Join(s.dir, blobPath(hash)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localStorage) Exists(ctx context.Context, hash string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.dir, blobPath(hash)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
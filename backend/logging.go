@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 创建输出 JSON 格式日志的 logger，使用 Context 方法记录的日志带有请求 id
+func newLogger(level slog.Level) *slog.Logger {
+	return slog.New(requestIDHandler{slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})})
+}
+
+// 请求日志中间件，记录每个请求的请求 id、方法、路由、状态码、耗时、响应大小和客户端 IP，以及错误响应的内部原因。
+// 路径使用路由模板，避免分享链接的 token 等敏感参数出现在日志中
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		path := c.FullPath()
+		if path == "" {
+			path = c.Request.URL.Path
+		}
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", path,
+			"status", c.Writer.Status(),
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"bytes", max(c.Writer.Size(), 0),
+			"client_ip", c.ClientIP(),
+		}
+		if userID := currentUserID(c); userID != 0 {
+			attrs = append(attrs, "user_id", userID)
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+
+		switch status := c.Writer.Status(); {
+		case status >= http.StatusInternalServerError:
+			slog.ErrorContext(c.Request.Context(), "request", attrs...)
+		case status >= http.StatusBadRequest:
+			slog.WarnContext(c.Request.Context(), "request", attrs...)
+		default:
+			slog.InfoContext(c.Request.Context(), "request", attrs...)
+		}
+	}
+}
@@ -1,170 +1,260 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
 	"database/sql"
-	"encoding/hex"
-	"io"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
-	_ "modernc.org/sqlite"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// File 数据结构
-type File struct {
-	ID   int    `json:"id"`
-	Hash string `json:"hash"`
-	Name string `json:"name"`
-	File []byte `json:"-"`
-}
-
 func main() {
+	slog.SetDefault(newLogger(slog.LevelInfo))
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	if cfg.ShowVersion {
+		fmt.Println(version)
+		return
+	}
+	slog.SetDefault(newLogger(cfg.LogLevel))
+	gin.SetMode(cfg.GinMode)
+	slog.Info("Starting server", "version", version, "gin_mode", cfg.GinMode, "storage_backend", cfg.StorageBackend, "chunking", cfg.Chunking, "compression", cfg.Compression, "encryption", cfg.EncryptionKey != nil, "hash_algorithm", cfg.HashAlgorithm)
+
 	// 连接 SQLite 数据库
-	db, err := sql.Open("sqlite", "./files.db")
+	db, err := openDB(cfg.DBPath, cfg.DBBusyTimeout)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to open database", err)
 	}
-	defer db.Close()
 
 	// 初始化数据库
-	initDB(db)
-
-	r := gin.Default()
-	r.GET("/ping", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "pong",
-		})
-	})
+	if err := initDB(db, cfg.DefaultQuota); err != nil {
+		fatal("Failed to initialize database", err)
+	}
 
-	// 上传文件接口
-	r.POST("/upload", func(c *gin.Context) {
-		// 获取上传的文件
-		file, err := c.FormFile("file")
+	// 初始化存储后端，并迁移之前保存在数据库中的内容
+	store, err := newStorage(cfg, db)
+	if err != nil {
+		fatal("Failed to initialize storage", err)
+	}
+	if cfg.SpoolDir != "" {
+		if err := os.MkdirAll(cfg.SpoolDir, 0o700); err != nil {
+			fatal("Failed to create spool directory", err)
+		}
+	}
+	if err := migrateContent(context.Background(), db, store); err != nil {
+		fatal("Failed to migrate file content", err)
+	}
+	if cfg.EncryptContent {
+		if err := encryptContent(context.Background(), db, store); err != nil {
+			fatal("Failed to encrypt file content", err)
+		}
+		if err := db.Close(); err != nil {
+			slog.Error("Failed to close database", "error", err)
+		}
+		return
+	}
+	if err := checkContentEncryption(context.Background(), db, cfg.EncryptionKey != nil); err != nil {
+		fatal("Invalid content encryption configuration", err)
+	}
+	if cfg.ImportDir != "" {
+		summary, err := importDirectory(withScanner(context.Background(), newUploadScanner(cfg)), db, store, cfg.HashAlgorithm, cfg.ImportDir, cfg.ImportUser, cfg.DryRun, os.Stdout)
+		fmt.Printf("%d imported (%d bytes), %d skipped, %d failed\n", summary.imported, summary.bytes, summary.skipped, summary.failed)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "No file is uploaded"})
-			return
+			fatal("Failed to import files", err)
 		}
-
-		// 打开文件读取数据
-		fileContent, err := file.Open()
+		if err := db.Close(); err != nil {
+			slog.Error("Failed to close database", "error", err)
+		}
+		if summary.failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.ExportDir != "" {
+		options := exportOptions{Layout: cfg.ExportLayout, Since: cfg.ExportSince, Owner: cfg.ExportOwner}
+		manifest, err := exportFiles(context.Background(), db, store, cfg.ExportDir, options)
+		printExportFailures(os.Stdout, manifest.Failures)
+		fmt.Printf("%d exported, %d failed\n", len(manifest.Files), len(manifest.Failures))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
-			return
+			fatal("Failed to export files", err)
 		}
-		defer fileContent.Close()
-
-		// 计算文件哈希
-		hash := calculateHash(fileContent)
-
-		// 重置文件读取指针
-		fileContent.Seek(0, io.SeekStart)
-
-		// 检查文件是否已存在
-		exists, err := fileExists(db, hash)
+		if err := db.Close(); err != nil {
+			slog.Error("Failed to close database", "error", err)
+		}
+		if len(manifest.Failures) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.BackfillMetadata {
+		n, err := backfillMetadata(context.Background(), db, store, cfg.MetadataStripGPS)
+		fmt.Printf("%d processed\n", n)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check file existence"})
-			return
+			fatal("Failed to extract file metadata", err)
 		}
-		if exists {
-			c.JSON(http.StatusConflict, gin.H{"error": "File already exists"})
-			return
+		if err := db.Close(); err != nil {
+			slog.Error("Failed to close database", "error", err)
 		}
-
-		// 读取文件内容到内存
-		fileData, err := io.ReadAll(fileContent)
+		return
+	}
+	if cfg.ReindexContent {
+		n, err := reindexContent(context.Background(), db, store)
+		fmt.Printf("%d processed\n", n)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file content"})
-			return
+			fatal("Failed to reindex file content", err)
 		}
-
-		// 插入文件到数据库
-		fileInfo := File{
-			Hash: hash,
-			Name: file.Filename,
-			File: fileData,
+		if err := db.Close(); err != nil {
+			slog.Error("Failed to close database", "error", err)
 		}
-		if err := addFile(db, fileInfo); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file to database"})
-			return
+		return
+	}
+	if cfg.Rehash {
+		if err := rehashContent(context.Background(), db, store, cfg.HashAlgorithm); err != nil {
+			fatal("Failed to rehash file content", err)
 		}
+		if err := db.Close(); err != nil {
+			slog.Error("Failed to close database", "error", err)
+		}
+		return
+	}
 
-		c.JSON(http.StatusOK, gin.H{
-			"message":  "File uploaded successfully",
-			"filename": fileInfo.Name,
-			"hash":     fileInfo.Hash,
-		})
-	})
-
-	// 获取所有文件信息接口
-	r.GET("/files", func(c *gin.Context) {
-		files, err := getAllFiles(db)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get files"})
-			return
+	// 接口和后台清理任务在退出时停止
+	cleanupCtx, stopCleanup := context.WithCancel(context.Background())
+	registry := newMetricsRegistry(db)
+	r, err := newRouter(cleanupCtx, cfg, db, store, registry)
+	if err != nil {
+		fatal("Failed to create router", err)
+	}
+	// 启用 HTTPS 时在启动前读取证书，无法读取或解析时退出
+	var certs *certReloader
+	if cfg.TLSCertFile != "" {
+		if certs, err = newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			fatal("Failed to load TLS certificate", err)
 		}
-		c.JSON(http.StatusOK, files)
-	})
+	}
+	// 在后台清理长时间中断的上传、已过期的文件、审计日志和没有引用的内容，索引文本内容，开启时持续校验内容
+	go runContentIndexer(cleanupCtx, db, store)
+	go runMetadataExtractor(cleanupCtx, db, store, cfg.MetadataStripGPS)
+	go cleanupUploads(cleanupCtx, db, cfg.UploadExpiry)
+	go purgeExpiredFiles(cleanupCtx, db, store)
+	go pruneAuditLog(cleanupCtx, db, cfg.AuditRetention)
+	go runGarbageCollector(cleanupCtx, db, store, cfg.GCInterval, cfg.GCGracePeriod)
+	if cfg.IntegrityScan {
+		go runIntegrityScan(cleanupCtx, db, store, cfg.IntegrityScanRate, cfg.IntegrityScanMaxRequests)
+	}
+	if err := runServer(r, metricsHandler(registry), cfg, certs); err != nil {
+		slog.Error("Server error", "error", err)
+	}
+	stopCleanup()
+	if err := db.Close(); err != nil {
+		slog.Error("Failed to close database", "error", err)
+	}
+	slog.Info("Shutdown complete")
+}
 
-	r.Run() // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
+// 记录启动阶段无法恢复的错误并退出
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
-// 初始化数据库表
-func initDB(db *sql.DB) {
-	createTableQuery := `
-	CREATE TABLE IF NOT EXISTS files (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		hash TEXT NOT NULL UNIQUE,
-		name TEXT NOT NULL,
-		file BLOB NOT NULL
-	);`
-	_, err := db.Exec(createTableQuery)
+// 创建路由并注册所有接口；返回的 handler 同时兼容旧的无版本前缀路径。ctx 被取消时停止接口的后台任务
+func newRouter(ctx context.Context, cfg Config, db *sql.DB, store Storage, registry *prometheus.Registry) (http.Handler, error) {
+	// 上传、下载和列表接口的限流配置
+	limiter, err := newRateLimiter(ctx)
 	if err != nil {
-		log.Fatal("Failed to create table:", err)
+		return nil, fmt.Errorf("failed to configure rate limits: %w", err)
 	}
-}
 
-// 计算文件哈希
-func calculateHash(file io.Reader) string {
-	hash := sha256.New()
-	_, err := io.Copy(hash, file)
-	if err != nil {
-		log.Fatal("Failed to calculate hash:", err)
+	// 上传和下载的并发限制
+	concurrency := newConcurrencyLimiter(cfg.MaxConcurrentUploads, cfg.MaxConcurrentDownloads, cfg.ConcurrencyWait)
+
+	// 上传前检查数据库、存储和暂存目录所在卷的剩余空间
+	disk := newDiskGuard(cfg.DiskReserve, filepath.Dir(cfg.DBPath), uploadTempDir(store), uploadSpoolDir(cfg, store))
+
+	// 下载的带宽限制
+	bandwidth := newBandwidthLimiter(cfg.DownloadRateLimit, cfg.PerDownloadLimit)
+
+	// 上传内容的病毒扫描
+	scanner := newUploadScanner(cfg)
+
+	// 上传的文件类型限制
+	typePolicy := &fileTypePolicy{allowed: cfg.AllowedTypes, blocked: cfg.BlockedTypes}
+
+	// 文件事件的 webhook 投递
+	hooks := newWebhookDispatcher(db)
+
+	r := gin.New()
+	r.Use(inFlightMiddleware(), metricsMiddleware(), requestIDMiddleware(), requestLogger(), gin.CustomRecovery(func(c *gin.Context, err any) {
+		renderError(c, internalError("Internal server error", fmt.Errorf("panic: %v", err)))
+	}), bandwidth.middleware(), scanner.middleware(), typePolicy.middleware())
+	if len(cfg.CORSOrigins) > 0 {
+		r.Use(corsMiddleware(cfg.CORSOrigins))
 	}
-	return hex.EncodeToString(hash.Sum(nil))
-}
+	r.NoRoute(func(c *gin.Context) {
+		renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Not found"))
+	})
+	// 超过该大小的表单内容写入临时文件，而不是全部保存在内存中
+	r.MaxMultipartMemory = maxMultipartMemory
+	r.GET("/ping", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "pong",
+		})
+	})
 
-// 检查文件是否存在
-func fileExists(db *sql.DB, hash string) (bool, error) {
-	var exists bool
-	query := `SELECT EXISTS(SELECT 1 FROM files WHERE hash = ?)`
-	err := db.QueryRow(query, hash).Scan(&exists)
-	return exists, err
-}
+	// 存活和就绪检查接口
+	registerHealthRoutes(r, db, store, disk)
 
-// 添加文件到数据库
-func addFile(db *sql.DB, file File) error {
-	insertQuery := `INSERT INTO files (hash, name, file) VALUES (?, ?, ?)`
-	_, err := db.Exec(insertQuery, file.Hash, file.Name, file.File)
-	return err
-}
+	// 未单独监听时在主地址上提供指标
+	if cfg.MetricsAddr == "" {
+		r.GET("/metrics", gin.WrapH(metricsHandler(registry)))
+	}
 
-// 获取所有文件信息
-func getAllFiles(db *sql.DB) ([]File, error) {
-	rows, err := db.Query("SELECT id, hash, name FROM files")
-	if err != nil {
+	// v1 接口，所有接口都限制数据库操作的时间、记录审计日志并在响应头中标明版本
+	v1 := r.Group(apiV1Prefix, apiVersionMiddleware(apiVersion), dbTimeoutMiddleware(cfg.DBTimeout), auditLogger(db, hooks))
+	registerV1Routes(ctx, v1, cfg, db, hooks, store, limiter, concurrency, disk)
+
+	// WebDAV 接口，通过 HTTP Basic 认证登录，与 v1 接口一样限制数据库操作的时间并记录审计日志
+	if cfg.WebDAV {
+		dav := r.Group(davPrefix, dbTimeoutMiddleware(cfg.DBTimeout), auditLogger(db, hooks))
+		registerWebDAVRoutes(dav, db, store, limiter, cfg.MaxUploadSize, cfg.MaxVersions, cfg.HashAlgorithm, uploadSpoolDir(cfg, store), concurrency, disk)
+	}
+	if err := checkAuditRoutes(r.Routes()); err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return legacyRoutes(r), nil
+}
 
-	var files []File
-	for rows.Next() {
-		var file File
-		if err := rows.Scan(&file.ID, &file.Hash, &file.Name); err != nil {
-			return nil, err
+// 限制请求体的大小；声明的长度超过限制时直接拒绝，
+// 未声明或声明不实的请求在读取超过限制时被截断
+func limitBodySize(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			uploadTooLarge(c, limit)
+			c.Abort()
+			return
 		}
-		files = append(files, file)
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
 	}
-	return files, nil
+}
+
+// 返回上传内容过大的错误响应
+func uploadTooLarge(c *gin.Context, limit int64) {
+	renderError(c, newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge, "Upload exceeds the maximum size of "+strconv.FormatInt(limit, 10)+" bytes").with(gin.H{
+		"max_upload_size": limit,
+	}))
 }
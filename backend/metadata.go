@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// 后台提取每批处理的内容数
+const metadataBatch = 20
+
+// 没有待处理的内容时，后台提取再次检查的间隔；上传后会立即唤醒
+const metadataPoll = time.Minute
+
+// 读取 MP4 的 moov 盒子时最多读取的字节数
+const mp4MaxMoovBytes = 32 << 20
+
+// 支持提取元数据的 MIME 类型：图片读取 EXIF，音视频读取时长
+var metadataMediaTypes = map[string]func(io.Reader, string, *FileMetadata) error{
+	"image/jpeg":      readExif,
+	"image/png":       readExif,
+	"image/webp":      readExif,
+	"image/tiff":      readExif,
+	"video/mp4":       readMP4Info,
+	"video/quicktime": readMP4Info,
+	"video/3gpp":      readMP4Info,
+	"audio/mp4":       readMP4Info,
+	"audio/x-m4a":     readMP4Info,
+	"audio/wav":       readWAVInfo,
+	"audio/x-wav":     readWAVInfo,
+	"audio/wave":      readWAVInfo,
+	"audio/vnd.wave":  readWAVInfo,
+	"audio/flac":      readFLACInfo,
+	"audio/x-flac":    readFLACInfo,
+}
+
+// 内容的拍摄时间，没有元数据时为 NULL，用于按拍摄时间排序和过滤
+const takenAtSQL = `(SELECT taken_at FROM file_metadata WHERE file_metadata.blob_key = ` + fileBlobKeySQL + `)`
+
+// 唤醒后台提取，上传了新内容时调用；已有待处理的唤醒时不阻塞
+var metadataWake = make(chan struct{}, 1)
+
+func wakeMetadataExtractor() {
+	select {
+	case metadataWake <- struct{}{}:
+	default:
+	}
+}
+
+// FileMetadata 从内容中提取的元数据，没有的字段为空
+type FileMetadata struct {
+	TakenAt     *time.Time `json:"taken_at,omitempty"` // 拍摄时间，图片来自 EXIF，视频来自 mvhd 的创建时间
+	CameraMake  string     `json:"camera_make,omitempty"`
+	CameraModel string     `json:"camera_model,omitempty"`
+	Latitude    *float64   `json:"latitude,omitempty"` // GPS 坐标，启用 -metadata-strip-gps 时不保存
+	Longitude   *float64   `json:"longitude,omitempty"`
+	Duration    *float64   `json:"duration,omitempty"` // 音视频的时长（秒）
+	ExtractedAt time.Time  `json:"extracted_at"`
+}
+
+// 获取内容的元数据，尚未提取或没有元数据时返回 nil
+func getFileMetadata(ctx context.Context, db *sql.DB, key string) (*FileMetadata, error) {
+	var meta FileMetadata
+	var cameraMake, cameraModel sql.NullString
+	query := `SELECT taken_at, camera_make, camera_model, latitude, longitude, duration, extracted_at FROM file_metadata WHERE blob_key = ?`
+	err := db.QueryRowContext(ctx, query, key).Scan(&meta.TakenAt, &cameraMake, &cameraModel, &meta.Latitude, &meta.Longitude, &meta.Duration, &meta.ExtractedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta.CameraMake, meta.CameraModel = cameraMake.String, cameraModel.String
+	if meta.TakenAt == nil && meta.CameraMake == "" && meta.CameraModel == "" && meta.Latitude == nil && meta.Duration == nil {
+		return nil, nil
+	}
+	return &meta, nil
+}
+
+// 在后台提取新上传的图片和音视频内容的元数据，直到 ctx 被取消；上传后通过 wakeMetadataExtractor 立即唤醒，
+// 否则每 metadataPoll 检查一次，因此也会逐步处理功能上线前上传的内容。stripGPS 为 true 时不保存 GPS 坐标
+func runMetadataExtractor(ctx context.Context, db *sql.DB, store Storage, stripGPS bool) {
+	for {
+		n, err := extractPendingMetadata(ctx, db, store, stripGPS, metadataBatch)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Metadata extraction failed", "error", err)
+		}
+		if n == metadataBatch && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-metadataWake:
+		case <-time.After(metadataPoll):
+		}
+	}
+}
+
+// 重新提取所有内容的元数据，用于处理功能上线前上传的内容或修改 stripGPS 之后；返回处理的内容数
+func backfillMetadata(ctx context.Context, db *sql.DB, store Storage, stripGPS bool) (int, error) {
+	if _, err := db.ExecContext(ctx, `DELETE FROM file_metadata`); err != nil {
+		return 0, err
+	}
+	total := 0
+	for {
+		n, err := extractPendingMetadata(ctx, db, store, stripGPS, metadataBatch)
+		total += n
+		if err != nil || n < metadataBatch {
+			return total, err
+		}
+	}
+}
+
+// 提取最多 limit 个尚未处理的内容的元数据，返回处理的内容数
+func extractPendingMetadata(ctx context.Context, db *sql.DB, store Storage, stripGPS bool, limit int) (int, error) {
+	mediaTypes := make([]string, 0, len(metadataMediaTypes))
+	for mediaType := range metadataMediaTypes {
+		mediaTypes = append(mediaTypes, "'"+mediaType+"'")
+	}
+	pendingQuery := `
+	SELECT ` + fileBlobKeySQL + ` AS blob_key, MIN(` + fileMediaTypeSQL + `) FROM files
+	WHERE ` + fileMediaTypeSQL + ` IN (` + strings.Join(mediaTypes, ", ") + `) AND ` + fileBlobKeySQL + ` NOT IN (SELECT blob_key FROM file_metadata)
+	GROUP BY blob_key LIMIT ?`
+	rows, err := db.QueryContext(ctx, pendingQuery, limit)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct{ key, mediaType string }
+	var contents []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.key, &p.mediaType); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		contents = append(contents, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, p := range contents {
+		if err := extractMetadata(ctx, db, store, p.key, p.mediaType, stripGPS); err != nil {
+			return i, err
+		}
+	}
+	return len(contents), nil
+}
+
+// 读取内容并保存元数据；内容无法解析时只记录日志并保存空的元数据，内容已被删除时跳过
+func extractMetadata(ctx context.Context, db *sql.DB, store Storage, key, mediaType string, stripGPS bool) error {
+	content, _, err := store.Get(ctx, key)
+	if err == errBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	meta := FileMetadata{ExtractedAt: time.Now().UTC()}
+	err = metadataMediaTypes[mediaType](content, mediaType, &meta)
+	content.Close()
+	if err != nil && !errors.Is(err, errNoExif) {
+		slog.Warn("Failed to extract metadata", "blob_key", key, "mime", mediaType, "error", err)
+		meta = FileMetadata{ExtractedAt: meta.ExtractedAt}
+	}
+	if stripGPS {
+		meta.Latitude, meta.Longitude = nil, nil
+	}
+
+	insertQuery := `
+	INSERT INTO file_metadata (blob_key, taken_at, camera_make, camera_model, latitude, longitude, duration, extracted_at)
+	SELECT ?, ?, ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM blobs WHERE hash = ?)
+	ON CONFLICT (blob_key) DO UPDATE SET taken_at = excluded.taken_at, camera_make = excluded.camera_make, camera_model = excluded.camera_model,
+		latitude = excluded.latitude, longitude = excluded.longitude, duration = excluded.duration, extracted_at = excluded.extracted_at`
+	_, err = db.ExecContext(ctx, insertQuery, key, meta.TakenAt, nullString(meta.CameraMake), nullString(meta.CameraModel),
+		meta.Latitude, meta.Longitude, meta.Duration, meta.ExtractedAt, key)
+	return err
+}
+
+// 空字符串保存为 NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// 删除内容的元数据，在删除内容记录的事务中调用
+func deleteFileMetadata(ctx context.Context, tx *sql.Tx, key string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM file_metadata WHERE blob_key = ?`, key)
+	return err
+}
+
+// 读取 MP4 和 QuickTime 的 moov/mvhd 中的时长和创建时间
+func readMP4Info(r io.Reader, _ string, meta *FileMetadata) error {
+	moov, err := findMP4Box(r, "moov", mp4MaxMoovBytes)
+	if err != nil {
+		return err
+	}
+	mvhd, err := findMP4Box(bytes.NewReader(moov), "mvhd", int64(len(moov)))
+	if err != nil {
+		return err
+	}
+	var created, timescale, duration uint64
+	switch {
+	case len(mvhd) >= 20 && mvhd[0] == 0:
+		created = uint64(binary.BigEndian.Uint32(mvhd[4:]))
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	case len(mvhd) >= 32 && mvhd[0] == 1:
+		created = binary.BigEndian.Uint64(mvhd[4:])
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	default:
+		return errors.New("invalid mvhd box")
+	}
+	if timescale > 0 {
+		seconds := float64(duration) / float64(timescale)
+		meta.Duration = &seconds
+	}
+	// 创建时间为从 1904 年开始的秒数，未设置时为 0
+	if created > 0 {
+		t := time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(created) * time.Second)
+		if t.Year() >= 1970 {
+			meta.TakenAt = &t
+		}
+	}
+	return nil
+}
+
+// 在同一层的盒子中查找 typ 并返回其内容，最多读取 limit 字节；跳过其他盒子，内容支持 Seek 时不读取被跳过的部分
+func findMP4Box(r io.Reader, typ string, limit int64) ([]byte, error) {
+	var header [16]byte
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return nil, errors.New(typ + " box not found")
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header[:4])), int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(r, header[8:16]); err != nil {
+				return nil, err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		}
+		if size != 0 && size < headerSize {
+			return nil, errors.New("invalid box size")
+		}
+		if string(header[4:8]) == typ {
+			if size == 0 || size-headerSize > limit {
+				return nil, errors.New(typ + " box is too large")
+			}
+			body := make([]byte, size-headerSize)
+			_, err := io.ReadFull(r, body)
+			return body, err
+		}
+		if size == 0 {
+			return nil, errors.New(typ + " box not found")
+		}
+		if err := skipBytes(r, size-headerSize); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// 跳过 n 字节，支持 Seek 时直接定位
+func skipBytes(r io.Reader, n int64) error {
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+// 根据 WAV 的 fmt 块中的字节率和 data 块的大小计算时长
+func readWAVInfo(r io.Reader, _ string, meta *FileMetadata) error {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return errors.New("not a WAV file")
+	}
+	byteRate := uint32(0)
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return errors.New("data chunk not found")
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+		switch string(header[:4]) {
+		case "fmt ":
+			if size < 16 {
+				return errors.New("invalid fmt chunk")
+			}
+			var format [16]byte
+			if _, err := io.ReadFull(r, format[:]); err != nil {
+				return err
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:12])
+			size -= 16
+		case "data":
+			if byteRate == 0 {
+				return errors.New("fmt chunk not found")
+			}
+			seconds := float64(size) / float64(byteRate)
+			meta.Duration = &seconds
+			return nil
+		}
+		if err := skipBytes(r, size+size%2); err != nil {
+			return err
+		}
+	}
+}
+
+// 根据 FLAC 的 STREAMINFO 中的采样率和总采样数计算时长
+func readFLACInfo(r io.Reader, _ string, meta *FileMetadata) error {
+	var header [4 + 4 + 34]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "fLaC" || header[4]&0x7f != 0 {
+		return errors.New("not a FLAC file")
+	}
+	info := binary.BigEndian.Uint64(header[8+10 : 8+18])
+	sampleRate, samples := info>>44, info&(1<<36-1)
+	if sampleRate == 0 || samples == 0 {
+		return nil
+	}
+	seconds := float64(samples) / float64(sampleRate)
+	meta.Duration = &seconds
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 指标名称的前缀
+const metricsNamespace = "netdisk"
+
+// 抓取指标时统计文件和内容数量的超时时间
+const metricsQueryTimeout = 2 * time.Second
+
+// 请求、上传下载和仓库查询的指标。计数器和直方图由 client_golang 保证并发安全，处理请求时只做内存中的累加
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template, method and status.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	uploadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Request body bytes read from clients.",
+	})
+	downloadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Response body bytes written to clients.",
+	})
+	uploadsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploads_in_flight",
+		Help:      "File uploads and upload parts currently being received.",
+	})
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "File repository operation latency by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"operation"})
+	concurrentRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "concurrent_requests",
+		Help:      "Upload and download requests currently being handled by class.",
+	}, []string{"class"})
+	concurrencyLimitGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "concurrency_limit",
+		Help:      "Configured limit of concurrent requests by class, 0 for unlimited.",
+	}, []string{"class"})
+	concurrencyRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "concurrency_rejected_total",
+		Help:      "Requests rejected because the concurrency limit of their class was reached.",
+	}, []string{"class"})
+	bandwidthLimitGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_bandwidth_limit_bytes",
+		Help:      "Configured download bandwidth limit in bytes per second by scope (global or per_download), 0 for unlimited.",
+	}, []string{"scope"})
+	throttledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_throttled_seconds_total",
+		Help:      "Time downloads spent waiting for bandwidth by scope (global or per_download).",
+	}, []string{"scope"})
+	contentScans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "content_scans_total",
+		Help:      "Virus scans of uploaded and existing content by result (clean, infected, pending or error).",
+	}, []string{"result"})
+	gcReclaimedBlobs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_reclaimed_blobs_total",
+		Help:      "Unreferenced content removed by garbage collection.",
+	})
+	gcReclaimedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_reclaimed_bytes_total",
+		Help:      "Size of the unreferenced content removed by garbage collection.",
+	})
+)
+
+// 创建指标的注册表，包括 Go 运行时、进程以及从数据库统计的文件和内容数量
+func newMetricsRegistry(db *sql.DB) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpRequestDuration, uploadedBytes, downloadedBytes, uploadsInFlight, dbQueryDuration,
+		concurrentRequests, concurrencyLimitGauge, concurrencyRejected, bandwidthLimitGauge, throttledSeconds, contentScans,
+		gcReclaimedBlobs, gcReclaimedBytes,
+		newStorageCollector(db),
+	)
+	return registry
+}
+
+// 返回指标的处理函数，使用 Prometheus 的文本格式
+func metricsHandler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// 记录每个请求的次数、耗时以及读取和写入的字节数。路由按去掉版本前缀的模板区分，未匹配的路由记为 unmatched
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		var body *countingReader
+		if c.Request.Body != nil {
+			body = &countingReader{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+		}
+		c.Next()
+
+		route := apiRoute(c)
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(route, c.Request.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+		if body != nil && body.n > 0 {
+			uploadedBytes.Add(float64(body.n))
+		}
+		if size := c.Writer.Size(); size > 0 {
+			downloadedBytes.Add(float64(size))
+		}
+	}
+}
+
+// 统计读取的字节数；请求体只在处理该请求的 goroutine 中读取
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// 开始接收上传的内容，返回结束时调用的函数
+func trackUpload() func() {
+	uploadsInFlight.Inc()
+	return uploadsInFlight.Dec
+}
+
+// 记录仓库操作的耗时，在操作开始时调用并 defer 返回的函数
+func observeQuery(operation string) func() {
+	start := time.Now()
+	return func() {
+		dbQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+}
+
+// 抓取时从数据库统计文件数、内容数和内容的总大小
+type storageCollector struct {
+	db                        *sql.DB
+	files, blobs, storedBytes *prometheus.Desc
+}
+
+func newStorageCollector(db *sql.DB) *storageCollector {
+	return &storageCollector{
+		db:          db,
+		files:       prometheus.NewDesc(metricsNamespace+"_files", "Files that are not in the trash.", nil, nil),
+		blobs:       prometheus.NewDesc(metricsNamespace+"_blobs", "Distinct stored contents.", nil, nil),
+		storedBytes: prometheus.NewDesc(metricsNamespace+"_stored_bytes", "Total size of distinct stored contents before compression.", nil, nil),
+	}
+}
+
+func (s *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.files
+	ch <- s.blobs
+	ch <- s.storedBytes
+}
+
+func (s *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsQueryTimeout)
+	defer cancel()
+	var files, blobs, size int64
+	query := `SELECT (SELECT COUNT(*) FROM files WHERE deleted_at IS NULL), COUNT(*), IFNULL(SUM(size), 0) FROM blobs`
+	if err := s.db.QueryRowContext(ctx, query).Scan(&files, &blobs, &size); err != nil {
+		ch <- prometheus.NewInvalidMetric(s.files, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(s.files, prometheus.GaugeValue, float64(files))
+	ch <- prometheus.MustNewConstMetric(s.blobs, prometheus.GaugeValue, float64(blobs))
+	ch <- prometheus.MustNewConstMetric(s.storedBytes, prometheus.GaugeValue, float64(size))
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// 数据库结构的一次变更。version 从 1 开始连续递增，已发布的迁移不能再修改，
+// 之后的结构变更通过在 schemaMigrations 末尾追加新的迁移完成
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// 按顺序排列的所有迁移；defaultQuota 为升级旧数据库时已有用户使用的配额
+func schemaMigrations(defaultQuota int64) []migration {
+	return []migration{
+		{1, "baseline", func(tx *sql.Tx) error { return createBaselineSchema(tx, defaultQuota) }},
+		{2, "remove shares of deleted files", removeOrphanShares},
+		{3, "add hash algorithm", addHashAlgorithm},
+		{4, "track upload activity", addUploadUpdatedAt},
+		{5, "add tags", createTagTables},
+		{6, "add starred flag", addStarred},
+		{7, "add download count", addDownloadCount},
+		{8, "add file expiry", addFileExpiry},
+		{9, "add visibility", addVisibility},
+		{10, "track last download", addLastDownloadedAt},
+		{11, "add audit log", createAuditLog},
+		{12, "add webhooks", createWebhooks},
+		{13, "add api keys", createAPIKeys},
+		{14, "index files by upload time", addFilesCreatedAtIndex},
+		{15, "index files by last download", addFilesLastDownloadedIndex},
+		{16, "add content chunks", createChunks},
+		{17, "add settings", createSettings},
+		{18, "add content compression", createCompressedContent},
+		{19, "add integrity scan", createIntegrityIssues},
+		{20, "add content deletions", createContentDeletions},
+		{21, "add blob segments", createBlobSegments},
+		{22, "add file search names", addSearchNames},
+		{23, "add content index", createContentIndex},
+		{24, "add share passwords", addSharePasswords},
+		{25, "add share download limits", addShareDownloadLimits},
+		{26, "add permissions", createPermissions},
+		{27, "add file metadata", createFileMetadata},
+		{28, "add content scans", createContentScans},
+		{29, "index files by content", addContentReferenceIndexes},
+	}
+}
+
+// 依次执行尚未执行的迁移，每个迁移及其版本记录在同一个事务中提交；
+// 迁移失败时回滚该迁移并返回错误，之前已成功的迁移保留。
+// 重建表时被引用的表会暂时不存在，因此迁移期间关闭外键约束，全部执行后再检查
+func runMigrations(db *sql.DB, migrations []migration) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return fmt.Errorf("failed to disable foreign keys: %w", err)
+	}
+	// 连接会回到连接池中继续使用，无法恢复外键约束时丢弃该连接
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`); err != nil {
+			slog.Error("Failed to enable foreign keys", "error", err)
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	);`
+	if _, err := conn.ExecContext(ctx, createQuery); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT IFNULL(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d, upgrade the server", current, latest)
+	}
+
+	var applied []int
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		applied = append(applied, m.version)
+	}
+	if len(applied) > 0 {
+		if err := checkForeignKeys(ctx, conn); err != nil {
+			return err
+		}
+	}
+	if len(applied) > 0 {
+		slog.Info("Applied database migrations", "versions", applied, "schema_version", applied[len(applied)-1])
+	} else {
+		slog.Info("Database schema is up to date", "schema_version", current)
+	}
+	return nil
+}
+
+// 在事务中执行一个迁移并记录版本
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	insertQuery := `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(insertQuery, m.version, m.name, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 确认迁移后没有违反外键约束的数据
+func checkForeignKeys(ctx context.Context, conn *sql.Conn) error {
+	rows, err := conn.QueryContext(ctx, `PRAGMA foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	violations := map[string]int{}
+	for rows.Next() {
+		var table, parent string
+		var rowID sql.NullInt64
+		var fkid int
+		if err := rows.Scan(&table, &rowID, &parent, &fkid); err != nil {
+			return err
+		}
+		violations[table+" -> "+parent]++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("database has foreign key violations after migrations: %v", violations)
+	}
+	return nil
+}
+
+// 之前彻底删除文件时没有删除其分享链接，这些链接已无法访问
+func removeOrphanShares(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM shares WHERE file_id NOT IN (SELECT id FROM files)`)
+	return err
+}
+
+// 记录计算哈希使用的算法，之前的内容都是 sha256
+func addHashAlgorithm(tx *sql.Tx) error {
+	for _, table := range []string{"files", "file_versions"} {
+		if err := addColumnIfMissing(tx, table, "hash_algo", "TEXT NOT NULL DEFAULT 'sha256'"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 记录上传会话最近一次收到内容的时间，用于清理长时间中断的上传
+func addUploadUpdatedAt(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "upload_sessions", "updated_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE upload_sessions SET updated_at = created_at WHERE updated_at IS NULL`)
+	return err
+}
+
+// 用户的标签及文件与标签的关联
+func createTagTables(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner_id INTEGER NOT NULL REFERENCES users (id),
+		name TEXT NOT NULL,
+		UNIQUE (owner_id, name)
+	);
+	CREATE TABLE IF NOT EXISTS file_tags (
+		file_id INTEGER NOT NULL REFERENCES files (id),
+		tag_id INTEGER NOT NULL REFERENCES tags (id),
+		PRIMARY KEY (file_id, tag_id)
+	);
+	CREATE INDEX IF NOT EXISTS file_tags_tag_id ON file_tags (tag_id);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 文件的星标
+func addStarred(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "files", "starred", "BOOLEAN NOT NULL DEFAULT 0")
+}
+
+// 文件的下载次数，用于按下载次数排序
+func addDownloadCount(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "files", "download_count", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// 文件的过期时间，清理时按过期时间查找
+func addFileExpiry(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "files", "expires_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS files_expires_at ON files (expires_at) WHERE expires_at IS NOT NULL`)
+	return err
+}
+
+// 文件的可见性，之前的文件都是私有的
+func addVisibility(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "files", "visibility", "TEXT NOT NULL DEFAULT 'private'")
+}
+
+// 文件最近一次下载的时间
+func addLastDownloadedAt(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "files", "last_downloaded_at", "TIMESTAMP")
+}
+
+// 文件操作的审计日志；不引用 files 表，文件删除后日志仍然保留
+func createAuditLog(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TIMESTAMP NOT NULL,
+		actor_id INTEGER,
+		action TEXT NOT NULL,
+		file_id INTEGER,
+		hash TEXT NOT NULL DEFAULT '',
+		client_ip TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		outcome TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log (created_at);
+	CREATE INDEX IF NOT EXISTS audit_log_actor_id ON audit_log (actor_id, created_at);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 接收文件事件的 webhook 及最近的投递记录
+func createWebhooks(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL DEFAULT '[]',
+		enabled BOOLEAN NOT NULL DEFAULT 1,
+		consecutive_failures INTEGER NOT NULL DEFAULT 0,
+		disabled_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks (id),
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 用户的 API key，只保存哈希
+func createAPIKeys(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users (id),
+		name TEXT NOT NULL DEFAULT '',
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP,
+		last_used_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS api_keys_user_id ON api_keys (user_id);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 按上传时间列出文件时使用的索引，游标分页按 (created_at, id) 继续读取
+func addFilesCreatedAtIndex(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS files_owner_created_at ON files (owner_id, created_at, id)`)
+	return err
+}
+
+// 列出最近下载的文件时使用的索引，只包括下载过的文件
+func addFilesLastDownloadedIndex(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS files_owner_last_downloaded_at ON files (owner_id, last_downloaded_at, id) WHERE last_downloaded_at IS NOT NULL`)
+	return err
+}
+
+// 分块存储的内容：chunks 记录每个分块的引用计数，file_chunks 按顺序记录每个内容由哪些分块组成，
+// blob_hash 为 blobs 表中内容的键
+func createChunks(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS chunks (
+		hash TEXT PRIMARY KEY,
+		size INTEGER NOT NULL,
+		refcount INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS file_chunks (
+		blob_hash TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		chunk_hash TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		PRIMARY KEY (blob_hash, seq)
+	);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 服务端的全局状态，如内容是否已加密
+func createSettings(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS settings (name TEXT PRIMARY KEY, value TEXT NOT NULL)`)
+	return err
+}
+
+// 压缩保存的内容：hash 为存储后端中的键（内容或分块），size 为原大小，stored_size 为压缩后的大小
+func createCompressedContent(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS compressed_content (
+		hash TEXT PRIMARY KEY,
+		codec TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		stored_size INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 后台完整性扫描：blobs.last_verified_at 记录内容上次校验的时间，integrity_issues 记录发现的问题，
+// 每个内容最多有一个未解决的问题
+func createIntegrityIssues(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "blobs", "last_verified_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	createQuery := `
+	CREATE INDEX IF NOT EXISTS blobs_last_verified_at ON blobs (last_verified_at, hash);
+	CREATE TABLE IF NOT EXISTS integrity_issues (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hash TEXT NOT NULL,
+		problem TEXT NOT NULL,
+		actual_hash TEXT,
+		actual_size INTEGER,
+		error TEXT,
+		detected_at TIMESTAMP NOT NULL,
+		last_seen_at TIMESTAMP NOT NULL,
+		resolved_at TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS integrity_issues_open_hash ON integrity_issues (hash) WHERE resolved_at IS NULL;
+	CREATE INDEX IF NOT EXISTS integrity_issues_detected_at ON integrity_issues (detected_at);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 正在从存储后端删除的内容或分块的键，用于与共用数据库的其他进程协调
+func createContentDeletions(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS content_deletions (hash TEXT PRIMARY KEY, started_at TIMESTAMP NOT NULL)`)
+	return err
+}
+
+// sqlite 后端中较大内容第一段之后的部分，按 n 从 1 开始依次排列，第一段仍保存在 blob_data 中
+func createBlobSegments(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS blob_segments (hash TEXT NOT NULL, n INTEGER NOT NULL, data BLOB NOT NULL, PRIMARY KEY (hash, n))`)
+	return err
+}
+
+// files.search_name 保存规范化后的文件名用于搜索，见 searchName；已有文件在迁移时按文件名计算。
+// 搜索使用前后都有通配符的 LIKE，无法按索引查找，索引使搜索只需扫描该用户的文件名
+func addSearchNames(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "files", "search_name", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT id, name FROM files`)
+	if err != nil {
+		return err
+	}
+	names := map[int]string{}
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		names[id] = name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, name := range names {
+		if _, err := tx.Exec(`UPDATE files SET search_name = ? WHERE id = ?`, searchName(name), id); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS files_owner_search_name ON files (owner_id, search_name)`)
+	return err
+}
+
+// 文本内容的全文索引：content_index_state 记录每个内容是否已处理，已索引的内容在 content_index 中的 rowid 为 doc_id
+func createContentIndex(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS content_index_state (
+		doc_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		blob_key TEXT NOT NULL UNIQUE,
+		indexed INTEGER NOT NULL,
+		indexed_at TIMESTAMP NOT NULL
+	);
+	CREATE VIRTUAL TABLE IF NOT EXISTS content_index USING fts5(body, tokenize = 'unicode61 remove_diacritics 2');`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 分享链接的访问密码，为空字符串时无需密码
+func addSharePasswords(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "shares", "password_hash", "TEXT NOT NULL DEFAULT ''")
+}
+
+// 分享链接的下载次数限制，max_downloads 为空时不限制
+func addShareDownloadLimits(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "shares", "max_downloads", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "shares", "download_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "shares", "last_downloaded_at", "TIMESTAMP")
+}
+
+// 授予其他用户访问文件或文件夹的权限；文件彻底删除、文件夹删除或用户删除时一并删除
+func createPermissions(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS permissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER REFERENCES files (id) ON DELETE CASCADE,
+		folder_id INTEGER REFERENCES folders (id) ON DELETE CASCADE,
+		owner_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		grantee_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		permission TEXT NOT NULL CHECK (permission IN ('read', 'write')),
+		created_at TIMESTAMP NOT NULL,
+		CHECK ((file_id IS NULL) != (folder_id IS NULL))
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS permissions_file_grantee ON permissions (file_id, grantee_id) WHERE file_id IS NOT NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS permissions_folder_grantee ON permissions (folder_id, grantee_id) WHERE folder_id IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS permissions_grantee ON permissions (grantee_id);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 从图片和音视频内容中提取的元数据，按内容记录；没有可提取的元数据或提取失败的内容也会记录，不再重试
+func createFileMetadata(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS file_metadata (
+		blob_key TEXT PRIMARY KEY,
+		taken_at TIMESTAMP,
+		camera_make TEXT,
+		camera_model TEXT,
+		latitude REAL,
+		longitude REAL,
+		duration REAL,
+		extracted_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS file_metadata_taken_at ON file_metadata (taken_at);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 病毒扫描的结果，按内容记录；没有记录的内容为 pending（尚未扫描或扫描服务不可用时 fail-open 保存的内容）
+func createContentScans(tx *sql.Tx) error {
+	createQuery := `
+	CREATE TABLE IF NOT EXISTS content_scans (
+		blob_key TEXT PRIMARY KEY,
+		status TEXT NOT NULL CHECK (status IN ('clean', 'infected')),
+		signature TEXT,
+		scanned_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS content_scans_status ON content_scans (status, scanned_at);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
+
+// 按内容查找引用它的文件和历史版本时使用的索引，如列出内容相同的文件；files_owner_hash 只能用于查找单个用户的文件
+func addContentReferenceIndexes(tx *sql.Tx) error {
+	createQuery := `
+	CREATE INDEX IF NOT EXISTS files_hash ON files (hash_algo, hash);
+	CREATE INDEX IF NOT EXISTS file_versions_hash ON file_versions (hash_algo, hash);`
+	_, err := tx.Exec(createQuery)
+	return err
+}
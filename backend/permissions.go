@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 授权的权限。read 允许下载和查看文件信息；write 还允许重命名和删除文件（移入所有者的回收站），
+// 文件夹的 write 还允许上传文件到其中。被授权的用户上传的文件属于所有者，计入所有者的配额
+const (
+	permissionRead  = "read"
+	permissionWrite = "write"
+)
+
+// Permission 授予其他用户访问文件或文件夹的权限；FileID 和 FolderID 只有一个不为空，
+// 文件夹的权限同样适用于其中的子文件夹和文件
+type Permission struct {
+	ID         int       `json:"id"`
+	FileID     *int      `json:"file_id,omitempty"`
+	FolderID   *int      `json:"folder_id,omitempty"`
+	OwnerID    int       `json:"owner_id"`
+	UserID     int       `json:"user_id"`
+	Username   string    `json:"username"`
+	Permission string    `json:"permission"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// SharedFile 其他用户授权给当前用户的文件
+type SharedFile struct {
+	File       File      `json:"file"`
+	Owner      string    `json:"owner"`
+	Permission string    `json:"permission"`
+	GrantedAt  time.Time `json:"granted_at"`
+}
+
+// SharedFolder 其他用户授权给当前用户的文件夹
+type SharedFolder struct {
+	Folder     Folder    `json:"folder"`
+	Owner      string    `json:"owner"`
+	Permission string    `json:"permission"`
+	GrantedAt  time.Time `json:"granted_at"`
+}
+
+// 注册授权接口：文件或文件夹的所有者可以授予其他用户访问权限，被授权的用户通过 /shared-with-me 查看。
+// 每次访问都重新检查授权，撤销后立即生效
+func registerPermissionRoutes(r gin.IRouter, db *sql.DB) {
+	repo := newFileRepository(db)
+
+	// 检查 kind（file 或 folder）对象属于当前用户，返回对象 id；不存在时已返回 404
+	target := func(c *gin.Context, kind string) (int, bool) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid "+kind+" id"))
+			return 0, false
+		}
+		if kind == "file" {
+			if _, err := repo.GetByID(c.Request.Context(), currentUserID(c), id); err != nil {
+				fileError(c, err, "Failed to get file")
+				return 0, false
+			}
+			return id, true
+		}
+		_, err = getFolder(c.Request.Context(), db, currentUserID(c), id)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Folder not found"))
+			return 0, false
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get folder", err))
+			return 0, false
+		}
+		return id, true
+	}
+
+	// 授予 username（或 user_id）用户 permission 权限，read（缺省）或 write；已授权时修改权限。新授权返回 201，修改返回 200
+	grant := func(c *gin.Context, kind string) {
+		id, ok := target(c, kind)
+		if !ok {
+			return
+		}
+		var req struct {
+			Username   string `json:"username"`
+			UserID     int    `json:"user_id"`
+			Permission string `json:"permission"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if req.Permission == "" {
+			req.Permission = permissionRead
+		}
+		if req.Permission != permissionRead && req.Permission != permissionWrite {
+			renderError(c, invalidRequest("Invalid permission, must be read or write"))
+			return
+		}
+		if (req.Username == "") == (req.UserID == 0) {
+			renderError(c, invalidRequest("Exactly one of username and user_id is required"))
+			return
+		}
+
+		var grantee User
+		var err error
+		if req.Username != "" {
+			grantee, err = getUserByName(c.Request.Context(), db, req.Username)
+		} else {
+			grantee, err = scanUser(db.QueryRowContext(c.Request.Context(), `SELECT `+userColumns+` FROM users WHERE id = ?`, req.UserID))
+		}
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "User not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get user", err))
+			return
+		}
+		if grantee.ID == currentUserID(c) {
+			renderError(c, invalidRequest("Cannot grant access to yourself"))
+			return
+		}
+
+		permission := Permission{OwnerID: currentUserID(c), UserID: grantee.ID, Username: grantee.Username, Permission: req.Permission, CreatedAt: time.Now().UTC()}
+		if kind == "file" {
+			permission.FileID = &id
+		} else {
+			permission.FolderID = &id
+		}
+		permission, created, err := grantPermission(c.Request.Context(), db, permission)
+		if errors.Is(err, errNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Target not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to grant permission", err))
+			return
+		}
+		if created {
+			c.JSON(http.StatusCreated, permission)
+			return
+		}
+		c.JSON(http.StatusOK, permission)
+	}
+
+	// 列出对象的授权
+	list := func(c *gin.Context, kind string) {
+		id, ok := target(c, kind)
+		if !ok {
+			return
+		}
+		column := "file_id"
+		if kind == "folder" {
+			column = "folder_id"
+		}
+		permissions, err := getPermissions(c.Request.Context(), db, currentUserID(c), column, id)
+		if err != nil {
+			renderError(c, internalError("Failed to get permissions", err))
+			return
+		}
+		c.JSON(http.StatusOK, permissions)
+	}
+
+	// 撤销 userId 用户的授权
+	revoke := func(c *gin.Context, kind string) {
+		id, ok := target(c, kind)
+		if !ok {
+			return
+		}
+		userID, err := strconv.Atoi(c.Param("userId"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid user id"))
+			return
+		}
+		column := "file_id"
+		if kind == "folder" {
+			column = "folder_id"
+		}
+		deleteQuery := `DELETE FROM permissions WHERE owner_id = ? AND ` + column + ` = ? AND grantee_id = ?`
+		result, err := db.ExecContext(c.Request.Context(), deleteQuery, currentUserID(c), id, userID)
+		if err != nil {
+			renderError(c, internalError("Failed to revoke permission", err))
+			return
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Permission not found"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Permission revoked"})
+	}
+
+	r.POST("/files/:id/permissions", func(c *gin.Context) { grant(c, "file") })
+	r.GET("/files/:id/permissions", func(c *gin.Context) { list(c, "file") })
+	r.DELETE("/files/:id/permissions/:userId", func(c *gin.Context) { revoke(c, "file") })
+	r.POST("/folders/:id/permissions", func(c *gin.Context) { grant(c, "folder") })
+	r.GET("/folders/:id/permissions", func(c *gin.Context) { list(c, "folder") })
+	r.DELETE("/folders/:id/permissions/:userId", func(c *gin.Context) { revoke(c, "folder") })
+
+	// 列出其他用户直接授权给当前用户的文件和文件夹；文件夹中的内容通过 /shared-with-me/folders/:id 查看，
+	// 文件通过 GET /files/:id 下载
+	r.GET("/shared-with-me", func(c *gin.Context) {
+		files, folders, err := getSharedWithMe(c.Request.Context(), db, currentUserID(c))
+		if err != nil {
+			renderError(c, internalError("Failed to get shared files", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"files": files, "folders": folders})
+	})
+
+	// 列出授权给当前用户的文件夹（或其子文件夹）中的子文件夹和文件，文件分页返回。
+	// 每页都重新检查授权，列出的过程中撤销授权后后续的请求返回 404
+	r.GET("/shared-with-me/folders/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid folder id"))
+			return
+		}
+		limit, err := queryInt(c, "limit", defaultPageLimit)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxPageLimit)))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil || offset < 0 {
+			renderError(c, invalidRequest("Invalid offset, must be a non-negative integer"))
+			return
+		}
+
+		ownerID, permission, err := folderPermission(c.Request.Context(), db, currentUserID(c), id)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Folder not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get folder", err))
+			return
+		}
+		folder, err := getFolder(c.Request.Context(), db, ownerID, id)
+		if err != nil {
+			renderError(c, internalError("Failed to get folder", err))
+			return
+		}
+		folders, err := getChildFolders(c.Request.Context(), db, ownerID, &id)
+		if err != nil {
+			renderError(c, internalError("Failed to get folders", err))
+			return
+		}
+		files, total, err := listFolderFiles(c.Request.Context(), db, ownerID, id, limit, offset)
+		if err != nil {
+			renderError(c, internalError("Failed to get files", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"folder":     folder,
+			"permission": permission,
+			"folders":    folders,
+			"files":      files,
+			"total":      total,
+			"limit":      limit,
+			"offset":     offset,
+		})
+	})
+}
+
+// 与 fileParam 相同，但也允许读取其他用户授权给当前用户的文件，用于下载和查看文件信息
+func readableFileParam(c *gin.Context, db *sql.DB, repo *FileRepository) (File, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		renderError(c, invalidRequest("Invalid file id"))
+		return File{}, false
+	}
+	file, err := repo.GetByID(c.Request.Context(), currentUserID(c), id)
+	if errors.Is(err, errNotFound) {
+		var ownerID int
+		ownerID, _, err = filePermission(c.Request.Context(), db, currentUserID(c), id)
+		if err == sql.ErrNoRows {
+			err = errNotFound
+		}
+		if err == nil {
+			file, err = repo.GetByID(c.Request.Context(), ownerID, id)
+		}
+	}
+	if err != nil {
+		fileError(c, err, "Failed to get file")
+		return File{}, false
+	}
+	return file, true
+}
+
+// 与 readableFileParam 相同，但其他用户的文件需要有 write 权限，用于重命名和删除；只有 read 权限时返回 403。
+// 返回的文件的 OwnerID 为所有者，修改时按所有者查找
+func writableFileParam(c *gin.Context, db *sql.DB, repo *FileRepository) (File, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		renderError(c, invalidRequest("Invalid file id"))
+		return File{}, false
+	}
+	file, err := repo.GetByID(c.Request.Context(), currentUserID(c), id)
+	if errors.Is(err, errNotFound) {
+		var ownerID int
+		var permission string
+		ownerID, permission, err = filePermission(c.Request.Context(), db, currentUserID(c), id)
+		if err == sql.ErrNoRows {
+			err = errNotFound
+		}
+		if err == nil && permission != permissionWrite {
+			renderError(c, newAPIError(http.StatusForbidden, codeForbidden, "Write permission required"))
+			return File{}, false
+		}
+		if err == nil {
+			file, err = repo.GetByID(c.Request.Context(), ownerID, id)
+		}
+	}
+	if err != nil {
+		fileError(c, err, "Failed to get file")
+		return File{}, false
+	}
+	return file, true
+}
+
+// 检查当前用户可以上传文件到 folderID 文件夹，返回文件夹的所有者：自己的文件夹，或其他用户授予 write 权限的文件夹
+// （及其子文件夹）。不存在或没有授权时返回 404，只有 read 权限时返回 403
+func writableFolderOwner(c *gin.Context, db *sql.DB, folderID int) (int, bool) {
+	userID := currentUserID(c)
+	_, err := getFolder(c.Request.Context(), db, userID, folderID)
+	if err == nil {
+		return userID, true
+	}
+	var ownerID int
+	var permission string
+	if err == sql.ErrNoRows {
+		ownerID, permission, err = folderPermission(c.Request.Context(), db, userID, folderID)
+	}
+	if err == sql.ErrNoRows {
+		renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Folder not found"))
+		return 0, false
+	}
+	if err != nil {
+		renderError(c, internalError("Failed to get folder", err))
+		return 0, false
+	}
+	if permission != permissionWrite {
+		renderError(c, newAPIError(http.StatusForbidden, codeForbidden, "Write permission required"))
+		return 0, false
+	}
+	return ownerID, true
+}
+
+// 添加或修改授权，返回授权和是否新增；对象已被删除时返回 errNotFound
+func grantPermission(ctx context.Context, db *sql.DB, permission Permission) (Permission, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return permission, false, err
+	}
+	defer tx.Rollback()
+
+	updateQuery := `
+	UPDATE permissions SET permission = ?
+	WHERE owner_id = ? AND file_id IS ? AND folder_id IS ? AND grantee_id = ? RETURNING id, created_at`
+	err = tx.QueryRowContext(ctx, updateQuery, permission.Permission, permission.OwnerID, permission.FileID, permission.FolderID, permission.UserID).Scan(&permission.ID, &permission.CreatedAt)
+	created := err == sql.ErrNoRows
+	if created {
+		insertQuery := `
+		INSERT INTO permissions (file_id, folder_id, owner_id, grantee_id, permission, created_at)
+		VALUES (?, ?, ?, ?, ?, ?) RETURNING id`
+		err = tx.QueryRowContext(ctx, insertQuery, permission.FileID, permission.FolderID, permission.OwnerID, permission.UserID, permission.Permission, permission.CreatedAt).Scan(&permission.ID)
+		if isForeignKeyViolation(err) {
+			return permission, false, errNotFound
+		}
+	}
+	if err != nil {
+		return permission, false, err
+	}
+	return permission, created, tx.Commit()
+}
+
+// 获取用户的文件或文件夹的授权，column 为 file_id 或 folder_id
+func getPermissions(ctx context.Context, db *sql.DB, ownerID int, column string, id int) ([]Permission, error) {
+	query := `
+	SELECT permissions.id, permissions.file_id, permissions.folder_id, permissions.owner_id, permissions.grantee_id,
+		users.username, permissions.permission, permissions.created_at
+	FROM permissions JOIN users ON users.id = permissions.grantee_id
+	WHERE permissions.owner_id = ? AND permissions.` + column + ` = ? ORDER BY permissions.id`
+	rows, err := db.QueryContext(ctx, query, ownerID, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	permissions := []Permission{}
+	for rows.Next() {
+		var p Permission
+		if err := rows.Scan(&p.ID, &p.FileID, &p.FolderID, &p.OwnerID, &p.UserID, &p.Username, &p.Permission, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, rows.Err()
+}
+
+// 获取直接授权给用户的文件和文件夹，不包括回收站中和已过期的文件
+func getSharedWithMe(ctx context.Context, db *sql.DB, userID int) ([]SharedFile, []SharedFolder, error) {
+	query := `
+	SELECT permissions.file_id, permissions.permission, permissions.created_at, users.username,
+		folders.id, folders.name, folders.parent_id, folders.owner_id, folders.created_at
+	FROM permissions
+	JOIN users ON users.id = permissions.owner_id
+	LEFT JOIN folders ON folders.id = permissions.folder_id
+	WHERE permissions.grantee_id = ? ORDER BY permissions.id`
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	files := []SharedFile{}
+	folders := []SharedFolder{}
+	var fileIDs []any
+	for rows.Next() {
+		var fileID, folderID, parentID, folderOwnerID sql.Null[int]
+		var folderName sql.NullString
+		var folderCreatedAt sql.NullTime
+		var permission, owner string
+		var grantedAt time.Time
+		if err := rows.Scan(&fileID, &permission, &grantedAt, &owner, &folderID, &folderName, &parentID, &folderOwnerID, &folderCreatedAt); err != nil {
+			return nil, nil, err
+		}
+		if fileID.Valid {
+			files = append(files, SharedFile{File: File{ID: fileID.V}, Owner: owner, Permission: permission, GrantedAt: grantedAt})
+			fileIDs = append(fileIDs, fileID.V)
+			continue
+		}
+		folder := Folder{ID: folderID.V, Name: folderName.String, OwnerID: folderOwnerID.V, CreatedAt: folderCreatedAt.Time}
+		if parentID.Valid {
+			folder.ParentID = &parentID.V
+		}
+		folders = append(folders, SharedFolder{Folder: folder, Owner: owner, Permission: permission, GrantedAt: grantedAt})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(fileIDs) == 0 {
+		return files, folders, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(fileIDs)), ", ")
+	fileQuery := `SELECT ` + fileColumns + ` FROM files WHERE id IN (` + placeholders + `) AND deleted_at IS NULL AND ` + fileNotExpired
+	fileRows, err := db.QueryContext(ctx, fileQuery, append(fileIDs, time.Now().UTC())...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fileRows.Close()
+	byID := map[int]File{}
+	for fileRows.Next() {
+		file, err := scanFile(fileRows)
+		if err != nil {
+			return nil, nil, err
+		}
+		byID[file.ID] = file
+	}
+	if err := fileRows.Err(); err != nil {
+		return nil, nil, err
+	}
+	shared := files[:0]
+	for _, f := range files {
+		if file, ok := byID[f.File.ID]; ok {
+			f.File = file
+			shared = append(shared, f)
+		}
+	}
+	return shared, folders, nil
+}
+
+// 用户通过授权对文件的权限，返回文件的所有者和权限；文件本身或其所在的任一级文件夹的授权都有效。
+// 没有授权或文件已被删除时返回 sql.ErrNoRows
+func filePermission(ctx context.Context, db *sql.DB, userID, fileID int) (int, string, error) {
+	query := `
+	WITH RECURSIVE ancestors (id) AS (
+		SELECT folder_id FROM files WHERE id = ? AND folder_id IS NOT NULL
+		UNION
+		SELECT folders.parent_id FROM folders JOIN ancestors ON folders.id = ancestors.id WHERE folders.parent_id IS NOT NULL
+	)
+	SELECT files.owner_id, MAX(permissions.permission) FROM files
+	JOIN permissions ON permissions.owner_id = files.owner_id
+	WHERE files.id = ? AND files.deleted_at IS NULL AND permissions.grantee_id = ?
+	AND (permissions.file_id = files.id OR permissions.folder_id IN (SELECT id FROM ancestors))
+	GROUP BY files.owner_id`
+	var ownerID int
+	var permission string
+	err := db.QueryRowContext(ctx, query, fileID, fileID, userID).Scan(&ownerID, &permission)
+	return ownerID, permission, err
+}
+
+// 用户通过授权对文件夹的权限，返回文件夹的所有者和权限；文件夹本身或任一级父文件夹的授权都有效。
+// 没有授权时返回 sql.ErrNoRows
+func folderPermission(ctx context.Context, db *sql.DB, userID, folderID int) (int, string, error) {
+	query := `
+	WITH RECURSIVE ancestors (id) AS (
+		SELECT id FROM folders WHERE id = ?
+		UNION
+		SELECT folders.parent_id FROM folders JOIN ancestors ON folders.id = ancestors.id WHERE folders.parent_id IS NOT NULL
+	)
+	SELECT folders.owner_id, MAX(permissions.permission) FROM folders
+	JOIN permissions ON permissions.owner_id = folders.owner_id
+	WHERE folders.id = ? AND permissions.grantee_id = ? AND permissions.folder_id IN (SELECT id FROM ancestors)
+	GROUP BY folders.owner_id`
+	var ownerID int
+	var permission string
+	err := db.QueryRowContext(ctx, query, folderID, folderID, userID).Scan(&ownerID, &permission)
+	return ownerID, permission, err
+}
+
+// 分页获取文件夹中未删除且未过期的文件，按名称排序，同时返回总数
+func listFolderFiles(ctx context.Context, db *sql.DB, ownerID, folderID, limit, offset int) ([]File, int, error) {
+	where := ` FROM files WHERE owner_id = ? AND folder_id = ? AND deleted_at IS NULL AND ` + fileNotExpired
+	now := time.Now().UTC()
+	var total int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*)`+where, ownerID, folderID, now).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT `+fileColumns+where+` ORDER BY name, id LIMIT ? OFFSET ?`, ownerID, folderID, now, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	files := []File{}
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		files = append(files, file)
+	}
+	return files, total, rows.Err()
+}
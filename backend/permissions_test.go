@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 授予 username 对 kind（files 或 folders）对象 id 的 permission 权限，返回授权
+func grantTestPermission(t *testing.T, s *testServer, token, kind string, id int, username, permission string) Permission {
+	t.Helper()
+	body := `{"username":"` + username + `","permission":"` + permission + `"}`
+	w := s.do(http.MethodPost, "/api/v1/"+kind+"/"+strconv.Itoa(id)+"/permissions", token, "application/json", strings.NewReader(body))
+	if w.Code != http.StatusCreated && w.Code != http.StatusOK {
+		t.Fatalf("grant %s on %s %d: %d %s", permission, kind, id, w.Code, w.Body)
+	}
+	var p Permission
+	decodeJSON(t, w, &p)
+	return p
+}
+
+// 创建文件夹并返回其 id，parent 为 0 时在根目录
+func createTestFolder(t *testing.T, s *testServer, token, name string, parent int) int {
+	t.Helper()
+	body := `{"name":"` + name + `"}`
+	if parent != 0 {
+		body = `{"name":"` + name + `","parent_id":` + strconv.Itoa(parent) + `}`
+	}
+	w := s.do(http.MethodPost, "/api/v1/folders", token, "application/json", strings.NewReader(body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create folder %s: %d %s", name, w.Code, w.Body)
+	}
+	var folder Folder
+	decodeJSON(t, w, &folder)
+	return folder.ID
+}
+
+func TestGrantPermissionValues(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	s.login("bob")
+	file := uploadTestFile(t, s, alice, "a.txt", "hello")
+	path := "/api/v1/files/" + strconv.Itoa(file.ID) + "/permissions"
+
+	tests := []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{`{"username":"bob"}`, http.StatusCreated, permissionRead},
+		{`{"username":"bob","permission":"write"}`, http.StatusOK, permissionWrite},
+		{`{"username":"bob","permission":"read"}`, http.StatusOK, permissionRead},
+		{`{"username":"bob","permission":"admin"}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		w := s.do(http.MethodPost, path, alice, "application/json", strings.NewReader(tt.body))
+		if w.Code != tt.status {
+			t.Errorf("grant %s: %d, want %d: %s", tt.body, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.want == "" {
+			continue
+		}
+		var permission Permission
+		decodeJSON(t, w, &permission)
+		if permission.Permission != tt.want {
+			t.Errorf("grant %s: permission %q, want %q", tt.body, permission.Permission, tt.want)
+		}
+	}
+}
+
+// write 权限允许重命名和删除文件，read 权限不允许；删除的文件移入所有者的回收站
+func TestWritePermissionOnFile(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+	file := uploadTestFile(t, s, alice, "a.txt", "hello")
+	path := "/api/v1/files/" + strconv.Itoa(file.ID)
+	grantTestPermission(t, s, alice, "files", file.ID, "bob", permissionWrite)
+	grantTestPermission(t, s, alice, "files", file.ID, "carol", permissionRead)
+
+	rename := func(token, name string) *httptest.ResponseRecorder {
+		return s.do(http.MethodPatch, path, token, "application/json", strings.NewReader(`{"name":"`+name+`"}`))
+	}
+	if w := rename(carol, "c.txt"); w.Code != http.StatusForbidden {
+		t.Errorf("rename with read permission: %d, want 403", w.Code)
+	}
+	if w := s.do(http.MethodDelete, path, carol, "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("delete with read permission: %d, want 403", w.Code)
+	}
+	w := rename(bob, "b.txt")
+	var renamed File
+	decodeJSON(t, w, &renamed)
+	if w.Code != http.StatusOK || renamed.Name != "b.txt" || renamed.OwnerID != file.OwnerID {
+		t.Errorf("rename with write permission: %d %s", w.Code, w.Body)
+	}
+	var stored File
+	decodeJSON(t, s.do(http.MethodGet, path+"/info", alice, "", nil), &stored)
+	if stored.Name != "b.txt" {
+		t.Errorf("stored name %q, want b.txt", stored.Name)
+	}
+
+	// 保护标记和可见性只有所有者可以修改
+	body := strings.NewReader(`{"name":"x.txt","visibility":"public"}`)
+	if w := s.do(http.MethodPatch, path, bob, "application/json", body); w.Code != http.StatusForbidden {
+		t.Errorf("change visibility with write permission: %d, want 403", w.Code)
+	}
+	decodeJSON(t, s.do(http.MethodGet, path+"/info", alice, "", nil), &stored)
+	if stored.Name != "b.txt" || stored.Visibility == visibilityPublic {
+		t.Errorf("file changed by a rejected request: %+v", stored)
+	}
+
+	if w := s.do(http.MethodDelete, path, bob, "", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete with write permission: %d %s", w.Code, w.Body)
+	}
+	var trash struct {
+		Files []File `json:"files"`
+	}
+	decodeJSON(t, s.do(http.MethodGet, "/api/v1/trash", alice, "", nil), &trash)
+	if len(trash.Files) != 1 || trash.Files[0].ID != file.ID {
+		t.Errorf("owner's trash = %+v, want the deleted file", trash.Files)
+	}
+}
+
+// 文件夹的 write 权限适用于其中的子文件夹：被授权的用户可以上传、重命名和删除，上传的文件属于所有者
+func TestWritePermissionOnFolder(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+	shared := createTestFolder(t, s, alice, "shared", 0)
+	sub := createTestFolder(t, s, alice, "sub", shared)
+	grant := grantTestPermission(t, s, alice, "folders", shared, "bob", permissionWrite)
+	grantTestPermission(t, s, alice, "folders", shared, "carol", permissionRead)
+
+	if w := s.upload(carol, "c.txt", []byte("carol"), map[string]string{"folder": strconv.Itoa(sub)}); w.Code != http.StatusForbidden {
+		t.Errorf("upload with read permission: %d, want 403: %s", w.Code, w.Body)
+	}
+	w := s.upload(bob, "b.txt", []byte("bob"), map[string]string{"folder": strconv.Itoa(sub)})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload with write permission: %d %s", w.Code, w.Body)
+	}
+	var uploaded struct {
+		File File `json:"file"`
+	}
+	decodeJSON(t, w, &uploaded)
+	file := uploaded.File
+	if file.OwnerID == 0 || file.FolderID == nil || *file.FolderID != sub {
+		t.Fatalf("uploaded file = %+v, want it in folder %d", file, sub)
+	}
+	path := "/api/v1/files/" + strconv.Itoa(file.ID)
+	var stored File
+	decodeJSON(t, s.do(http.MethodGet, path+"/info", alice, "", nil), &stored)
+	if stored.OwnerID != file.OwnerID || stored.Name != "b.txt" {
+		t.Errorf("file uploaded by the grantee as seen by the owner: %+v", stored)
+	}
+	var bobsFiles struct {
+		Total int `json:"total"`
+	}
+	decodeJSON(t, s.do(http.MethodGet, "/api/v1/files", bob, "", nil), &bobsFiles)
+	if bobsFiles.Total != 0 {
+		t.Errorf("grantee has %d files of their own, want 0", bobsFiles.Total)
+	}
+	// 计入所有者的配额
+	for _, user := range []struct {
+		name  string
+		token string
+		used  int64
+	}{{"alice", alice, int64(len("bob"))}, {"bob", bob, 0}} {
+		var quota struct {
+			UsedBytes int64 `json:"used_bytes"`
+		}
+		decodeJSON(t, s.do(http.MethodGet, "/api/v1/quota", user.token, "", nil), &quota)
+		if quota.UsedBytes != user.used {
+			t.Errorf("%s used %d bytes, want %d", user.name, quota.UsedBytes, user.used)
+		}
+	}
+
+	if w := s.do(http.MethodPatch, path, carol, "application/json", strings.NewReader(`{"name":"c.txt"}`)); w.Code != http.StatusForbidden {
+		t.Errorf("rename with read permission: %d, want 403", w.Code)
+	}
+	if w := s.do(http.MethodPatch, path, bob, "application/json", strings.NewReader(`{"name":"renamed.txt"}`)); w.Code != http.StatusOK {
+		t.Errorf("rename with write permission: %d %s", w.Code, w.Body)
+	}
+	if w := s.do(http.MethodDelete, path, bob, "", nil); w.Code != http.StatusOK {
+		t.Errorf("delete with write permission: %d %s", w.Code, w.Body)
+	}
+
+	// 撤销后立即失去权限
+	if w := s.do(http.MethodDelete, "/api/v1/folders/"+strconv.Itoa(shared)+"/permissions/"+strconv.Itoa(grant.UserID), alice, "", nil); w.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	if w := s.upload(bob, "late.txt", []byte("late"), map[string]string{"folder": strconv.Itoa(sub)}); w.Code != http.StatusNotFound {
+		t.Errorf("upload after revoking: %d, want 404", w.Code)
+	}
+}
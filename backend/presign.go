@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 签名下载链接的默认和最长有效期
+const (
+	defaultPresignExpiry = time.Hour
+	maxPresignExpiry     = 7 * 24 * time.Hour
+)
+
+// 注册签名下载链接接口；public 上的接口无需登录。
+// 链接只由 key 签名，不保存在数据库中，因此无法单独撤销，只能等待过期或更换密钥
+func registerPresignRoutes(public, api gin.IRouter, db *sql.DB, store Storage, key []byte) {
+	repo := newFileRepository(db)
+
+	// 为文件生成有效期为 expires_in 秒（默认一小时，最长七天）的下载链接。
+	// bind_ip 为 true 时链接只能从当前请求的 IP 使用；disposition 为 attachment（默认）或 inline，
+	// inline 时按预览的规则显示，HTML、SVG 等按纯文本返回，不支持预览的类型仍然下载
+	api.POST("/files/:id/presign", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+		var req struct {
+			ExpiresIn   int64  `json:"expires_in"` // 有效期（秒）
+			BindIP      bool   `json:"bind_ip"`
+			Disposition string `json:"disposition"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				renderError(c, invalidRequest("Invalid request body"))
+				return
+			}
+		}
+		expiry := defaultPresignExpiry
+		if req.ExpiresIn != 0 {
+			expiry = time.Duration(req.ExpiresIn) * time.Second
+		}
+		if req.ExpiresIn < 0 || expiry > maxPresignExpiry {
+			renderError(c, invalidRequest("Invalid expires_in, must be between 1 and "+strconv.Itoa(int(maxPresignExpiry/time.Second))+" seconds"))
+			return
+		}
+		if req.Disposition == "" {
+			req.Disposition = "attachment"
+		}
+		if req.Disposition != "attachment" && req.Disposition != "inline" {
+			renderError(c, invalidRequest("Invalid disposition, must be attachment or inline"))
+			return
+		}
+
+		file, err := repo.GetByID(c.Request.Context(), currentUserID(c), id)
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+		ip := ""
+		if req.BindIP {
+			ip = c.ClientIP()
+		}
+		expiresAt := time.Now().UTC().Add(expiry).Truncate(time.Second)
+		query := url.Values{}
+		query.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+		if req.Disposition != "attachment" {
+			query.Set("disposition", req.Disposition)
+		}
+		query.Set("sig", presignSignature(key, file.ID, expiresAt.Unix(), ip, req.Disposition))
+		c.JSON(http.StatusOK, gin.H{
+			"url":         apiV1Prefix + "/dl/" + strconv.Itoa(file.ID) + "?" + query.Encode(),
+			"expires_at":  expiresAt,
+			"bind_ip":     req.BindIP,
+			"disposition": req.Disposition,
+		})
+	})
+
+	// 通过签名下载链接下载文件；签名不正确、已过期或不是从绑定的 IP 使用时返回 403
+	public.GET("/dl/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil {
+			renderError(c, newAPIError(http.StatusForbidden, codeForbidden, "Invalid signature"))
+			return
+		}
+		disposition := c.DefaultQuery("disposition", "attachment")
+		sig := c.Query("sig")
+		if !hmac.Equal([]byte(sig), []byte(presignSignature(key, id, expires, "", disposition))) &&
+			!hmac.Equal([]byte(sig), []byte(presignSignature(key, id, expires, c.ClientIP(), disposition))) {
+			renderError(c, newAPIError(http.StatusForbidden, codeForbidden, "Invalid signature"))
+			return
+		}
+		if time.Now().Unix() >= expires {
+			renderError(c, newAPIError(http.StatusForbidden, codeForbidden, "Download link has expired"))
+			return
+		}
+
+		var ownerID int
+		err = db.QueryRowContext(c.Request.Context(), `SELECT owner_id FROM files WHERE id = ?`, id).Scan(&ownerID)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get file", err))
+			return
+		}
+		file, err := repo.GetByID(c.Request.Context(), ownerID, id)
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+		addAuditFile(c, file)
+		serveFileAs(c, store, file, disposition)
+		recordDownload(c, repo, file)
+	})
+}
+
+// 签名下载链接的 HMAC-SHA256 签名，覆盖文件 id、过期时间（Unix 秒）、绑定的 IP（未绑定时为空）和 disposition
+func presignSignature(key []byte, id int, expires int64, ip, disposition string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strconv.Itoa(id) + "\n" + strconv.FormatInt(expires, 10) + "\n" + ip + "\n" + disposition))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文本预览最多返回的字节数，超过时截断
+const maxPreviewTextSize = 256 << 10
+
+// 可以按原类型在浏览器中直接显示的类型
+var previewTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// 注册文件预览接口
+func registerPreviewRoutes(r gin.IRouter, db *sql.DB, store Storage) {
+	repo := newFileRepository(db)
+
+	// 在浏览器中预览文件。HTML、SVG 等可能包含脚本的类型按纯文本返回，
+	// 并通过 CSP sandbox 禁止执行脚本，避免上传的文件在本站点下运行
+	r.GET("/files/:id/preview", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+		file, err := repo.GetByID(c.Request.Context(), currentUserID(c), id)
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+
+		contentType, isText := previewContentType(file)
+		if contentType == "" {
+			renderError(c, newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Preview is not available for this file type, download it instead"))
+			return
+		}
+
+		detachDeadline(c)
+		content, size, err := openFileContent(c.Request.Context(), store, file)
+		if errors.Is(err, errBlobNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File content not found"))
+			return
+		}
+		if errors.Is(err, errFileInfected) {
+			renderError(c, fileQuarantined())
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to read file", err))
+			return
+		}
+		defer content.Close()
+
+		var body io.Reader = content
+		etag := `"` + file.Hash + `"`
+		if isText && size > maxPreviewTextSize {
+			head := make([]byte, maxPreviewTextSize)
+			if _, err := io.ReadFull(content, head); err != nil {
+				renderError(c, internalError("Failed to read file", err))
+				return
+			}
+			body = bytes.NewReader(head)
+			size = maxPreviewTextSize
+			c.Header("X-Preview-Truncated", "true")
+			etag = `"` + file.Hash + `-truncated"`
+		}
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", contentDisposition("inline", file.Name))
+		setInlineSecurityHeaders(c)
+		setCacheHeaders(c, etag)
+		writeContent(c, file.Name, file.UpdatedAt, body, size)
+	})
+}
+
+// 在浏览器中直接显示上传的内容时禁止类型嗅探，并通过 CSP sandbox 禁止执行脚本
+func setInlineSecurityHeaders(c *gin.Context) {
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "sandbox; default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'")
+}
+
+// 返回预览时使用的类型以及是否按文本处理；不支持预览时返回空字符串
+func previewContentType(file File) (string, bool) {
+	mimeType := file.Mime
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(file.Name))
+	}
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "", false
+	}
+
+	switch {
+	case mediaType == "text/plain":
+		return "text/plain; charset=utf-8", true
+	case previewTypes[mediaType]:
+		return mediaType, false
+	// HTML、SVG、JSON 等文本内容一律按纯文本显示
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "image/svg+xml",
+		mediaType == "application/json", mediaType == "application/xml", mediaType == "application/javascript":
+		return "text/plain; charset=utf-8", true
+	}
+	return "", false
+}
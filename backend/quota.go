@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上传后用户的已用空间将超过配额
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// 注册存储配额相关接口；admin 上的接口仅管理员可以访问
+func registerQuotaRoutes(api, admin gin.IRouter, db *sql.DB) {
+	// 获取当前用户的已用空间和配额
+	api.GET("/quota", func(c *gin.Context) {
+		used, quota, err := getUserQuota(c.Request.Context(), db, currentUserID(c))
+		if err != nil {
+			renderError(c, internalError("Failed to get quota", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"used_bytes":  used,
+			"quota_bytes": quota,
+		})
+	})
+
+	// 调整用户的配额，0 表示不限制
+	admin.PUT("/users/:id/quota", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid user id"))
+			return
+		}
+		var req struct {
+			QuotaBytes *int64 `json:"quota_bytes"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.QuotaBytes == nil || *req.QuotaBytes < 0 {
+			renderError(c, invalidRequest("Invalid quota_bytes, must be a non-negative number of bytes"))
+			return
+		}
+
+		user, err := setUserQuota(c.Request.Context(), db, id, *req.QuotaBytes)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "User not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to update quota", err))
+			return
+		}
+		c.JSON(http.StatusOK, user)
+	})
+}
+
+// 返回配额不足的错误响应，包含当前已用空间和配额
+func quotaExceeded(c *gin.Context, db *sql.DB, ownerID int) {
+	used, quota, err := getUserQuota(c.Request.Context(), db, ownerID)
+	if err != nil {
+		renderError(c, internalError("Failed to get quota", err))
+		return
+	}
+	renderError(c, newAPIError(http.StatusRequestEntityTooLarge, codeQuotaExceeded, "Quota exceeded").with(gin.H{
+		"used_bytes":  used,
+		"quota_bytes": quota,
+	}))
+}
+
+// 获取用户的已用空间和配额
+func getUserQuota(ctx context.Context, db *sql.DB, userID int) (int64, int64, error) {
+	var used, quota int64
+	err := db.QueryRowContext(ctx, `SELECT used_bytes, quota_bytes FROM users WHERE id = ?`, userID).Scan(&used, &quota)
+	return used, quota, err
+}
+
+// 检查用户是否还能再存储 size 字节，用于在读取上传内容前提前拒绝
+func checkQuota(ctx context.Context, db *sql.DB, userID int, size int64) error {
+	used, quota, err := getUserQuota(ctx, db, userID)
+	if err != nil {
+		return err
+	}
+	if quota > 0 && used+size > quota {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// 在事务中增加用户的已用空间，超过配额时返回 errQuotaExceeded。
+// 每条文件记录都按其大小计入，即使内容与其他文件共用同一份存储
+func reserveQuota(ctx context.Context, tx *sql.Tx, userID int, size int64) error {
+	updateQuery := `
+	UPDATE users SET used_bytes = used_bytes + ?
+	WHERE id = ? AND (quota_bytes = 0 OR used_bytes + ? <= quota_bytes) RETURNING id`
+	err := tx.QueryRowContext(ctx, updateQuery, size, userID, size).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return errQuotaExceeded
+	}
+	return err
+}
+
+// 在事务中减少用户的已用空间
+func releaseQuota(ctx context.Context, tx *sql.Tx, userID int, size int64) error {
+	_, err := tx.ExecContext(ctx, `UPDATE users SET used_bytes = MAX(used_bytes - ?, 0) WHERE id = ?`, size, userID)
+	return err
+}
+
+// 重新统计所有用户的已用空间
+func recalculateUsage(db querier) error {
+	_, err := db.Exec(`UPDATE users SET used_bytes =
+		(SELECT IFNULL(SUM(size), 0) FROM files WHERE owner_id = users.id) +
+		(SELECT IFNULL(SUM(file_versions.size), 0) FROM file_versions JOIN files ON files.id = file_versions.file_id WHERE files.owner_id = users.id)`)
+	return err
+}
+
+// 设置用户的配额，返回更新后的用户信息；用户不存在时返回 sql.ErrNoRows
+func setUserQuota(ctx context.Context, db *sql.DB, userID int, quota int64) (User, error) {
+	updateQuery := `UPDATE users SET quota_bytes = ? WHERE id = ? RETURNING ` + userColumns
+	return scanUser(db.QueryRowContext(ctx, updateQuery, quota, userID))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 限流规则：每个 period 内最多 limit 次请求，允许一次性用完
+type rateRule struct {
+	limit  int
+	period time.Duration
+}
+
+// 一类接口的限流配置；routes 中的接口共用同一个令牌桶
+type rateLimitClass struct {
+	name   string
+	env    string
+	rule   string // 默认规则
+	routes []string
+}
+
+// 默认的限流配置，可以通过环境变量调整，如 RATE_LIMIT_UPLOAD=20/m，设为 off 表示不限制
+var rateLimitClasses = []rateLimitClass{
+	{"upload", "RATE_LIMIT_UPLOAD", "10/m", []string{"POST /upload", "POST /upload/json", "POST /upload/remote", "PUT /files/by-name/*name", "POST /upload/check", "POST /uploads", "PUT /dav/*path"}},
+	{"download", "RATE_LIMIT_DOWNLOAD", "60/m", []string{"GET /files/:id", "GET /files/hash/:hash", "GET /s/:token", "POST /s/:token", "GET /dl/:id", "GET /public/:hash", "POST /files/archive", "GET /folders/:id/archive", "GET /files/:id/versions/:v", "GET /dav/*path"}},
+	{"list", "RATE_LIMIT_LIST", "120/m", []string{"GET /files", "GET /files/starred", "GET /files/recent", "GET /files/duplicates", "GET /files/export", "GET /search", "GET /folders", "GET /shares", "GET /shared-with-me", "GET /upload/remote/:job", "GET /shared-with-me/folders/:id", "GET /trash", "GET /tags", "GET /stats", "GET /public", "HEAD /files/:id", "GET /files/:id/info", "GET /files/:id/siblings", "POST /files/lookup", "PROPFIND /dav/*path"}},
+	// 分享链接的密码错误次数，按分享链接和 IP 计数，见 checkSharePassword
+	{sharePasswordClass, "RATE_LIMIT_SHARE_PASSWORD", "5/m", nil},
+	// WebDAV Basic 认证的密码错误次数，按用户名和 IP 计数，见 davAuthCache
+	{davPasswordClass, "RATE_LIMIT_DAV_PASSWORD", "5/m", nil},
+}
+
+// 令牌桶
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 按用户（未登录时按 IP）限制请求频率的内存限流器
+type rateLimiter struct {
+	mu      sync.Mutex
+	classes map[string]string   // "METHOD 路由"（不含版本前缀） -> 类别
+	rules   map[string]rateRule // 类别 -> 规则
+	buckets map[string]*bucket  // 类别:用户 -> 令牌桶
+}
+
+// 根据环境变量创建限流器，并定期清理空闲的令牌桶，直到 ctx 被取消
+func newRateLimiter(ctx context.Context) (*rateLimiter, error) {
+	l := &rateLimiter{
+		classes: map[string]string{},
+		rules:   map[string]rateRule{},
+		buckets: map[string]*bucket{},
+	}
+	for _, class := range rateLimitClasses {
+		value := class.rule
+		if v := os.Getenv(class.env); v != "" {
+			value = v
+		}
+		rule, err := parseRateRule(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", class.env, value, err)
+		}
+		if rule.limit == 0 {
+			continue
+		}
+		l.rules[class.name] = rule
+		for _, route := range class.routes {
+			l.classes[route] = class.name
+		}
+	}
+	go l.cleanup(ctx, time.Minute)
+	return l, nil
+}
+
+// 解析形如 10/m、100/30s 的规则；off 或 0 表示不限制
+func parseRateRule(s string) (rateRule, error) {
+	if s == "off" || s == "0" {
+		return rateRule{}, nil
+	}
+	n, unit, ok := strings.Cut(s, "/")
+	limit, err := strconv.Atoi(n)
+	if !ok || err != nil || limit <= 0 {
+		return rateRule{}, fmt.Errorf("must look like 10/m")
+	}
+	if unit != "" && (unit[0] < '0' || unit[0] > '9') {
+		unit = "1" + unit
+	}
+	period, err := time.ParseDuration(unit)
+	if err != nil || period <= 0 {
+		return rateRule{}, fmt.Errorf("must look like 10/m")
+	}
+	return rateRule{limit: limit, period: period}, nil
+}
+
+// 限流中间件，需在 authMiddleware 之后使用才能按用户限流；超过限制时返回 429
+func (l *rateLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		class, ok := l.classes[c.Request.Method+" "+apiRoute(c)]
+		if !ok {
+			c.Next()
+			return
+		}
+		key := c.ClientIP()
+		if userID := currentUserID(c); userID != 0 {
+			key = "user:" + strconv.Itoa(userID)
+		}
+
+		if wait := l.take(class, key, time.Now()); wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			renderError(c, newAPIError(http.StatusTooManyRequests, codeRateLimited, "Too many requests, please retry later"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// 从令牌桶中取出一个令牌；没有令牌时返回需要等待的时间，该类别不限流时返回 0
+func (l *rateLimiter) take(class, key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, rate, ok := l.refill(class, key, now)
+	if !ok {
+		return 0
+	}
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// 与 take 相同，但不取出令牌；用于只有失败时才计数的情况，如分享链接的密码错误
+func (l *rateLimiter) peek(class, key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, rate, ok := l.refill(class, key, now)
+	if !ok || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// 按经过的时间补充令牌，返回令牌桶和每秒补充的令牌数；该类别不限流时返回 false。需持有 l.mu
+func (l *rateLimiter) refill(class, key string, now time.Time) (*bucket, float64, bool) {
+	rule, ok := l.rules[class]
+	if !ok {
+		return nil, 0, false
+	}
+	rate := float64(rule.limit) / rule.period.Seconds()
+	b, ok := l.buckets[class+":"+key]
+	if !ok {
+		b = &bucket{tokens: float64(rule.limit), last: now}
+		l.buckets[class+":"+key] = b
+	}
+	b.tokens = math.Min(float64(rule.limit), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	return b, rate, true
+}
+
+// 定期删除已经补满的令牌桶，避免占用的内存无限增长，直到 ctx 被取消
+func (l *rateLimiter) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			class, _, _ := strings.Cut(key, ":")
+			if now.Sub(b.last) >= l.rules[class].period {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 从远程地址上传时最多跟随的重定向次数
+const maxRemoteRedirects = 5
+
+// 每个用户同时进行的异步远程上传数
+const maxRemoteJobsPerUser = 4
+
+// 异步远程上传完成后保留结果的时间
+const remoteJobRetention = time.Hour
+
+// 远程上传任务的状态
+const (
+	remoteJobPending   = "pending"
+	remoteJobSucceeded = "succeeded"
+	remoteJobFailed    = "failed"
+)
+
+// 远程地址解析到了不允许访问的地址
+var errRemoteAddressBlocked = errors.New("remote address is not allowed")
+
+// 远程地址返回的内容超过大小限制
+var errRemoteTooLarge = errors.New("remote content exceeds the maximum upload size")
+
+// 不允许访问的地址段：除 netip 能判断的回环、私有和链路本地地址外，还包括运营商级 NAT、基准测试等保留地址
+var blockedRemotePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// RemoteJob 异步远程上传任务
+type RemoteJob struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"`
+	URL        string          `json:"url"`
+	File       *File           `json:"file,omitempty"`
+	Error      *RemoteJobError `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt *time.Time      `json:"finished_at"`
+	ownerID    int
+}
+
+// RemoteJobError 失败的远程上传任务的错误，与同步上传时的错误响应相同
+type RemoteJobError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details gin.H  `json:"details,omitempty"`
+}
+
+// 远程上传任务，只保存在内存中，重启后丢失
+type remoteJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*RemoteJob
+}
+
+// 注册从远程地址上传的接口；timeout 为获取内容的最长时间，allowPrivate 为 true 时允许访问内网地址，
+// hooks 用于异步任务完成后通知 webhook，ctx 被取消时停止清理已完成的任务。其余参数与 registerFileRoutes 相同
+func registerRemoteUploadRoutes(ctx context.Context, r gin.IRouter, db *sql.DB, hooks *webhookDispatcher, store Storage, maxUploadSize int64, hashAlgo, spoolDir string, timeout time.Duration, allowPrivate bool) {
+	client := newRemoteClient(timeout, allowPrivate)
+	jobs := &remoteJobs{jobs: map[string]*RemoteJob{}}
+	go jobs.cleanup(ctx, time.Minute)
+
+	// 获取 url 的内容并保存为新文件，与 /upload 一样计算哈希、检测类型并计入配额。只允许 http 和 https，
+	// 解析到回环、内网和链路本地地址时拒绝。name 缺省时使用响应的 Content-Disposition 或地址中的文件名；
+	// on_name_conflict 为 error（默认）或 rename，见 nameConflictError。
+	// async 为 true 时立即返回 202 和任务，通过 GET /upload/remote/:job 查询结果
+	r.POST("/upload/remote", func(c *gin.Context) {
+		var req struct {
+			URL            string `json:"url"`
+			Name           string `json:"name"`
+			FolderID       *int   `json:"folder_id"`
+			OnNameConflict string `json:"on_name_conflict"`
+			Async          bool   `json:"async"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			renderError(c, invalidRequest("Invalid url, must be an http or https URL"))
+			return
+		}
+		if req.Name != "" {
+			name, err := cleanFileName(req.Name)
+			if err != nil {
+				renderError(c, invalidRequest(err.Error()))
+				return
+			}
+			req.Name = name
+		}
+		if req.OnNameConflict == "" {
+			req.OnNameConflict = nameConflictError
+		}
+		if req.OnNameConflict != nameConflictError && req.OnNameConflict != nameConflictRename {
+			renderError(c, invalidRequest("Invalid on_name_conflict, must be error or rename"))
+			return
+		}
+		ownerID := currentUserID(c)
+		if !checkTargetFolder(c, db, ownerID, req.FolderID) {
+			return
+		}
+
+		upload := func(ctx context.Context) (File, error) {
+			defer trackUpload()()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return fetchRemote(ctx, client, db, store, u.String(), File{
+				HashAlgo:   hashAlgo,
+				Name:       req.Name,
+				OwnerID:    ownerID,
+				FolderID:   req.FolderID,
+				autoRename: req.OnNameConflict == nameConflictRename,
+			}, maxUploadSize, spoolDir)
+		}
+
+		if !req.Async {
+			detachDeadline(c)
+			file, err := upload(c.Request.Context())
+			if err != nil {
+				renderError(c, remoteUploadError(c.Request.Context(), db, ownerID, file, err, maxUploadSize))
+				return
+			}
+			addAuditFile(c, file)
+			c.Header("Location", apiV1Prefix+"/files/"+strconv.Itoa(file.ID))
+			c.JSON(http.StatusCreated, gin.H{"file": file})
+			return
+		}
+
+		job, err := jobs.add(ownerID, u.String())
+		if err != nil {
+			renderError(c, newAPIError(http.StatusTooManyRequests, codeRateLimited, "Too many remote uploads in progress, please retry later"))
+			return
+		}
+		// 任务完成时审计中间件已经返回，由任务自己记录审计日志并通知 webhook
+		setAuditAction(c, auditDeferred)
+		clientIP := c.ClientIP()
+		go func() {
+			// 请求返回后继续执行，不随请求取消
+			ctx := context.WithoutCancel(c.Request.Context())
+			file, err := upload(ctx)
+			if err != nil {
+				slog.WarnContext(ctx, "Remote upload failed", "job_id", job.ID, "url", job.URL, "error", err)
+				e := remoteUploadError(ctx, db, ownerID, file, err, maxUploadSize)
+				writeAuditEntries(ctx, db, hooks, "upload", ownerID, clientIP, e.status, []File{{}})
+				jobs.finish(job, nil, e)
+				return
+			}
+			writeAuditEntries(ctx, db, hooks, "upload", ownerID, clientIP, http.StatusCreated, []File{file})
+			jobs.finish(job, &file, nil)
+		}()
+		c.Header("Location", apiV1Prefix+"/upload/remote/"+job.ID)
+		c.JSON(http.StatusAccepted, jobs.get(ownerID, job.ID))
+	})
+
+	// 查询异步远程上传任务；任务只对创建者可见，完成一小时后不再保留
+	r.GET("/upload/remote/:job", func(c *gin.Context) {
+		job := jobs.get(currentUserID(c), c.Param("job"))
+		if job == nil {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Job not found"))
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	})
+}
+
+// 获取 rawURL 的内容并保存为 file；file.Name 为空时根据响应确定文件名
+func fetchRemote(ctx context.Context, client *http.Client, db *sql.DB, store Storage, rawURL string, file File, maxUploadSize int64, spoolDir string) (File, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return file, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return file, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return file, fmt.Errorf("remote server returned %s", resp.Status)
+	}
+	if resp.ContentLength > maxUploadSize {
+		return file, errRemoteTooLarge
+	}
+	if file.Name == "" {
+		file.Name = remoteFileName(resp)
+	}
+
+	content, err := spoolContent(&limitedReader{r: resp.Body, n: maxUploadSize}, spoolDir, file.HashAlgo, spoolMemoryLimit)
+	if err != nil {
+		return file, err
+	}
+	defer content.Close()
+	body, err := content.reader()
+	if err != nil {
+		return file, err
+	}
+	declared, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if file.Mime, _, err = detectContentType(body, declared, file.Name); err != nil {
+		return file, err
+	}
+	if !file.autoRename {
+		_, err := newFileRepository(db).GetByName(ctx, file.OwnerID, file.FolderID, file.Name)
+		if err == nil {
+			return file, errNameConflict
+		}
+		if !errors.Is(err, errNotFound) {
+			return file, err
+		}
+	}
+	file.CreatedAt = time.Now().UTC()
+	file.rejectConflict = !file.autoRename
+	return storeSpooled(ctx, db, store, file, content, "", false)
+}
+
+// 远程内容的文件名：优先使用 Content-Disposition，其次是最终地址的最后一段，清理后都为空时为 download
+func remoteFileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		if name, err := cleanFileName(params["filename"]); err == nil {
+			return name
+		}
+	}
+	if segment, err := url.PathUnescape(path.Base(resp.Request.URL.Path)); err == nil {
+		if name, err := cleanFileName(segment); err == nil {
+			return name
+		}
+	}
+	return "download"
+}
+
+// 将远程上传的错误转换为错误响应
+func remoteUploadError(ctx context.Context, db *sql.DB, ownerID int, file File, err error, maxUploadSize int64) *apiError {
+	if e := uploadRejectedError(err); e != nil {
+		return e
+	}
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errRemoteAddressBlocked):
+		return newAPIError(http.StatusForbidden, codeForbidden, "Remote address is not allowed")
+	case errors.Is(err, errRemoteTooLarge):
+		return newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge, "Remote content exceeds the maximum size of "+strconv.FormatInt(maxUploadSize, 10)+" bytes").with(gin.H{
+			"max_upload_size": maxUploadSize,
+		})
+	case errors.Is(err, errQuotaExceeded):
+		e := newAPIError(http.StatusRequestEntityTooLarge, codeQuotaExceeded, "Storage quota exceeded")
+		if used, quota, err := getUserQuota(ctx, db, ownerID); err == nil {
+			e = e.with(gin.H{"used_bytes": used, "quota_bytes": quota})
+		}
+		return e
+	case errors.Is(err, errNameConflict):
+		return newAPIError(http.StatusConflict, codeFileExists, "A file with the same name already exists").with(gin.H{"name": file.Name})
+	case errors.Is(err, errFolderNotFound):
+		return newAPIError(http.StatusNotFound, codeNotFound, "Target folder not found")
+	case errors.Is(err, context.DeadlineExceeded):
+		return newAPIError(http.StatusGatewayTimeout, codeRemoteFailed, "Timed out fetching the remote URL")
+	case errors.As(err, &dnsErr):
+		return newAPIError(http.StatusBadGateway, codeRemoteFailed, "Failed to resolve the remote host")
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) || strings.HasPrefix(err.Error(), "remote server returned") || errors.Is(err, errTooManyRedirects) {
+		return newAPIError(http.StatusBadGateway, codeRemoteFailed, "Failed to fetch the remote URL: "+err.Error())
+	}
+	return internalError("Failed to save remote file", err)
+}
+
+// 重定向次数过多
+var errTooManyRedirects = errors.New("too many redirects")
+
+// 获取远程内容的 HTTP 客户端：不使用代理，连接前检查解析出的地址，因此 DNS 重新绑定和重定向到内网地址也会被拒绝
+func newRemoteClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowPrivate {
+				return nil
+			}
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !remoteAddressAllowed(addrPort.Addr()) {
+				return errRemoteAddressBlocked
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRemoteRedirects {
+				return errTooManyRedirects
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errRemoteAddressBlocked
+			}
+			return nil
+		},
+	}
+}
+
+// 地址是否允许访问：拒绝回环、私有、链路本地、组播、未指定和其他保留地址
+func remoteAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range blockedRemotePrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// 读取超过 n 字节时返回 errRemoteTooLarge
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errRemoteTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errRemoteTooLarge
+	}
+	return n, err
+}
+
+// 添加任务；用户进行中的任务达到 maxRemoteJobsPerUser 时返回错误
+func (j *remoteJobs) add(ownerID int, rawURL string) (*RemoteJob, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	pending := 0
+	for _, job := range j.jobs {
+		if job.ownerID == ownerID && job.Status == remoteJobPending {
+			pending++
+		}
+	}
+	if pending >= maxRemoteJobsPerUser {
+		return nil, errors.New("too many remote uploads in progress")
+	}
+	job := &RemoteJob{ID: hex.EncodeToString(b), Status: remoteJobPending, URL: rawURL, CreatedAt: time.Now().UTC(), ownerID: ownerID}
+	j.jobs[job.ID] = job
+	return job, nil
+}
+
+// 记录任务的结果
+func (j *remoteJobs) finish(job *RemoteJob, file *File, e *apiError) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	job.File = file
+	job.Status = remoteJobSucceeded
+	if e != nil {
+		job.Status = remoteJobFailed
+		job.Error = &RemoteJobError{Status: e.status, Code: e.code, Message: e.message, Details: e.details}
+	}
+}
+
+// 返回用户的任务的副本，不存在或不属于该用户时返回 nil
+func (j *remoteJobs) get(ownerID int, id string) *RemoteJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok || job.ownerID != ownerID {
+		return nil
+	}
+	copied := *job
+	return &copied
+}
+
+// 定期删除完成超过 remoteJobRetention 的任务，直到 ctx 被取消
+func (j *remoteJobs) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		j.mu.Lock()
+		for id, job := range j.jobs {
+			if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > remoteJobRetention {
+				delete(j.jobs, id)
+			}
+		}
+		j.mu.Unlock()
+	}
+}
@@ -0,0 +1,837 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 文件仓库返回的错误，处理函数据此返回 404、409 和 410
+var (
+	errNotFound    = errors.New("not found")
+	errDuplicate   = errors.New("duplicate")
+	errFileExpired = errors.New("file expired")
+)
+
+// 排除已过期文件的查询条件，参数为当前时间；过期的文件在清理前仍保留记录
+const fileNotExpired = "(files.expires_at IS NULL OR files.expires_at > ?)"
+
+// FileRepository 读写 files 表。所有方法都接收 context，请求取消或超时时查询随之中止；
+// 记录不存在时返回 errNotFound，违反唯一约束时返回 errDuplicate
+type FileRepository struct {
+	db *sql.DB
+}
+
+// 创建文件仓库
+func newFileRepository(db *sql.DB) *FileRepository {
+	return &FileRepository{db: db}
+}
+
+// 将数据库错误转换为仓库的错误，文件夹已被删除时返回 errFolderNotFound
+func repositoryError(err error) error {
+	switch {
+	case err == sql.ErrNoRows:
+		return errNotFound
+	case isUniqueViolation(err):
+		return errDuplicate
+	// 文件引用的文件夹只有在检查之后被并发删除时才会不存在
+	case isForeignKeyViolation(err):
+		return errFolderNotFound
+	}
+	return err
+}
+
+// 保存文件记录并计入用户的已用空间，同时增加内容的引用计数，返回包含 id 的文件信息；
+// 内容需已保存到存储后端。超过配额时返回 errQuotaExceeded，文件夹已被删除时返回 errFolderNotFound；
+// file.rejectConflict 为 true 且已有同名文件时返回该文件和 errNameConflict
+func (r *FileRepository) Create(ctx context.Context, file File) (File, error) {
+	defer observeQuery("create")()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return file, err
+	}
+	defer tx.Rollback()
+
+	if err := reserveQuota(ctx, tx, file.OwnerID, file.Size); err != nil {
+		return file, err
+	}
+	if err := acquireBlob(ctx, tx, file.blobKey(), file.Size); err != nil {
+		return file, err
+	}
+	// 事务开始时即取得写锁，并发的上传不会选中同一个名称，也不会都通过同名检查
+	switch {
+	case file.autoRename:
+		if file.Name, err = availableName(ctx, tx, file.OwnerID, file.FolderID, file.Name); err != nil {
+			return file, err
+		}
+	case file.rejectConflict:
+		if existing, err := checkNameConflict(ctx, tx, file.OwnerID, file.FolderID, file.Name, 0); err != nil {
+			return existing, err
+		}
+	}
+	inserted, err := insertFile(ctx, tx, file)
+	if err != nil {
+		return file, repositoryError(err)
+	}
+	return inserted, tx.Commit()
+}
+
+// 返回文件夹下未被占用的文件名：name 未被占用时直接使用，否则在扩展名前加上序号，如 name (1).ext，
+// 超过长度限制时截短主名；序号超过 maxRenameSuffix 时返回 errNameConflict
+func availableName(ctx context.Context, tx *sql.Tx, ownerID int, folderID *int, name string) (string, error) {
+	query := `SELECT name FROM files WHERE owner_id = ? AND folder_id IS ? AND deleted_at IS NULL AND ` + fileNotExpired
+	rows, err := tx.QueryContext(ctx, query, ownerID, folderID, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	used := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return "", err
+		}
+		used[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; used[candidate]; i++ {
+		if i > maxRenameSuffix {
+			return "", errNameConflict
+		}
+		suffix := " (" + strconv.Itoa(i) + ")" + ext
+		candidate = truncateUTF8(base, maxFileNameLength-len(suffix)) + suffix
+	}
+	return candidate, nil
+}
+
+// 在事务中查找文件夹下未过期的同名文件，exceptID 的文件除外；有同名文件时返回该文件和 errNameConflict
+func checkNameConflict(ctx context.Context, tx *sql.Tx, ownerID int, folderID *int, name string, exceptID int) (File, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE owner_id = ? AND folder_id IS ? AND name = ? AND id != ? AND deleted_at IS NULL AND ` + fileNotExpired + ` ORDER BY id LIMIT 1`
+	existing, err := scanFile(tx.QueryRowContext(ctx, query, ownerID, folderID, name, exceptID, time.Now().UTC()))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return File{}, nil
+	case err != nil:
+		return File{}, err
+	}
+	return existing, errNameConflict
+}
+
+// 将 s 截短到最多 n 字节，不截断多字节字符
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:max(n, 0)]
+}
+
+// 为用户已拥有的内容添加一个新文件，不需要再次上传内容，按 file.HashAlgo 和 file.Hash 查找内容；
+// 用户没有该内容的文件时返回 errNotFound。
+// 只查找用户自己的文件，避免只凭哈希就能获取其他用户的内容；超过配额时返回 errQuotaExceeded
+func (r *FileRepository) Link(ctx context.Context, file File) (File, error) {
+	defer observeQuery("link")()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return file, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT size, mime FROM files WHERE owner_id = ? AND hash_algo = ? AND hash = ? AND ` + fileNotExpired + ` ORDER BY id LIMIT 1`
+	if err := tx.QueryRowContext(ctx, query, file.OwnerID, file.HashAlgo, file.Hash, time.Now().UTC()).Scan(&file.Size, &file.Mime); err != nil {
+		return file, repositoryError(err)
+	}
+	if err := reserveQuota(ctx, tx, file.OwnerID, file.Size); err != nil {
+		return file, err
+	}
+	retained, err := retainBlob(ctx, tx, file.blobKey())
+	if err != nil {
+		return file, err
+	}
+	if !retained {
+		return file, errNotFound
+	}
+	file, err = insertFile(ctx, tx, file)
+	if err != nil {
+		return file, repositoryError(err)
+	}
+	return file, tx.Commit()
+}
+
+// 以 target 的名称、所有者和文件夹新增一个与 source 内容相同的文件，只增加内容的引用计数，不复制内容；
+// 内容已被删除时返回 errNotFound，超过 target 所有者的配额时返回 errQuotaExceeded，文件夹已被删除时返回 errFolderNotFound
+func (r *FileRepository) Copy(ctx context.Context, source, target File) (File, error) {
+	defer observeQuery("copy")()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return target, err
+	}
+	defer tx.Rollback()
+
+	target.HashAlgo, target.Hash, target.Size, target.Mime = source.HashAlgo, source.Hash, source.Size, source.Mime
+	if err := reserveQuota(ctx, tx, target.OwnerID, target.Size); err != nil {
+		return target, err
+	}
+	retained, err := retainBlob(ctx, tx, target.blobKey())
+	if err != nil {
+		return target, err
+	}
+	if !retained {
+		return target, errNotFound
+	}
+	if target.rejectConflict {
+		if existing, err := checkNameConflict(ctx, tx, target.OwnerID, target.FolderID, target.Name, 0); err != nil {
+			return existing, err
+		}
+	}
+	file, err := insertFile(ctx, tx, target)
+	if err != nil {
+		return target, repositoryError(err)
+	}
+	return file, tx.Commit()
+}
+
+// 根据 id 获取用户的文件信息；文件不存在、不属于该用户或在回收站中时返回 errNotFound，已过期时返回 errFileExpired
+func (r *FileRepository) GetByID(ctx context.Context, ownerID, id int) (File, error) {
+	defer observeQuery("get_by_id")()
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NULL`
+	file, err := scanFile(r.db.QueryRowContext(ctx, query, id, ownerID))
+	if err == nil && file.expired(time.Now().UTC()) {
+		return File{}, errFileExpired
+	}
+	return file, repositoryError(err)
+}
+
+// 根据算法和哈希获取用户未过期的文件信息；有多个相同内容的文件时返回最早上传的
+func (r *FileRepository) GetByHash(ctx context.Context, ownerID int, algo, hash string) (File, error) {
+	defer observeQuery("get_by_hash")()
+	query := `SELECT ` + fileColumns + ` FROM files WHERE hash_algo = ? AND hash = ? AND owner_id = ? AND deleted_at IS NULL AND ` + fileNotExpired + ` ORDER BY id LIMIT 1`
+	file, err := scanFile(r.db.QueryRowContext(ctx, query, algo, hash, ownerID, time.Now().UTC()))
+	return file, repositoryError(err)
+}
+
+// 在一次查询中按哈希获取用户未过期的文件信息，按哈希索引；有多个相同内容的文件时返回最早上传的，没有的哈希不在结果中
+func (r *FileRepository) FindByHashes(ctx context.Context, ownerID int, algo string, hashes []string) (map[string]File, error) {
+	defer observeQuery("find_by_hashes")()
+	files := map[string]File{}
+	if len(hashes) == 0 {
+		return files, nil
+	}
+	args := []any{algo}
+	for _, hash := range hashes {
+		args = append(args, hash)
+	}
+	args = append(args, ownerID, time.Now().UTC())
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(hashes)), ", ")
+	query := `SELECT ` + fileColumns + ` FROM files WHERE hash_algo = ? AND hash IN (` + placeholders + `) AND owner_id = ? AND deleted_at IS NULL AND ` + fileNotExpired + ` ORDER BY id`
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := files[file.Hash]; !ok {
+			files[file.Hash] = file
+		}
+	}
+	return files, rows.Err()
+}
+
+// 根据算法和哈希获取公开的文件信息，不限制所有者；有多个相同内容的公开文件时返回最早上传的
+func (r *FileRepository) GetPublicByHash(ctx context.Context, algo, hash string) (File, error) {
+	defer observeQuery("get_public_by_hash")()
+	query := `SELECT ` + fileColumns + ` FROM files WHERE hash_algo = ? AND hash = ? AND visibility = 'public' AND deleted_at IS NULL AND ` + fileNotExpired + ` ORDER BY id LIMIT 1`
+	file, err := scanFile(r.db.QueryRowContext(ctx, query, algo, hash, time.Now().UTC()))
+	return file, repositoryError(err)
+}
+
+// 获取用户在指定文件夹下未过期的同名文件，folderID 为空表示根目录；有多个同名文件时返回最早上传的
+func (r *FileRepository) GetByName(ctx context.Context, ownerID int, folderID *int, name string) (File, error) {
+	defer observeQuery("get_by_name")()
+	query := `SELECT ` + fileColumns + ` FROM files WHERE owner_id = ? AND folder_id IS ? AND name = ? AND deleted_at IS NULL AND ` + fileNotExpired + ` ORDER BY id LIMIT 1`
+	file, err := scanFile(r.db.QueryRowContext(ctx, query, ownerID, folderID, name, time.Now().UTC()))
+	return file, repositoryError(err)
+}
+
+// 分页获取符合条件的文件信息，同时返回符合条件的文件总数（使用游标时为 0）和是否还有下一页；已过期的文件不列出
+func (r *FileRepository) List(ctx context.Context, opts listOptions) ([]File, int, bool, error) {
+	defer observeQuery("list")()
+	conditions := []string{"owner_id = ?", "deleted_at IS NULL", fileNotExpired}
+	order := "id"
+	if opts.Trashed {
+		conditions[1] = "deleted_at IS NOT NULL"
+		order = "deleted_at DESC, id"
+	}
+	// 排序字段相同时按 id 排列，保证分页结果稳定
+	if column, ok := fileSortColumns[opts.Sort]; ok {
+		direction := " ASC"
+		if opts.Desc {
+			direction = " DESC"
+		}
+		order = column + direction + ", id" + direction
+	}
+	conditions, args := listFilters(opts, conditions, []any{opts.OwnerID, time.Now().UTC()})
+	if opts.Type != "" {
+		conditions = append(conditions, fileTypeSQL+" = ?")
+		args = append(args, opts.Type)
+	}
+	total := 0
+	if opts.After == nil {
+		where := " WHERE " + strings.Join(conditions, " AND ")
+		if err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM files"+where, args...).Scan(&total); err != nil {
+			return nil, 0, false, err
+		}
+	} else {
+		// 按 (排序字段, id) 从游标之后继续，可以使用索引而不需要跳过之前的行
+		value, err := opts.After.value()
+		if err != nil {
+			return nil, 0, false, err
+		}
+		column, op := fileSortColumns[opts.After.Sort], ">"
+		if opts.After.Desc {
+			op = "<"
+		}
+		conditions = append(conditions, "("+column+" "+op+" ? OR ("+column+" = ? AND id "+op+" ?))")
+		args = append(args, value, value, opts.After.ID)
+	}
+	where := " WHERE " + strings.Join(conditions, " AND ")
+
+	// 多读取一行以判断是否还有下一页
+	query := "SELECT " + fileColumns + " FROM files" + where + " ORDER BY " + order + " LIMIT ? OFFSET ?"
+	rows, err := r.db.QueryContext(ctx, query, append(args, opts.Limit+1, opts.Offset)...)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		files = append(files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	more := len(files) > opts.Limit
+	if more {
+		files = files[:opts.Limit]
+	}
+	return files, total, more, nil
+}
+
+// 统计符合条件的文件中每种类型的文件数，不按 opts.Type 过滤；没有文件的类型为 0
+func (r *FileRepository) CountTypes(ctx context.Context, opts listOptions) (map[string]int, error) {
+	defer observeQuery("count_types")()
+	conditions, args := listFilters(opts, []string{"owner_id = ?", "deleted_at IS NULL", fileNotExpired}, []any{opts.OwnerID, time.Now().UTC()})
+	query := "SELECT " + fileTypeSQL + " AS type, COUNT(*) FROM files WHERE " + strings.Join(conditions, " AND ") + " GROUP BY type"
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for _, name := range fileTypeNames {
+		counts[name] = 0
+	}
+	for rows.Next() {
+		var name string
+		var count int
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		counts[name] = count
+	}
+	return counts, rows.Err()
+}
+
+// 在 conditions 和 args 之后添加 opts 中文件夹、文件名、星标、标签和 MIME 类型的过滤条件
+func listFilters(opts listOptions, conditions []string, args []any) ([]string, []any) {
+	if opts.FolderID != nil {
+		if *opts.FolderID == 0 {
+			conditions = append(conditions, "folder_id IS NULL")
+		} else {
+			conditions = append(conditions, "folder_id = ?")
+			args = append(args, *opts.FolderID)
+		}
+	}
+	if opts.Query != "" {
+		// 与规范化后的文件名比较，忽略大小写和重音
+		conditions = append(conditions, `search_name LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(searchName(opts.Query))+"%")
+	}
+	if opts.Starred {
+		conditions = append(conditions, "starred = 1")
+	}
+	for _, tag := range opts.Tags {
+		conditions = append(conditions, `id IN (SELECT file_tags.file_id FROM file_tags JOIN tags ON tags.id = file_tags.tag_id WHERE tags.owner_id = ? AND tags.name = ?)`)
+		args = append(args, opts.OwnerID, tag)
+	}
+	if opts.MediaType != "" {
+		conditions = append(conditions, fileMediaTypeSQL+" = ?")
+		args = append(args, opts.MediaType)
+	}
+	if opts.Since != nil {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, *opts.Since)
+	}
+	if opts.Until != nil {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, *opts.Until)
+	}
+	if opts.TakenSince != nil {
+		conditions = append(conditions, takenAtSQL+" >= ?")
+		args = append(args, *opts.TakenSince)
+	}
+	if opts.TakenUntil != nil {
+		conditions = append(conditions, takenAtSQL+" < ?")
+		args = append(args, *opts.TakenUntil)
+	}
+	return conditions, args
+}
+
+// 分页获取所有用户的公开文件及总数，最新上传的在前，不包括回收站中和已过期的文件
+func (r *FileRepository) ListPublic(ctx context.Context, limit, offset int) ([]PublicFile, int, error) {
+	defer observeQuery("list_public")()
+	where := ` FROM files WHERE visibility = 'public' AND deleted_at IS NULL AND ` + fileNotExpired
+	now := time.Now().UTC()
+	var total int
+	if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*)`+where, now).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT id, name, size, hash, hash_algo, mime, created_at` + where + ` ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?`
+	rows, err := r.db.QueryContext(ctx, query, now, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	files := []PublicFile{}
+	for rows.Next() {
+		var f PublicFile
+		if err := rows.Scan(&f.ID, &f.Name, &f.Size, &f.Hash, &f.HashAlgo, &f.Mime, &f.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		files = append(files, f)
+	}
+	return files, total, rows.Err()
+}
+
+// 将文件移入回收站，内容和配额在彻底删除前保留；文件不存在或已在回收站中时返回 errNotFound，
+// 受保护时返回 errFileProtected
+func (r *FileRepository) Trash(ctx context.Context, ownerID, id int) (File, error) {
+	defer observeQuery("trash")()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return File{}, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NULL`
+	file, err := scanFile(tx.QueryRowContext(ctx, query, id, ownerID))
+	if err != nil {
+		return File{}, repositoryError(err)
+	}
+	if file.Protected {
+		return File{}, errFileProtected
+	}
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `UPDATE files SET deleted_at = ? WHERE id = ?`, now, id); err != nil {
+		return File{}, err
+	}
+	file.DeletedAt = &now
+	return file, tx.Commit()
+}
+
+// 在一个事务中将多个文件移入回收站，返回与 ids 一一对应的文件和错误，单个文件的错误与 Trash 相同。
+// atomic 为 true 时有任何一个文件失败都不提交，所有文件都不移入回收站；否则提交其余成功的文件
+func (r *FileRepository) TrashBatch(ctx context.Context, ownerID int, ids []int, atomic bool) ([]File, []error, error) {
+	defer observeQuery("trash_batch")()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	files := make([]File, len(ids))
+	errs := make([]error, len(ids))
+	failed := false
+	now := time.Now().UTC()
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NULL`
+	for i, id := range ids {
+		file, err := scanFile(tx.QueryRowContext(ctx, query, id, ownerID))
+		switch {
+		case err == sql.ErrNoRows:
+			errs[i] = errNotFound
+		case err != nil:
+			return nil, nil, err
+		case file.Protected:
+			errs[i] = errFileProtected
+		}
+		if errs[i] != nil {
+			failed = true
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE files SET deleted_at = ? WHERE id = ?`, now, id); err != nil {
+			return nil, nil, err
+		}
+		file.DeletedAt = &now
+		files[i] = file
+	}
+	if failed && atomic {
+		return files, errs, nil
+	}
+	return files, errs, tx.Commit()
+}
+
+// 彻底删除回收站中的文件及其历史版本、分享链接和标签，释放占用的配额和内容引用，
+// 返回被删除的文件信息和已没有引用的内容，存储后端中的内容由调用方删除。
+// 文件不存在或不在回收站中时返回 errNotFound，受保护时返回 errFileProtected
+func (r *FileRepository) Delete(ctx context.Context, ownerID, id int) (File, []string, error) {
+	defer observeQuery("delete")()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return File{}, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NOT NULL`
+	file, err := scanFile(tx.QueryRowContext(ctx, query, id, ownerID))
+	if err != nil {
+		return File{}, nil, repositoryError(err)
+	}
+	if file.Protected {
+		return File{}, nil, errFileProtected
+	}
+	unused, err := removeFile(ctx, tx, file)
+	if err != nil {
+		return File{}, nil, err
+	}
+	return file, unused, tx.Commit()
+}
+
+// 在一个事务中将文件记录替换为 file 的内容，更新哈希、大小、类型和 updated_at，不保留原内容为历史版本；
+// 原内容的配额和引用同时释放，返回更新后的文件信息、原内容的哈希和已没有引用的内容。
+// 新内容需已保存到存储后端。文件不存在或在回收站中时返回 errNotFound，受保护时返回 errFileProtected，
+// 超过配额时返回 errQuotaExceeded
+func (r *FileRepository) Replace(ctx context.Context, file File) (File, string, []string, error) {
+	defer observeQuery("replace")()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return file, "", nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NULL`
+	current, err := scanFile(tx.QueryRowContext(ctx, query, file.ID, file.OwnerID))
+	if err != nil {
+		return file, "", nil, repositoryError(err)
+	}
+	if current.Protected {
+		return file, "", nil, errFileProtected
+	}
+	if err := releaseQuota(ctx, tx, file.OwnerID, current.Size); err != nil {
+		return file, "", nil, err
+	}
+	if err := reserveQuota(ctx, tx, file.OwnerID, file.Size); err != nil {
+		return file, "", nil, err
+	}
+	// 先增加新内容的引用再释放原内容，内容相同时不会被删除
+	if err := acquireBlob(ctx, tx, file.blobKey(), file.Size); err != nil {
+		return file, "", nil, err
+	}
+	var unused []string
+	released, err := releaseBlob(ctx, tx, current.blobKey())
+	if err != nil {
+		return file, "", nil, err
+	}
+	if released {
+		unused = append(unused, current.blobKey())
+	}
+	// 指定了过期时间则一并更新
+	updateQuery := `UPDATE files SET hash = ?, hash_algo = ?, size = ?, mime = ?, updated_at = ?, expires_at = IFNULL(?, expires_at) WHERE id = ? RETURNING ` + fileColumns
+	updated, err := scanFile(tx.QueryRowContext(ctx, updateQuery, file.Hash, file.HashAlgo, file.Size, file.Mime, file.CreatedAt, file.ExpiresAt, file.ID))
+	if err != nil {
+		return file, "", nil, err
+	}
+	return updated, current.Hash, unused, tx.Commit()
+}
+
+// 获取用户在 since 之后上传（mode 为 recentUploaded）或下载（recentDownloaded）的文件，最新的在前，
+// 最多返回 limit 个；不包括回收站中和已过期的文件。两种查询都使用 (owner_id, 时间) 索引
+func (r *FileRepository) Recent(ctx context.Context, ownerID int, mode string, since time.Time, limit int) ([]File, error) {
+	defer observeQuery("recent")()
+	column := "created_at"
+	if mode == recentDownloaded {
+		column = "last_downloaded_at"
+	}
+	query := "SELECT " + fileColumns + " FROM files WHERE owner_id = ? AND " + column + " >= ? AND deleted_at IS NULL AND " + fileNotExpired +
+		" ORDER BY " + column + " DESC, id DESC LIMIT ?"
+	rows, err := r.db.QueryContext(ctx, query, ownerID, since, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := []File{}
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// 分页获取用户的重复文件组及组的总数，by 为 duplicatesByName 时按规范化的文件名分组，
+// duplicatesByContent 时按内容分组；不包括回收站中和已过期的文件。
+// 先在 SQL 中用 GROUP BY/HAVING 选出当前页的组，再只读取这些组中的文件
+func (r *FileRepository) Duplicates(ctx context.Context, ownerID int, by string, limit, offset int) ([]DuplicateGroup, int, error) {
+	defer observeQuery("duplicates")()
+	key := "lower(trim(name))"
+	if by == duplicatesByContent {
+		key = "hash_algo || ':' || hash"
+	}
+	where := " FROM files WHERE owner_id = ? AND deleted_at IS NULL AND " + fileNotExpired
+	grouped := "SELECT " + key + " AS dup_key, COUNT(*) AS n, SUM(size)" + where + " GROUP BY dup_key HAVING COUNT(*) > 1"
+	now := time.Now().UTC()
+
+	var total int
+	if err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+grouped+")", ownerID, now).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, grouped+" ORDER BY n DESC, dup_key LIMIT ? OFFSET ?", ownerID, now, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	groups := []DuplicateGroup{}
+	index := map[string]int{}
+	var keys []any
+	for rows.Next() {
+		group := DuplicateGroup{Files: []File{}}
+		if err := rows.Scan(&group.Key, &group.Count, &group.TotalSize); err != nil {
+			return nil, 0, err
+		}
+		index[group.Key] = len(groups)
+		keys = append(keys, group.Key)
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(groups) == 0 {
+		return groups, total, nil
+	}
+
+	query := "SELECT " + key + ", " + fileColumns + where + " AND " + key + " IN (?" + strings.Repeat(", ?", len(keys)-1) + ") ORDER BY created_at, id"
+	fileRows, err := r.db.QueryContext(ctx, query, append([]any{ownerID, now}, keys...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fileRows.Close()
+	for fileRows.Next() {
+		var groupKey string
+		file, err := scanFile(keyedRow{fileRows, &groupKey})
+		if err != nil {
+			return nil, 0, err
+		}
+		i := index[groupKey]
+		groups[i].Files = append(groups[i].Files, file)
+	}
+	return groups, total, fileRows.Err()
+}
+
+// 获取与 file 内容相同的其他文件，包括回收站中的文件，按上传时间排列；ownerID 不为 0 时只返回该用户的文件。
+// 同时返回所有用户中内容相同的其他文件总数，以及其他文件的历史版本中引用该内容的数量
+func (r *FileRepository) Siblings(ctx context.Context, file File, ownerID int) ([]SiblingFile, int, int, error) {
+	defer observeQuery("siblings")()
+	var total, versions int
+	err := r.db.QueryRowContext(ctx, `
+	SELECT (SELECT COUNT(*) FROM files WHERE hash_algo = ? AND hash = ? AND id != ?),
+		(SELECT COUNT(*) FROM file_versions WHERE hash_algo = ? AND hash = ? AND file_id != ?)`,
+		file.HashAlgo, file.Hash, file.ID, file.HashAlgo, file.Hash, file.ID).Scan(&total, &versions)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	query := "SELECT IFNULL((SELECT username FROM users WHERE users.id = files.owner_id), ''), " + fileColumns + " FROM files WHERE hash_algo = ? AND hash = ? AND id != ?"
+	args := []any{file.HashAlgo, file.Hash, file.ID}
+	if ownerID != 0 {
+		query += " AND owner_id = ?"
+		args = append(args, ownerID)
+	}
+	rows, err := r.db.QueryContext(ctx, query+" ORDER BY created_at, id", args...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+	siblings := []SiblingFile{}
+	for rows.Next() {
+		var sibling SiblingFile
+		if sibling.File, err = scanFile(keyedRow{rows, &sibling.Owner}); err != nil {
+			return nil, 0, 0, err
+		}
+		siblings = append(siblings, sibling)
+	}
+	return siblings, total, versions, rows.Err()
+}
+
+// 读取 scanFile 的字段之前先将第一列读入 key，用于同时查询分组键和文件信息
+type keyedRow struct {
+	rows *sql.Rows
+	key  *string
+}
+
+func (r keyedRow) Scan(dest ...any) error {
+	return r.rows.Scan(append([]any{r.key}, dest...)...)
+}
+
+// 获取 now 时已过期的文件 id，最多返回 limit 个；受保护的文件在取消保护前不会被清理，不包括在内
+func (r *FileRepository) ListExpired(ctx context.Context, now time.Time, limit int) ([]int, error) {
+	defer observeQuery("list_expired")()
+	query := `SELECT id FROM files WHERE expires_at <= ? AND NOT protected ORDER BY expires_at, id LIMIT ?`
+	rows, err := r.db.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// 彻底删除已过期的文件，无论是否在回收站中，与 Delete 一样释放配额和内容引用；
+// 文件不存在、未过期或受保护时返回 errNotFound
+func (r *FileRepository) DeleteExpired(ctx context.Context, id int, now time.Time) (File, []string, error) {
+	defer observeQuery("delete_expired")()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return File{}, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND expires_at <= ? AND NOT protected`
+	file, err := scanFile(tx.QueryRowContext(ctx, query, id, now))
+	if err != nil {
+		return File{}, nil, repositoryError(err)
+	}
+	unused, err := removeFile(ctx, tx, file)
+	if err != nil {
+		return File{}, nil, err
+	}
+	return file, unused, tx.Commit()
+}
+
+// 在事务中删除文件及其历史版本、分享链接和标签，释放配额和内容引用，返回已没有引用的内容
+func removeFile(ctx context.Context, tx *sql.Tx, file File) ([]string, error) {
+	// 先删除引用该文件的记录
+	versionsSize, unused, err := deleteVersions(ctx, tx, file.ID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM shares WHERE file_id = ?`, file.ID); err != nil {
+		return nil, err
+	}
+	if err := deleteFileTags(ctx, tx, file.OwnerID, file.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM files WHERE id = ?`, file.ID); err != nil {
+		return nil, err
+	}
+	if err := releaseQuota(ctx, tx, file.OwnerID, file.Size+versionsSize); err != nil {
+		return nil, err
+	}
+	released, err := releaseBlob(ctx, tx, file.blobKey())
+	if err != nil {
+		return nil, err
+	}
+	if released {
+		unused = append(unused, file.blobKey())
+	}
+	return unused, nil
+}
+
+// 更新文件名，返回更新后的文件信息；文件不存在时返回 errNotFound，
+// 所在文件夹下已有同名文件时返回该文件和 errNameConflict
+func (r *FileRepository) Rename(ctx context.Context, ownerID, id int, name string) (File, error) {
+	defer observeQuery("rename")()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return File{}, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NULL`
+	file, err := scanFile(tx.QueryRowContext(ctx, query, id, ownerID))
+	if err != nil {
+		return File{}, repositoryError(err)
+	}
+	if existing, err := checkNameConflict(ctx, tx, ownerID, file.FolderID, name, id); err != nil {
+		return existing, err
+	}
+	updateQuery := `UPDATE files SET name = ?, search_name = ? WHERE id = ? RETURNING ` + fileColumns
+	if file, err = scanFile(tx.QueryRowContext(ctx, updateQuery, name, searchName(name), id)); err != nil {
+		return File{}, repositoryError(err)
+	}
+	return file, tx.Commit()
+}
+
+// 设置文件的保护标记，返回更新后的文件信息；ownerID 为 0 时不限制所有者，文件不存在时返回 errNotFound
+func (r *FileRepository) SetProtected(ctx context.Context, ownerID, id int, protected bool) (File, error) {
+	defer observeQuery("set_protected")()
+	updateQuery := `UPDATE files SET protected = ? WHERE id = ? AND (? = 0 OR owner_id = ?) AND deleted_at IS NULL RETURNING ` + fileColumns
+	file, err := scanFile(r.db.QueryRowContext(ctx, updateQuery, protected, id, ownerID, ownerID))
+	return file, repositoryError(err)
+}
+
+// 设置文件的可见性，返回更新后的文件信息；文件不存在时返回 errNotFound
+func (r *FileRepository) SetVisibility(ctx context.Context, ownerID, id int, visibility string) (File, error) {
+	defer observeQuery("set_visibility")()
+	updateQuery := `UPDATE files SET visibility = ? WHERE id = ? AND owner_id = ? AND deleted_at IS NULL RETURNING ` + fileColumns
+	file, err := scanFile(r.db.QueryRowContext(ctx, updateQuery, visibility, id, ownerID))
+	return file, repositoryError(err)
+}
+
+// 设置文件的星标，返回更新后的文件信息；文件不存在时返回 errNotFound
+func (r *FileRepository) SetStarred(ctx context.Context, ownerID, id int, starred bool) (File, error) {
+	defer observeQuery("set_starred")()
+	updateQuery := `UPDATE files SET starred = ? WHERE id = ? AND owner_id = ? AND deleted_at IS NULL RETURNING ` + fileColumns
+	file, err := scanFile(r.db.QueryRowContext(ctx, updateQuery, starred, id, ownerID))
+	return file, repositoryError(err)
+}
+
+// 增加文件的下载次数并记录下载时间；在 SQL 中递增，并发下载不会丢失计数
+func (r *FileRepository) RecordDownload(ctx context.Context, id int) error {
+	defer observeQuery("record_download")()
+	_, err := r.db.ExecContext(ctx, `UPDATE files SET download_count = download_count + 1, last_downloaded_at = ? WHERE id = ?`, time.Now().UTC(), id)
+	return err
+}
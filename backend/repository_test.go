@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 保存一个内容为 hash 的测试文件记录，不需要存储后端中的内容
+func createTestFile(t *testing.T, repo *FileRepository, ownerID int, name, hash string) File {
+	t.Helper()
+	file, err := repo.Create(context.Background(), File{
+		HashAlgo:  hashSHA256,
+		Hash:      hash,
+		Name:      name,
+		Size:      int64(len(name)),
+		Mime:      "text/plain",
+		CreatedAt: time.Now().UTC(),
+		OwnerID:   ownerID,
+	})
+	if err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+	return file
+}
+
+func TestFileRepositoryCreateAndGet(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	ctx := context.Background()
+	alice := newTestUser(t, db, "alice")
+	bob := newTestUser(t, db, "bob")
+
+	created := createTestFile(t, repo, alice, "a.txt", "hash-a")
+	if created.ID == 0 || created.Version != 1 || created.Visibility != visibilityPrivate {
+		t.Fatalf("created file = %+v", created)
+	}
+
+	got, err := repo.GetByID(ctx, alice, created.ID)
+	if err != nil {
+		t.Fatalf("GetByID: %v", err)
+	}
+	if got.Name != "a.txt" || got.Hash != "hash-a" || got.OwnerID != alice {
+		t.Errorf("GetByID = %+v", got)
+	}
+	if _, err := repo.GetByID(ctx, bob, created.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("GetByID of another user's file: err = %v, want errNotFound", err)
+	}
+	if _, err := repo.GetByID(ctx, alice, created.ID+1); !errors.Is(err, errNotFound) {
+		t.Errorf("GetByID of a missing file: err = %v, want errNotFound", err)
+	}
+
+	byHash, err := repo.GetByHash(ctx, alice, hashSHA256, "hash-a")
+	if err != nil || byHash.ID != created.ID {
+		t.Errorf("GetByHash = %+v, %v", byHash, err)
+	}
+	if _, err := repo.GetByHash(ctx, bob, hashSHA256, "hash-a"); !errors.Is(err, errNotFound) {
+		t.Errorf("GetByHash of another user's content: err = %v, want errNotFound", err)
+	}
+}
+
+func TestFileRepositoryCreateCountsUsageAndReferences(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	alice := newTestUser(t, db, "alice")
+
+	createTestFile(t, repo, alice, "a.txt", "same")
+	createTestFile(t, repo, alice, "b.txt", "same")
+
+	var refcount int
+	if err := db.QueryRow(`SELECT refcount FROM blobs WHERE hash = 'same'`).Scan(&refcount); err != nil {
+		t.Fatal(err)
+	}
+	if refcount != 2 {
+		t.Errorf("refcount = %d, want 2", refcount)
+	}
+	var used int64
+	if err := db.QueryRow(`SELECT used_bytes FROM users WHERE id = ?`, alice).Scan(&used); err != nil {
+		t.Fatal(err)
+	}
+	if used != int64(len("a.txt")+len("b.txt")) {
+		t.Errorf("used_bytes = %d, want %d", used, len("a.txt")+len("b.txt"))
+	}
+}
+
+func TestFileRepositoryCreateQuotaExceeded(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	alice := newTestUser(t, db, "alice")
+	if _, err := db.Exec(`UPDATE users SET quota_bytes = 1 WHERE id = ?`, alice); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := repo.Create(context.Background(), File{HashAlgo: hashSHA256, Hash: "h", Name: "a.txt", Size: 2, CreatedAt: time.Now().UTC(), OwnerID: alice})
+	if !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("err = %v, want errQuotaExceeded", err)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM blobs`).Scan(&count); err != nil || count != 0 {
+		t.Errorf("blobs = %d, %v; the failed create must not keep a reference", count, err)
+	}
+}
+
+func TestFileRepositoryGetExpired(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	ctx := context.Background()
+	alice := newTestUser(t, db, "alice")
+
+	expires := time.Now().UTC().Add(-time.Minute)
+	file, err := repo.Create(ctx, File{HashAlgo: hashSHA256, Hash: "h", Name: "old.txt", CreatedAt: time.Now().UTC(), OwnerID: alice, ExpiresAt: &expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetByID(ctx, alice, file.ID); !errors.Is(err, errFileExpired) {
+		t.Errorf("GetByID: err = %v, want errFileExpired", err)
+	}
+	if _, err := repo.GetByName(ctx, alice, nil, "old.txt"); !errors.Is(err, errNotFound) {
+		t.Errorf("GetByName: err = %v, want errNotFound", err)
+	}
+}
+
+func TestFileRepositoryList(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	ctx := context.Background()
+	alice := newTestUser(t, db, "alice")
+	bob := newTestUser(t, db, "bob")
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		createTestFile(t, repo, alice, name, "hash-"+name)
+	}
+	createTestFile(t, repo, bob, "bob.txt", "hash-bob")
+
+	files, total, hasMore, err := repo.List(ctx, listOptions{OwnerID: alice, Limit: 2})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if total != 3 || !hasMore || len(files) != 2 || files[0].Name != "a.txt" || files[1].Name != "b.txt" {
+		t.Errorf("first page = %v, total %d, has more %v", fileNames(files), total, hasMore)
+	}
+	files, _, hasMore, err = repo.List(ctx, listOptions{OwnerID: alice, Limit: 2, Offset: 2})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if hasMore || len(files) != 1 || files[0].Name != "c.txt" {
+		t.Errorf("second page = %v, has more %v", fileNames(files), hasMore)
+	}
+	files, _, _, err = repo.List(ctx, listOptions{OwnerID: alice, Query: "b", Limit: 10})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != "b.txt" {
+		t.Errorf("search = %v, want [b.txt]", fileNames(files))
+	}
+}
+
+func TestFileRepositoryTrashAndDelete(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	ctx := context.Background()
+	alice := newTestUser(t, db, "alice")
+
+	file := createTestFile(t, repo, alice, "a.txt", "hash-a")
+	if _, _, err := repo.Delete(ctx, alice, file.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("Delete before trashing: err = %v, want errNotFound", err)
+	}
+	if _, err := repo.Trash(ctx, alice, file.ID); err != nil {
+		t.Fatalf("Trash: %v", err)
+	}
+	if _, err := repo.GetByID(ctx, alice, file.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("GetByID of a trashed file: err = %v, want errNotFound", err)
+	}
+	deleted, unused, err := repo.Delete(ctx, alice, file.ID)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if deleted.ID != file.ID || len(unused) != 1 || unused[0] != "hash-a" {
+		t.Errorf("Delete = %+v, unused %v", deleted, unused)
+	}
+	if _, _, err := repo.Delete(ctx, alice, file.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("second Delete: err = %v, want errNotFound", err)
+	}
+}
+
+func TestFileRepositoryTrashProtected(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	ctx := context.Background()
+	alice := newTestUser(t, db, "alice")
+
+	file := createTestFile(t, repo, alice, "a.txt", "hash-a")
+	if _, err := repo.SetProtected(ctx, alice, file.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Trash(ctx, alice, file.ID); !errors.Is(err, errFileProtected) {
+		t.Errorf("Trash: err = %v, want errFileProtected", err)
+	}
+}
+
+func TestFileRepositoryRename(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	ctx := context.Background()
+	alice := newTestUser(t, db, "alice")
+	bob := newTestUser(t, db, "bob")
+
+	file := createTestFile(t, repo, alice, "a.txt", "hash-a")
+	other := createTestFile(t, repo, alice, "b.txt", "hash-b")
+
+	renamed, err := repo.Rename(ctx, alice, file.ID, "report.txt")
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if renamed.Name != "report.txt" || renamed.Hash != file.Hash || renamed.Size != file.Size || renamed.ID != file.ID {
+		t.Errorf("Rename = %+v, only the name should change from %+v", renamed, file)
+	}
+	if _, err := repo.Rename(ctx, alice, file.ID, "report.txt"); err != nil {
+		t.Errorf("Rename to the current name: %v", err)
+	}
+	existing, err := repo.Rename(ctx, alice, file.ID, "b.txt")
+	if !errors.Is(err, errNameConflict) || existing.ID != other.ID {
+		t.Errorf("Rename to a taken name = %+v, %v; want file %d and errNameConflict", existing, err, other.ID)
+	}
+	if _, err := repo.Rename(ctx, bob, file.ID, "x.txt"); !errors.Is(err, errNotFound) {
+		t.Errorf("Rename of another user's file: err = %v, want errNotFound", err)
+	}
+
+	// 过期的文件不占用名称
+	if _, err := db.Exec(`UPDATE files SET expires_at = ? WHERE id = ?`, time.Now().UTC().Add(-time.Minute), other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Rename(ctx, alice, file.ID, "b.txt"); err != nil {
+		t.Errorf("Rename to the name of an expired file: %v", err)
+	}
+}
+
+// 文件名列表，用于测试失败时的输出
+func fileNames(files []File) []string {
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name
+	}
+	return names
+}
+
+// 同名检查在保存的事务中进行，客户端之前的检查都通过时也只有一个保存成功
+func TestFileRepositoryCreateRejectConflictConcurrently(t *testing.T) {
+	db := openTestFileDB(t)
+	repo := newFileRepository(db)
+	alice := newTestUser(t, db, "alice")
+
+	const creates = 8
+	errs := make(chan error, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repo.Create(context.Background(), File{HashAlgo: hashSHA256, Hash: "h", Name: "same.txt", Size: 1, CreatedAt: time.Now().UTC(), OwnerID: alice, rejectConflict: true})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, errNameConflict):
+			t.Errorf("Create: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d files created, want 1", created)
+	}
+}
+
+func TestAvailableNameSkipsExpiredFiles(t *testing.T) {
+	db := newTestDB(t)
+	repo := newFileRepository(db)
+	ctx := context.Background()
+	alice := newTestUser(t, db, "alice")
+
+	first := createTestFile(t, repo, alice, "a.txt", "h1")
+	renamed, err := repo.Create(ctx, File{HashAlgo: hashSHA256, Hash: "h2", Name: "a.txt", CreatedAt: time.Now().UTC(), OwnerID: alice, autoRename: true})
+	if err != nil || renamed.Name != "a (1).txt" {
+		t.Fatalf("Create with autoRename = %q, %v; want a (1).txt", renamed.Name, err)
+	}
+	if _, err := db.Exec(`UPDATE files SET expires_at = ? WHERE id = ?`, time.Now().UTC().Add(-time.Minute), first.ID); err != nil {
+		t.Fatal(err)
+	}
+	again, err := repo.Create(ctx, File{HashAlgo: hashSHA256, Hash: "h3", Name: "a.txt", CreatedAt: time.Now().UTC(), OwnerID: alice, autoRename: true})
+	if err != nil || again.Name != "a.txt" {
+		t.Errorf("Create with autoRename after expiry = %q, %v; want a.txt", again.Name, err)
+	}
+}
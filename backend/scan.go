@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 可选的病毒扫描服务
+const (
+	scannerNone  = "none"
+	scannerClamd = "clamd"
+)
+
+// 内容的扫描状态：pending 为尚未扫描的内容，未配置扫描服务或 fail-open 时扫描服务不可用的上传保存为 pending
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+)
+
+// 重新扫描时每次从数据库读取的内容数
+const scanBatchSize = 100
+
+// 发送给 clamd 的每块内容的大小
+const clamdChunkSize = 64 << 10
+
+// 扫描服务不可用，fail-closed 时拒绝上传
+var errScanUnavailable = errors.New("virus scanner unavailable")
+
+// 文件内容被判定为感染，不会被保存或返回给客户端
+var errFileInfected = errors.New("file is infected")
+
+// 内容被判定为感染，signature 为扫描服务报告的病毒名称；errors.Is(err, errFileInfected) 成立
+type infectedError struct {
+	signature string
+}
+
+func (e *infectedError) Error() string        { return "file is infected: " + e.signature }
+func (e *infectedError) Is(target error) bool { return target == errFileInfected }
+
+// 文件当前内容的扫描状态
+const scanStatusSQL = `IFNULL((SELECT status FROM content_scans WHERE content_scans.blob_key = ` + fileBlobKeySQL + `), 'pending')`
+
+// ScanVerdict 扫描结果，Status 为 clean、infected 或 pending（没有扫描）；感染时 Signature 为病毒名称
+type ScanVerdict struct {
+	Status    string
+	Signature string
+}
+
+// Scanner 病毒扫描服务，读取 r 的全部内容并返回结果；name 为文件名，只用于日志。
+// 无法完成扫描（如服务不可用）时返回错误
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader, name string) (ScanVerdict, error)
+}
+
+// 不扫描，内容保持 pending；未配置扫描服务时使用
+type noopScanner struct{}
+
+func (noopScanner) Scan(ctx context.Context, r io.Reader, name string) (ScanVerdict, error) {
+	return ScanVerdict{Status: scanPending}, nil
+}
+
+// 通过 TCP 使用 clamd 的 INSTREAM 命令扫描。内容超过 clamd 的 StreamMaxLength 时 clamd 返回错误，按扫描失败处理
+type clamdScanner struct {
+	addr string
+}
+
+func (s clamdScanner) Scan(ctx context.Context, r io.Reader, name string) (ScanVerdict, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	defer conn.Close()
+	// ctx 结束时中断正在进行的读写
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	w := bufio.NewWriter(conn)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return ScanVerdict{}, err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return ScanVerdict{}, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return ScanVerdict{}, err
+		}
+	}
+	// 长度为 0 的块表示内容结束
+	if _, err := w.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanVerdict{}, err
+	}
+	if err := w.Flush(); err != nil {
+		return ScanVerdict{}, err
+	}
+
+	// 回复如 stream: OK、stream: Eicar-Signature FOUND 或 INSTREAM size limit exceeded. ERROR
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return ScanVerdict{}, err
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return ScanVerdict{Status: scanClean}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return ScanVerdict{Status: scanInfected, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	}
+	return ScanVerdict{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// 上传时使用的扫描服务及其配置，通过请求的 context 传给保存内容的代码
+type uploadScanner struct {
+	scanner  Scanner
+	name     string // none 或 clamd
+	timeout  time.Duration
+	failOpen bool // 扫描服务不可用时是否仍然保存上传的内容
+}
+
+type uploadScannerKey struct{}
+
+func newUploadScanner(cfg Config) *uploadScanner {
+	s := &uploadScanner{scanner: noopScanner{}, name: scannerNone, timeout: cfg.ScanTimeout, failOpen: cfg.ScanFailOpen}
+	if cfg.Scanner == scannerClamd {
+		s.scanner, s.name = clamdScanner{addr: cfg.ClamdAddr}, scannerClamd
+	}
+	return s
+}
+
+// 为请求设置上传使用的扫描服务
+func (s *uploadScanner) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(withScanner(c.Request.Context(), s))
+		c.Next()
+	}
+}
+
+// 返回使用 s 扫描上传内容的 context，用于不经过 HTTP 的上传（如命令行导入）
+func withScanner(ctx context.Context, s *uploadScanner) context.Context {
+	return context.WithValue(ctx, uploadScannerKey{}, s)
+}
+
+// 扫描内容并记录指标，超过 timeout 时返回错误
+func (s *uploadScanner) scan(ctx context.Context, r io.Reader, name string) (ScanVerdict, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	verdict, err := s.scanner.Scan(ctx, r, name)
+	if err != nil {
+		contentScans.WithLabelValues("error").Inc()
+		return verdict, err
+	}
+	contentScans.WithLabelValues(verdict.Status).Inc()
+	return verdict, nil
+}
+
+// 保存前扫描上传的内容，返回内容的扫描状态；context 中没有扫描服务时为 pending。
+// 相同内容已有扫描结果时直接沿用；内容被感染时返回 *infectedError，
+// 扫描服务不可用时 fail-open 则返回 pending，否则返回 errScanUnavailable
+func scanUpload(ctx context.Context, db *sql.DB, file File, content *spooledContent) (string, error) {
+	s, ok := ctx.Value(uploadScannerKey{}).(*uploadScanner)
+	if !ok {
+		return scanPending, nil
+	}
+	status, signature, err := contentScanStatus(ctx, db, file.blobKey())
+	if err != nil {
+		return "", err
+	}
+	if status == scanInfected {
+		return "", &infectedError{signature: signature}
+	}
+	if status == scanClean {
+		return status, nil
+	}
+
+	body, err := content.reader()
+	if err != nil {
+		return "", err
+	}
+	verdict, err := s.scan(ctx, body, file.Name)
+	if err != nil {
+		if s.failOpen {
+			slog.WarnContext(ctx, "Virus scan failed, saving the upload unscanned", "name", file.Name, "error", err)
+			return scanPending, nil
+		}
+		return "", fmt.Errorf("%w: %v", errScanUnavailable, err)
+	}
+	if verdict.Status == scanInfected {
+		slog.WarnContext(ctx, "Rejected infected upload", "name", file.Name, "owner_id", file.OwnerID, "signature", verdict.Signature)
+		return "", &infectedError{signature: verdict.Signature}
+	}
+	return verdict.Status, nil
+}
+
+// 将上传被拒绝（感染、扫描服务不可用或文件类型不被允许）的错误转换为错误响应，其他错误时返回 nil
+func uploadRejectedError(err error) *apiError {
+	var typeErr *fileTypeError
+	if errors.As(err, &typeErr) {
+		return fileTypeNotAllowed(typeErr)
+	}
+	var infected *infectedError
+	if errors.As(err, &infected) {
+		return newAPIError(http.StatusUnprocessableEntity, codeFileInfected, "File is infected and has been rejected").with(gin.H{
+			"signature": infected.signature,
+		})
+	}
+	if errors.Is(err, errScanUnavailable) {
+		e := newAPIError(http.StatusServiceUnavailable, codeScanUnavailable, "Virus scanner is unavailable, try again later")
+		e.cause = err
+		return e
+	}
+	return nil
+}
+
+// 下载被判定为感染的文件时的错误
+func fileQuarantined() *apiError {
+	return newAPIError(http.StatusForbidden, codeFileInfected, "File is quarantined because its content is infected")
+}
+
+// 内容的扫描状态和病毒名称，没有记录时为 pending
+func contentScanStatus(ctx context.Context, db *sql.DB, key string) (string, string, error) {
+	var status, signature string
+	err := db.QueryRowContext(ctx, `SELECT status, IFNULL(signature, '') FROM content_scans WHERE blob_key = ?`, key).Scan(&status, &signature)
+	if err == sql.ErrNoRows {
+		return scanPending, "", nil
+	}
+	return status, signature, err
+}
+
+// 记录内容的扫描结果；pending 不记录。内容已被删除时不记录，避免留下无用的记录
+func recordContentScan(ctx context.Context, db *sql.DB, key string, verdict ScanVerdict) error {
+	if verdict.Status == scanPending {
+		return nil
+	}
+	upsertQuery := `
+	INSERT INTO content_scans (blob_key, status, signature, scanned_at)
+	SELECT ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM blobs WHERE hash = ?)
+	ON CONFLICT (blob_key) DO UPDATE SET status = excluded.status, signature = excluded.signature, scanned_at = excluded.scanned_at`
+	_, err := db.ExecContext(ctx, upsertQuery, key, verdict.Status, nullString(verdict.Signature), time.Now().UTC(), key)
+	return err
+}
+
+// 删除内容的扫描结果，在删除内容记录的事务中调用
+func deleteContentScan(ctx context.Context, tx *sql.Tx, key string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM content_scans WHERE blob_key = ?`, key)
+	return err
+}
+
+// QuarantinedContent 被判定为感染的内容及引用该内容的文件，这些文件不能被下载
+type QuarantinedContent struct {
+	Hash      string         `json:"hash"`
+	HashAlgo  string         `json:"hash_algo"`
+	Size      int64          `json:"size"`
+	Signature string         `json:"signature"`
+	ScannedAt time.Time      `json:"scanned_at"`
+	Files     []AffectedFile `json:"files"`
+}
+
+// ScanJob 重新扫描已有内容的任务及其进度，状态与校验任务相同
+type ScanJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	All        bool       `json:"all"` // 是否重新扫描所有内容，否则只扫描 pending 的内容
+	Total      int        `json:"total"`
+	Scanned    int        `json:"scanned"`
+	Clean      int        `json:"clean"`
+	Infected   int        `json:"infected"`
+	Failed     int        `json:"failed"` // 扫描服务返回错误的内容数，保持原来的状态
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// 保存在内存中的扫描任务，同一时间只运行一个
+type scanJobs struct {
+	mu       sync.Mutex
+	jobs     map[string]*ScanJob
+	finished []string // 已结束的任务 id，按结束顺序
+	running  string
+}
+
+// 注册病毒扫描的管理接口，仅管理员可以访问
+func registerScanRoutes(admin gin.IRouter, cfg Config, db *sql.DB, store Storage) {
+	scanner := newUploadScanner(cfg)
+	jobs := &scanJobs{jobs: map[string]*ScanJob{}}
+
+	// 在后台重新扫描已有内容，立即返回任务；默认只扫描 pending 的内容，病毒库更新后可以用 all=true 重新扫描所有内容，
+	// 新发现感染的内容被隔离，之前感染的内容扫描通过后恢复
+	admin.POST("/scan", func(c *gin.Context) {
+		if scanner.name == scannerNone {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Virus scanning is disabled, set SCANNER to scan content"))
+			return
+		}
+		all, err := queryBool(c, "all")
+		if err != nil {
+			renderError(c, invalidRequest("Invalid all, must be true or false"))
+			return
+		}
+		id, err := newUploadID()
+		if err != nil {
+			renderError(c, internalError("Failed to create scan job", err))
+			return
+		}
+		job := &ScanJob{ID: id, Status: verifyRunning, All: all, StartedAt: time.Now().UTC()}
+		if running, ok := jobs.start(job); !ok {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Scan is already running").with(gin.H{"job": running}))
+			return
+		}
+		slog.Info("Started content scan", "job", job.ID, "all", all)
+		go jobs.run(context.Background(), db, store, scanner, job.ID)
+		c.JSON(http.StatusAccepted, jobs.get(job.ID))
+	})
+
+	// 获取扫描任务的进度
+	admin.GET("/scan/:job", func(c *gin.Context) {
+		job := jobs.get(c.Param("job"))
+		if job == nil {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Scan job not found"))
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	})
+
+	// 分页查询被隔离的内容及引用它们的文件，最近扫描的在前；scan 中为扫描的配置和尚未扫描的内容数
+	admin.GET("/quarantine", func(c *gin.Context) {
+		limit, err := queryInt(c, "limit", defaultPageLimit)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxPageLimit)))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil || offset < 0 {
+			renderError(c, invalidRequest("Invalid offset, must be a non-negative integer"))
+			return
+		}
+
+		ctx := c.Request.Context()
+		items, total, err := listQuarantine(ctx, db, limit, offset)
+		if err != nil {
+			renderError(c, internalError("Failed to get quarantined content", err))
+			return
+		}
+		var pending int
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM blobs WHERE hash NOT IN (SELECT blob_key FROM content_scans)`).Scan(&pending); err != nil {
+			renderError(c, internalError("Failed to get quarantined content", err))
+			return
+		}
+		failMode := "closed"
+		if scanner.failOpen {
+			failMode = "open"
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"items":  items,
+			"total":  total,
+			"limit":  limit,
+			"offset": offset,
+			"scan": gin.H{
+				"scanner":       scanner.name,
+				"fail_mode":     failMode,
+				"pending_blobs": pending,
+			},
+		})
+	})
+}
+
+// 查询被隔离的内容及总数
+func listQuarantine(ctx context.Context, db *sql.DB, limit, offset int) ([]QuarantinedContent, int, error) {
+	var total int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM content_scans WHERE status = 'infected'`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := `
+	SELECT content_scans.blob_key, IFNULL(blobs.size, 0), IFNULL(content_scans.signature, ''), content_scans.scanned_at
+	FROM content_scans LEFT JOIN blobs ON blobs.hash = content_scans.blob_key
+	WHERE content_scans.status = 'infected' ORDER BY content_scans.scanned_at DESC, content_scans.blob_key LIMIT ? OFFSET ?`
+	rows, err := db.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	items := []QuarantinedContent{}
+	for rows.Next() {
+		var item QuarantinedContent
+		if err := rows.Scan(&item.Hash, &item.Size, &item.Signature, &item.ScannedAt); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	for i := range items {
+		items[i].HashAlgo, items[i].Hash = splitBlobKey(items[i].Hash)
+		if items[i].Files, err = blobFiles(ctx, db, items[i].HashAlgo, items[i].Hash); err != nil {
+			return nil, 0, err
+		}
+	}
+	return items, total, nil
+}
+
+// 记录新任务；已有任务在运行时返回该任务的副本和 false
+func (j *scanJobs) start(job *ScanJob) (*ScanJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running != "" {
+		return j.copy(j.running), false
+	}
+	j.jobs[job.ID] = job
+	j.running = job.ID
+	return nil, true
+}
+
+// 返回任务的副本，不存在时返回 nil
+func (j *scanJobs) get(id string) *ScanJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.copy(id)
+}
+
+// 复制任务，避免返回的任务被后台的扫描修改；调用方需要持有 mu
+func (j *scanJobs) copy(id string) *ScanJob {
+	job, ok := j.jobs[id]
+	if !ok {
+		return nil
+	}
+	c := *job
+	return &c
+}
+
+// 在锁内更新任务
+func (j *scanJobs) update(id string, fn func(job *ScanJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(j.jobs[id])
+}
+
+// 结束任务，只保留最近 maxFinishedVerifyJobs 个已结束的任务
+func (j *scanJobs) finish(id string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.jobs[id]
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	job.Status = verifyCompleted
+	if err != nil {
+		job.Status = verifyFailed
+		job.Error = err.Error()
+	}
+	j.running = ""
+	j.finished = append(j.finished, id)
+	if len(j.finished) > maxFinishedVerifyJobs {
+		delete(j.jobs, j.finished[0])
+		j.finished = j.finished[1:]
+	}
+}
+
+// 逐批扫描内容并记录结果。扫描服务对单个内容返回错误时该内容保持原来的状态，继续扫描其他内容
+func (j *scanJobs) run(ctx context.Context, db *sql.DB, store Storage, scanner *uploadScanner, id string) {
+	all := j.get(id).All
+	err := func() error {
+		var total int
+		countQuery := `SELECT COUNT(*) FROM blobs WHERE ? OR hash NOT IN (SELECT blob_key FROM content_scans)`
+		if err := db.QueryRowContext(ctx, countQuery, all).Scan(&total); err != nil {
+			return err
+		}
+		j.update(id, func(job *ScanJob) { job.Total = total })
+
+		after := ""
+		for {
+			batch, err := nextScanBlobs(ctx, db, all, after)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				return nil
+			}
+			for _, key := range batch {
+				verdict, err := rescanBlob(ctx, db, store, scanner, key)
+				if err != nil && !errors.Is(err, errScanUnavailable) {
+					return err
+				}
+				j.update(id, func(job *ScanJob) {
+					job.Scanned++
+					switch {
+					case err != nil:
+						job.Failed++
+					case verdict.Status == scanClean:
+						job.Clean++
+					case verdict.Status == scanInfected:
+						job.Infected++
+					}
+				})
+			}
+			after = batch[len(batch)-1]
+		}
+	}()
+	j.finish(id, err)
+
+	job := j.get(id)
+	if err != nil {
+		slog.Error("Content scan failed", "job", id, "scanned", job.Scanned, "error", err)
+		return
+	}
+	slog.Info("Finished content scan", "job", id, "scanned", job.Scanned, "infected", job.Infected, "failed", job.Failed)
+}
+
+// 按键的顺序读取 after 之后的一批需要扫描的内容
+func nextScanBlobs(ctx context.Context, db *sql.DB, all bool, after string) ([]string, error) {
+	query := `SELECT hash FROM blobs WHERE hash > ? AND (? OR hash NOT IN (SELECT blob_key FROM content_scans)) ORDER BY hash LIMIT ?`
+	rows, err := db.QueryContext(ctx, query, after, all, scanBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// 扫描一个已保存的内容并记录结果；内容已被删除时返回 pending，扫描服务返回错误时返回 errScanUnavailable
+func rescanBlob(ctx context.Context, db *sql.DB, store Storage, scanner *uploadScanner, key string) (ScanVerdict, error) {
+	content, _, err := store.Get(ctx, key)
+	if errors.Is(err, errBlobNotFound) {
+		return ScanVerdict{Status: scanPending}, nil
+	}
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	verdict, err := scanner.scan(ctx, content, key)
+	content.Close()
+	if err != nil {
+		slog.Warn("Failed to scan content", "hash", key, "error", err)
+		return verdict, fmt.Errorf("%w: %v", errScanUnavailable, err)
+	}
+	if err := recordContentScan(ctx, db, key, verdict); err != nil {
+		return verdict, err
+	}
+	if verdict.Status == scanInfected {
+		slog.Warn("Quarantined infected content", "hash", key, "signature", verdict.Signature)
+	}
+	return verdict, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// 文件名的搜索形式，保存在 files.search_name 中：按 NFKC 兼容分解后去掉重音等组合符号、转为小写，
+// 搜索关键字也按同样的方式规范化，使 "RÉSUMÉ" 与 "resume.pdf"、全角与半角字符互相匹配。
+// 只用于搜索，返回给客户端的文件名保持原样
+func searchName(name string) string {
+	t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), cases.Fold(), norm.NFC)
+	s, _, err := transform.String(t, name)
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	return s
+}
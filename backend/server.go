@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// 启动 HTTP 服务，certs 不为空时使用 HTTPS，并可以在 cfg.HTTPRedirect 上将 HTTP 请求重定向到 HTTPS。
+// cfg.MetricsAddr 不为空时在该地址上单独提供 metrics 指标。
+// 收到 SIGINT/SIGTERM 后停止接受新连接，并等待进行中的请求完成，超过 cfg.ShutdownTimeout 仍未完成的请求会被取消
+func runServer(handler, metrics http.Handler, cfg Config, certs *certReloader) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 所有请求的上下文都派生自 baseCtx，超时后取消以中断仍在进行的上传和下载
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+	}
+
+	errc := make(chan error, 3)
+	servers := []*http.Server{srv}
+	if certs == nil {
+		go func() {
+			slog.Info("Listening", "addr", cfg.Addr)
+			errc <- srv.ListenAndServe()
+		}()
+	} else {
+		srv.TLSConfig = newTLSConfig(certs)
+		go certs.watchSIGHUP(ctx)
+		go func() {
+			slog.Info("Listening with TLS", "addr", cfg.Addr, "cert_file", cfg.TLSCertFile)
+			errc <- srv.ListenAndServeTLS("", "")
+		}()
+	}
+	if cfg.HTTPRedirect != "" {
+		redirect := &http.Server{
+			Addr:              cfg.HTTPRedirect,
+			Handler:           httpsRedirect(cfg.Addr),
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		}
+		servers = append(servers, redirect)
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "addr", cfg.HTTPRedirect)
+			errc <- redirect.ListenAndServe()
+		}()
+	}
+	if cfg.MetricsAddr != "" {
+		metricsSrv := &http.Server{
+			Addr:              cfg.MetricsAddr,
+			Handler:           metrics,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		}
+		servers = append(servers, metricsSrv)
+		go func() {
+			slog.Info("Serving metrics", "addr", cfg.MetricsAddr)
+			errc <- metricsSrv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		for _, s := range servers {
+			s.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+	// 再次收到信号时按默认行为立即退出
+	stop()
+
+	// 重定向和指标的请求很快完成，无需等待
+	for _, s := range servers[1:] {
+		s.Close()
+	}
+	slog.Info("Shutting down, waiting for in-flight requests", "timeout", cfg.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Drain timeout exceeded, cancelling remaining requests", "error", err)
+		cancelRequests()
+		srv.Close()
+	}
+	for range servers {
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
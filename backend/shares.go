@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share 文件分享链接
+type Share struct {
+	ID        int        `json:"id"`
+	Token     string     `json:"token"`
+	FileID    int        `json:"file_id"`
+	OwnerID   int        `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	RevokedAt *time.Time `json:"-"`
+	// 访问密码的 bcrypt 哈希，为空时无需密码
+	PasswordHash      string `json:"-"`
+	PasswordProtected bool   `json:"password_protected"`
+	// 最多下载的次数，为空时不限制；Downloads 为已通过该分享链接下载的次数
+	MaxDownloads     *int       `json:"max_downloads"`
+	Downloads        int        `json:"downloads"`
+	LastDownloadedAt *time.Time `json:"-"`
+}
+
+// 分享链接的下载次数用完后，仍允许在该时间内通过 Range 继续最后一次下载
+const shareResumeWindow = time.Hour
+
+// 分享链接的下载次数已用完
+var errShareExhausted = errors.New("share download limit reached")
+
+// 分享链接密码的长度限制；bcrypt 只使用前 72 字节
+const (
+	minSharePasswordLength = 4
+	maxSharePasswordLength = 72
+)
+
+// 分享链接密码错误的限流类别
+const sharePasswordClass = "share_password"
+
+// 分享链接密码的请求头，也可以通过 POST /s/:token 的请求体提供
+const sharePasswordHeader = "X-Share-Password"
+
+// 注册分享相关接口；public 上的接口无需登录，limiter 用于限制密码错误的次数
+func registerShareRoutes(public, api gin.IRouter, db *sql.DB, store Storage, limiter *rateLimiter) {
+	repo := newFileRepository(db)
+
+	// 为文件创建分享链接；设置 password 时访问需要提供该密码，设置 max_downloads 时下载该次数后失效
+	api.POST("/files/:id/share", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+
+		var req struct {
+			ExpiresIn    int64      `json:"expires_in"` // 有效期（秒）
+			ExpiresAt    *time.Time `json:"expires_at"`
+			Password     string     `json:"password"`
+			MaxDownloads *int       `json:"max_downloads"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				renderError(c, invalidRequest("Invalid request body"))
+				return
+			}
+		}
+		now := time.Now().UTC()
+		var expiresAt *time.Time
+		switch {
+		case req.ExpiresIn < 0:
+			renderError(c, invalidRequest("Invalid expires_in, must be a positive number of seconds"))
+			return
+		case req.ExpiresIn > 0:
+			t := now.Add(time.Duration(req.ExpiresIn) * time.Second)
+			expiresAt = &t
+		case req.ExpiresAt != nil:
+			if !req.ExpiresAt.After(now) {
+				renderError(c, invalidRequest("Invalid expires_at, must be in the future"))
+				return
+			}
+			t := req.ExpiresAt.UTC()
+			expiresAt = &t
+		}
+		if req.MaxDownloads != nil && *req.MaxDownloads < 1 {
+			renderError(c, invalidRequest("Invalid max_downloads, must be a positive integer"))
+			return
+		}
+		passwordHash, ok := sharePasswordHash(c, req.Password)
+		if !ok {
+			return
+		}
+
+		file, err := repo.GetByID(c.Request.Context(), currentUserID(c), id)
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+
+		token, err := newShareToken()
+		if err != nil {
+			renderError(c, internalError("Failed to create share", err))
+			return
+		}
+		share, err := addShare(c.Request.Context(), db, Share{
+			Token:             token,
+			FileID:            file.ID,
+			OwnerID:           file.OwnerID,
+			CreatedAt:         now,
+			ExpiresAt:         expiresAt,
+			PasswordHash:      passwordHash,
+			PasswordProtected: passwordHash != "",
+			MaxDownloads:      req.MaxDownloads,
+		})
+		if err != nil {
+			renderError(c, internalError("Failed to create share", err))
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"share": share,
+			"url":   apiV1Prefix + "/s/" + share.Token,
+		})
+	})
+
+	// 获取当前用户所有有效的分享链接
+	api.GET("/shares", func(c *gin.Context) {
+		shares, err := getActiveShares(c.Request.Context(), db, currentUserID(c))
+		if err != nil {
+			renderError(c, internalError("Failed to get shares", err))
+			return
+		}
+		c.JSON(http.StatusOK, shares)
+	})
+
+	// 修改分享链接的密码：password 为新密码，为空字符串时取消密码。已撤销的分享链接不能修改
+	api.PATCH("/shares/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid share id"))
+			return
+		}
+		var req struct {
+			Password *string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Password == nil {
+			renderError(c, invalidRequest("Invalid request body, password is required"))
+			return
+		}
+		passwordHash, ok := sharePasswordHash(c, *req.Password)
+		if !ok {
+			return
+		}
+		share, err := updateSharePassword(c.Request.Context(), db, currentUserID(c), id, passwordHash)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Share not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to update share", err))
+			return
+		}
+		c.JSON(http.StatusOK, share)
+	})
+
+	// 撤销分享链接
+	api.DELETE("/shares/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid share id"))
+			return
+		}
+		err = revokeShare(c.Request.Context(), db, currentUserID(c), id)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Share not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to revoke share", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Share revoked"})
+	})
+
+	// 通过分享链接下载文件，无需登录；有密码的分享链接需在 X-Share-Password 请求头中提供密码，
+	// 未提供或密码错误时返回 401，details 中 password_required 为 true
+	download := func(c *gin.Context, password string) {
+		share, err := getShareByToken(c.Request.Context(), db, c.Param("token"))
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Share not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get share", err))
+			return
+		}
+		if share.RevokedAt != nil || (share.ExpiresAt != nil && !share.ExpiresAt.After(time.Now())) {
+			renderError(c, newAPIError(http.StatusGone, codeGone, "Share has expired or been revoked"))
+			return
+		}
+		if !checkSharePassword(c, limiter, share, password) {
+			return
+		}
+
+		file, err := repo.GetByID(c.Request.Context(), share.OwnerID, share.FileID)
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+		// 只有获取完整内容或从头开始的请求计为一次下载，断点续传和 HEAD 不计数
+		if countsAsShareDownload(c, file) {
+			err = useShareDownload(c.Request.Context(), db, share)
+		} else if share.MaxDownloads != nil && share.Downloads >= *share.MaxDownloads &&
+			(share.LastDownloadedAt == nil || time.Since(*share.LastDownloadedAt) > shareResumeWindow) {
+			err = errShareExhausted
+		}
+		if errors.Is(err, errShareExhausted) {
+			renderError(c, newAPIError(http.StatusGone, codeGone, "Share download limit reached"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to update share", err))
+			return
+		}
+		addAuditFile(c, file)
+		serveFile(c, store, file)
+		recordDownload(c, repo, file)
+	}
+	public.GET("/s/:token", func(c *gin.Context) {
+		download(c, c.GetHeader(sharePasswordHeader))
+	})
+
+	// 与 GET 相同，密码也可以通过 JSON 请求体 {"password": "..."} 或表单字段 password 提供，
+	// 避免密码出现在代理的请求头日志中
+	public.POST("/s/:token", func(c *gin.Context) {
+		password := c.GetHeader(sharePasswordHeader)
+		if c.ContentType() == "application/json" {
+			var req struct {
+				Password string `json:"password"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				renderError(c, invalidRequest("Invalid request body"))
+				return
+			}
+			password = req.Password
+		} else if v := c.PostForm("password"); v != "" {
+			password = v
+		}
+		download(c, password)
+	})
+}
+
+// 请求是否会获取完整内容或从第一个字节开始的内容；If-Range 与当前内容不一致时也会返回完整内容
+func countsAsShareDownload(c *gin.Context, file File) bool {
+	if c.Request.Method == http.MethodHead || etagMatches(c.GetHeader("If-None-Match"), `"`+file.Hash+`"`) {
+		return false
+	}
+	ranges, ok := strings.CutPrefix(c.GetHeader("Range"), "bytes=")
+	if !ok {
+		return true
+	}
+	if ifRange := c.GetHeader("If-Range"); ifRange != "" && ifRange != `"`+file.Hash+`"` {
+		return true
+	}
+	for _, r := range strings.Split(ranges, ",") {
+		start, _, _ := strings.Cut(strings.TrimSpace(r), "-")
+		if n, err := strconv.ParseInt(start, 10, 64); err == nil && n == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 分享链接的下载次数加一；有次数限制且已用完时返回 errShareExhausted。
+// 通过 UPDATE 的条件保证并发的请求中最多只有剩余次数个成功
+func useShareDownload(ctx context.Context, db *sql.DB, share Share) error {
+	updateQuery := `
+	UPDATE shares SET download_count = download_count + 1, last_downloaded_at = ?
+	WHERE id = ? AND (max_downloads IS NULL OR download_count < max_downloads) RETURNING id`
+	err := db.QueryRowContext(ctx, updateQuery, time.Now().UTC(), share.ID).Scan(&share.ID)
+	if err == sql.ErrNoRows {
+		return errShareExhausted
+	}
+	return err
+}
+
+// 校验并计算分享链接密码的哈希，password 为空时返回空字符串表示无需密码；不合法时已返回错误响应
+func sharePasswordHash(c *gin.Context, password string) (string, bool) {
+	if password == "" {
+		return "", true
+	}
+	if len(password) < minSharePasswordLength || len(password) > maxSharePasswordLength {
+		renderError(c, invalidRequest("Invalid password, must be "+strconv.Itoa(minSharePasswordLength)+" to "+strconv.Itoa(maxSharePasswordLength)+" bytes"))
+		return "", false
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		renderError(c, internalError("Failed to hash password", err))
+		return "", false
+	}
+	return string(hash), true
+}
+
+// 校验分享链接的密码，没有密码的分享链接直接通过；未通过时已返回错误响应。
+// 密码错误按分享链接和 IP 计数，超过限制后在 Retry-After 之前返回 429，不再校验密码
+func checkSharePassword(c *gin.Context, limiter *rateLimiter, share Share, password string) bool {
+	if share.PasswordHash == "" {
+		return true
+	}
+	key := share.Token + ":" + c.ClientIP()
+	if wait := limiter.peek(sharePasswordClass, key, time.Now()); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		renderError(c, newAPIError(http.StatusTooManyRequests, codeRateLimited, "Too many wrong passwords, please retry later"))
+		return false
+	}
+	if password == "" {
+		renderError(c, newAPIError(http.StatusUnauthorized, codePasswordRequired, "Share is password protected").with(gin.H{
+			"password_required": true,
+			"header":            sharePasswordHeader,
+		}))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)) != nil {
+		limiter.take(sharePasswordClass, key, time.Now())
+		renderError(c, newAPIError(http.StatusUnauthorized, codePasswordRequired, "Wrong share password").with(gin.H{
+			"password_required": true,
+			"header":            sharePasswordHeader,
+		}))
+		return false
+	}
+	return true
+}
+
+// 生成不可猜测的分享 token
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// 添加分享链接，返回包含 id 的分享信息
+func addShare(ctx context.Context, db *sql.DB, share Share) (Share, error) {
+	insertQuery := `INSERT INTO shares (token, file_id, owner_id, created_at, expires_at, password_hash, max_downloads) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`
+	err := db.QueryRowContext(ctx, insertQuery, share.Token, share.FileID, share.OwnerID, share.CreatedAt, share.ExpiresAt, share.PasswordHash, share.MaxDownloads).Scan(&share.ID)
+	return share, err
+}
+
+// 根据 token 获取分享链接；不存在时返回 sql.ErrNoRows
+func getShareByToken(ctx context.Context, db *sql.DB, token string) (Share, error) {
+	query := `SELECT ` + shareColumns + ` FROM shares WHERE token = ?`
+	return scanShare(db.QueryRowContext(ctx, query, token))
+}
+
+// 获取用户未过期、未撤销且下载次数未用完的分享链接
+func getActiveShares(ctx context.Context, db *sql.DB, ownerID int) ([]Share, error) {
+	query := `
+	SELECT ` + shareColumns + ` FROM shares
+	WHERE owner_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)
+	AND (max_downloads IS NULL OR download_count < max_downloads)
+	ORDER BY id`
+	rows, err := db.QueryContext(ctx, query, ownerID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// 分享链接的字段，与 scanShare 的顺序一致
+const shareColumns = `id, token, file_id, owner_id, created_at, expires_at, revoked_at, password_hash, max_downloads, download_count, last_downloaded_at`
+
+// 读取 shareColumns 的一行
+func scanShare(row interface{ Scan(...any) error }) (Share, error) {
+	var share Share
+	err := row.Scan(&share.ID, &share.Token, &share.FileID, &share.OwnerID, &share.CreatedAt, &share.ExpiresAt, &share.RevokedAt, &share.PasswordHash, &share.MaxDownloads, &share.Downloads, &share.LastDownloadedAt)
+	share.PasswordProtected = share.PasswordHash != ""
+	return share, err
+}
+
+// 修改用户未撤销的分享链接的密码哈希，为空时取消密码；不存在或已撤销时返回 sql.ErrNoRows
+func updateSharePassword(ctx context.Context, db *sql.DB, ownerID, id int, passwordHash string) (Share, error) {
+	updateQuery := `UPDATE shares SET password_hash = ? WHERE id = ? AND owner_id = ? AND revoked_at IS NULL RETURNING ` + shareColumns
+	return scanShare(db.QueryRowContext(ctx, updateQuery, passwordHash, id, ownerID))
+}
+
+// 撤销用户的分享链接；不存在或已撤销时返回 sql.ErrNoRows
+func revokeShare(ctx context.Context, db *sql.DB, ownerID, id int) error {
+	updateQuery := `UPDATE shares SET revoked_at = ? WHERE id = ? AND owner_id = ? AND revoked_at IS NULL RETURNING id`
+	return db.QueryRowContext(ctx, updateQuery, time.Now().UTC(), id, ownerID).Scan(&id)
+}
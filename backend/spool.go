@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"os"
+)
+
+// 较大的上传内容暂存的目录，未配置时使用 uploadTempDir
+func uploadSpoolDir(cfg Config, store Storage) string {
+	if cfg.SpoolDir != "" {
+		return cfg.SpoolDir
+	}
+	return uploadTempDir(store)
+}
+
+// 上传内容超过该大小时暂存到临时文件，而不是保存在内存中
+const spoolMemoryLimit = 32 << 20
+
+// 上传表单中文件以外的字段的总大小限制
+const maxFormValuesSize = 1 << 20
+
+// 表单字段超过大小限制
+var errFormTooLarge = errors.New("form values are too large")
+
+// 暂存的上传内容：不超过内存限制时保存在内存中，否则写入临时文件，读取时已计算好哈希和大小
+type spooledContent struct {
+	data   []byte   // 保存在内存中的内容
+	file   *os.File // 超过内存限制时写入的临时文件
+	size   int64
+	hash   string // 按上传使用的算法计算的哈希
+	sha256 string // 内容的 sha256，用于校验客户端声明的哈希
+}
+
+// 读取 r 的全部内容并暂存，读取的同时计算 algo 的哈希和 sha256；超过 memory 字节时写入 dir 下的临时文件，
+// 任何一步失败时删除已写入的临时文件
+func spoolContent(r io.Reader, dir, algo string, memory int64) (*spooledContent, error) {
+	memory = max(memory, 0)
+	content := &spooledContent{}
+	digest := newHash(algo)
+	var checksum hash.Hash
+	writers := []io.Writer{digest}
+	if algo != hashSHA256 {
+		checksum = sha256.New()
+		writers = append(writers, checksum)
+	}
+	r = io.TeeReader(r, io.MultiWriter(writers...))
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, memory+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n > memory {
+		if content.file, err = os.CreateTemp(dir, "upload-*"); err != nil {
+			return nil, err
+		}
+		_, err = buf.WriteTo(content.file)
+		if err == nil {
+			n, err = io.Copy(content.file, r)
+			n += memory + 1
+		}
+		if err != nil {
+			content.Close()
+			return nil, err
+		}
+	} else {
+		content.data = buf.Bytes()
+	}
+
+	content.size = n
+	content.hash = hex.EncodeToString(digest.Sum(nil))
+	content.sha256 = content.hash
+	if checksum != nil {
+		content.sha256 = hex.EncodeToString(checksum.Sum(nil))
+	}
+	return content, nil
+}
+
+// 从头读取暂存的内容，每次调用都重新从头开始
+func (s *spooledContent) reader() (io.ReadSeeker, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.data), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+// 删除临时文件
+func (s *spooledContent) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// 上传表单中的一个文件
+type uploadFormPart struct {
+	filename    string
+	contentType string // 客户端声明的类型
+	content     *spooledContent
+}
+
+// 流式读取的上传表单：file 字段的文件在读取时计算哈希并暂存，其他字段保存在 values 中
+type uploadForm struct {
+	values url.Values
+	files  []uploadFormPart
+}
+
+// 依次读取表单的各个部分，file 字段的文件逐个暂存，所有文件合计最多 memory 字节保存在内存中，超过的写入 dir。
+// 只读取一遍请求体，内容不会整个读入内存；返回错误时已暂存的文件都已删除
+func readUploadForm(mr *multipart.Reader, dir, algo string, memory int64) (*uploadForm, error) {
+	form := &uploadForm{values: url.Values{}}
+	valuesSize := int64(0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			form.Close()
+			return nil, err
+		}
+		name := part.FormName()
+		switch {
+		case name == "":
+		case part.FileName() == "":
+			value, err := io.ReadAll(io.LimitReader(part, maxFormValuesSize-valuesSize+1))
+			if err != nil {
+				form.Close()
+				return nil, err
+			}
+			if valuesSize += int64(len(value)); valuesSize > maxFormValuesSize {
+				form.Close()
+				return nil, errFormTooLarge
+			}
+			form.values.Add(name, string(value))
+		case name == "file":
+			content, err := spoolContent(part, dir, algo, memory)
+			if err != nil {
+				form.Close()
+				return nil, err
+			}
+			if content.file == nil {
+				memory -= content.size
+			}
+			form.files = append(form.files, uploadFormPart{filename: sanitizeFileName(part.FileName()), contentType: part.Header.Get("Content-Type"), content: content})
+		}
+		part.Close()
+	}
+}
+
+// 删除暂存的文件
+func (f *uploadForm) Close() {
+	for _, file := range f.files {
+		file.content.Close()
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// 按顺序生成 size 字节的伪随机内容，不在内存中保存整个内容
+type syntheticReader struct {
+	size, offset int64
+}
+
+func (r *syntheticReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), r.size-r.offset))
+	for i := range p[:n] {
+		x := uint64(r.offset) + uint64(i)
+		p[i] = byte(x*2654435761>>13) ^ byte(x>>7)
+	}
+	r.offset += int64(n)
+	return n, nil
+}
+
+// 生成的内容的 sha256
+func syntheticSHA256(size int64) string {
+	h := sha256.New()
+	io.Copy(h, &syntheticReader{size: size})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 读取到 n 字节后返回错误，模拟客户端断开
+type failingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	p = p[:min(int64(len(p)), r.n)]
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+// dir 中的文件数
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestSpoolContentInMemory(t *testing.T) {
+	dir := t.TempDir()
+	content, err := spoolContent(&syntheticReader{size: 1000}, dir, hashSHA256, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if content.file != nil || len(content.data) != 1000 || content.size != 1000 {
+		t.Errorf("content of the memory limit: file %v, %d bytes in memory, size %d", content.file, len(content.data), content.size)
+	}
+	if want := syntheticSHA256(1000); content.hash != want || content.sha256 != want {
+		t.Errorf("hash = %s, sha256 = %s, want %s", content.hash, content.sha256, want)
+	}
+	if n := countFiles(t, dir); n != 0 {
+		t.Errorf("%d temporary files, want none", n)
+	}
+}
+
+func TestSpoolContentToFile(t *testing.T) {
+	const size, memory = 64 << 20, 1 << 20
+	dir := t.TempDir()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	content, err := spoolContent(&syntheticReader{size: size}, dir, hashBLAKE2b256, memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// 内存中最多保存 memory 字节，其余直接写入临时文件。只比较回收后仍在使用的堆内存，
+	// 累计分配量包含其他 goroutine 和 -race 运行时的分配，不能说明内容是否留在内存中
+	if inuse := int64(after.HeapInuse) - int64(before.HeapInuse); inuse > memory+8<<20 {
+		t.Errorf("spooling %d bytes kept %d bytes of heap in use", size, inuse)
+	}
+	if content.file == nil || content.data != nil || content.size != size {
+		t.Fatalf("content over the memory limit: file %v, %d bytes in memory, size %d", content.file, len(content.data), content.size)
+	}
+	if want := syntheticSHA256(size); content.sha256 != want {
+		t.Errorf("sha256 = %s, want %s", content.sha256, want)
+	}
+	if content.hash == content.sha256 || len(content.hash) != 64 {
+		t.Errorf("blake2b-256 hash = %s", content.hash)
+	}
+
+	// 每次读取都从头开始
+	for i := 0; i < 2; i++ {
+		r, err := content.reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.New()
+		if n, err := io.Copy(h, r); err != nil || n != size {
+			t.Fatalf("read %d bytes: %v", n, err)
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != content.sha256 {
+			t.Errorf("read %d: sha256 = %s, want %s", i, got, content.sha256)
+		}
+	}
+
+	if n := countFiles(t, dir); n != 1 {
+		t.Errorf("%d temporary files, want 1", n)
+	}
+	if err := content.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(t, dir); n != 0 {
+		t.Errorf("%d temporary files after Close, want none", n)
+	}
+}
+
+func TestSpoolContentReadErrorRemovesFile(t *testing.T) {
+	dir := t.TempDir()
+	_, err := spoolContent(&failingReader{r: &syntheticReader{size: 10 << 20}, n: 5 << 20}, dir, hashSHA256, 1<<20)
+	if err == nil {
+		t.Fatal("spoolContent succeeded with a failing reader")
+	}
+	if n := countFiles(t, dir); n != 0 {
+		t.Errorf("%d temporary files after a failed read, want none", n)
+	}
+}
+
+// 超过暂存内存限制的上传完成后不留下临时文件
+func TestUploadLargeFileSpoolsToDisk(t *testing.T) {
+	const size = spoolMemoryLimit + 4<<20
+	spoolDir := t.TempDir()
+	s := newTestServer(t, map[string]string{"SPOOL_DIR": spoolDir})
+	alice := s.login("alice")
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", "large.bin")
+		if err == nil {
+			_, err = io.Copy(part, &syntheticReader{size: size})
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	w := s.do(http.MethodPost, "/api/v1/upload", alice, mw.FormDataContentType(), pr)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		File File `json:"file"`
+	}
+	decodeJSON(t, w, &resp)
+	if resp.File.Size != size || resp.File.Hash != syntheticSHA256(size) {
+		t.Errorf("uploaded file = %+v, want %d bytes", resp.File, size)
+	}
+	if n := countFiles(t, spoolDir); n != 0 {
+		t.Errorf("%d files left in the spool directory, want none", n)
+	}
+
+	w = s.do(http.MethodHead, "/api/v1/files/"+strconv.Itoa(resp.File.ID), alice, "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(size) {
+		t.Errorf("HEAD: %d, Content-Length %s", w.Code, w.Header().Get("Content-Length"))
+	}
+}
+
+// 上传中途断开时删除暂存的内容，不保存文件
+func TestUploadInterruptedRemovesSpooledContent(t *testing.T) {
+	spoolDir := t.TempDir()
+	s := newTestServer(t, map[string]string{"SPOOL_DIR": spoolDir})
+	alice := s.login("alice")
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, _ := mw.CreateFormFile("file", "partial.bin")
+		io.Copy(part, &syntheticReader{size: spoolMemoryLimit + 1<<20})
+		pw.CloseWithError(errors.New("connection reset"))
+	}()
+	w := s.do(http.MethodPost, "/api/v1/upload", alice, mw.FormDataContentType(), pr)
+	if w.Code < http.StatusBadRequest {
+		t.Fatalf("interrupted upload: %d %s", w.Code, w.Body)
+	}
+	if n := countFiles(t, spoolDir); n != 0 {
+		t.Errorf("%d files left in the spool directory, want none", n)
+	}
+	var files int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&files); err != nil || files != 0 {
+		t.Errorf("files = %d, %v; want none", files, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 将内容保存在数据库 blob_data 表中的存储后端，适合本地开发和小规模部署
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+// sqlite 后端每段内容的大小：较大的内容分段保存，读写时内存中只有一段
+const sqliteSegmentSize = 4 << 20
+
+// 内存中的文件内容，实现 io.ReadSeekCloser
+type blobReader struct {
+	*bytes.Reader
+}
+
+func (blobReader) Close() error { return nil }
+
+// 将数据包装为 blobReader
+func bytesReader(data []byte) blobReader {
+	return blobReader{bytes.NewReader(data)}
+}
+
+func newSQLiteStorage(db *sql.DB) (*sqliteStorage, error) {
+	return &sqliteStorage{db: db}, nil
+}
+
+func (s *sqliteStorage) Put(ctx context.Context, hash string, r io.Reader) error {
+	buf := make([]byte, sqliteSegmentSize)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 第一段保存在 blob_data 中，之后的每段依次保存在 blob_segments 中
+	n, last, err := readSegment(r, buf)
+	if err != nil {
+		return err
+	}
+	upsertQuery := `INSERT INTO blob_data (hash, data) VALUES (?, ?) ON CONFLICT (hash) DO UPDATE SET data = excluded.data`
+	if _, err := tx.ExecContext(ctx, upsertQuery, hash, buf[:n]); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blob_segments WHERE hash = ?`, hash); err != nil {
+		return err
+	}
+	for i := 1; !last; i++ {
+		if n, last, err = readSegment(r, buf); err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO blob_segments (hash, n, data) VALUES (?, ?, ?)`, hash, i, buf[:n]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 读取一段内容填满 buf，返回读到的字节数以及是否已读完
+func readSegment(r io.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	return n, false, err
+}
+
+// 只分了一段的内容直接读入内存，否则之后的各段在读取时才逐段从数据库加载
+func (s *sqliteStorage) Get(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	var first []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM blob_data WHERE hash = ?`, hash).Scan(&first)
+	if err == sql.ErrNoRows {
+		return nil, 0, errBlobNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT length(data) FROM blob_segments WHERE hash = ? ORDER BY n`, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	r := &segmentReader{ctx: ctx, db: s.db, hash: hash, first: first, sizes: []int64{int64(len(first))}, data: first}
+	size := int64(len(first))
+	for rows.Next() {
+		var n int64
+		if err := rows.Scan(&n); err != nil {
+			return nil, 0, err
+		}
+		r.sizes = append(r.sizes, n)
+		size += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(r.sizes) == 1 {
+		return bytesReader(first), size, nil
+	}
+	r.size = size
+	return r, size, nil
+}
+
+func (s *sqliteStorage) Delete(ctx context.Context, hash string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blob_segments WHERE hash = ?`, hash); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blob_data WHERE hash = ?`, hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) Exists(ctx context.Context, hash string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM blob_data WHERE hash = ?)`, hash).Scan(&exists)
+	return exists, err
+}
+
+// 分段保存的内容，实现 io.ReadSeekCloser；first 为 blob_data 中的第一段，sizes 为各段的大小，data 为第 loaded 段的内容
+type segmentReader struct {
+	ctx    context.Context
+	db     *sql.DB
+	hash   string
+	first  []byte
+	sizes  []int64
+	size   int64
+	offset int64
+	loaded int
+	data   []byte
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	// 找到 offset 所在的段
+	i, start := 0, int64(0)
+	for start+r.sizes[i] <= r.offset {
+		start += r.sizes[i]
+		i++
+	}
+	if i != r.loaded {
+		if err := r.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.data[r.offset-start:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// 加载第 i 段；读取期间内容被覆盖导致大小不一致时返回错误
+func (r *segmentReader) load(i int) error {
+	if i == 0 {
+		r.loaded, r.data = 0, r.first
+		return nil
+	}
+	var data []byte
+	err := r.db.QueryRowContext(r.ctx, `SELECT data FROM blob_segments WHERE hash = ? AND n = ?`, r.hash, i).Scan(&data)
+	if err == sql.ErrNoRows || err == nil && int64(len(data)) != r.sizes[i] {
+		return fmt.Errorf("segment %d of %s changed while reading", i, r.hash)
+	}
+	if err != nil {
+		return err
+	}
+	r.loaded, r.data = i, data
+	return nil
+}
+
+func (r *segmentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *segmentReader) Close() error { return nil }
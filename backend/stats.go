@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 统计中列出的最大文件数
+const statsLargestFiles = 10
+
+// 存储空间统计需要汇总所有内容，结果缓存该时长
+const storageStatsTTL = time.Minute
+
+// FileStats 文件数量和大小的统计，不包括回收站中和已过期的文件
+type FileStats struct {
+	FileCount       int    `json:"file_count"`
+	LogicalBytes    int64  `json:"logical_bytes"`     // 所有文件当前版本的大小之和
+	UploadedLast24h int    `json:"uploaded_last_24h"` // 最近 24 小时上传的文件数
+	LargestFiles    []File `json:"largest_files"`
+}
+
+// StorageStats 整个服务的存储空间统计
+type StorageStats struct {
+	BlobCount             int       `json:"blob_count"`
+	PhysicalBytes         int64     `json:"physical_bytes"`    // 去重后实际保存的内容大小
+	ReferencedBytes       int64     `json:"referenced_bytes"`  // 所有文件、历史版本和回收站中的文件引用的内容大小之和
+	DedupSavedBytes       int64     `json:"dedup_saved_bytes"` // 去重节省的空间
+	ChunkedBytes          int64     `json:"chunked_bytes"`     // 分块保存的内容大小之和
+	ChunkCount            int       `json:"chunk_count"`
+	ChunkBytes            int64     `json:"chunk_bytes"`             // 分块去重后实际保存的大小
+	ChunkSavedBytes       int64     `json:"chunk_saved_bytes"`       // 分块去重在内容去重之外节省的空间
+	CompressedCount       int       `json:"compressed_count"`        // 压缩保存的内容和分块数
+	CompressedBytes       int64     `json:"compressed_bytes"`        // 压缩保存的内容和分块的原大小之和
+	CompressedStoredBytes int64     `json:"compressed_stored_bytes"` // 压缩后实际保存的大小
+	CompressionSavedBytes int64     `json:"compression_saved_bytes"` // 压缩节省的空间
+	DatabaseBytes         int64     `json:"database_bytes"`          // 数据库文件的大小，不包括 WAL
+	ComputedAt            time.Time `json:"computed_at"`
+}
+
+// UserStats 单个用户的统计
+type UserStats struct {
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	FileCount    int    `json:"file_count"`
+	LogicalBytes int64  `json:"logical_bytes"` // 当前版本的大小之和，不包括回收站和已过期的文件
+	UsedBytes    int64  `json:"used_bytes"`    // 计入配额的空间，包括历史版本和回收站
+	QuotaBytes   int64  `json:"quota_bytes"`
+}
+
+// 缓存的存储空间统计
+type storageStatsCache struct {
+	mu    sync.Mutex
+	stats StorageStats
+}
+
+// 注册统计接口；admin 上的接口仅管理员可以访问
+func registerStatsRoutes(api, admin gin.IRouter, db *sql.DB, concurrency *concurrencyLimiter, disk *diskGuard) {
+	cache := &storageStatsCache{}
+
+	// 当前用户的文件统计
+	api.GET("/stats", func(c *gin.Context) {
+		stats, err := fileStats(c.Request.Context(), db, currentUserID(c))
+		if err != nil {
+			renderError(c, internalError("Failed to get stats", err))
+			return
+		}
+		c.JSON(http.StatusOK, stats)
+	})
+
+	// 整个服务的统计及每个用户的统计，存储空间统计最多缓存一分钟；concurrency 为当前正在处理的上传和下载数，
+	// disk 为数据库、存储和暂存目录所在卷的剩余空间
+	admin.GET("/stats", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		files, err := fileStats(ctx, db, 0)
+		if err != nil {
+			renderError(c, internalError("Failed to get stats", err))
+			return
+		}
+		storage, err := cache.get(ctx, db)
+		if err != nil {
+			renderError(c, internalError("Failed to get stats", err))
+			return
+		}
+		users, err := userStats(ctx, db)
+		if err != nil {
+			renderError(c, internalError("Failed to get stats", err))
+			return
+		}
+		disk, err := disk.usage()
+		if err != nil {
+			renderError(c, internalError("Failed to get stats", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"files":       files,
+			"storage":     storage,
+			"users":       users,
+			"concurrency": concurrency.stats(),
+			"disk":        disk,
+		})
+	})
+}
+
+// 返回缓存的存储空间统计，超过 storageStatsTTL 时重新计算
+func (s *storageStatsCache) get(ctx context.Context, db *sql.DB) (StorageStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.stats.ComputedAt) < storageStatsTTL {
+		return s.stats, nil
+	}
+	stats, err := storageStats(ctx, db)
+	if err != nil {
+		return stats, err
+	}
+	s.stats = stats
+	return stats, nil
+}
+
+// 统计用户的文件，ownerID 为 0 时统计所有用户；在只读事务中查询，各项数字来自同一时刻
+func fileStats(ctx context.Context, db *sql.DB, ownerID int) (FileStats, error) {
+	stats := FileStats{LargestFiles: []File{}}
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	where := ` FROM files WHERE deleted_at IS NULL AND ` + fileNotExpired + ` AND (? = 0 OR owner_id = ?)`
+	now := time.Now().UTC()
+	query := `SELECT COUNT(*), IFNULL(SUM(size), 0), COUNT(CASE WHEN created_at >= ? THEN 1 END)` + where
+	if err := tx.QueryRowContext(ctx, query, now.Add(-24*time.Hour), now, ownerID, ownerID).Scan(&stats.FileCount, &stats.LogicalBytes, &stats.UploadedLast24h); err != nil {
+		return stats, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT `+fileColumns+where+` ORDER BY size DESC, id LIMIT ?`, now, ownerID, ownerID, statsLargestFiles)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return stats, err
+		}
+		stats.LargestFiles = append(stats.LargestFiles, file)
+	}
+	return stats, rows.Err()
+}
+
+// 统计去重后的存储空间、分块去重和压缩节省的空间和数据库大小
+func storageStats(ctx context.Context, db *sql.DB) (StorageStats, error) {
+	var stats StorageStats
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT COUNT(*), IFNULL(SUM(size), 0), IFNULL(SUM(size * refcount), 0) FROM blobs`
+	if err := tx.QueryRowContext(ctx, query).Scan(&stats.BlobCount, &stats.PhysicalBytes, &stats.ReferencedBytes); err != nil {
+		return stats, err
+	}
+	chunkQuery := `SELECT (SELECT IFNULL(SUM(size), 0) FROM file_chunks), COUNT(*), IFNULL(SUM(size), 0) FROM chunks`
+	if err := tx.QueryRowContext(ctx, chunkQuery).Scan(&stats.ChunkedBytes, &stats.ChunkCount, &stats.ChunkBytes); err != nil {
+		return stats, err
+	}
+	compressedQuery := `SELECT COUNT(*), IFNULL(SUM(size), 0), IFNULL(SUM(stored_size), 0) FROM compressed_content`
+	if err := tx.QueryRowContext(ctx, compressedQuery).Scan(&stats.CompressedCount, &stats.CompressedBytes, &stats.CompressedStoredBytes); err != nil {
+		return stats, err
+	}
+	sizeQuery := `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
+	if err := tx.QueryRowContext(ctx, sizeQuery).Scan(&stats.DatabaseBytes); err != nil {
+		return stats, err
+	}
+	stats.DedupSavedBytes = stats.ReferencedBytes - stats.PhysicalBytes
+	stats.ChunkSavedBytes = stats.ChunkedBytes - stats.ChunkBytes
+	stats.CompressionSavedBytes = stats.CompressedBytes - stats.CompressedStoredBytes
+	stats.ComputedAt = time.Now().UTC()
+	return stats, nil
+}
+
+// 统计每个用户的文件，按已用空间倒序
+func userStats(ctx context.Context, db *sql.DB) ([]UserStats, error) {
+	query := `
+	SELECT users.id, users.username, COUNT(files.id), IFNULL(SUM(files.size), 0), users.used_bytes, users.quota_bytes
+	FROM users LEFT JOIN files ON files.owner_id = users.id AND files.deleted_at IS NULL AND ` + fileNotExpired + `
+	GROUP BY users.id ORDER BY users.used_bytes DESC, users.id`
+	rows, err := db.QueryContext(ctx, query, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserStats{}
+	for rows.Next() {
+		var u UserStats
+		if err := rows.Scan(&u.ID, &u.Username, &u.FileCount, &u.LogicalBytes, &u.UsedBytes, &u.QuotaBytes); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
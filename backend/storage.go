@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 存储后端中没有该哈希对应的内容
+var errBlobNotFound = errors.New("blob not found")
+
+// 内容的哈希与期望的哈希不一致
+var errHashMismatch = errors.New("hash mismatch")
+
+// Storage 按内容的键保存文件内容的存储后端，键由 blobKey 根据哈希算法和摘要生成。
+// 引用计数等元数据保存在 blobs 表中，后端只负责内容本身；相同键的内容相同，因此 Put 可以重复调用。
+// 内容不存在时 Get 返回 errBlobNotFound，Delete 不返回错误
+type Storage interface {
+	Put(ctx context.Context, hash string, r io.Reader) error
+	Get(ctx context.Context, hash string) (io.ReadCloser, int64, error)
+	Delete(ctx context.Context, hash string) error
+	Exists(ctx context.Context, hash string) (bool, error)
+}
+
+// 支持的存储后端
+const (
+	storageBackendSQLite = "sqlite"
+	storageBackendLocal  = "local"
+)
+
+// 根据配置创建存储后端；设置了加密密钥时内容加密后保存。
+// 后端总是包装为 chunkedStorage 和 compressedStorage，关闭分块或压缩后已保存的内容仍然可以读取
+func newStorage(cfg Config, db *sql.DB) (Storage, error) {
+	var base Storage
+	var err error
+	switch cfg.StorageBackend {
+	case storageBackendSQLite:
+		base, err = newSQLiteStorage(db)
+	case storageBackendLocal:
+		base, err = newLocalStorage(cfg.StorageDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 分块之后再加密，每个分块单独加密，相同的分块仍然只保存一次
+	if cfg.EncryptionKey != nil {
+		if base, err = newEncryptedStorage(base, cfg.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	// 压缩在加密之前，加密后的内容无法压缩
+	compressed := newCompressedStorage(db, base, cfg.Compression)
+	return newChunkedStorage(db, compressed, cfg.Chunking, cfg.ChunkSize), nil
+}
+
+// 去掉分块、压缩和加密的包装，返回实际保存内容的存储后端
+func baseStorage(store Storage) Storage {
+	for {
+		switch s := store.(type) {
+		case *chunkedStorage:
+			store = s.base
+		case *compressedStorage:
+			store = s.base
+		case *encryptedStorage:
+			store = s.base
+		default:
+			return store
+		}
+	}
+}
+
+// 上传内容在计算哈希前暂存的目录；本地存储使用存储目录下的临时目录，以便与内容位于同一文件系统
+func uploadTempDir(store Storage) string {
+	if local, ok := baseStorage(store).(*localStorage); ok {
+		return local.tempDir()
+	}
+	return os.TempDir()
+}
+
+// 读取 r 的内容并保存为 file.OwnerID 的文件，返回保存后的文件信息；哈希使用 file.HashAlgo 计算。
+// file.ID 不为 0 时作为该文件的新版本保存，原内容成为历史版本；replace 为 true 时直接替换该文件的内容，不保留原内容。
+// expectedHash 不为空时校验内容的 sha256，不一致时返回 errHashMismatch，读取的内容被丢弃，
+// 返回的文件信息中为实际的 sha256。已存储过相同内容时只增加引用计数
+func storeFile(ctx context.Context, db *sql.DB, store Storage, file File, r io.Reader, expectedHash string, replace bool) (File, error) {
+	content, err := spoolContent(r, uploadTempDir(store), file.HashAlgo, spoolMemoryLimit)
+	if err != nil {
+		return file, err
+	}
+	defer content.Close()
+	return storeSpooled(ctx, db, store, file, content, expectedHash, replace)
+}
+
+// 保存已暂存的内容，参数和返回值与 storeFile 相同
+func storeSpooled(ctx context.Context, db *sql.DB, store Storage, file File, content *spooledContent, expectedHash string, replace bool) (File, error) {
+	file.Hash, file.Size = content.hash, content.size
+	if expectedHash != "" && content.sha256 != expectedHash {
+		file.HashAlgo, file.Hash = hashSHA256, content.sha256
+		return file, errHashMismatch
+	}
+	// 不允许的文件类型不保存内容
+	if err := checkUploadType(ctx, file, content); err != nil {
+		return file, err
+	}
+	// 超过配额时不保存内容；插入记录时会在事务中再次检查
+	if err := checkQuota(ctx, db, file.OwnerID, file.Size); err != nil {
+		return file, err
+	}
+	// 扫描通过（或 fail-open 时扫描服务不可用）后才保存内容
+	scanStatus, err := scanUpload(ctx, db, file, content)
+	if err != nil {
+		return file, err
+	}
+	body, err := content.reader()
+	if err != nil {
+		return file, err
+	}
+	// 保存后唤醒后台索引和元数据提取，文本内容随后可以被全文搜索
+	defer wakeContentIndexer()
+	defer wakeMetadataExtractor()
+
+	switch {
+	case file.ID != 0 && replace:
+		file, err = replaceFile(ctx, db, store, file, body)
+	case file.ID != 0:
+		file.Version, err = addVersion(ctx, db, store, file, body)
+		file.UpdatedAt = file.CreatedAt
+	default:
+		file, err = addFile(ctx, db, store, file, body)
+	}
+	if err != nil {
+		return file, err
+	}
+	// 内容已经保存，记录失败时内容保持 pending，可以通过重新扫描更新
+	if err := recordContentScan(ctx, db, file.blobKey(), ScanVerdict{Status: scanStatus}); err != nil {
+		slog.ErrorContext(ctx, "Failed to record virus scan result", "hash", file.blobKey(), "error", err)
+		scanStatus = scanPending
+	}
+	file.ScanStatus = scanStatus
+	return file, nil
+}
+
+// 内容尚未存储时从 content 读取并保存，然后将 file.ID 的文件替换为该内容，返回的文件信息中 replacedHash 为原内容的哈希。
+// 记录在一个事务中更新，新内容在更新前已保存，原内容在提交后才删除，中途失败时文件仍指向完整的内容
+func replaceFile(ctx context.Context, db *sql.DB, store Storage, file File, content io.Reader) (File, error) {
+	unlock := lockContent(file.blobKey())
+	created, err := putContent(ctx, store, file.blobKey(), content)
+	if err != nil {
+		unlock()
+		return file, err
+	}
+	replaced, previousHash, unused, err := newFileRepository(db).Replace(ctx, file)
+	if err != nil && created {
+		discardContent(store, file.blobKey())
+	}
+	// 原内容可能与新内容使用同一把锁，解锁后再删除
+	unlock()
+	if err != nil {
+		return file, err
+	}
+	deleteUnusedContent(db, store, unused)
+	replaced.replacedHash = previousHash
+	return replaced, nil
+}
+
+// 同一内容的保存和删除互斥，避免刚确认存在的内容被并发的删除移除。
+// 按哈希分为 256 组，不同内容之间基本不会相互等待
+var contentLocks [256]sync.Mutex
+
+// 锁定键对应的内容，返回解锁函数
+func lockContent(key string) func() {
+	var n uint64
+	if _, digest := splitBlobKey(key); len(digest) >= 2 {
+		n, _ = strconv.ParseUint(digest[:2], 16, 8)
+	}
+	contentLocks[n].Lock()
+	return contentLocks[n].Unlock
+}
+
+// 内容尚未存储时从 r 读取并保存，返回是否新保存了内容；调用方需要持有 lockContent
+func putContent(ctx context.Context, store Storage, hash string, r io.Reader) (bool, error) {
+	exists, err := store.Exists(ctx, hash)
+	if err != nil || exists {
+		return false, err
+	}
+	return true, store.Put(ctx, hash, r)
+}
+
+// 保存记录失败时删除新保存的内容；调用方需要持有 lockContent
+func discardContent(store Storage, hash string) {
+	if err := store.Delete(context.Background(), hash); err != nil {
+		slog.Error("Failed to delete unreferenced content", "hash", hash, "error", err)
+	}
+}
+
+// 增加内容的引用计数，内容尚未记录时创建记录，内容本身需已保存到存储后端
+func acquireBlob(ctx context.Context, tx *sql.Tx, hash string, size int64) error {
+	retained, err := retainBlob(ctx, tx, hash)
+	if err != nil || retained {
+		return err
+	}
+	insertQuery := `INSERT INTO blobs (hash, size, refcount, created_at) VALUES (?, ?, 1, ?)`
+	_, err = tx.ExecContext(ctx, insertQuery, hash, size, time.Now().UTC())
+	return err
+}
+
+// 为已存储的内容增加一次引用，内容不存在时返回 false
+func retainBlob(ctx context.Context, tx *sql.Tx, hash string) (bool, error) {
+	result, err := tx.ExecContext(ctx, `UPDATE blobs SET refcount = refcount + 1 WHERE hash = ?`, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// 减少内容的引用计数，没有引用时删除记录及缩略图并返回 true；
+// 存储后端中的内容在事务提交后由 deleteUnusedContent 删除
+func releaseBlob(ctx context.Context, tx *sql.Tx, hash string) (bool, error) {
+	var refcount int
+	err := tx.QueryRowContext(ctx, `UPDATE blobs SET refcount = refcount - 1 WHERE hash = ? RETURNING refcount`, hash).Scan(&refcount)
+	if err == sql.ErrNoRows {
+		slog.Warn("Released content has no blob record", "hash", hash)
+		return false, nil
+	}
+	if err != nil || refcount > 0 {
+		return false, err
+	}
+	return true, deleteBlob(ctx, tx, hash)
+}
+
+// 删除内容的记录以及由内容生成的索引、元数据、扫描结果和缩略图，存储后端中的内容由调用方在提交后删除
+func deleteBlob(ctx context.Context, tx *sql.Tx, hash string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blobs WHERE hash = ?`, hash); err != nil {
+		return err
+	}
+	if err := deleteContentIndex(ctx, tx, hash); err != nil {
+		return err
+	}
+	if err := deleteFileMetadata(ctx, tx, hash); err != nil {
+		return err
+	}
+	if err := deleteContentScan(ctx, tx, hash); err != nil {
+		return err
+	}
+	return deleteThumbnails(ctx, tx, hash)
+}
+
+// 从存储后端删除已没有引用的内容。记录已经删除，失败时只记录日志；
+// 删除前再次确认没有记录，期间被重新上传的内容会保留
+func deleteUnusedContent(db *sql.DB, store Storage, hashes []string) {
+	// 请求结束后也要完成删除，不使用请求的 context
+	ctx := context.Background()
+	for _, hash := range hashes {
+		unlock := lockContent(hash)
+		claimed, err := claimContentDeletion(ctx, db, "blobs", hash, hash)
+		if err == nil && claimed {
+			err = store.Delete(ctx, hash)
+			finishContentDeletion(ctx, db, hash)
+		}
+		unlock()
+		if err != nil {
+			slog.Error("Failed to delete unreferenced content", "hash", hash, "error", err)
+		}
+	}
+}
+
+// 认领的删除超过该时间仍未结束时，认为删除的进程已经退出
+const contentDeletionTimeout = time.Minute
+
+// 等待其他进程删除内容时检查的间隔
+const contentDeletionPoll = 100 * time.Millisecond
+
+// 导入命令等其他进程可能与服务端同时使用数据库和存储后端，进程内的 lockContent 无法阻止它们与删除交错。
+// 删除内容前在 content_deletions 中认领删除，table 中仍有 hash 为 row 的记录时不认领，返回是否认领；
+// 其他进程增加引用后调用 awaitContentDeletion，等待已认领的删除结束后再确认内容存在
+func claimContentDeletion(ctx context.Context, db *sql.DB, table, row, key string) (bool, error) {
+	claimQuery := `
+	INSERT INTO content_deletions (hash, started_at) SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM ` + table + ` WHERE hash = ?)
+	ON CONFLICT (hash) DO UPDATE SET started_at = excluded.started_at`
+	result, err := db.ExecContext(ctx, claimQuery, key, time.Now().UTC(), row)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// 删除结束后移除认领，失败时只记录日志，超时后认领自动失效
+func finishContentDeletion(ctx context.Context, db *sql.DB, key string) {
+	if _, err := db.ExecContext(ctx, `DELETE FROM content_deletions WHERE hash = ?`, key); err != nil {
+		slog.Error("Failed to finish content deletion", "hash", key, "error", err)
+	}
+}
+
+// 等待 key 已认领的删除结束。调用前需已提交对该内容的引用，之后不会再有新的删除被认领，
+// 返回后内容要么未被删除，要么已删除完毕需要重新保存
+func awaitContentDeletion(ctx context.Context, db *sql.DB, key string) error {
+	for {
+		var claimed bool
+		query := `SELECT EXISTS(SELECT 1 FROM content_deletions WHERE hash = ? AND started_at > ?)`
+		if err := db.QueryRowContext(ctx, query, key, time.Now().UTC().Add(-contentDeletionTimeout)).Scan(&claimed); err != nil || !claimed {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(contentDeletionPoll):
+		}
+	}
+}
+
+// 打开文件内容，调用方负责关闭；内容不存在时返回 errBlobNotFound，内容被判定为感染时返回 errFileInfected
+func openFileContent(ctx context.Context, store Storage, file File) (io.ReadCloser, int64, error) {
+	if file.ScanStatus == scanInfected {
+		return nil, 0, errFileInfected
+	}
+	return store.Get(ctx, file.blobKey())
+}
+
+// 将内容读入可以随机访问的 Reader，后端返回的内容本身支持 Seek 时直接使用
+func readSeeker(r io.Reader) (io.ReadSeeker, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytesReader(data), nil
+}
+
+// 使用其他后端时，将保存在数据库中的内容迁移过去；使用 sqlite 后端时确认所有内容都在数据库中
+func migrateContent(ctx context.Context, db *sql.DB, store Storage) error {
+	// 分块、压缩、加密和整体保存的内容都按原来的键和字节直接迁移
+	store = baseStorage(store)
+	if _, ok := store.(*sqliteStorage); ok {
+		var missing bool
+		query := `SELECT EXISTS(SELECT 1 FROM blobs WHERE hash NOT IN (SELECT hash FROM blob_data) AND hash NOT IN (SELECT blob_hash FROM file_chunks))`
+		if err := db.QueryRowContext(ctx, query).Scan(&missing); err != nil {
+			return err
+		}
+		if missing {
+			return errors.New("database stores file content outside the database, STORAGE_BACKEND must be set")
+		}
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT hash FROM blob_data`)
+	if err != nil {
+		return err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	// 逐个迁移，避免一次性将所有内容读入内存
+	slog.Info("Migrating file content from database to storage backend", "blobs", len(hashes))
+	source := &sqliteStorage{db: db}
+	for _, hash := range hashes {
+		content, _, err := source.Get(ctx, hash)
+		if err != nil {
+			return err
+		}
+		err = store.Put(ctx, hash, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+		if err := source.Delete(ctx, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 标签的限制
+const (
+	maxTagLength    = 50 // 标签的最大长度（字节）
+	maxTagsPerFile  = 20 // 每个文件最多的标签数
+	maxTagsPerQuery = 10 // 列表查询时最多按多少个标签过滤
+)
+
+// 文件的标签数超过限制
+var errTooManyTags = errors.New("too many tags")
+
+// 查询文件的标签时使用的子查询，结果为按名称排序的 JSON 数组
+const fileTagsColumn = `(SELECT json_group_array(name) FROM (
+		SELECT tags.name FROM file_tags JOIN tags ON tags.id = file_tags.tag_id WHERE file_tags.file_id = files.id ORDER BY tags.name
+	))`
+
+// TagCount 标签及使用该标签的文件数
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// 注册标签接口
+func registerTagRoutes(r gin.IRouter, db *sql.DB) {
+	repo := newFileRepository(db)
+
+	// 为文件添加标签，已有的标签不重复添加；标签会去除首尾空白并转为小写
+	r.PUT("/files/:id/tags", func(c *gin.Context) {
+		var req struct {
+			Tags []string `json:"tags"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || len(req.Tags) == 0 {
+			renderError(c, invalidRequest("Invalid request body, tags must be a non-empty list"))
+			return
+		}
+		tags, err := normalizeTags(req.Tags)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		file, ok := fileParam(c, repo)
+		if !ok {
+			return
+		}
+
+		err = addFileTags(c.Request.Context(), db, file.OwnerID, file.ID, tags)
+		if errors.Is(err, errTooManyTags) {
+			renderError(c, invalidRequest("A file can have at most "+strconv.Itoa(maxTagsPerFile)+" tags"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to add tags", err))
+			return
+		}
+		file, err = repo.GetByID(c.Request.Context(), file.OwnerID, file.ID)
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+		c.JSON(http.StatusOK, file)
+	})
+
+	// 移除文件的一个标签
+	r.DELETE("/files/:id/tags/:tag", func(c *gin.Context) {
+		tag, err := normalizeTag(c.Param("tag"))
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		file, ok := fileParam(c, repo)
+		if !ok {
+			return
+		}
+
+		err = removeFileTag(c.Request.Context(), db, file.OwnerID, file.ID, tag)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Tag not found on file"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to remove tag", err))
+			return
+		}
+		file, err = repo.GetByID(c.Request.Context(), file.OwnerID, file.ID)
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+		c.JSON(http.StatusOK, file)
+	})
+
+	// 列出当前用户的所有标签及使用的文件数，回收站中的文件不计入；按使用次数倒序
+	r.GET("/tags", func(c *gin.Context) {
+		tags, err := listTags(c.Request.Context(), db, currentUserID(c))
+		if err != nil {
+			renderError(c, internalError("Failed to get tags", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"tags": tags})
+	})
+}
+
+// 规范化标签：去除首尾空白并转为小写；标签为空、过长或包含 / 时返回错误
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", errors.New("Tag must not be empty")
+	}
+	if len(tag) > maxTagLength {
+		return "", errors.New("Tag is too long, must be at most " + strconv.Itoa(maxTagLength) + " bytes")
+	}
+	if strings.Contains(tag, "/") {
+		return "", errors.New("Tag must not contain /")
+	}
+	return tag, nil
+}
+
+// 规范化一组标签并去除重复
+func normalizeTags(tags []string) ([]string, error) {
+	seen := map[string]bool{}
+	var normalized []string
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized, nil
+}
+
+// 为文件添加标签，用户还没有的标签会被创建；添加后超过 maxTagsPerFile 时返回 errTooManyTags
+func addFileTags(ctx context.Context, db *sql.DB, ownerID, fileID int, tags []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, tag := range tags {
+		var tagID int
+		insertQuery := `INSERT INTO tags (owner_id, name) VALUES (?, ?) ON CONFLICT (owner_id, name) DO UPDATE SET name = excluded.name RETURNING id`
+		if err := tx.QueryRowContext(ctx, insertQuery, ownerID, tag).Scan(&tagID); err != nil {
+			return err
+		}
+		linkQuery := `INSERT INTO file_tags (file_id, tag_id) VALUES (?, ?) ON CONFLICT DO NOTHING`
+		if _, err := tx.ExecContext(ctx, linkQuery, fileID, tagID); err != nil {
+			return err
+		}
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM file_tags WHERE file_id = ?`, fileID).Scan(&count); err != nil {
+		return err
+	}
+	if count > maxTagsPerFile {
+		return errTooManyTags
+	}
+	return tx.Commit()
+}
+
+// 移除文件的标签，没有文件使用的标签一并删除；文件没有该标签时返回 sql.ErrNoRows
+func removeFileTag(ctx context.Context, db *sql.DB, ownerID, fileID int, tag string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleteQuery := `DELETE FROM file_tags WHERE file_id = ? AND tag_id = (SELECT id FROM tags WHERE owner_id = ? AND name = ?)`
+	result, err := tx.ExecContext(ctx, deleteQuery, fileID, ownerID, tag)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := deleteUnusedTags(ctx, tx, ownerID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 删除文件的所有标签，没有文件使用的标签一并删除；用于彻底删除文件
+func deleteFileTags(ctx context.Context, tx *sql.Tx, ownerID, fileID int) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM file_tags WHERE file_id = ?`, fileID); err != nil {
+		return err
+	}
+	return deleteUnusedTags(ctx, tx, ownerID)
+}
+
+// 删除用户没有文件使用的标签
+func deleteUnusedTags(ctx context.Context, tx *sql.Tx, ownerID int) error {
+	deleteQuery := `DELETE FROM tags WHERE owner_id = ? AND NOT EXISTS (SELECT 1 FROM file_tags WHERE tag_id = tags.id)`
+	_, err := tx.ExecContext(ctx, deleteQuery, ownerID)
+	return err
+}
+
+// 获取用户的标签及使用的文件数，只有回收站中或已过期的文件使用的标签不列出
+func listTags(ctx context.Context, db *sql.DB, ownerID int) ([]TagCount, error) {
+	query := `
+	SELECT tags.name, COUNT(*) FROM tags
+	JOIN file_tags ON file_tags.tag_id = tags.id
+	JOIN files ON files.id = file_tags.file_id AND files.deleted_at IS NULL AND ` + fileNotExpired + `
+	WHERE tags.owner_id = ?
+	GROUP BY tags.id ORDER BY COUNT(*) DESC, tags.name`
+	rows, err := db.QueryContext(ctx, query, time.Now().UTC(), ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 打开一个已执行所有迁移的内存数据库，测试结束时关闭。每个测试使用以测试名命名的独立数据库，
+// 共享缓存使连接池中的连接访问同一个数据库
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	params := url.Values{}
+	params.Set("mode", "memory")
+	params.Set("cache", "shared")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "foreign_keys(ON)")
+	params.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+url.PathEscape(t.Name())+"?"+params.Encode())
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := initDB(db, 0); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	return db
+}
+
+// 打开临时目录中的数据库文件并执行迁移，测试结束时关闭。共享缓存的内存数据库在并发写入时
+// 直接返回表被锁定的错误而不等待，测试并发时使用与生产环境相同的 WAL 数据库文件
+func openTestFileDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := openDB(filepath.Join(t.TempDir(), "files.db"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := initDB(db, 0); err != nil {
+		t.Fatalf("initialize database: %v", err)
+	}
+	return db
+}
+
+// 创建测试用户并返回其 id，第一个创建的用户是管理员
+func newTestUser(t *testing.T, db *sql.DB, username string) int {
+	t.Helper()
+	var id int
+	query := `INSERT INTO users (username, password_hash, created_at) VALUES (?, '', ?) RETURNING id`
+	if err := db.QueryRow(query, username, time.Now().UTC()).Scan(&id); err != nil {
+		t.Fatalf("create user %s: %v", username, err)
+	}
+	return id
+}
+
+// 测试用的完整接口：默认配置、内存数据库和 sqlite 存储后端，不限流也不限制并发
+type testServer struct {
+	t       *testing.T
+	db      *sql.DB
+	handler http.Handler
+}
+
+// 按 env 覆盖默认配置创建接口
+func newTestServer(t *testing.T, env map[string]string) *testServer {
+	t.Helper()
+	return newTestServerWithDB(t, env, newTestDB(t))
+}
+
+// 与 newTestServer 相同，但使用给定的数据库，如测试并发请求时使用 openTestFileDB
+func newTestServerWithDB(t *testing.T, env map[string]string, db *sql.DB) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	for key, value := range map[string]string{
+		"JWT_SECRET":             "test",
+		"RATE_LIMIT_UPLOAD":      "off",
+		"RATE_LIMIT_DOWNLOAD":    "off",
+		"RATE_LIMIT_LIST":        "off",
+		"MAX_CONCURRENT_UPLOADS": "0",
+		"DISK_RESERVE":           "0",
+	} {
+		t.Setenv(key, value)
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	store, err := newStorage(cfg, db)
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler, err := newRouter(ctx, cfg, db, store, newMetricsRegistry(db))
+	if err != nil {
+		t.Fatalf("create router: %v", err)
+	}
+	return &testServer{t: t, db: db, handler: handler}
+}
+
+// 注册并登录用户，返回登录令牌
+func (s *testServer) login(username string) string {
+	s.t.Helper()
+	body := `{"username":"` + username + `","password":"password1"}`
+	if w := s.do(http.MethodPost, "/api/v1/register", "", "application/json", strings.NewReader(body)); w.Code != http.StatusCreated && w.Code != http.StatusOK {
+		s.t.Fatalf("register %s: %d %s", username, w.Code, w.Body)
+	}
+	w := s.do(http.MethodPost, "/api/v1/login", "", "application/json", strings.NewReader(body))
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Token == "" {
+		s.t.Fatalf("login %s: %d %s", username, w.Code, w.Body)
+	}
+	return resp.Token
+}
+
+// 发送请求并返回记录的响应；token 为空时不带认证
+func (s *testServer) do(method, target, token, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	return w
+}
+
+// 以表单上传一个文件，fields 为其他表单字段
+func (s *testServer) upload(token, filename string, content []byte, fields map[string]string) *httptest.ResponseRecorder {
+	return s.uploadTo(apiV1Prefix+"/upload", token, filename, content, fields)
+}
+
+// 与 upload 相同，但上传到 target
+func (s *testServer) uploadTo(target, token, filename string, content []byte, fields map[string]string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for key, value := range fields {
+		mw.WriteField(key, value)
+	}
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		s.t.Fatalf("create form file: %v", err)
+	}
+	part.Write(content)
+	mw.Close()
+	return s.do(http.MethodPost, target, token, mw.FormDataContentType(), &buf)
+}
+
+// 将响应体解析到 v 中
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body, err)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// 缩略图的默认边长和允许的边长，限制可选尺寸以免缓存无限增长
+const defaultThumbnailSize = 150
+
+var thumbnailSizes = []int{64, 150, 300, 600}
+
+// 支持生成缩略图的图片类型
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// 解码前检查图片尺寸，避免超大图片耗尽内存
+const maxThumbnailPixels = 50_000_000
+
+// 图片内容无法解码
+var errInvalidImage = errors.New("invalid image")
+
+// 注册缩略图接口
+func registerThumbnailRoutes(r gin.IRouter, db *sql.DB, store Storage) {
+	repo := newFileRepository(db)
+
+	// 获取图片的缩略图，首次请求时生成并缓存；缩略图按内容哈希缓存，相同内容的文件共用
+	r.GET("/files/:id/thumbnail", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+		size, err := queryInt(c, "size", defaultThumbnailSize)
+		if err != nil || !slices.Contains(thumbnailSizes, size) {
+			renderError(c, invalidRequest("Invalid size").with(gin.H{"sizes": thumbnailSizes}))
+			return
+		}
+
+		file, err := repo.GetByID(c.Request.Context(), currentUserID(c), id)
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(file.Mime)
+		if !thumbnailTypes[mediaType] {
+			renderError(c, newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Thumbnails are only available for JPEG, PNG, GIF and WebP images"))
+			return
+		}
+
+		// 内容在生成缩略图后才被判定为感染时，缓存的缩略图也不再返回
+		if file.ScanStatus == scanInfected {
+			renderError(c, fileQuarantined())
+			return
+		}
+
+		// 缩略图只由内容和尺寸决定，可以长期缓存
+		etag := `"` + file.Hash + "-" + strconv.Itoa(size) + `"`
+		c.Header("ETag", etag)
+		c.Header("Cache-Control", "private, max-age=86400")
+		if etagMatches(c.GetHeader("If-None-Match"), etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		contentType, data, err := getThumbnail(c.Request.Context(), db, file.blobKey(), size)
+		if err == sql.ErrNoRows {
+			contentType, data, err = generateThumbnail(c.Request.Context(), db, store, file, mediaType, size)
+		}
+		if errors.Is(err, errBlobNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File content not found"))
+			return
+		}
+		if errors.Is(err, errInvalidImage) {
+			renderError(c, newAPIError(http.StatusUnprocessableEntity, codeUnprocessable, "Failed to decode image"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to generate thumbnail", err))
+			return
+		}
+		c.Data(http.StatusOK, contentType, data)
+	})
+}
+
+// 读取文件内容生成缩略图并保存到缓存
+func generateThumbnail(ctx context.Context, db *sql.DB, store Storage, file File, mediaType string, size int) (string, []byte, error) {
+	content, _, err := openFileContent(ctx, store, file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer content.Close()
+	rs, err := readSeeker(content)
+	if err != nil {
+		return "", nil, err
+	}
+
+	contentType, data, err := makeThumbnail(rs, mediaType, size)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := addThumbnail(ctx, db, file.blobKey(), size, contentType, data); err != nil {
+		return "", nil, err
+	}
+	return contentType, data, nil
+}
+
+// 生成不超过 size×size 的缩略图，保持宽高比且不放大；JPEG 按 EXIF 方向旋转。
+// 有透明通道的 PNG 和 GIF 输出 PNG，其他输出 JPEG
+func makeThumbnail(r io.ReadSeeker, mediaType string, size int) (contentType string, data []byte, err error) {
+	// 解码器遇到构造异常的图片时可能 panic
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%w: %v", errInvalidImage, p)
+		}
+	}()
+
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxThumbnailPixels {
+		return "", nil, fmt.Errorf("%w: image is too large", errInvalidImage)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+
+	orientation := 1
+	if mediaType == "image/jpeg" {
+		orientation = jpegOrientation(r)
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var src image.Image
+	if mediaType == "image/gif" {
+		// GIF 只取第一帧
+		src, err = gif.Decode(r)
+	} else {
+		src, _, err = image.Decode(r)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+
+	// 等比缩放到不超过 size×size
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	thumb := orient(dst, orientation)
+
+	var buf bytes.Buffer
+	if mediaType == "image/png" || mediaType == "image/gif" {
+		err = png.Encode(&buf, thumb)
+		contentType = "image/png"
+	} else {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+		contentType = "image/jpeg"
+	}
+	return contentType, buf.Bytes(), err
+}
+
+// 读取 JPEG 中 EXIF 的方向标记（1-8），没有或无法解析时返回 1
+func jpegOrientation(r io.Reader) int {
+	var marker [4]byte
+	if _, err := io.ReadFull(r, marker[:2]); err != nil || marker[0] != 0xFF || marker[1] != 0xD8 {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+		// 图像数据开始后不会再有 EXIF
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 1
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+// 解析 TIFF 结构中 IFD0 的方向标记（0x0112）
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// 按 EXIF 方向标记翻转或旋转图片，使其正向显示
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // 水平翻转
+				sx, sy = w-1-x, y
+			case 3: // 旋转 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // 垂直翻转
+				sx, sy = x, h-1-y
+			case 5: // 沿左上-右下对角线翻转
+				sx, sy = y, x
+			case 6: // 顺时针旋转 90°
+				sx, sy = y, h-1-x
+			case 7: // 沿右上-左下对角线翻转
+				sx, sy = w-1-y, h-1-x
+			case 8: // 逆时针旋转 90°
+				sx, sy = w-1-y, x
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// 获取缓存的缩略图；不存在时返回 sql.ErrNoRows
+func getThumbnail(ctx context.Context, db *sql.DB, hash string, size int) (string, []byte, error) {
+	var contentType string
+	var data []byte
+	query := `SELECT content_type, data FROM thumbnails WHERE hash = ? AND size = ?`
+	err := db.QueryRowContext(ctx, query, hash, size).Scan(&contentType, &data)
+	return contentType, data, err
+}
+
+// 缓存缩略图；并发生成的相同缩略图只保留一份
+func addThumbnail(ctx context.Context, db *sql.DB, hash string, size int, contentType string, data []byte) error {
+	insertQuery := `INSERT INTO thumbnails (hash, size, content_type, data) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`
+	_, err := db.ExecContext(ctx, insertQuery, hash, size, contentType, data)
+	return err
+}
+
+// 删除内容对应的所有缩略图
+func deleteThumbnails(ctx context.Context, tx *sql.Tx, hash string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM thumbnails WHERE hash = ?`, hash)
+	return err
+}
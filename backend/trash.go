@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 注册回收站接口
+func registerTrashRoutes(r gin.IRouter, db *sql.DB, store Storage) {
+	repo := newFileRepository(db)
+
+	// 列出回收站中的文件，最近删除的在前
+	r.GET("/trash", func(c *gin.Context) {
+		limit, err := queryInt(c, "limit", defaultPageLimit)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxPageLimit)))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil || offset < 0 {
+			renderError(c, invalidRequest("Invalid offset, must be a non-negative integer"))
+			return
+		}
+
+		files, total, _, err := repo.List(c.Request.Context(), listOptions{
+			OwnerID: currentUserID(c),
+			Trashed: true,
+			Limit:   limit,
+			Offset:  offset,
+		})
+		if err != nil {
+			renderError(c, internalError("Failed to get trash", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"files":  files,
+			"total":  total,
+			"limit":  limit,
+			"offset": offset,
+		})
+	})
+
+	// 从回收站恢复文件到原来的文件夹，原文件夹已删除时恢复到根目录。
+	// 目标位置已有同名文件时，on_conflict=rename 自动重命名为 name (1).ext，默认 reject 返回 409
+	r.POST("/trash/:id/restore", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+		onConflict := c.DefaultQuery("on_conflict", "reject")
+		if onConflict != "reject" && onConflict != "rename" {
+			renderError(c, invalidRequest("Invalid on_conflict, must be reject or rename"))
+			return
+		}
+
+		file, err := restoreFile(c.Request.Context(), db, currentUserID(c), id, onConflict == "rename")
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File not found in trash"))
+			return
+		}
+		if errors.Is(err, errNameConflict) {
+			renderError(c, newAPIError(http.StatusConflict, codeFileExists, "A file with the same name already exists, use on_conflict=rename to restore it under a new name"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to restore file", err))
+			return
+		}
+
+		path, err := filePath(c.Request.Context(), db, file)
+		if err != nil {
+			renderError(c, internalError("Failed to get file path", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"file": file,
+			"path": path,
+		})
+	})
+
+	// 彻底删除回收站中的文件及其历史版本，释放配额；没有其他文件引用的内容一并删除
+	r.DELETE("/trash/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+
+		file, unused, err := repo.Delete(c.Request.Context(), currentUserID(c), id)
+		if errors.Is(err, errNotFound) {
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File not found in trash"))
+			return
+		}
+		if errors.Is(err, errFileProtected) {
+			renderError(c, newAPIError(http.StatusLocked, codeLocked, "File is protected, unprotect it before deleting"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to delete file", err))
+			return
+		}
+		// 没有其他文件引用的内容在提交后从存储后端删除
+		deleteUnusedContent(db, store, unused)
+		addAuditFile(c, file)
+		c.JSON(http.StatusOK, gin.H{
+			"message": "File deleted permanently",
+			"id":      id,
+			"hash":    file.Hash,
+		})
+	})
+}
+
+// 将回收站中的文件恢复到原文件夹，原文件夹不存在时恢复到根目录。目标位置已有同名文件时，
+// rename 为 true 则改用未被占用的名称，否则返回 errNameConflict；文件不在回收站中时返回 sql.ErrNoRows
+func restoreFile(ctx context.Context, db *sql.DB, ownerID, id int, rename bool) (File, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return File{}, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NOT NULL`
+	file, err := scanFile(tx.QueryRowContext(ctx, query, id, ownerID))
+	if err != nil {
+		return File{}, err
+	}
+
+	if file.FolderID != nil {
+		var exists bool
+		folderQuery := `SELECT EXISTS(SELECT 1 FROM folders WHERE id = ? AND owner_id = ?)`
+		if err := tx.QueryRowContext(ctx, folderQuery, *file.FolderID, ownerID).Scan(&exists); err != nil {
+			return File{}, err
+		}
+		if !exists {
+			file.FolderID = nil
+		}
+	}
+
+	// 目标文件夹下未在回收站中的文件名
+	rows, err := tx.QueryContext(ctx, `SELECT name FROM files WHERE owner_id = ? AND folder_id IS ? AND deleted_at IS NULL`, ownerID, file.FolderID)
+	if err != nil {
+		return File{}, err
+	}
+	used := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return File{}, err
+		}
+		used[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return File{}, err
+	}
+	if used[file.Name] && !rename {
+		return File{}, errNameConflict
+	}
+
+	name := uniqueName(used, file.Name)
+	updateQuery := `UPDATE files SET name = ?, search_name = ?, folder_id = ?, deleted_at = NULL WHERE id = ? RETURNING ` + fileColumns
+	file, err = scanFile(tx.QueryRowContext(ctx, updateQuery, name, searchName(name), file.FolderID, id))
+	if err != nil {
+		return File{}, err
+	}
+	return file, tx.Commit()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上传的文件类型不被允许
+var errFileTypeNotAllowed = errors.New("file type not allowed")
+
+// 被拒绝的类型，typ 为检测到的 MIME 类型或匹配到禁止列表的扩展名；errors.Is(err, errFileTypeNotAllowed) 成立
+type fileTypeError struct {
+	typ string
+}
+
+func (e *fileTypeError) Error() string        { return "file type " + e.typ + " is not allowed" }
+func (e *fileTypeError) Is(target error) bool { return target == errFileTypeNotAllowed }
+
+// 上传文件类型的允许和禁止列表。每一项为扩展名（如 .exe 或 .tar.gz）、MIME 类型（如 image/png）
+// 或 MIME 类型的通配（如 image/*），不区分大小写；允许列表为空时允许所有未被禁止的类型
+type fileTypePolicy struct {
+	allowed []string
+	blocked []string
+}
+
+type fileTypePolicyKey struct{}
+
+// 按内容或扩展名对类型的判断
+const (
+	typeNeutral = iota // 没有匹配的规则
+	typeAllowed
+	typeBlocked
+)
+
+// 解析逗号分隔的类型列表，没有 / 的项为扩展名，可以省略开头的 .
+func parseFileTypeList(s string) ([]string, error) {
+	var rules []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		switch {
+		case item == "":
+			continue
+		case strings.Contains(item, "/"):
+			mediaType, subtype, _ := strings.Cut(item, "/")
+			if mediaType == "" || subtype == "" || strings.Contains(subtype, "/") || (strings.Contains(subtype, "*") && subtype != "*") {
+				return nil, fmt.Errorf("invalid MIME type %q", item)
+			}
+		case strings.ContainsAny(item, `*\`):
+			return nil, fmt.Errorf("invalid extension %q", item)
+		case !strings.HasPrefix(item, "."):
+			item = "." + item
+		}
+		rules = append(rules, item)
+	}
+	return rules, nil
+}
+
+// 为请求设置上传的文件类型限制；没有限制时不做任何处理
+func (p *fileTypePolicy) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(p.allowed) > 0 || len(p.blocked) > 0 {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), fileTypePolicyKey{}, p))
+		}
+		c.Next()
+	}
+}
+
+// 保存前按请求的文件类型限制检查上传的内容，不允许时返回 *fileTypeError；context 中没有限制时不检查
+func checkUploadType(ctx context.Context, file File, content *spooledContent) error {
+	p, ok := ctx.Value(fileTypePolicyKey{}).(*fileTypePolicy)
+	if !ok {
+		return nil
+	}
+	body, err := content.reader()
+	if err != nil {
+		return err
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return p.check(file.Name, sniffUploadType(head[:n]))
+}
+
+// 判断文件名为 name、内容检测为 mediaType 的文件是否允许上传。内容和扩展名分别判断，
+// 两者不一致时以内容为准，例如禁止 .exe 但允许 image/* 时，内容为 JPEG 的 photo.exe 允许上传；
+// 内容没有匹配的规则（如无法识别的 application/octet-stream）时按扩展名判断，都没有匹配时只要设置了允许列表就拒绝
+func (p *fileTypePolicy) check(name, mediaType string) error {
+	name = strings.ToLower(name)
+	mediaType = strings.ToLower(mediaType)
+	byContent, _ := p.verdict(func(rule string) bool { return matchMIMERule(rule, mediaType) })
+	byExtension, ext := p.verdict(func(rule string) bool { return strings.HasPrefix(rule, ".") && strings.HasSuffix(name, rule) })
+	switch {
+	case byContent == typeAllowed:
+		return nil
+	case byContent == typeBlocked:
+		return &fileTypeError{typ: mediaType}
+	case byExtension == typeAllowed:
+		return nil
+	case byExtension == typeBlocked:
+		return &fileTypeError{typ: ext}
+	case len(p.allowed) > 0:
+		return &fileTypeError{typ: mediaType}
+	}
+	return nil
+}
+
+// 按 match 查找匹配的规则，禁止列表优先，返回判断结果和匹配的规则
+func (p *fileTypePolicy) verdict(match func(rule string) bool) (int, string) {
+	for _, rule := range p.blocked {
+		if match(rule) {
+			return typeBlocked, rule
+		}
+	}
+	for _, rule := range p.allowed {
+		if match(rule) {
+			return typeAllowed, rule
+		}
+	}
+	return typeNeutral, ""
+}
+
+// MIME 规则是否匹配 mediaType，image/* 匹配所有 image/ 开头的类型
+func matchMIMERule(rule, mediaType string) bool {
+	if prefix, ok := strings.CutSuffix(rule, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return strings.Contains(rule, "/") && rule == mediaType
+}
+
+// 可执行文件和脚本的开头，http.DetectContentType 只能将它们识别为通用类型
+var executableSignatures = []struct {
+	prefix    []byte
+	mediaType string
+}{
+	{[]byte("MZ"), "application/x-msdownload"},
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xca\xfe\xba\xbe"), "application/x-mach-binary"},
+	{[]byte("#!"), "text/x-shellscript"},
+}
+
+// 检测内容的类型，不含参数；只根据内容判断，不使用客户端声明的类型，避免通过声明类型绕过限制
+func sniffUploadType(head []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if mediaType == "application/octet-stream" || mediaType == "text/plain" {
+		for _, sig := range executableSignatures {
+			if bytes.HasPrefix(head, sig.prefix) {
+				return sig.mediaType
+			}
+		}
+	}
+	return mediaType
+}
+
+// 上传的文件类型不被允许时的错误，type 为被拒绝的类型
+func fileTypeNotAllowed(e *fileTypeError) *apiError {
+	return newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "File type "+e.typ+" is not allowed").with(gin.H{
+		"type": e.typ,
+	})
+}
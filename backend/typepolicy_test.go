@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseFileTypeList(t *testing.T) {
+	got, err := parseFileTypeList(" exe, .BAT,,image/*, application/PDF ,tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".exe", ".bat", "image/*", "application/pdf", ".tar.gz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFileTypeList = %q, want %q", got, want)
+	}
+	if got, err := parseFileTypeList(""); err != nil || got != nil {
+		t.Errorf("parseFileTypeList of an empty list = %q, %v", got, err)
+	}
+	for _, s := range []string{"image/", "/png", "image/p*", "a/b/c", "*.exe", `dir\exe`} {
+		if _, err := parseFileTypeList(s); err == nil {
+			t.Errorf("parseFileTypeList(%q) succeeded", s)
+		}
+	}
+}
+
+func TestFileTypePolicyCheck(t *testing.T) {
+	blockExecutables := &fileTypePolicy{blocked: []string{".exe", ".sh", ".bat", "application/x-msdownload", "application/x-executable", "text/x-shellscript"}}
+	onlyImages := &fileTypePolicy{allowed: []string{"image/*"}}
+	imagesNoExe := &fileTypePolicy{allowed: []string{"image/*"}, blocked: []string{".exe"}}
+	onlyText := &fileTypePolicy{allowed: []string{".txt", ".md"}}
+	tests := []struct {
+		name      string
+		policy    *fileTypePolicy
+		file      string
+		mediaType string
+		blocked   string // 被拒绝的类型，为空表示允许
+	}{
+		{"no rules", &fileTypePolicy{}, "setup.exe", "application/x-msdownload", ""},
+		{"blocked extension", blockExecutables, "setup.exe", "application/octet-stream", ".exe"},
+		{"extension is case insensitive", blockExecutables, "SETUP.EXE", "application/octet-stream", ".exe"},
+		{"double extension", blockExecutables, "file.jpg.exe", "application/octet-stream", ".exe"},
+		{"double extension with executable content", blockExecutables, "file.jpg.exe", "application/x-msdownload", "application/x-msdownload"},
+		{"executable renamed to an image", blockExecutables, "photo.jpg", "application/x-msdownload", "application/x-msdownload"},
+		{"script without extension", blockExecutables, "run", "text/x-shellscript", "text/x-shellscript"},
+		{"no extension", blockExecutables, "README", "text/plain", ""},
+		{"exe in the middle of the name", blockExecutables, "file.exe.jpg", "image/jpeg", ""},
+		{"unknown content", blockExecutables, "data.bin", "application/octet-stream", ""},
+		{"allowed image", onlyImages, "photo.jpg", "image/jpeg", ""},
+		{"allowed image without extension", onlyImages, "photo", "image/png", ""},
+		{"image extension with unknown content", onlyImages, "photo.jpg", "application/octet-stream", "application/octet-stream"},
+		{"not an image", onlyImages, "doc.pdf", "application/pdf", "application/pdf"},
+		{"content wins over a blocked extension", imagesNoExe, "photo.exe", "image/jpeg", ""},
+		{"blocked extension with unknown content", imagesNoExe, "tool.exe", "application/octet-stream", ".exe"},
+		{"allowed extension", onlyText, "notes.TXT", "text/plain", ""},
+		{"allowed extension with unknown content", onlyText, "notes.md", "application/octet-stream", ""},
+		{"extension not allowed", onlyText, "data.bin", "application/octet-stream", "application/octet-stream"},
+		{"missing extension not allowed", onlyText, "notes", "text/plain", "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check(tt.file, tt.mediaType)
+			if tt.blocked == "" {
+				if err != nil {
+					t.Errorf("check(%q, %q) = %v, want allowed", tt.file, tt.mediaType, err)
+				}
+				return
+			}
+			var typeErr *fileTypeError
+			if !errors.As(err, &typeErr) || !errors.Is(err, errFileTypeNotAllowed) || typeErr.typ != tt.blocked {
+				t.Errorf("check(%q, %q) = %v, want %s not allowed", tt.file, tt.mediaType, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestSniffUploadType(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want string
+	}{
+		{"windows executable", "MZ\x90\x00\x03\x00\x00\x00", "application/x-msdownload"},
+		{"elf", "\x7fELF\x02\x01\x01\x00", "application/x-executable"},
+		{"shell script", "#!/bin/sh\necho hi\n", "text/x-shellscript"},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"text", "hello world", "text/plain"},
+		{"empty", "", "text/plain"},
+	}
+	for _, tt := range tests {
+		if got := sniffUploadType([]byte(tt.head)); got != tt.want {
+			t.Errorf("%s: sniffUploadType = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUploadBlockedType(t *testing.T) {
+	s := newTestServer(t, map[string]string{"BLOCKED_TYPES": ".exe,application/x-msdownload", "ALLOWED_TYPES": ""})
+	alice := s.login("alice")
+
+	w := s.upload(alice, "photo.jpg", []byte("MZ\x90\x00 disguised executable"), nil)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want 415: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Error struct {
+			Code string `json:"code"`
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	decodeJSON(t, w, &resp)
+	if resp.Error.Code != codeUnsupportedMediaType || resp.Error.Type != "application/x-msdownload" {
+		t.Errorf("error = %s", w.Body)
+	}
+	var blobs int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM blobs`).Scan(&blobs); err != nil || blobs != 0 {
+		t.Errorf("blobs = %d, %v; rejected content must not be stored", blobs, err)
+	}
+
+	if w := s.upload(alice, "notes.txt", []byte("hello"), nil); w.Code != http.StatusCreated {
+		t.Errorf("allowed upload: %d %s", w.Code, w.Body)
+	}
+
+	w = s.do(http.MethodGet, "/api/v1/config", "", "", nil)
+	var config struct {
+		AllowedTypes []string `json:"allowed_types"`
+		BlockedTypes []string `json:"blocked_types"`
+	}
+	decodeJSON(t, w, &config)
+	if len(config.AllowedTypes) != 0 || !reflect.DeepEqual(config.BlockedTypes, []string{".exe", "application/x-msdownload"}) {
+		t.Errorf("config = %s", w.Body)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// 上传接口单个文件时的响应
+type uploadResponse struct {
+	ID       int    `json:"id"`
+	File     File   `json:"file"`
+	Existing bool   `json:"existing"`
+	Filename string `json:"filename"`
+	Renamed  bool   `json:"renamed"`
+	Hash     string `json:"hash"`
+	Error    struct {
+		Code         string        `json:"code"`
+		ExistingFile *existingFile `json:"existing_file"`
+	} `json:"error"`
+}
+
+func TestUploadCreated(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+
+	w := s.upload(alice, "a.txt", []byte("hello"), nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201: %s", w.Code, w.Body)
+	}
+	var resp uploadResponse
+	decodeJSON(t, w, &resp)
+	if resp.File.ID == 0 || resp.ID != resp.File.ID || resp.File.Name != "a.txt" || resp.File.Size != 5 || resp.File.Hash == "" || resp.Existing {
+		t.Errorf("response = %+v", resp)
+	}
+	location := apiV1Prefix + "/files/" + strconv.Itoa(resp.File.ID)
+	if got := w.Header().Get("Location"); got != location {
+		t.Errorf("Location = %q, want %q", got, location)
+	}
+	if w := s.do(http.MethodGet, location, alice, "", nil); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("GET Location: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestUploadConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		content  string
+		status   int
+		existing bool // 响应为已有文件
+		files    int  // 上传后的文件数
+	}{
+		{"default rejects", nil, "other", http.StatusConflict, false, 1},
+		{"reject", map[string]string{"on_conflict": "reject"}, "hello", http.StatusConflict, false, 1},
+		{"return with the same content", map[string]string{"on_conflict": "return"}, "hello", http.StatusOK, true, 1},
+		{"return with different content", map[string]string{"on_conflict": "return"}, "other", http.StatusConflict, false, 1},
+		{"create", map[string]string{"on_conflict": "create"}, "other", http.StatusCreated, false, 2},
+		{"rename", map[string]string{"on_name_conflict": "rename"}, "other", http.StatusCreated, false, 2},
+		{"invalid", map[string]string{"on_conflict": "skip"}, "other", http.StatusBadRequest, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			alice := s.login("alice")
+			original := uploadTestFile(t, s, alice, "a.txt", "hello")
+
+			w := s.upload(alice, "a.txt", []byte(tt.content), tt.fields)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var resp uploadResponse
+			decodeJSON(t, w, &resp)
+			switch {
+			case tt.status == http.StatusConflict:
+				want := existingFile{ID: original.ID, Name: "a.txt", Hash: original.Hash, HashAlgo: original.HashAlgo}
+				if resp.Error.Code != codeFileExists || resp.Error.ExistingFile == nil || *resp.Error.ExistingFile != want {
+					t.Errorf("conflict response = %s, want existing_file %+v", w.Body, want)
+				}
+			case tt.existing:
+				if !resp.Existing || resp.File.ID != original.ID || w.Header().Get("Location") != "" {
+					t.Errorf("response = %s, want the existing file %d without Location", w.Body, original.ID)
+				}
+			case tt.status == http.StatusCreated:
+				if resp.Existing || resp.File.ID == original.ID {
+					t.Errorf("response = %s, want a new file", w.Body)
+				}
+			}
+			if tt.name == "rename" && (resp.File.Name != "a (1).txt" || !resp.Renamed) {
+				t.Errorf("renamed to %q (renamed %v), want a (1).txt", resp.File.Name, resp.Renamed)
+			}
+
+			var files int
+			if err := s.db.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&files); err != nil {
+				t.Fatal(err)
+			}
+			if files != tt.files {
+				t.Errorf("%d files after the upload, want %d", files, tt.files)
+			}
+		})
+	}
+}
+
+func TestUploadMultipleFilesResults(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.login("alice")
+	existing := uploadTestFile(t, s, alice, "taken.txt", "hello")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{{"new.txt", "new"}, {"taken.txt", "other"}} {
+		part, _ := mw.CreateFormFile("file", f.name)
+		part.Write([]byte(f.content))
+	}
+	mw.Close()
+	w := s.do(http.MethodPost, "/api/v1/upload", alice, mw.FormDataContentType(), &buf)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want 207: %s", w.Code, w.Body)
+	}
+	var results []uploadResult
+	decodeJSON(t, w, &results)
+	if len(results) != 2 || results[0].Status != "uploaded" || results[0].ID == 0 ||
+		results[1].Status != "failed" || results[1].ExistingFile == nil || results[1].ExistingFile.ID != existing.ID {
+		t.Errorf("results = %s", w.Body)
+	}
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 已接收的分片超过上传会话声明的大小
+var errUploadTooLarge = errors.New("upload exceeds declared size")
+
+// 分片上传的限制
+const (
+	maxPartSize  = 64 << 20 // 单个分片的最大字节数
+	maxPartCount = 10000    // 分片编号的最大值
+)
+
+// 断点续传时每次追加的内容按该大小拆分为分片保存
+const streamPartSize = 8 << 20
+
+// 过期上传会话的清理间隔上限
+const uploadCleanupInterval = time.Hour
+
+// UploadSession 分片上传会话
+type UploadSession struct {
+	ID        string    `json:"upload_id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"` // 最近一次收到内容的时间，长时间没有更新的会话会被清理
+	OwnerID   int       `json:"-"`
+}
+
+// UploadPart 已接收的分片
+type UploadPart struct {
+	Number int    `json:"part"`
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`
+}
+
+// 注册分片上传和断点续传相关接口；maxUploadSize 限制合并后文件的大小，合并的内容暂存在 spoolDir 中
+func registerUploadRoutes(r gin.IRouter, db *sql.DB, store Storage, maxUploadSize int64, hashAlgo, spoolDir string) {
+	// 创建分片上传会话
+	r.POST("/uploads", func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+			Hash string `json:"hash"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		name, err := cleanFileName(req.Name)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+		req.Name = name
+		if req.Size <= 0 {
+			renderError(c, invalidRequest("Invalid file size"))
+			return
+		}
+		if req.Size > maxUploadSize || req.Size > maxPartSize*maxPartCount {
+			uploadTooLarge(c, min(maxUploadSize, maxPartSize*maxPartCount))
+			return
+		}
+		if req.Hash != "" && !isValidHash(req.Hash) {
+			renderError(c, invalidRequest("Invalid hash, must be 64 hex characters"))
+			return
+		}
+
+		if err := checkQuota(c.Request.Context(), db, currentUserID(c), req.Size); errors.Is(err, errQuotaExceeded) {
+			quotaExceeded(c, db, currentUserID(c))
+			return
+		} else if err != nil {
+			renderError(c, internalError("Failed to get quota", err))
+			return
+		}
+
+		id, err := newUploadID()
+		if err != nil {
+			renderError(c, internalError("Failed to create upload", err))
+			return
+		}
+		now := time.Now().UTC()
+		session := UploadSession{
+			ID:        id,
+			Name:      req.Name,
+			Size:      req.Size,
+			Hash:      req.Hash,
+			CreatedAt: now,
+			UpdatedAt: now,
+			OwnerID:   currentUserID(c),
+		}
+		if err := addUploadSession(c.Request.Context(), db, session); err != nil {
+			renderError(c, internalError("Failed to create upload", err))
+			return
+		}
+		c.JSON(http.StatusCreated, session)
+	})
+
+	// 查询分片上传会话及已接收的分片
+	r.GET("/uploads/:id", func(c *gin.Context) {
+		session, err := getUploadSession(c.Request.Context(), db, currentUserID(c), c.Param("id"))
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Upload not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get upload", err))
+			return
+		}
+		parts, err := getUploadParts(c.Request.Context(), db, session.ID)
+		if err != nil {
+			renderError(c, internalError("Failed to get upload", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"upload": session,
+			"parts":  parts,
+		})
+	})
+
+	// 查询断点续传的进度：Upload-Offset 为从开头起连续收到的字节数，Upload-Length 为声明的总大小
+	r.HEAD("/uploads/:id", func(c *gin.Context) {
+		session, err := getUploadSession(c.Request.Context(), db, currentUserID(c), c.Param("id"))
+		if err == sql.ErrNoRows {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		parts, err := getUploadParts(c.Request.Context(), db, session.ID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		offset, _, _ := uploadProgress(parts)
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+		c.Header("Cache-Control", "no-store")
+		c.Status(http.StatusOK)
+	})
+
+	// 断点续传：从当前偏移量追加内容，起始位置通过 Upload-Offset 或 Content-Range 请求头声明，
+	// 与已收到的字节数不一致时返回 409 和正确的偏移量。连接中断时已收到的内容会保留，
+	// 收到最后一个字节后合并保存为文件
+	r.PATCH("/uploads/:id", func(c *gin.Context) {
+		defer trackUpload()()
+		detachDeadline(c)
+		session, err := getUploadSession(c.Request.Context(), db, currentUserID(c), c.Param("id"))
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Upload not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get upload", err))
+			return
+		}
+		start, length, err := appendRange(c, session.Size)
+		if err != nil {
+			renderError(c, invalidRequest(err.Error()))
+			return
+		}
+
+		parts, err := getUploadParts(c.Request.Context(), db, session.ID)
+		if err != nil {
+			renderError(c, internalError("Failed to get upload", err))
+			return
+		}
+		offset, next, missing := uploadProgress(parts)
+		if len(missing) > 0 {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Upload has missing parts, upload them with PUT /uploads/:id/parts/:n").with(gin.H{"missing_parts": missing}))
+			return
+		}
+		if start != offset {
+			uploadOffsetMismatch(c, offset)
+			return
+		}
+		remaining := session.Size - offset
+		if length > remaining {
+			renderError(c, newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge, "Upload exceeds declared size").with(gin.H{"offset": offset, "size": session.Size}))
+			return
+		}
+		if length >= 0 {
+			remaining = length
+		}
+
+		offset, err = appendUploadParts(c.Request.Context(), db, session.ID, session.Size, next, offset, io.LimitReader(c.Request.Body, remaining))
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		if isUniqueViolation(err) {
+			// 同一会话的并发追加，以先保存的为准
+			parts, err := getUploadParts(c.Request.Context(), db, session.ID)
+			if err != nil {
+				renderError(c, internalError("Failed to get upload", err))
+				return
+			}
+			offset, _, _ := uploadProgress(parts)
+			uploadOffsetMismatch(c, offset)
+			return
+		}
+		if errors.Is(err, errInsufficientStorage) {
+			renderError(c, internalError("Failed to read upload", err).with(gin.H{"offset": offset}))
+			return
+		}
+		if errors.Is(err, errUploadTooLarge) {
+			renderError(c, newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge, "Upload exceeds declared size").with(gin.H{"offset": offset, "size": session.Size}))
+			return
+		}
+		if err != nil {
+			renderError(c, invalidRequest("Failed to read upload").with(gin.H{"offset": offset}))
+			return
+		}
+		if offset < session.Size {
+			c.JSON(http.StatusOK, gin.H{
+				"upload_id": session.ID,
+				"offset":    offset,
+				"size":      session.Size,
+			})
+			return
+		}
+
+		parts, err = getUploadParts(c.Request.Context(), db, session.ID)
+		if err != nil {
+			renderError(c, internalError("Failed to get upload", err))
+			return
+		}
+		finishUpload(c, db, store, session, parts, hashAlgo, spoolDir)
+	})
+
+	// 上传单个分片；分片可以乱序上传，重复上传同一编号的分片会覆盖之前的内容。
+	// 设置 X-Content-SHA256 请求头时校验分片的哈希，不一致时不保存；所有分片之和超过会话声明的大小时返回 413。
+	// 声明的大小在创建会话时已检查过上传大小限制和配额
+	r.PUT("/uploads/:id/parts/:n", func(c *gin.Context) {
+		defer trackUpload()()
+		detachDeadline(c)
+		n, err := strconv.Atoi(c.Param("n"))
+		if err != nil || n < 1 || n > maxPartCount {
+			renderError(c, invalidRequest("Invalid part number"))
+			return
+		}
+		expectedHash := strings.ToLower(c.GetHeader(contentSHA256Header))
+		if expectedHash != "" && !isValidHash(expectedHash) {
+			renderError(c, invalidRequest("Invalid hash, must be 64 hex characters"))
+			return
+		}
+
+		session, err := getUploadSession(c.Request.Context(), db, currentUserID(c), c.Param("id"))
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Upload not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get upload", err))
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPartSize+1))
+		if errors.Is(err, errInsufficientStorage) {
+			renderError(c, internalError("Failed to read part", err))
+			return
+		}
+		if err != nil {
+			renderError(c, invalidRequest("Failed to read part"))
+			return
+		}
+		if len(data) == 0 {
+			renderError(c, invalidRequest("Part must not be empty"))
+			return
+		}
+		if len(data) > maxPartSize {
+			renderError(c, newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge, "Part is too large"))
+			return
+		}
+
+		hash, _ := calculateHash(bytes.NewReader(data))
+		if expectedHash != "" && expectedHash != hash {
+			renderError(c, newAPIError(http.StatusUnprocessableEntity, codeHashMismatch, "Hash does not match").with(gin.H{
+				"part":          n,
+				"expected_hash": expectedHash,
+				"actual_hash":   hash,
+			}))
+			return
+		}
+		part := UploadPart{Number: n, Size: int64(len(data)), Hash: hash}
+		err = putUploadPart(c.Request.Context(), db, session.ID, part, data, false, session.Size)
+		if errors.Is(err, errUploadTooLarge) {
+			renderError(c, newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge, "Parts exceed the declared upload size").with(gin.H{"part": n, "size": session.Size}))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to save part", err))
+			return
+		}
+		c.JSON(http.StatusOK, part)
+	})
+
+	// 合并所有分片，校验哈希后保存为文件
+	r.POST("/uploads/:id/complete", func(c *gin.Context) {
+		session, err := getUploadSession(c.Request.Context(), db, currentUserID(c), c.Param("id"))
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Upload not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get upload", err))
+			return
+		}
+		parts, err := getUploadParts(c.Request.Context(), db, session.ID)
+		if err != nil {
+			renderError(c, internalError("Failed to get upload", err))
+			return
+		}
+
+		// 分片编号必须从 1 开始连续，且总大小与声明的一致
+		var size int64
+		missing := []int{}
+		next := 1
+		for _, part := range parts {
+			for ; next < part.Number; next++ {
+				missing = append(missing, next)
+			}
+			next = part.Number + 1
+			size += part.Size
+		}
+		if len(parts) == 0 || len(missing) > 0 {
+			renderError(c, invalidRequest("Upload has missing parts").with(gin.H{"missing_parts": missing}))
+			return
+		}
+		if size != session.Size {
+			renderError(c, invalidRequest("Uploaded size does not match declared size").with(gin.H{
+				"size":          size,
+				"declared_size": session.Size,
+			}))
+			return
+		}
+		// 合并分片的时间取决于上传的大小
+		detachDeadline(c)
+		finishUpload(c, db, store, session, parts, hashAlgo, spoolDir)
+	})
+
+	// 取消分片上传
+	r.DELETE("/uploads/:id", func(c *gin.Context) {
+		err := deleteUploadSession(c.Request.Context(), db, currentUserID(c), c.Param("id"))
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Upload not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to delete upload", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Upload cancelled"})
+	})
+}
+
+// 按编号顺序合并分片，校验哈希后保存为文件并删除上传会话，写入响应
+func finishUpload(c *gin.Context, db *sql.DB, store Storage, session UploadSession, parts []UploadPart, hashAlgo, spoolDir string) {
+	// 追加内容的请求也可能完成上传
+	setAuditAction(c, "upload")
+	ctx := c.Request.Context()
+	// 分片上传没有声明的类型，根据内容和扩展名检测
+	content, err := spoolContent(&partsReader{ctx: ctx, db: db, uploadID: session.ID, parts: parts}, spoolDir, hashAlgo, spoolMemoryLimit)
+	if err != nil {
+		renderError(c, internalError("Failed to read upload", err))
+		return
+	}
+	defer content.Close()
+	body, err := content.reader()
+	if err != nil {
+		renderError(c, internalError("Failed to read upload", err))
+		return
+	}
+	mimeType, _, err := detectContentType(body, "", session.Name)
+	if err != nil {
+		renderError(c, internalError("Failed to read upload", err))
+		return
+	}
+	file, err := storeSpooled(ctx, db, store, File{
+		HashAlgo:  hashAlgo,
+		Name:      session.Name,
+		Size:      session.Size,
+		Mime:      mimeType,
+		CreatedAt: time.Now().UTC(),
+		OwnerID:   session.OwnerID,
+	}, content, session.Hash, false)
+	if e := uploadRejectedError(err); e != nil {
+		renderError(c, e)
+		return
+	}
+	if errors.Is(err, errHashMismatch) {
+		renderError(c, newAPIError(http.StatusUnprocessableEntity, codeHashMismatch, "Hash does not match").with(gin.H{
+			"expected_hash": session.Hash,
+			"actual_hash":   file.Hash,
+		}))
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		quotaExceeded(c, db, session.OwnerID)
+		return
+	}
+	if err != nil {
+		renderError(c, internalError("Failed to save file", err))
+		return
+	}
+	addAuditFile(c, file)
+
+	if err := deleteUploadSession(ctx, db, session.OwnerID, session.ID); err != nil {
+		renderError(c, internalError("Failed to clean up upload", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "File uploaded successfully",
+		"filename":  file.Name,
+		"hash":      file.Hash,
+		"hash_algo": file.HashAlgo,
+		"size":      file.Size,
+		"mime":      file.Mime,
+		"verified":  session.Hash != "",
+	})
+}
+
+// 返回从第 1 个分片起连续收到的字节数、下一个分片的编号，以及之后的分片之前缺少的分片编号
+func uploadProgress(parts []UploadPart) (int64, int, []int) {
+	var offset int64
+	next := 1
+	for _, part := range parts {
+		if part.Number != next {
+			break
+		}
+		offset += part.Size
+		next++
+	}
+	var missing []int
+	for _, part := range parts {
+		for ; next < part.Number; next++ {
+			missing = append(missing, next)
+		}
+		if part.Number >= next {
+			next = part.Number + 1
+		}
+	}
+	if len(missing) > 0 {
+		return offset, 0, missing
+	}
+	return offset, next, nil
+}
+
+// 读取追加内容的起始位置和长度，长度未知时为 -1。Upload-Offset 优先于 Content-Range，
+// Content-Range 中的总大小需与声明的一致
+func appendRange(c *gin.Context, size int64) (int64, int64, error) {
+	length := c.Request.ContentLength
+	if v := c.GetHeader("Upload-Offset"); v != "" {
+		start, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || start < 0 {
+			return 0, 0, errors.New("Invalid Upload-Offset header, must be a non-negative integer")
+		}
+		return start, length, nil
+	}
+	v := c.GetHeader("Content-Range")
+	if v == "" {
+		return 0, 0, errors.New("Upload-Offset or Content-Range header is required")
+	}
+	invalid := errors.New("Invalid Content-Range header, must be bytes start-end/size")
+	spec, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return 0, 0, invalid
+	}
+	byteRange, total, ok := strings.Cut(spec, "/")
+	if !ok || (total != "*" && total != strconv.FormatInt(size, 10)) {
+		return 0, 0, invalid
+	}
+	first, last, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, 0, invalid
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, invalid
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start || (length >= 0 && length != end-start+1) {
+		return 0, 0, invalid
+	}
+	return start, end - start + 1, nil
+}
+
+// 追加的起始位置与已收到的字节数不一致
+func uploadOffsetMismatch(c *gin.Context, offset int64) {
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	renderError(c, newAPIError(http.StatusConflict, codeConflict, "Upload offset does not match").with(gin.H{"offset": offset}))
+}
+
+// 从 r 读取内容，按 streamPartSize 保存为编号从 next 开始的分片，返回保存后的偏移量。
+// 读取失败（如连接中断）时之前读到的内容仍会保存；分片编号已被并发的追加占用时返回唯一约束错误，
+// 分片之和超过 limit 时返回 errUploadTooLarge
+func appendUploadParts(ctx context.Context, db *sql.DB, uploadID string, limit int64, next int, offset int64, r io.Reader) (int64, error) {
+	buf := make([]byte, streamPartSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			data := buf[:n]
+			hash, _ := calculateHash(bytes.NewReader(data))
+			part := UploadPart{Number: next, Size: int64(n), Hash: hash}
+			if err := putUploadPart(ctx, db, uploadID, part, data, true, limit); err != nil {
+				return offset, err
+			}
+			offset += int64(n)
+			next++
+		}
+		switch readErr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return offset, nil
+		default:
+			return offset, readErr
+		}
+	}
+}
+
+// 定期清理超过 expiry 没有收到内容的上传会话，expiry 为 0 时不清理
+func cleanupUploads(ctx context.Context, db *sql.DB, expiry time.Duration) {
+	if expiry == 0 {
+		return
+	}
+	ticker := time.NewTicker(min(expiry, uploadCleanupInterval))
+	defer ticker.Stop()
+	for {
+		n, err := deleteExpiredUploads(ctx, db, time.Now().UTC().Add(-expiry))
+		if err != nil {
+			slog.Error("Failed to clean up expired uploads", "error", err)
+		} else if n > 0 {
+			slog.Info("Cleaned up expired uploads", "uploads", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 删除 before 之前最后一次收到内容的上传会话及其分片，返回删除的会话数
+func deleteExpiredUploads(ctx context.Context, db *sql.DB, before time.Time) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	partsQuery := `DELETE FROM upload_parts WHERE upload_id IN (SELECT id FROM upload_sessions WHERE updated_at < ?)`
+	if _, err := tx.ExecContext(ctx, partsQuery, before); err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM upload_sessions WHERE updated_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// 按编号顺序依次读取分片内容，每次只在内存中保留一个分片
+type partsReader struct {
+	ctx      context.Context
+	db       *sql.DB
+	uploadID string
+	parts    []UploadPart
+	current  *bytes.Reader
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for r.current == nil || r.current.Len() == 0 {
+		if len(r.parts) == 0 {
+			return 0, io.EOF
+		}
+		data, err := getUploadPartData(r.ctx, r.db, r.uploadID, r.parts[0].Number)
+		if err != nil {
+			return 0, err
+		}
+		r.current = bytes.NewReader(data)
+		r.parts = r.parts[1:]
+	}
+	return r.current.Read(p)
+}
+
+// 生成随机的上传会话 id
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// 添加分片上传会话
+func addUploadSession(ctx context.Context, db *sql.DB, session UploadSession) error {
+	insertQuery := `INSERT INTO upload_sessions (id, name, size, hash, created_at, updated_at, owner_id) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.ExecContext(ctx, insertQuery, session.ID, session.Name, session.Size, session.Hash, session.CreatedAt, session.UpdatedAt, session.OwnerID)
+	return err
+}
+
+// 获取用户的分片上传会话；不存在或不属于该用户时返回 sql.ErrNoRows
+func getUploadSession(ctx context.Context, db *sql.DB, ownerID int, id string) (UploadSession, error) {
+	var session UploadSession
+	query := `SELECT id, name, size, hash, created_at, updated_at, owner_id FROM upload_sessions WHERE id = ? AND owner_id = ?`
+	err := db.QueryRowContext(ctx, query, id, ownerID).Scan(&session.ID, &session.Name, &session.Size, &session.Hash, &session.CreatedAt, &session.UpdatedAt, &session.OwnerID)
+	return session, err
+}
+
+// 删除用户的分片上传会话及其所有分片；不存在时返回 sql.ErrNoRows
+func deleteUploadSession(ctx context.Context, db *sql.DB, ownerID int, id string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM upload_sessions WHERE id = ? AND owner_id = ?`, id, ownerID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM upload_parts WHERE upload_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 保存分片并更新会话的活动时间；同一编号的分片已存在时，appendOnly 为 true 则返回唯一约束错误，否则覆盖。
+// 所有分片的大小之和超过 limit（会话声明的大小）时不保存并返回 errUploadTooLarge
+func putUploadPart(ctx context.Context, db *sql.DB, uploadID string, part UploadPart, data []byte, appendOnly bool, limit int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insertQuery := `INSERT INTO upload_parts (upload_id, part_number, size, hash, data) VALUES (?, ?, ?, ?, ?)`
+	if !appendOnly {
+		insertQuery += ` ON CONFLICT (upload_id, part_number) DO UPDATE SET size = excluded.size, hash = excluded.hash, data = excluded.data`
+	}
+	if _, err := tx.ExecContext(ctx, insertQuery, uploadID, part.Number, part.Size, part.Hash, data); err != nil {
+		return err
+	}
+	// 写入后在同一事务中统计，已持有写锁，并发上传的分片不会同时通过检查
+	var total int64
+	if err := tx.QueryRowContext(ctx, `SELECT IFNULL(SUM(size), 0) FROM upload_parts WHERE upload_id = ?`, uploadID).Scan(&total); err != nil {
+		return err
+	}
+	if total > limit {
+		return errUploadTooLarge
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE upload_sessions SET updated_at = ? WHERE id = ?`, time.Now().UTC(), uploadID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 按编号顺序获取已接收的分片信息
+func getUploadParts(ctx context.Context, db *sql.DB, uploadID string) ([]UploadPart, error) {
+	rows, err := db.QueryContext(ctx, `SELECT part_number, size, hash FROM upload_parts WHERE upload_id = ? ORDER BY part_number`, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := []UploadPart{}
+	for rows.Next() {
+		var part UploadPart
+		if err := rows.Scan(&part.Number, &part.Size, &part.Hash); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
+
+// 获取分片内容
+func getUploadPartData(ctx context.Context, db *sql.DB, uploadID string, n int) ([]byte, error) {
+	var data []byte
+	query := `SELECT data FROM upload_parts WHERE upload_id = ? AND part_number = ?`
+	err := db.QueryRowContext(ctx, query, uploadID, n).Scan(&data)
+	return data, err
+}
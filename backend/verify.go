@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 校验时每次从数据库读取的内容数
+const verifyBatchSize = 100
+
+// 保留的已结束校验任务数，更早的任务被丢弃
+const maxFinishedVerifyJobs = 20
+
+// 校验任务的状态
+const (
+	verifyRunning   = "running"
+	verifyCompleted = "completed"
+	verifyFailed    = "failed"
+)
+
+// 校验发现的问题类型
+const (
+	problemMissing    = "missing"       // 存储后端中没有该内容
+	problemUnreadable = "unreadable"    // 读取内容失败
+	problemMismatch   = "hash_mismatch" // 内容的哈希与记录的不一致
+	problemSize       = "size_mismatch" // 内容的大小与记录的不一致
+)
+
+// VerifyJob 内容校验任务及其进度
+type VerifyJob struct {
+	ID           string          `json:"id"`
+	Status       string          `json:"status"`
+	Since        *time.Time      `json:"since,omitempty"`
+	Limit        int             `json:"limit,omitempty"`
+	Total        int             `json:"total"`
+	Checked      int             `json:"checked"`
+	CheckedBytes int64           `json:"checked_bytes"`
+	Problems     []VerifyProblem `json:"problems"`
+	Error        string          `json:"error,omitempty"`
+	StartedAt    time.Time       `json:"started_at"`
+	FinishedAt   *time.Time      `json:"finished_at,omitempty"`
+}
+
+// VerifyProblem 校验失败的内容及引用该内容的文件
+type VerifyProblem struct {
+	Hash       string         `json:"hash"`
+	HashAlgo   string         `json:"hash_algo"`
+	Size       int64          `json:"size"`
+	Problem    string         `json:"problem"`
+	ActualHash string         `json:"actual_hash,omitempty"`
+	ActualSize *int64         `json:"actual_size,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Files      []AffectedFile `json:"files"`
+}
+
+// AffectedFile 引用了校验失败内容的文件，包括内容为其历史版本的文件
+type AffectedFile struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	OwnerID int    `json:"owner_id"`
+}
+
+// 保存在内存中的校验任务，同一时间只运行一个
+type verifyJobs struct {
+	mu       sync.Mutex
+	jobs     map[string]*VerifyJob
+	finished []string // 已结束的任务 id，按结束顺序
+	running  string
+}
+
+// 待校验的内容
+type verifyBlob struct {
+	key  string
+	size int64
+}
+
+// 注册内容校验接口，仅管理员可以访问
+func registerVerifyRoutes(admin gin.IRouter, db *sql.DB, store Storage) {
+	jobs := &verifyJobs{jobs: map[string]*VerifyJob{}}
+
+	// 在后台重新计算所有内容的哈希，立即返回任务；
+	// since 只校验该时间之后保存的内容，limit 限制校验的内容数，用于分批校验
+	admin.POST("/verify", func(c *gin.Context) {
+		job := &VerifyJob{Problems: []VerifyProblem{}}
+		if s := c.Query("since"); s != "" {
+			since, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				renderError(c, invalidRequest("Invalid since, must be an RFC 3339 time"))
+				return
+			}
+			since = since.UTC()
+			job.Since = &since
+		}
+		if s := c.Query("limit"); s != "" {
+			limit, err := strconv.Atoi(s)
+			if err != nil || limit <= 0 {
+				renderError(c, invalidRequest("Invalid limit, must be a positive integer"))
+				return
+			}
+			job.Limit = limit
+		}
+
+		id, err := newUploadID()
+		if err != nil {
+			renderError(c, internalError("Failed to create verification job", err))
+			return
+		}
+		job.ID = id
+		job.Status = verifyRunning
+		job.StartedAt = time.Now().UTC()
+		if running, ok := jobs.start(job); !ok {
+			renderError(c, newAPIError(http.StatusConflict, codeConflict, "Verification is already running").with(gin.H{"job": running}))
+			return
+		}
+		slog.Info("Started content verification", "job", job.ID)
+		go jobs.run(context.Background(), db, store, job.ID)
+		c.JSON(http.StatusAccepted, jobs.get(job.ID))
+	})
+
+	// 获取校验任务的进度和发现的问题
+	admin.GET("/verify/:job", func(c *gin.Context) {
+		job := jobs.get(c.Param("job"))
+		if job == nil {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Verification job not found"))
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	})
+}
+
+// 记录新任务；已有任务在运行时返回该任务的副本和 false
+func (j *verifyJobs) start(job *VerifyJob) (*VerifyJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running != "" {
+		return j.copy(j.running), false
+	}
+	j.jobs[job.ID] = job
+	j.running = job.ID
+	return nil, true
+}
+
+// 返回任务的副本，不存在时返回 nil
+func (j *verifyJobs) get(id string) *VerifyJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.copy(id)
+}
+
+// 复制任务，避免返回的任务被后台的校验修改；调用方需要持有 mu
+func (j *verifyJobs) copy(id string) *VerifyJob {
+	job, ok := j.jobs[id]
+	if !ok {
+		return nil
+	}
+	c := *job
+	c.Problems = append([]VerifyProblem{}, job.Problems...)
+	return &c
+}
+
+// 在锁内更新任务
+func (j *verifyJobs) update(id string, fn func(job *VerifyJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(j.jobs[id])
+}
+
+// 结束任务，只保留最近 maxFinishedVerifyJobs 个已结束的任务
+func (j *verifyJobs) finish(id string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.jobs[id]
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	job.Status = verifyCompleted
+	if err != nil {
+		job.Status = verifyFailed
+		job.Error = err.Error()
+	}
+	j.running = ""
+	j.finished = append(j.finished, id)
+	if len(j.finished) > maxFinishedVerifyJobs {
+		delete(j.jobs, j.finished[0])
+		j.finished = j.finished[1:]
+	}
+}
+
+// 逐批读取并校验内容。每批单独查询，不在整个过程中持有事务，也不锁定内容，上传和删除可以同时进行
+func (j *verifyJobs) run(ctx context.Context, db *sql.DB, store Storage, id string) {
+	job := j.get(id)
+	err := func() error {
+		total, err := countVerifyBlobs(ctx, db, job.Since)
+		if err != nil {
+			return err
+		}
+		if job.Limit > 0 && total > job.Limit {
+			total = job.Limit
+		}
+		j.update(id, func(job *VerifyJob) { job.Total = total })
+
+		after, checked := "", 0
+		for checked < total {
+			batch, err := nextVerifyBlobs(ctx, db, job.Since, after, min(verifyBatchSize, total-checked))
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				break
+			}
+			for _, blob := range batch {
+				problem, err := verifyBlobContent(ctx, db, store, blob)
+				if err != nil {
+					return err
+				}
+				checked++
+				j.update(id, func(job *VerifyJob) {
+					job.Checked++
+					job.CheckedBytes += blob.size
+					if problem != nil {
+						job.Problems = append(job.Problems, *problem)
+					}
+				})
+			}
+			after = batch[len(batch)-1].key
+		}
+		return nil
+	}()
+	j.finish(id, err)
+
+	job = j.get(id)
+	if err != nil {
+		slog.Error("Content verification failed", "job", id, "checked", job.Checked, "error", err)
+		return
+	}
+	slog.Info("Finished content verification", "job", id, "checked", job.Checked, "problems", len(job.Problems))
+}
+
+// 统计需要校验的内容数
+func countVerifyBlobs(ctx context.Context, db *sql.DB, since *time.Time) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM blobs WHERE (? IS NULL OR created_at >= ?)`, since, since).Scan(&count)
+	return count, err
+}
+
+// 按键的顺序读取 after 之后的一批内容
+func nextVerifyBlobs(ctx context.Context, db *sql.DB, since *time.Time, after string, limit int) ([]verifyBlob, error) {
+	query := `SELECT hash, size FROM blobs WHERE hash > ? AND (? IS NULL OR created_at >= ?) ORDER BY hash LIMIT ?`
+	rows, err := db.QueryContext(ctx, query, after, since, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var blobs []verifyBlob
+	for rows.Next() {
+		var b verifyBlob
+		if err := rows.Scan(&b.key, &b.size); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, rows.Err()
+}
+
+// 重新计算内容的哈希并与记录比较，一致时返回 nil。
+// 校验期间内容可能已被删除，因此发现问题后再次确认记录仍然存在
+func verifyBlobContent(ctx context.Context, db *sql.DB, store Storage, blob verifyBlob) (*VerifyProblem, error) {
+	algo, digest := splitBlobKey(blob.key)
+	problem := &VerifyProblem{Hash: digest, HashAlgo: algo, Size: blob.size}
+
+	content, _, err := store.Get(ctx, blob.key)
+	if err == nil {
+		var actual string
+		var size int64
+		actual, size, err = copyAndHash(io.Discard, content, algo)
+		content.Close()
+		switch {
+		case err != nil:
+		case actual != digest:
+			problem.Problem, problem.ActualHash = problemMismatch, actual
+		case size != blob.size:
+			problem.Problem, problem.ActualSize = problemSize, &size
+		default:
+			return nil, nil
+		}
+	}
+	if errors.Is(err, errBlobNotFound) {
+		problem.Problem = problemMissing
+	} else if err != nil {
+		problem.Problem, problem.Error = problemUnreadable, err.Error()
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM blobs WHERE hash = ?)`, blob.key).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	problem.Files, err = blobFiles(ctx, db, algo, digest)
+	if err != nil {
+		return nil, err
+	}
+	return problem, nil
+}
+
+// 获取当前内容或历史版本使用该内容的文件，包括回收站中的文件
+func blobFiles(ctx context.Context, db *sql.DB, algo, digest string) ([]AffectedFile, error) {
+	query := `
+	SELECT id, name, owner_id FROM files WHERE hash_algo = ? AND hash = ?
+	UNION
+	SELECT files.id, files.name, files.owner_id FROM file_versions JOIN files ON files.id = file_versions.file_id
+	WHERE file_versions.hash_algo = ? AND file_versions.hash = ?
+	ORDER BY id`
+	rows, err := db.QueryContext(ctx, query, algo, digest, algo, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := []AffectedFile{}
+	for rows.Next() {
+		var f AffectedFile
+		if err := rows.Scan(&f.ID, &f.Name, &f.OwnerID); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文件存在但没有指定的版本
+var errVersionNotFound = errors.New("version not found")
+
+// FileVersion 文件的一个版本；当前版本保存在 files 表中，其余保存在 file_versions 表中
+type FileVersion struct {
+	ID        int       `json:"-"`
+	FileID    int       `json:"file_id"`
+	Version   int       `json:"version"`
+	Hash      string    `json:"hash"`
+	HashAlgo  string    `json:"hash_algo"`
+	Size      int64     `json:"size"`
+	Mime      string    `json:"mime"`
+	CreatedAt time.Time `json:"created_at"` // 该版本的上传时间
+	Current   bool      `json:"current"`
+}
+
+// 查询历史版本时选取的字段，与 scanVersion 的顺序一致
+const versionColumns = "id, file_id, version, hash, size, mime, created_at, hash_algo"
+
+// 注册文件版本接口；maxVersions 限制每个文件保留的版本数，0 表示不限制
+func registerVersionRoutes(r gin.IRouter, db *sql.DB, store Storage, maxVersions int) {
+	repo := newFileRepository(db)
+
+	// 列出文件的所有版本，当前版本在前
+	r.GET("/files/:id/versions", func(c *gin.Context) {
+		file, ok := fileParam(c, repo)
+		if !ok {
+			return
+		}
+		versions, err := listVersions(c.Request.Context(), db, file)
+		if err != nil {
+			renderError(c, internalError("Failed to get versions", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"file_id":  file.ID,
+			"versions": versions,
+		})
+	})
+
+	// 下载文件的指定版本
+	r.GET("/files/:id/versions/:v", func(c *gin.Context) {
+		file, ok := fileParam(c, repo)
+		if !ok {
+			return
+		}
+		v, err := strconv.Atoi(c.Param("v"))
+		if err != nil || v < 1 {
+			renderError(c, invalidRequest("Invalid version"))
+			return
+		}
+		// 版本号对应的内容不会变化
+		if v == file.Version {
+			c.Header("Cache-Control", cacheImmutable)
+			serveFile(c, store, file)
+			return
+		}
+
+		version, err := getVersion(c.Request.Context(), db, file.ID, v)
+		if err == sql.ErrNoRows {
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Version not found"))
+			return
+		}
+		if err != nil {
+			renderError(c, internalError("Failed to get version", err))
+			return
+		}
+		// 以文件当前的名称返回历史版本的内容
+		file.Hash, file.HashAlgo, file.Size, file.Mime, file.UpdatedAt = version.Hash, version.HashAlgo, version.Size, version.Mime, version.CreatedAt
+		if file.ScanStatus, _, err = contentScanStatus(c.Request.Context(), db, file.blobKey()); err != nil {
+			renderError(c, internalError("Failed to get version", err))
+			return
+		}
+		c.Header("Cache-Control", cacheImmutable)
+		serveFile(c, store, file)
+	})
+
+	// 将历史版本恢复为当前版本；恢复的内容作为新的版本号保存，原当前版本成为历史版本
+	r.POST("/files/:id/versions/:v/restore", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderError(c, invalidRequest("Invalid file id"))
+			return
+		}
+		v, err := strconv.Atoi(c.Param("v"))
+		if err != nil || v < 1 {
+			renderError(c, invalidRequest("Invalid version"))
+			return
+		}
+
+		ownerID := currentUserID(c)
+		file, err := restoreVersion(c.Request.Context(), db, ownerID, id, v)
+		switch {
+		case err == sql.ErrNoRows:
+			renderError(c, newAPIError(http.StatusNotFound, codeFileNotFound, "File not found"))
+			return
+		case errors.Is(err, errVersionNotFound):
+			renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Version not found"))
+			return
+		case errors.Is(err, errQuotaExceeded):
+			quotaExceeded(c, db, ownerID)
+			return
+		case err != nil:
+			renderError(c, internalError("Failed to restore version", err))
+			return
+		}
+		pruneVersions(c.Request.Context(), db, store, file, maxVersions)
+		c.JSON(http.StatusOK, file)
+	})
+}
+
+// 获取文件的所有版本，按版本号倒序，第一个为当前版本
+func listVersions(ctx context.Context, db *sql.DB, file File) ([]FileVersion, error) {
+	versions := []FileVersion{{
+		FileID:    file.ID,
+		Version:   file.Version,
+		Hash:      file.Hash,
+		HashAlgo:  file.HashAlgo,
+		Size:      file.Size,
+		Mime:      file.Mime,
+		CreatedAt: file.UpdatedAt,
+		Current:   true,
+	}}
+	rows, err := db.QueryContext(ctx, `SELECT `+versionColumns+` FROM file_versions WHERE file_id = ? ORDER BY version DESC`, file.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		version, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// 获取文件的一个历史版本；不存在时返回 sql.ErrNoRows
+func getVersion(ctx context.Context, db *sql.DB, fileID, v int) (FileVersion, error) {
+	query := `SELECT ` + versionColumns + ` FROM file_versions WHERE file_id = ? AND version = ?`
+	return scanVersion(db.QueryRowContext(ctx, query, fileID, v))
+}
+
+// 按 versionColumns 的顺序读取一行历史版本
+func scanVersion(row interface{ Scan(...any) error }) (FileVersion, error) {
+	var v FileVersion
+	err := row.Scan(&v.ID, &v.FileID, &v.Version, &v.Hash, &v.Size, &v.Mime, &v.CreatedAt, &v.HashAlgo)
+	return v, err
+}
+
+// 将 file 保存为 file.ID 的新版本，原当前版本转为历史版本，返回新的版本号；内容尚未存储时从 content 读取并保存。
+// file.CreatedAt 为新版本的上传时间；文件不存在或在回收站中时返回 sql.ErrNoRows，
+// 超过配额时返回 errQuotaExceeded
+func addVersion(ctx context.Context, db *sql.DB, store Storage, file File, content io.Reader) (int, error) {
+	unlock := lockContent(file.blobKey())
+	defer unlock()
+	created, err := putContent(ctx, store, file.blobKey(), content)
+	if err != nil {
+		return 0, err
+	}
+	version, err := updateFileVersion(ctx, db, file)
+	if err != nil && created {
+		discardContent(store, file.blobKey())
+	}
+	return version, err
+}
+
+// 在事务中归档当前版本并将文件记录更新为新版本
+func updateFileVersion(ctx context.Context, db *sql.DB, file File) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := archiveCurrentVersion(ctx, tx, file.OwnerID, file.ID); err != nil {
+		return 0, err
+	}
+	if err := reserveQuota(ctx, tx, file.OwnerID, file.Size); err != nil {
+		return 0, err
+	}
+	if err := acquireBlob(ctx, tx, file.blobKey(), file.Size); err != nil {
+		return 0, err
+	}
+
+	var version int
+	// 上传新版本时指定了过期时间则一并更新
+	updateQuery := `UPDATE files SET hash = ?, hash_algo = ?, size = ?, mime = ?, version = version + 1, updated_at = ?, expires_at = IFNULL(?, expires_at) WHERE id = ? RETURNING version`
+	if err := tx.QueryRowContext(ctx, updateQuery, file.Hash, file.HashAlgo, file.Size, file.Mime, file.CreatedAt, file.ExpiresAt, file.ID).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+// 将历史版本的内容恢复为文件的当前版本，返回更新后的文件信息；v 已是当前版本或内容相同时不做修改。
+// 文件不存在时返回 sql.ErrNoRows，版本不存在时返回 errVersionNotFound，超过配额时返回 errQuotaExceeded
+func restoreVersion(ctx context.Context, db *sql.DB, ownerID, id, v int) (File, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return File{}, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NULL`
+	file, err := scanFile(tx.QueryRowContext(ctx, query, id, ownerID))
+	if err != nil {
+		return File{}, err
+	}
+	if v == file.Version {
+		return file, nil
+	}
+	version, err := scanVersion(tx.QueryRowContext(ctx, `SELECT `+versionColumns+` FROM file_versions WHERE file_id = ? AND version = ?`, id, v))
+	if err == sql.ErrNoRows {
+		return File{}, errVersionNotFound
+	}
+	if err != nil {
+		return File{}, err
+	}
+	if version.HashAlgo == file.HashAlgo && version.Hash == file.Hash {
+		return file, nil
+	}
+
+	if err := archiveCurrentVersion(ctx, tx, ownerID, id); err != nil {
+		return File{}, err
+	}
+	// 恢复的内容单独计入配额和引用，原历史版本仍然保留
+	if err := reserveQuota(ctx, tx, ownerID, version.Size); err != nil {
+		return File{}, err
+	}
+	if _, err := retainBlob(ctx, tx, blobKey(version.HashAlgo, version.Hash)); err != nil {
+		return File{}, err
+	}
+	updateQuery := `UPDATE files SET hash = ?, hash_algo = ?, size = ?, mime = ?, version = version + 1, updated_at = ? WHERE id = ? RETURNING ` + fileColumns
+	file, err = scanFile(tx.QueryRowContext(ctx, updateQuery, version.Hash, version.HashAlgo, version.Size, version.Mime, time.Now().UTC(), id))
+	if err != nil {
+		return File{}, err
+	}
+	return file, tx.Commit()
+}
+
+// 将文件的当前版本复制为历史版本，内容的引用由当前版本转给历史版本；
+// 文件不存在或在回收站中时返回 sql.ErrNoRows
+func archiveCurrentVersion(ctx context.Context, tx *sql.Tx, ownerID, id int) error {
+	insertQuery := `INSERT INTO file_versions (file_id, version, hash, hash_algo, size, mime, created_at)
+	SELECT id, version, hash, hash_algo, size, mime, updated_at FROM files WHERE id = ? AND owner_id = ? AND deleted_at IS NULL`
+	result, err := tx.ExecContext(ctx, insertQuery, id, ownerID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// 删除文件的所有历史版本并释放其内容引用，返回被删除版本的总大小和已没有引用的内容，配额由调用方释放
+func deleteVersions(ctx context.Context, tx *sql.Tx, fileID int) (int64, []string, error) {
+	rows, err := tx.QueryContext(ctx, `DELETE FROM file_versions WHERE file_id = ? RETURNING hash_algo, hash, size`, fileID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return releaseVersions(ctx, tx, rows)
+}
+
+// 读取被删除的历史版本并释放其内容引用，返回总大小和已没有引用的内容
+func releaseVersions(ctx context.Context, tx *sql.Tx, rows *sql.Rows) (int64, []string, error) {
+	var hashes []string
+	var size int64
+	for rows.Next() {
+		var algo, hash string
+		var n int64
+		if err := rows.Scan(&algo, &hash, &n); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		hashes = append(hashes, blobKey(algo, hash))
+		size += n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	var unused []string
+	for _, hash := range hashes {
+		released, err := releaseBlob(ctx, tx, hash)
+		if err != nil {
+			return 0, nil, err
+		}
+		if released {
+			unused = append(unused, hash)
+		}
+	}
+	return size, unused, nil
+}
+
+// 删除超出数量限制的最旧的历史版本并释放其配额和内容；maxVersions 包括当前版本，0 表示不限制。
+// 新版本已经保存，失败时只记录日志
+func pruneVersions(ctx context.Context, db *sql.DB, store Storage, file File, maxVersions int) {
+	if maxVersions == 0 {
+		return
+	}
+	if err := deleteOldVersions(ctx, db, store, file.OwnerID, file.ID, maxVersions-1); err != nil {
+		slog.Error("Failed to prune file versions", "file_id", file.ID, "error", err)
+	}
+}
+
+// 只保留文件最新的 keep 个历史版本
+func deleteOldVersions(ctx context.Context, db *sql.DB, store Storage, ownerID, fileID, keep int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleteQuery := `DELETE FROM file_versions WHERE file_id = ? AND id NOT IN (
+		SELECT id FROM file_versions WHERE file_id = ? ORDER BY version DESC LIMIT ?
+	) RETURNING hash_algo, hash, size`
+	rows, err := tx.QueryContext(ctx, deleteQuery, fileID, fileID, keep)
+	if err != nil {
+		return err
+	}
+	size, unused, err := releaseVersions(ctx, tx, rows)
+	if err != nil {
+		return err
+	}
+	if err := releaseQuota(ctx, tx, ownerID, size); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	deleteUnusedContent(db, store, unused)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文件的可见性：私有文件只有所有者可以访问，公开文件无需登录即可按哈希下载
+const (
+	visibilityPrivate = "private"
+	visibilityPublic  = "public"
+)
+
+// 公开文件的缓存策略：允许共享缓存，但每次都要验证，文件改为私有后缓存立即失效
+const cachePublic = "public, no-cache"
+
+// PublicFile 公开文件列表中的文件信息，不包含所有者等信息
+type PublicFile struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash"`
+	HashAlgo  string    `json:"hash_algo"`
+	Mime      string    `json:"mime"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 检查可见性是否合法，空字符串表示使用默认的 private
+func validVisibility(visibility string) bool {
+	return visibility == "" || visibility == visibilityPrivate || visibility == visibilityPublic
+}
+
+// 注册无需登录的公开文件接口
+func registerPublicRoutes(r gin.IRouter, db *sql.DB, store Storage) {
+	repo := newFileRepository(db)
+
+	// 分页列出所有用户的公开文件，最新上传的在前
+	r.GET("/public", func(c *gin.Context) {
+		limit, err := queryInt(c, "limit", defaultPageLimit)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			renderError(c, invalidRequest("Invalid limit, must be an integer between 1 and "+strconv.Itoa(maxPageLimit)))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil || offset < 0 {
+			renderError(c, invalidRequest("Invalid offset, must be a non-negative integer"))
+			return
+		}
+
+		files, total, err := repo.ListPublic(c.Request.Context(), limit, offset)
+		if err != nil {
+			renderError(c, internalError("Failed to get files", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"files":  files,
+			"total":  total,
+			"limit":  limit,
+			"offset": offset,
+		})
+	})
+
+	// 按哈希下载公开文件，algo 为哈希使用的算法，缺省为 sha256。
+	// 每次请求都重新检查可见性，文件改为私有后立即返回 404
+	r.GET("/public/:hash", func(c *gin.Context) {
+		algo := c.DefaultQuery("algo", hashSHA256)
+		if !checkDigest(c, algo, c.Param("hash")) {
+			return
+		}
+		file, err := repo.GetPublicByHash(c.Request.Context(), algo, c.Param("hash"))
+		if err != nil {
+			fileError(c, err, "Failed to get file")
+			return
+		}
+		addAuditFile(c, file)
+		c.Header("Cache-Control", cachePublic)
+		serveFile(c, store, file)
+		recordDownload(c, repo, file)
+	})
+}
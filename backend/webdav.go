@@ -0,0 +1,727 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV 接口的路径前缀
+const davPrefix = "/dav"
+
+// WebDAV 支持的请求方法
+var davMethods = []string{"OPTIONS", "GET", "HEAD", "PUT", "DELETE", "PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"}
+
+// 客户端每个请求都会带上 Basic 认证，校验成功后在该时间内不再重新计算 bcrypt
+const davAuthCacheTTL = 5 * time.Minute
+
+// WebDAV 密码错误的限流类别
+const davPasswordClass = "dav_password"
+
+// 注册 WebDAV 接口，文件和文件夹与 REST 接口相同，使用用户名和密码通过 HTTP Basic 认证登录。
+// 上传的内容超过 maxUploadSize 时中止，内容不同的同名文件作为新版本保存，最多保留 maxVersions 个版本。
+// 所有方法共用一个路由，审计日志的操作由 davFileSystem 在执行时设置
+func registerWebDAVRoutes(r gin.IRouter, db *sql.DB, store Storage, limiter *rateLimiter, maxUploadSize int64, maxVersions int, hashAlgo, spoolDir string, concurrency *concurrencyLimiter, disk *diskGuard) {
+	auth := &davAuthCache{entries: map[[sha256.Size]byte]davAuthEntry{}}
+	locks := &davLocks{systems: map[int]webdav.LockSystem{}}
+	handler := func(c *gin.Context) {
+		// webdav 只能以 405 响应写入时的错误，声明的长度超过限制时直接返回 413
+		if c.Request.Method == http.MethodPut && c.Request.ContentLength > maxUploadSize {
+			uploadTooLarge(c, maxUploadSize)
+			return
+		}
+		// 传输内容的时间取决于内容大小和客户端的速度
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodPut, "COPY":
+			detachDeadline(c)
+		}
+		davFS := &davFileSystem{
+			c:             c,
+			db:            db,
+			store:         store,
+			repo:          newFileRepository(db),
+			ownerID:       currentUserID(c),
+			maxUploadSize: maxUploadSize,
+			maxVersions:   maxVersions,
+			hashAlgo:      hashAlgo,
+			spoolDir:      spoolDir,
+		}
+		// 记录读取请求体时的错误，客户端中途断开时不保存不完整的内容
+		c.Request.Body = &davBody{ReadCloser: c.Request.Body, fs: davFS}
+		h := &webdav.Handler{
+			Prefix:     davPrefix,
+			FileSystem: davFS,
+			LockSystem: locks.get(currentUserID(c)),
+			Logger: func(req *http.Request, err error) {
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					slog.WarnContext(req.Context(), "WebDAV request failed", "method", req.Method, "path", req.URL.Path, "error", err)
+				}
+			},
+		}
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+	for _, method := range davMethods {
+		r.Handle(method, "/*path", auth.middleware(db, limiter), limiter.middleware(), concurrency.middleware(), disk.middleware(), handler)
+	}
+}
+
+// 缓存校验成功的 Basic 认证，键为用户名和密码的 sha256
+type davAuthCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]davAuthEntry
+}
+
+type davAuthEntry struct {
+	userID  int
+	expires time.Time
+}
+
+// 校验 HTTP Basic 认证并将用户 id 保存到上下文中，失败时返回 401 和 WWW-Authenticate。
+// 密码错误按用户名和 IP 计数，超过限制后在 Retry-After 之前返回 429，不再校验密码
+func (a *davAuthCache) middleware(db *sql.DB, limiter *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, password, ok := c.Request.BasicAuth()
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="net-disk", charset="UTF-8"`)
+			renderError(c, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Invalid username or password"))
+			return
+		}
+		key := sha256.Sum256([]byte(username + "\x00" + password))
+		a.mu.Lock()
+		entry, cached := a.entries[key]
+		a.mu.Unlock()
+		if !cached || time.Now().After(entry.expires) {
+			limitKey := username + ":" + c.ClientIP()
+			if wait := limiter.peek(davPasswordClass, limitKey, time.Now()); wait > 0 {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				renderError(c, newAPIError(http.StatusTooManyRequests, codeRateLimited, "Too many wrong passwords, please retry later"))
+				return
+			}
+			user, err := getUserByName(c.Request.Context(), db, username)
+			if err != nil && err != sql.ErrNoRows {
+				renderError(c, internalError("Failed to get user", err))
+				return
+			}
+			if err == sql.ErrNoRows || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+				limiter.take(davPasswordClass, limitKey, time.Now())
+				c.Header("WWW-Authenticate", `Basic realm="net-disk", charset="UTF-8"`)
+				renderError(c, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Invalid username or password"))
+				return
+			}
+			entry = davAuthEntry{userID: user.ID, expires: time.Now().Add(davAuthCacheTTL)}
+			a.mu.Lock()
+			// 清理过期的缓存，缓存的数量不会超过一段时间内登录的用户数
+			for k, e := range a.entries {
+				if time.Now().After(e.expires) {
+					delete(a.entries, k)
+				}
+			}
+			a.entries[key] = entry
+			a.mu.Unlock()
+		}
+		c.Set("userID", entry.userID)
+		c.Next()
+	}
+}
+
+// 每个用户的锁，各用户的路径互不相关；LOCK 只在内存中记录，重启后失效
+type davLocks struct {
+	mu      sync.Mutex
+	systems map[int]webdav.LockSystem
+}
+
+func (l *davLocks) get(userID int) webdav.LockSystem {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.systems[userID]
+	if !ok {
+		ls = webdav.NewMemLS()
+		l.systems[userID] = ls
+	}
+	return ls
+}
+
+// 记录读取请求体时的错误
+type davBody struct {
+	io.ReadCloser
+	fs *davFileSystem
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.fs.bodyErr = err
+	}
+	return n, err
+}
+
+// 上传的内容超过大小限制
+var errDavTooLarge = errors.New("upload exceeds the maximum size")
+
+// davFileSystem 将用户的文件和文件夹作为 webdav.FileSystem，每个请求创建一个。
+// 同一文件夹下有同名的文件夹和文件时使用文件夹，有多个同名文件时使用最早上传的
+type davFileSystem struct {
+	c             *gin.Context // 记录审计日志的操作和文件
+	db            *sql.DB
+	store         Storage
+	repo          *FileRepository
+	ownerID       int
+	maxUploadSize int64
+	maxVersions   int
+	hashAlgo      string
+	spoolDir      string
+	bodyErr       error // 读取请求体时的错误
+}
+
+// 路径对应的文件夹或文件；都为空时为根目录
+type davNode struct {
+	folder *Folder
+	file   *File
+}
+
+func (n davNode) info() *davFileInfo {
+	switch {
+	case n.folder != nil:
+		return &davFileInfo{name: n.folder.Name, modTime: n.folder.CreatedAt, dir: true}
+	case n.file != nil:
+		return fileDavInfo(*n.file)
+	}
+	return &davFileInfo{name: "/", dir: true}
+}
+
+// 父文件夹的 id，根目录为空
+func (n davNode) folderID() *int {
+	if n.folder == nil {
+		return nil
+	}
+	return &n.folder.ID
+}
+
+// 将路径拆分为各级名称，根目录为空
+func davSegments(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// 查找路径对应的文件夹或文件，不存在时返回 os.ErrNotExist
+func (d *davFileSystem) resolve(ctx context.Context, name string) (davNode, error) {
+	segments := davSegments(name)
+	if len(segments) == 0 {
+		return davNode{}, nil
+	}
+	parent, err := d.resolveFolder(ctx, segments[:len(segments)-1])
+	if err != nil {
+		return davNode{}, err
+	}
+	return d.child(ctx, parent, segments[len(segments)-1])
+}
+
+// 查找父文件夹下名为 name 的文件夹或文件
+func (d *davFileSystem) child(ctx context.Context, parentID *int, name string) (davNode, error) {
+	folder, err := d.lookupFolder(ctx, parentID, name)
+	if err == nil {
+		return davNode{folder: &folder}, nil
+	}
+	if err != sql.ErrNoRows {
+		return davNode{}, err
+	}
+	file, err := d.repo.GetByName(ctx, d.ownerID, parentID, name)
+	if errors.Is(err, errNotFound) {
+		return davNode{}, os.ErrNotExist
+	}
+	if err != nil {
+		return davNode{}, err
+	}
+	return davNode{file: &file}, nil
+}
+
+// 依次查找路径上的文件夹，返回最后一个文件夹的 id，根目录为空；不存在时返回 os.ErrNotExist
+func (d *davFileSystem) resolveFolder(ctx context.Context, names []string) (*int, error) {
+	var folderID *int
+	for _, name := range names {
+		folder, err := d.lookupFolder(ctx, folderID, name)
+		if err == sql.ErrNoRows {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		folderID = &folder.ID
+	}
+	return folderID, nil
+}
+
+// 获取父文件夹下名为 name 的文件夹，不存在时返回 sql.ErrNoRows
+func (d *davFileSystem) lookupFolder(ctx context.Context, parentID *int, name string) (Folder, error) {
+	var folder Folder
+	query := `SELECT id, name, parent_id, owner_id, created_at FROM folders WHERE owner_id = ? AND parent_id IS ? AND name = ?`
+	err := d.db.QueryRowContext(ctx, query, d.ownerID, parentID, name).Scan(&folder.ID, &folder.Name, &folder.ParentID, &folder.OwnerID, &folder.CreatedAt)
+	return folder, err
+}
+
+// 查找路径的父文件夹并校验最后一级名称，返回父文件夹 id 和名称
+func (d *davFileSystem) resolveParent(ctx context.Context, name string) (*int, string, error) {
+	segments := davSegments(name)
+	if len(segments) == 0 {
+		return nil, "", os.ErrPermission
+	}
+	base := segments[len(segments)-1]
+	if err := checkFileName(base); err != nil {
+		return nil, "", os.ErrInvalid
+	}
+	parentID, err := d.resolveFolder(ctx, segments[:len(segments)-1])
+	return parentID, base, err
+}
+
+func (d *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parentID, base, err := d.resolveParent(ctx, name)
+	if err != nil {
+		return err
+	}
+	if _, err := d.child(ctx, parentID, base); err == nil {
+		return os.ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	setAuditAction(d.c, "create_folder")
+	_, err = addFolder(ctx, d.db, Folder{Name: base, ParentID: parentID, OwnerID: d.ownerID, CreatedAt: time.Now().UTC()})
+	switch {
+	case errors.Is(err, errFolderExists):
+		return os.ErrExist
+	case errors.Is(err, errFolderNotFound):
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (d *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return d.create(ctx, name, flag)
+	}
+	node, err := d.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if node.file == nil {
+		return &davDir{fs: d, ctx: ctx, folderID: node.folderID(), info: node.info()}, nil
+	}
+	// PROPFIND 等请求也会打开文件读取属性，只有 GET 记录下载
+	if d.c.Request.Method == http.MethodGet {
+		setAuditAction(d.c, "download")
+		addAuditFile(d.c, *node.file)
+	}
+	return &davReadFile{fs: d, ctx: ctx, file: *node.file, info: node.info()}, nil
+}
+
+// 打开要写入的文件，关闭时保存写入的内容；已有同名文件时作为新版本保存
+func (d *davFileSystem) create(ctx context.Context, name string, flag int) (webdav.File, error) {
+	parentID, base, err := d.resolveParent(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	node, err := d.child(ctx, parentID, base)
+	switch {
+	case err == nil && node.folder != nil:
+		return nil, os.ErrExist
+	case err == nil && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	case errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE == 0:
+		return nil, err
+	}
+	// 保存的文件在关闭时记录，未能保存时只记录操作的结果
+	if d.c.Request.Method == "COPY" {
+		setAuditAction(d.c, "copy")
+	} else {
+		setAuditAction(d.c, "upload")
+	}
+
+	pr, pw := io.Pipe()
+	f := &davWriteFile{
+		fs:       d,
+		ctx:      ctx,
+		folderID: parentID,
+		name:     base,
+		current:  node.file,
+		pw:       pw,
+		done:     make(chan struct{}),
+		info:     &davFileInfo{name: base, modTime: time.Now().UTC()},
+	}
+	go func() {
+		defer close(f.done)
+		f.content, f.err = spoolContent(pr, d.spoolDir, d.hashAlgo, spoolMemoryLimit)
+		pr.CloseWithError(f.err)
+	}()
+	return f, nil
+}
+
+func (d *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	node, err := d.resolve(ctx, name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case node.folder != nil:
+		setAuditAction(d.c, "delete_folder")
+		_, err = deleteFolder(ctx, d.db, d.ownerID, node.folder.ID, true)
+		if err == sql.ErrNoRows {
+			return os.ErrNotExist
+		}
+	case node.file != nil:
+		setAuditAction(d.c, "delete")
+		addAuditFile(d.c, *node.file)
+		_, err = d.repo.Trash(ctx, d.ownerID, node.file.ID)
+		if errors.Is(err, errNotFound) {
+			return os.ErrNotExist
+		}
+	default:
+		return os.ErrPermission
+	}
+	if errors.Is(err, errFileProtected) {
+		return os.ErrPermission
+	}
+	return err
+}
+
+func (d *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	node, err := d.resolve(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	parentID, base, err := d.resolveParent(ctx, newName)
+	if err != nil {
+		return err
+	}
+	switch {
+	case node.folder != nil:
+		setAuditAction(d.c, "update_folder")
+		err = updateFolder(ctx, d.db, Folder{ID: node.folder.ID, Name: base, ParentID: parentID, OwnerID: d.ownerID})
+		switch {
+		case errors.Is(err, errFolderExists):
+			return os.ErrExist
+		case errors.Is(err, errFolderCycle):
+			return os.ErrInvalid
+		}
+		return err
+	case node.file != nil:
+		setAuditAction(d.c, "move")
+		addAuditFile(d.c, *node.file)
+		return moveAndRenameFile(ctx, d.db, d.ownerID, node.file.ID, parentID, base)
+	}
+	return os.ErrPermission
+}
+
+func (d *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	node, err := d.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+// 将文件移动到 folderID 文件夹并重命名为 name；目标位置已有同名文件时返回 os.ErrExist
+func moveAndRenameFile(ctx context.Context, db *sql.DB, ownerID, id int, folderID *int, name string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	conflictQuery := `SELECT EXISTS(SELECT 1 FROM files WHERE owner_id = ? AND folder_id IS ? AND name = ? AND id != ? AND deleted_at IS NULL AND ` + fileNotExpired + `)`
+	if err := tx.QueryRowContext(ctx, conflictQuery, ownerID, folderID, name, id, time.Now().UTC()).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	updateQuery := `UPDATE files SET name = ?, search_name = ?, folder_id = ? WHERE id = ? AND owner_id = ? AND deleted_at IS NULL`
+	if _, err := tx.ExecContext(ctx, updateQuery, name, searchName(name), folderID, id, ownerID); err != nil {
+		if isForeignKeyViolation(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// davFileInfo 文件或文件夹的属性；文件的 ETag 为内容的哈希，与 REST 接口下载时一致
+type davFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	hash    string
+	mime    string
+}
+
+func fileDavInfo(file File) *davFileInfo {
+	return &davFileInfo{name: file.Name, size: file.Size, modTime: file.UpdatedAt, hash: file.Hash, mime: file.Mime}
+}
+
+func (i *davFileInfo) Name() string       { return i.name }
+func (i *davFileInfo) Size() int64        { return i.size }
+func (i *davFileInfo) ModTime() time.Time { return i.modTime }
+func (i *davFileInfo) IsDir() bool        { return i.dir }
+func (i *davFileInfo) Sys() any           { return nil }
+
+func (i *davFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+func (i *davFileInfo) ETag(ctx context.Context) (string, error) {
+	if i.hash == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + i.hash + `"`, nil
+}
+
+func (i *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if i.mime == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.mime, nil
+}
+
+// 文件夹，只支持列出其中的文件夹和文件
+type davDir struct {
+	fs       *davFileSystem
+	ctx      context.Context
+	folderID *int
+	info     *davFileInfo
+	children []fs.FileInfo
+	loaded   bool
+}
+
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.loaded {
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+		d.loaded = true
+	}
+	if count <= 0 {
+		children := d.children
+		d.children = nil
+		return children, nil
+	}
+	if len(d.children) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.children))
+	children := d.children[:n]
+	d.children = d.children[n:]
+	return children, nil
+}
+
+// 读取其中的文件夹和未过期的文件；与文件夹同名的文件和重复的同名文件不列出，与按路径查找一致
+func (d *davDir) load() error {
+	folders, err := getChildFolders(d.ctx, d.fs.db, d.fs.ownerID, d.folderID)
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, folder := range folders {
+		d.children = append(d.children, &davFileInfo{name: folder.Name, modTime: folder.CreatedAt, dir: true})
+		used[folder.Name] = true
+	}
+	query := `SELECT ` + fileColumns + ` FROM files WHERE owner_id = ? AND folder_id IS ? AND deleted_at IS NULL AND ` + fileNotExpired + ` ORDER BY id`
+	rows, err := d.fs.db.QueryContext(d.ctx, query, d.fs.ownerID, d.folderID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return err
+		}
+		if !used[file.Name] {
+			d.children = append(d.children, fileDavInfo(file))
+			used[file.Name] = true
+		}
+	}
+	return rows.Err()
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error)                   { return d.info, nil }
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read([]byte) (int, error)                     { return 0, os.ErrInvalid }
+func (d *davDir) Write([]byte) (int, error)                    { return 0, os.ErrPermission }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+
+// 读取的文件；存储后端的内容不支持 Seek 时，跳转后重新打开内容并跳过之前的部分
+type davReadFile struct {
+	fs      *davFileSystem
+	ctx     context.Context
+	file    File
+	info    *davFileInfo
+	content io.ReadCloser
+	offset  int64 // 下次读取的位置
+	read    int64 // content 已读取到的位置
+}
+
+func (f *davReadFile) Read(p []byte) (int, error) {
+	if f.offset >= f.file.Size {
+		return 0, io.EOF
+	}
+	if f.content == nil || f.read != f.offset {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := contextReader{f.ctx, f.content}.Read(p)
+	f.offset += int64(n)
+	f.read = f.offset
+	return n, err
+}
+
+// 打开内容并定位到 offset
+func (f *davReadFile) open() error {
+	if seeker, ok := f.content.(io.Seeker); ok {
+		if _, err := seeker.Seek(f.offset, io.SeekStart); err == nil {
+			return nil
+		}
+	}
+	if f.content != nil {
+		f.content.Close()
+		f.content = nil
+	}
+	content, _, err := openFileContent(f.ctx, f.fs.store, f.file)
+	if errors.Is(err, errFileInfected) {
+		return os.ErrPermission
+	}
+	if err != nil {
+		return err
+	}
+	f.content = content
+	if _, ok := content.(io.Seeker); !ok {
+		_, err = io.CopyN(io.Discard, content, f.offset)
+		return err
+	}
+	_, err = content.(io.Seeker).Seek(f.offset, io.SeekStart)
+	return err
+}
+
+func (f *davReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.file.Size
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *davReadFile) Close() error {
+	if f.content == nil {
+		return nil
+	}
+	return f.content.Close()
+}
+
+func (f *davReadFile) Stat() (fs.FileInfo, error)         { return f.info, nil }
+func (f *davReadFile) Readdir(int) ([]fs.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *davReadFile) Write([]byte) (int, error)          { return 0, os.ErrPermission }
+
+// 写入的文件：写入的内容通过管道暂存，关闭时保存。Stat 返回的属性在关闭后更新为保存的内容，
+// webdav 在关闭后才读取 ETag
+type davWriteFile struct {
+	fs       *davFileSystem
+	ctx      context.Context
+	folderID *int
+	name     string
+	current  *File // 已有的同名文件，为空时新建文件
+	pw       *io.PipeWriter
+	done     chan struct{}
+	content  *spooledContent
+	err      error
+	written  int64
+	info     *davFileInfo
+}
+
+func (f *davWriteFile) Write(p []byte) (int, error) {
+	if f.written+int64(len(p)) > f.fs.maxUploadSize {
+		f.pw.CloseWithError(errDavTooLarge)
+		return 0, errDavTooLarge
+	}
+	n, err := f.pw.Write(p)
+	f.written += int64(n)
+	f.info.size = f.written
+	return n, err
+}
+
+func (f *davWriteFile) Close() error {
+	f.pw.Close()
+	<-f.done
+	if f.err != nil {
+		return f.err
+	}
+	defer f.content.Close()
+	if f.fs.bodyErr != nil {
+		return f.fs.bodyErr
+	}
+	if err := f.ctx.Err(); err != nil {
+		return err
+	}
+	// 内容不变时不保存新版本
+	if f.current != nil && sameContent(*f.current, f.content, f.fs.hashAlgo) {
+		f.info = fileDavInfo(*f.current)
+		return nil
+	}
+
+	body, err := f.content.reader()
+	if err != nil {
+		return err
+	}
+	mimeType, _, err := detectContentType(body, "", f.name)
+	if err != nil {
+		return err
+	}
+	file := File{HashAlgo: f.fs.hashAlgo, Name: f.name, Mime: mimeType, CreatedAt: time.Now().UTC(), OwnerID: f.fs.ownerID, FolderID: f.folderID}
+	if f.current != nil {
+		file.ID = f.current.ID
+	}
+	saved, err := storeSpooled(f.ctx, f.fs.db, f.fs.store, file, f.content, "", false)
+	if err != nil {
+		return err
+	}
+	addAuditFile(f.fs.c, saved)
+	if saved.Version > 1 {
+		pruneVersions(f.ctx, f.fs.db, f.fs.store, saved, f.fs.maxVersions)
+	}
+	*f.info = davFileInfo{name: saved.Name, size: saved.Size, modTime: saved.CreatedAt, hash: saved.Hash, mime: saved.Mime}
+	return nil
+}
+
+func (f *davWriteFile) Stat() (fs.FileInfo, error)                   { return f.info, nil }
+func (f *davWriteFile) Read([]byte) (int, error)                     { return 0, os.ErrInvalid }
+func (f *davWriteFile) Readdir(int) ([]fs.FileInfo, error)           { return nil, os.ErrInvalid }
+func (f *davWriteFile) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhook 投递的限制
+const (
+	webhookWorkers        = 4                // 同时投递的请求数
+	webhookQueueSize      = 1000             // 等待投递的事件数，队列满时丢弃新事件
+	webhookTimeout        = 10 * time.Second // 单次投递的超时时间
+	webhookMaxAttempts    = 5                // 每个事件最多尝试的次数
+	webhookRetryDelay     = time.Second      // 第一次重试前等待的时间，之后每次翻倍
+	webhookMaxFailures    = 10               // 连续投递失败这么多个事件后自动停用
+	webhookDeliveriesKept = 50               // 每个 webhook 保留的最近投递记录数
+)
+
+// 请求头中的签名和事件类型；签名为以 secret 为密钥对请求体计算的 HMAC-SHA256
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+)
+
+// 审计日志中的操作对应的 webhook 事件
+var webhookEvents = map[string]string{
+	"upload": "file.uploaded",
+	"rename": "file.renamed",
+	"delete": "file.deleted", // 移入回收站
+	"purge":  "file.purged",  // 彻底删除
+}
+
+// Webhook 接收文件事件的地址
+type Webhook struct {
+	ID                  int        `json:"id"`
+	URL                 string     `json:"url"`
+	Events              []string   `json:"events"` // 订阅的事件，为空表示所有事件
+	Enabled             bool       `json:"enabled"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"` // 连续失败而被自动停用的时间
+	CreatedAt           time.Time  `json:"created_at"`
+	secret              string
+}
+
+// WebhookDelivery 一次投递尝试的记录
+type WebhookDelivery struct {
+	ID         int       `json:"id"`
+	Event      string    `json:"event"`
+	Payload    string    `json:"payload"`
+	Attempt    int       `json:"attempt"`
+	StatusCode *int      `json:"status_code"` // 没有收到响应时为空
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// 发送给 webhook 的事件内容
+type webhookPayload struct {
+	Event     string    `json:"event"`
+	FileID    int       `json:"file_id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	HashAlgo  string    `json:"hash_algo"`
+	Size      int64     `json:"size"`
+	OwnerID   int       `json:"owner_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// 一次待投递的事件
+type webhookJob struct {
+	hook    Webhook
+	event   string
+	body    []byte
+	attempt int
+}
+
+// 在后台异步投递 webhook 事件
+type webhookDispatcher struct {
+	db     *sql.DB
+	client *http.Client
+	queue  chan webhookJob
+}
+
+// 创建投递器并启动投递的 goroutine
+func newWebhookDispatcher(db *sql.DB) *webhookDispatcher {
+	d := &webhookDispatcher{
+		db:     db,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan webhookJob, webhookQueueSize),
+	}
+	for range webhookWorkers {
+		go d.work()
+	}
+	return d
+}
+
+// 注册 webhook 管理接口，仅管理员可以访问
+func registerWebhookRoutes(admin gin.IRouter, db *sql.DB) {
+	// 添加 webhook；未指定 secret 时随机生成，secret 只在创建时返回
+	admin.POST("/webhooks", func(c *gin.Context) {
+		var req struct {
+			URL    string   `json:"url"`
+			Secret string   `json:"secret"`
+			Events []string `json:"events"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderError(c, invalidRequest("Invalid request body"))
+			return
+		}
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			renderError(c, invalidRequest("Invalid url, must be an absolute http or https URL"))
+			return
+		}
+		for _, event := range req.Events {
+			if !slices.Contains(webhookEventNames(), event) {
+				renderError(c, invalidRequest("Invalid event "+strconv.Quote(event)+", must be one of "+strings.Join(webhookEventNames(), ", ")).with(gin.H{
+					"valid_events": webhookEventNames(),
+				}))
+				return
+			}
+		}
+		if req.Secret == "" {
+			secret, err := newShareToken()
+			if err != nil {
+				renderError(c, internalError("Failed to create webhook", err))
+				return
+			}
+			req.Secret = secret
+		}
+
+		hook, err := addWebhook(c.Request.Context(), db, req.URL, req.Secret, req.Events)
+		if err != nil {
+			renderError(c, internalError("Failed to create webhook", err))
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"webhook": hook,
+			"secret":  req.Secret,
+		})
+	})
+
+	// 列出所有 webhook
+	admin.GET("/webhooks", func(c *gin.Context) {
+		hooks, err := listWebhooks(c.Request.Context(), db)
+		if err != nil {
+			renderError(c, internalError("Failed to get webhooks", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"webhooks": hooks})
+	})
+
+	// 列出 webhook 最近的投递记录，最新的在前
+	admin.GET("/webhooks/:id/deliveries", func(c *gin.Context) {
+		id, ok := webhookParam(c, db)
+		if !ok {
+			return
+		}
+		deliveries, err := listWebhookDeliveries(c.Request.Context(), db, id)
+		if err != nil {
+			renderError(c, internalError("Failed to get deliveries", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+	})
+
+	// 重新启用被自动停用的 webhook，并清零连续失败次数
+	admin.POST("/webhooks/:id/enable", func(c *gin.Context) {
+		id, ok := webhookParam(c, db)
+		if !ok {
+			return
+		}
+		hook, err := enableWebhook(c.Request.Context(), db, id)
+		if err != nil {
+			renderError(c, internalError("Failed to enable webhook", err))
+			return
+		}
+		c.JSON(http.StatusOK, hook)
+	})
+
+	// 删除 webhook 及其投递记录，尚未完成的投递不再重试
+	admin.DELETE("/webhooks/:id", func(c *gin.Context) {
+		id, ok := webhookParam(c, db)
+		if !ok {
+			return
+		}
+		if err := deleteWebhook(c.Request.Context(), db, id); err != nil {
+			renderError(c, internalError("Failed to delete webhook", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted", "id": id})
+	})
+}
+
+// 支持的事件，按名称排序
+func webhookEventNames() []string {
+	var names []string
+	for _, event := range webhookEvents {
+		names = append(names, event)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// 解析路径中的 webhook id 并确认存在，失败时写入错误响应并返回 false
+func webhookParam(c *gin.Context, db *sql.DB) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		renderError(c, invalidRequest("Invalid webhook id"))
+		return 0, false
+	}
+	if _, err := getWebhook(c.Request.Context(), db, id); err == sql.ErrNoRows {
+		renderError(c, newAPIError(http.StatusNotFound, codeNotFound, "Webhook not found"))
+		return 0, false
+	} else if err != nil {
+		renderError(c, internalError("Failed to get webhook", err))
+		return 0, false
+	}
+	return id, true
+}
+
+// 将文件事件加入订阅了该事件的已启用 webhook 的投递队列；查询失败或队列已满时只记录日志
+func (d *webhookDispatcher) notify(ctx context.Context, event string, file File) {
+	hooks, err := listWebhooks(ctx, d.db)
+	if err != nil {
+		slog.Error("Failed to get webhooks", "event", event, "error", err)
+		return
+	}
+	body, err := json.Marshal(webhookPayload{
+		Event:     event,
+		FileID:    file.ID,
+		Name:      file.Name,
+		Hash:      file.Hash,
+		HashAlgo:  file.HashAlgo,
+		Size:      file.Size,
+		OwnerID:   file.OwnerID,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		slog.Error("Failed to encode webhook payload", "event", event, "error", err)
+		return
+	}
+	for _, hook := range hooks {
+		if !hook.Enabled || (len(hook.Events) > 0 && !slices.Contains(hook.Events, event)) {
+			continue
+		}
+		d.enqueue(webhookJob{hook: hook, event: event, body: body, attempt: 1})
+	}
+}
+
+// 加入投递队列，队列已满时丢弃
+func (d *webhookDispatcher) enqueue(job webhookJob) {
+	select {
+	case d.queue <- job:
+	default:
+		slog.Error("Webhook queue is full, dropping event", "webhook_id", job.hook.ID, "event", job.event)
+	}
+}
+
+// 从队列中取出事件并投递
+func (d *webhookDispatcher) work() {
+	for job := range d.queue {
+		d.deliver(job)
+	}
+}
+
+// 投递一次事件并记录结果；失败时按指数退避稍后重试，用完重试次数后计入连续失败次数，
+// 达到 webhookMaxFailures 时停用该 webhook。webhook 已被删除或停用时不再投递
+func (d *webhookDispatcher) deliver(job webhookJob) {
+	ctx := context.Background()
+	hook, err := getWebhook(ctx, d.db, job.hook.ID)
+	if err != nil || !hook.Enabled {
+		return
+	}
+
+	start := time.Now()
+	statusCode, err := d.post(hook, job.event, job.body)
+	delivery := WebhookDelivery{
+		Event:      job.event,
+		Payload:    string(job.body),
+		Attempt:    job.attempt,
+		DurationMS: time.Since(start).Milliseconds(),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if statusCode != 0 {
+		delivery.StatusCode = &statusCode
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	if err := addWebhookDelivery(ctx, d.db, hook.ID, delivery); err != nil {
+		slog.Error("Failed to record webhook delivery", "webhook_id", hook.ID, "error", err)
+	}
+
+	if err == nil {
+		if err := recordWebhookResult(ctx, d.db, hook.ID, true); err != nil {
+			slog.Error("Failed to update webhook", "webhook_id", hook.ID, "error", err)
+		}
+		return
+	}
+	if job.attempt < webhookMaxAttempts {
+		delay := webhookRetryDelay << (job.attempt - 1)
+		job.attempt++
+		time.AfterFunc(delay, func() { d.enqueue(job) })
+		return
+	}
+	slog.Warn("Webhook delivery failed", "webhook_id", hook.ID, "event", job.event, "attempts", job.attempt, "error", err)
+	if err := recordWebhookResult(ctx, d.db, hook.ID, false); err != nil {
+		slog.Error("Failed to update webhook", "webhook_id", hook.ID, "error", err)
+	}
+}
+
+// 发送事件，返回响应的状态码；状态码不是 2xx 时返回错误
+func (d *webhookDispatcher) post(hook Webhook, event string, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "net-disk/"+version)
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(hook.secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("unexpected status " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// 以 secret 为密钥计算请求体的 HMAC-SHA256，返回十六进制字符串
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 查询 webhook 时选取的字段，与 scanWebhook 的顺序一致
+const webhookColumns = "id, url, secret, events, enabled, consecutive_failures, disabled_at, created_at"
+
+// 按 webhookColumns 的字段顺序读取一行 webhook
+func scanWebhook(row interface{ Scan(...any) error }) (Webhook, error) {
+	var hook Webhook
+	var events string
+	err := row.Scan(&hook.ID, &hook.URL, &hook.secret, &events, &hook.Enabled, &hook.ConsecutiveFailures, &hook.DisabledAt, &hook.CreatedAt)
+	if err != nil {
+		return hook, err
+	}
+	err = json.Unmarshal([]byte(events), &hook.Events)
+	return hook, err
+}
+
+// 添加 webhook，返回包含 id 的 webhook
+func addWebhook(ctx context.Context, db *sql.DB, url, secret string, events []string) (Webhook, error) {
+	if events == nil {
+		events = []string{}
+	}
+	encoded, err := json.Marshal(events)
+	if err != nil {
+		return Webhook{}, err
+	}
+	insertQuery := `INSERT INTO webhooks (url, secret, events, created_at) VALUES (?, ?, ?, ?) RETURNING ` + webhookColumns
+	return scanWebhook(db.QueryRowContext(ctx, insertQuery, url, secret, string(encoded), time.Now().UTC()))
+}
+
+// 获取 webhook；不存在时返回 sql.ErrNoRows
+func getWebhook(ctx context.Context, db *sql.DB, id int) (Webhook, error) {
+	return scanWebhook(db.QueryRowContext(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id))
+}
+
+// 获取所有 webhook
+func listWebhooks(ctx context.Context, db *sql.DB) ([]Webhook, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+webhookColumns+` FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []Webhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// 启用 webhook 并清零连续失败次数，返回更新后的 webhook
+func enableWebhook(ctx context.Context, db *sql.DB, id int) (Webhook, error) {
+	updateQuery := `UPDATE webhooks SET enabled = 1, consecutive_failures = 0, disabled_at = NULL WHERE id = ? RETURNING ` + webhookColumns
+	return scanWebhook(db.QueryRowContext(ctx, updateQuery, id))
+}
+
+// 删除 webhook 及其投递记录
+func deleteWebhook(ctx context.Context, db *sql.DB, id int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM webhooks WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 记录一次事件的投递结果：成功时清零连续失败次数，失败时增加，达到 webhookMaxFailures 时停用
+func recordWebhookResult(ctx context.Context, db *sql.DB, id int, success bool) error {
+	if success {
+		_, err := db.ExecContext(ctx, `UPDATE webhooks SET consecutive_failures = 0 WHERE id = ?`, id)
+		return err
+	}
+	var failures int
+	var enabled bool
+	updateQuery := `
+	UPDATE webhooks SET consecutive_failures = consecutive_failures + 1,
+		enabled = consecutive_failures + 1 < ?,
+		disabled_at = CASE WHEN consecutive_failures + 1 >= ? THEN ? ELSE disabled_at END
+	WHERE id = ? RETURNING consecutive_failures, enabled`
+	err := db.QueryRowContext(ctx, updateQuery, webhookMaxFailures, webhookMaxFailures, time.Now().UTC(), id).Scan(&failures, &enabled)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err == nil && !enabled {
+		slog.Warn("Webhook disabled after consecutive failures", "webhook_id", id, "failures", failures)
+	}
+	return err
+}
+
+// 记录一次投递，只保留最近 webhookDeliveriesKept 条
+func addWebhookDelivery(ctx context.Context, db *sql.DB, webhookID int, delivery WebhookDelivery) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insertQuery := `INSERT INTO webhook_deliveries (webhook_id, event, payload, attempt, status_code, error, duration_ms, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.ExecContext(ctx, insertQuery, webhookID, delivery.Event, delivery.Payload, delivery.Attempt, delivery.StatusCode, delivery.Error, delivery.DurationMS, delivery.CreatedAt); err != nil {
+		return err
+	}
+	pruneQuery := `
+	DELETE FROM webhook_deliveries WHERE webhook_id = ? AND id NOT IN (
+		SELECT id FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?
+	)`
+	if _, err := tx.ExecContext(ctx, pruneQuery, webhookID, webhookID, webhookDeliveriesKept); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 获取 webhook 最近的投递记录，最新的在前
+func listWebhookDeliveries(ctx context.Context, db *sql.DB, webhookID int) ([]WebhookDelivery, error) {
+	query := `SELECT id, event, payload, attempt, status_code, error, duration_ms, created_at FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC`
+	rows, err := db.QueryContext(ctx, query, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.Event, &d.Payload, &d.Attempt, &d.StatusCode, &d.Error, &d.DurationMS, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}